@@ -60,38 +60,122 @@ func cliHandler(c *cli.Context) {
 	}
 
 	backend := backendFromConfig(conf)
+	tenantBackends := tenantBackendsFromConfig(conf)
 	store := storeFromConfig(conf)
 
 	options := chartmuseum.ServerOptions{
 		StorageBackend:         backend,
+		StorageBackendType:     strings.ToLower(conf.GetString("storage.backend")),
+		TenantStorageBackends:  tenantBackends,
+		StoragePrefix:          conf.GetString("storage.prefix"),
+		StorageLayout:          strings.ToLower(conf.GetString("storage.layout")),
 		ExternalCacheStore:     store,
 		ChartURL:               conf.GetString("charturl"),
+		ExternalURL:            conf.GetString("externalurl"),
+		ChartURLTemplate:       conf.GetString("charturltemplate"),
 		TlsCert:                conf.GetString("tls.cert"),
 		TlsKey:                 conf.GetString("tls.key"),
+		TlsMinVersion:          conf.GetString("tls.minversion"),
+		TlsCipherSuites:        conf.GetStringSlice("tls.ciphersuites"),
+		TlsCACert:              conf.GetString("tls.cacert"),
+		TlsClientAuth:          conf.GetString("tls.clientauth"),
+		EnableH2C:              conf.GetBool("enableh2c"),
 		Username:               conf.GetString("basicauth.user"),
 		Password:               conf.GetString("basicauth.pass"),
+		BasicAuthUsers:         conf.GetStringSlice("basicauth.users"),
+		BasicAuthUsersFile:     conf.GetString("basicauth.usersfile"),
+		BasicAuthHtpasswd:      conf.GetString("basicauth.htpasswd"),
+		BasicAuthRealm:         conf.GetString("basicauth.realm"),
 		ChartPostFormFieldName: conf.GetString("chartpostformfieldname"),
 		ProvPostFormFieldName:  conf.GetString("provpostformfieldname"),
 		ContextPath:            conf.GetString("contextpath"),
+		ListenHost:             conf.GetString("listenhost"),
+		ListenSocket:           conf.GetString("listensocket"),
 		LogJSON:                conf.GetBool("logjson"),
 		Debug:                  conf.GetBool("debug"),
 		EnableAPI:              !conf.GetBool("disableapi"),
 		UseStatefiles:          !conf.GetBool("disablestatefiles"),
 		AllowOverwrite:         conf.GetBool("allowoverwrite"),
 		AllowForceOverwrite:    !conf.GetBool("disableforceoverwrite"),
+		ValidateCharts:         !conf.GetBool("disablechartvalidation"),
 		EnableMetrics:          !conf.GetBool("disablemetrics"),
+		MetricsNamespace:       conf.GetString("metricsnamespace"),
+		MetricsSubsystem:       conf.GetString("metricssubsystem"),
+		MetricsPath:            conf.GetString("metricspath"),
+		EnablePprof:            conf.GetBool("enablepprof"),
+		TrailingSlash:          conf.GetString("trailingslash"),
+		AllowedChartNameRegex:  conf.GetString("allowedchartnameregex"),
+		EnableGzip:             conf.GetBool("enablegzip"),
+		RateLimit:              conf.GetInt("ratelimit.rps"),
+		RateLimitBurst:         conf.GetInt("ratelimit.burst"),
+		WriteAllowedCIDRs:      conf.GetStringSlice("writeallowedcidrs"),
+		TrustedProxies:         conf.GetStringSlice("trustedproxies"),
+		TrustedPlatform:        conf.GetString("trustedplatform"),
+		AccessLogFields:        conf.GetStringSlice("accesslogfields"),
+		AccessLogSampling:      conf.GetInt("accesslogsampling"),
+		RequestIDHeader:        conf.GetString("requestidheader"),
+		ResponseHeaders:        conf.GetStringSlice("responseheaders"),
+		Version:                Version,
+		Revision:               Revision,
 		AnonymousGet:           conf.GetBool("authanonymousget"),
+		ReadOnlyAnonymous:      conf.GetBool("authreadonlyanonymous"),
+		AnonymousRepos:         conf.GetStringSlice("authanonymousrepos"),
 		GenIndex:               conf.GetBool("genindex"),
 		MaxStorageObjects:      conf.GetInt("maxstorageobjects"),
+		MaxVersionsPerChart:    conf.GetInt("maxversionsperchart"),
+		IgnoreChartNameCase:    conf.GetBool("ignorechartnamecase"),
 		IndexLimit:             conf.GetInt("indexlimit"),
+		IndexVersionOrder:      conf.GetString("indexversionorder"),
+		PushAnnotations:        conf.GetStringSlice("pushannotations"),
+		AuditLog:               conf.GetString("auditlog"),
 		Depth:                  conf.GetInt("depth"),
+		VariableDepth:          conf.GetBool("variabledepth"),
 		MaxUploadSize:          conf.GetInt("maxuploadsize"),
+		MaxChartSize:           conf.GetInt("maxchartsize"),
+		MaxRequestSize:         conf.GetInt("maxrequestsize"),
+		MaxConcurrentUploads:   conf.GetInt("maxconcurrentuploads"),
+		StorageRetryAttempts:   conf.GetInt("storage.retry.maxattempts"),
+		StorageRetryDelay:      conf.GetInt("storage.retry.basedelay"),
+		ReadinessTimeout:       conf.GetInt("readinesstimeout"),
+		ShutdownTimeout:        conf.GetInt("shutdowntimeout"),
+		RequestTimeout:         conf.GetInt("requesttimeout"),
+		ReadHeaderTimeout:      conf.GetInt("readheadertimeout"),
+		ReadTimeout:            conf.GetInt("readtimeout"),
+		WriteTimeout:           conf.GetInt("writetimeout"),
+		IdleTimeout:            conf.GetInt("idletimeout"),
 		BearerAuth:             conf.GetBool("bearerauth"),
 		AuthType:               conf.GetString("authtype"),
 		AuthRealm:              conf.GetString("authrealm"),
 		AuthService:            conf.GetString("authservice"),
 		AuthIssuer:             conf.GetString("authissuer"),
 		AuthCertPath:           conf.GetString("authcertpath"),
+		AuthCertPem:            conf.GetString("authcertpem"),
+		AuthCertUrl:            conf.GetString("authcerturl"),
+		AuthJwksUrl:            conf.GetString("authjwksurl"),
+		AuthJwksRefresh:        conf.GetInt("authjwksrefreshinterval"),
+		AuthTokenCacheSize:     conf.GetInt("authtokencachesize"),
+		AccessRules:            conf.GetString("authaccessrules"),
+		CORSAllowedOrigins:     conf.GetStringSlice("cors.origins"),
+		CORSAllowedMethods:     conf.GetStringSlice("cors.methods"),
+		CORSAllowedHeaders:     conf.GetStringSlice("cors.headers"),
+		CORSAllowCredentials:   conf.GetBool("cors.credentials"),
+		WebhookURLs:            conf.GetStringSlice("webhook.urls"),
+		WebhookSecret:          conf.GetString("webhook.secret"),
+		RetentionKeepVersions:  conf.GetInt("retention.keepversions"),
+		RetentionMaxAge:        conf.GetInt("retention.maxage"),
+		RetentionInterval:      conf.GetInt("retention.interval"),
+		RetentionDryRun:        conf.GetBool("retention.dryrun"),
+		ReindexInterval:        conf.GetInt("reindex.interval"),
+		ReindexJitter:          conf.GetInt("reindex.jitter"),
+		IndexReconcileInterval: conf.GetInt("indexreconcileinterval"),
+		CacheTTL:               conf.GetInt("cache.ttl"),
+		PresignedRedirect:      conf.GetBool("presignedredirect"),
+		PresignedURLExpiry:     conf.GetInt("presignedexpiry"),
+		UpstreamRepoURL:        conf.GetString("upstreamrepourl"),
+		EnableOCI:              conf.GetBool("enableoci"),
+		IndexSigningKeyring:    conf.GetString("indexsigning.keyring"),
+		IndexSigningKey:        conf.GetString("indexsigning.key"),
+		IndexSigningPassphrase: conf.GetString("indexsigning.passphrase"),
 	}
 
 	server, err := newServer(options)
@@ -121,6 +205,8 @@ func backendFromConfig(conf *config.Config) storage.Backend {
 		backend = alibabaBackendFromConfig(conf)
 	case "openstack":
 		backend = openstackBackendFromConfig(conf)
+	case "backblaze":
+		backend = backblazeBackendFromConfig(conf)
 	default:
 		crash("Unsupported storage backend: ", storageFlag)
 	}
@@ -128,11 +214,29 @@ func backendFromConfig(conf *config.Config) storage.Backend {
 	return backend
 }
 
+func tenantBackendsFromConfig(conf *config.Config) map[string]storage.Backend {
+	path := conf.GetString("storage.tenants")
+	if path == "" {
+		return nil
+	}
+	tenantConfs, err := config.NewTenantStorageConfigs(path)
+	if err != nil {
+		crash(err)
+	}
+	backends := map[string]storage.Backend{}
+	for prefix, tenantConf := range tenantConfs {
+		backends[prefix] = backendFromConfig(tenantConf)
+	}
+	return backends
+}
+
 func localBackendFromConfig(conf *config.Config) storage.Backend {
 	crashIfConfigMissingVars(conf, []string{"storage.local.rootdir"})
-	return storage.Backend(storage.NewLocalFilesystemBackend(
+	backend := storage.NewLocalFilesystemBackend(
 		conf.GetString("storage.local.rootdir"),
-	))
+	)
+	backend.Fsync = conf.GetBool("storage.local.fsync")
+	return storage.Backend(backend)
 }
 
 func amazonBackendFromConfig(conf *config.Config) storage.Backend {
@@ -141,49 +245,75 @@ func amazonBackendFromConfig(conf *config.Config) storage.Backend {
 		conf.Set("storage.amazon.region", "us-east-1")
 	}
 	crashIfConfigMissingVars(conf, []string{"storage.amazon.bucket", "storage.amazon.region"})
-	return storage.Backend(storage.NewAmazonS3Backend(
+	backend := storage.NewAmazonS3Backend(
 		conf.GetString("storage.amazon.bucket"),
 		conf.GetString("storage.amazon.prefix"),
 		conf.GetString("storage.amazon.region"),
 		conf.GetString("storage.amazon.endpoint"),
 		conf.GetString("storage.amazon.sse"),
-	))
+	)
+	backend.SSEKMSKeyID = conf.GetString("storage.amazon.ssekmskeyid")
+	backend.ListPageSize = conf.GetInt("storage.listpagesize")
+	if err := backend.ValidateSSE(); err != nil {
+		crash(err)
+	}
+	return storage.Backend(backend)
 }
 
 func googleBackendFromConfig(conf *config.Config) storage.Backend {
 	crashIfConfigMissingVars(conf, []string{"storage.google.bucket"})
-	return storage.Backend(storage.NewGoogleCSBackend(
+	backend := storage.NewGoogleCSBackend(
 		conf.GetString("storage.google.bucket"),
 		conf.GetString("storage.google.prefix"),
-	))
+	)
+	backend.ListPageSize = conf.GetInt("storage.listpagesize")
+	return storage.Backend(backend)
 }
 
 func microsoftBackendFromConfig(conf *config.Config) storage.Backend {
 	crashIfConfigMissingVars(conf, []string{"storage.microsoft.container"})
-	return storage.Backend(storage.NewMicrosoftBlobBackend(
+	backend := storage.NewMicrosoftBlobBackend(
 		conf.GetString("storage.microsoft.container"),
 		conf.GetString("storage.microsoft.prefix"),
-	))
+	)
+	backend.ListPageSize = conf.GetInt("storage.listpagesize")
+	return storage.Backend(backend)
 }
 
 func alibabaBackendFromConfig(conf *config.Config) storage.Backend {
 	crashIfConfigMissingVars(conf, []string{"storage.alibaba.bucket"})
-	return storage.Backend(storage.NewAlibabaCloudOSSBackend(
+	backend := storage.NewAlibabaCloudOSSBackend(
 		conf.GetString("storage.alibaba.bucket"),
 		conf.GetString("storage.alibaba.prefix"),
 		conf.GetString("storage.alibaba.endpoint"),
 		conf.GetString("storage.alibaba.sse"),
-	))
+	)
+	backend.ListPageSize = conf.GetInt("storage.listpagesize")
+	return storage.Backend(backend)
 }
 
 func openstackBackendFromConfig(conf *config.Config) storage.Backend {
 	crashIfConfigMissingVars(conf, []string{"storage.openstack.container", "storage.openstack.region"})
-	return storage.Backend(storage.NewOpenstackOSBackend(
+	backend := storage.NewOpenstackOSBackend(
 		conf.GetString("storage.openstack.container"),
 		conf.GetString("storage.openstack.prefix"),
 		conf.GetString("storage.openstack.region"),
 		conf.GetString("storage.openstack.cacert"),
-	))
+	)
+	backend.ListPageSize = conf.GetInt("storage.listpagesize")
+	return storage.Backend(backend)
+}
+
+func backblazeBackendFromConfig(conf *config.Config) storage.Backend {
+	crashIfConfigMissingVars(conf, []string{"storage.backblaze.bucket", "storage.backblaze.keyid", "storage.backblaze.applicationkey"})
+	backend := storage.NewBackblazeB2Backend(
+		conf.GetString("storage.backblaze.bucket"),
+		conf.GetString("storage.backblaze.prefix"),
+		conf.GetString("storage.backblaze.keyid"),
+		conf.GetString("storage.backblaze.applicationkey"),
+	)
+	backend.ListPageSize = conf.GetInt("storage.listpagesize")
+	return storage.Backend(backend)
 }
 
 func storeFromConfig(conf *config.Config) cache.Store {
@@ -210,6 +340,7 @@ func redisCacheFromConfig(conf *config.Config) cache.Store {
 		conf.GetString("cache.redis.addr"),
 		conf.GetString("cache.redis.password"),
 		conf.GetInt("cache.redis.db"),
+		conf.GetBool("cache.redis.tls"),
 	))
 }
 
@@ -17,24 +17,45 @@ limitations under the License.
 package cache
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strings"
+
 	"github.com/go-redis/redis"
 )
 
+const (
+	// RedisInvalidationChannel is the pub/sub channel on which changed keys are announced
+	RedisInvalidationChannel = "chartmuseum:invalidate"
+)
+
 type (
 	// RedisStore implements the Store interface, used for storing objects in-memory
 	RedisStore struct {
 		Client *redis.Client
+
+		// identifies this store in published messages, so that it can ignore its own
+		instanceID string
 	}
 )
 
-// NewRedisStore creates a new RedisStore
-func NewRedisStore(addr string, password string, db int) *RedisStore {
-	store := &RedisStore{}
+// NewRedisStore creates a new RedisStore. If useTLS is set, the connection to Redis is made over TLS
+func NewRedisStore(addr string, password string, db int, useTLS bool) *RedisStore {
+	store := &RedisStore{instanceID: newInstanceID()}
 	redisClientOptions := &redis.Options{
 		Addr:     addr,
 		Password: password,
 		DB:       db,
 	}
+	if useTLS {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		redisClientOptions.TLSConfig = &tls.Config{ServerName: host}
+	}
 	store.Client = redis.NewClient(redisClientOptions)
 	return store
 }
@@ -56,3 +77,45 @@ func (store *RedisStore) Delete(key string) error {
 	err := store.Client.Del(key).Err()
 	return err
 }
+
+// Ping checks that Redis is reachable
+func (store *RedisStore) Ping() error {
+	return store.Client.Ping().Err()
+}
+
+// Publish announces to the other stores subscribed to the same Redis that key has changed
+func (store *RedisStore) Publish(key string) error {
+	return store.Client.Publish(RedisInvalidationChannel, encodeInvalidation(store.instanceID, key)).Err()
+}
+
+// Subscribe calls handler in the background with each key announced by the other stores
+func (store *RedisStore) Subscribe(handler func(key string)) {
+	pubsub := store.Client.Subscribe(RedisInvalidationChannel)
+	go func() {
+		for msg := range pubsub.Channel() {
+			instanceID, key, ok := decodeInvalidation(msg.Payload)
+			if !ok || instanceID == store.instanceID {
+				continue
+			}
+			handler(key)
+		}
+	}()
+}
+
+func encodeInvalidation(instanceID string, key string) string {
+	return instanceID + " " + key
+}
+
+func decodeInvalidation(payload string) (string, string, bool) {
+	parts := strings.SplitN(payload, " ", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
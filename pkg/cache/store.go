@@ -23,4 +23,16 @@ type (
 		Set(key string, contents []byte) error
 		Delete(key string) error
 	}
+
+	// Pinger is implemented by stores which can check that they are reachable
+	Pinger interface {
+		Ping() error
+	}
+
+	// Notifier is implemented by stores shared between several servers,
+	// to let the other servers know when a key has been changed
+	Notifier interface {
+		Publish(key string) error
+		Subscribe(handler func(key string))
+	}
 )
@@ -36,7 +36,7 @@ func (suite *StoreTestSuite) SetupSuite() {
 	redisMock, err := miniredis.Run()
 	suite.Nil(err, "able to create miniredis instance")
 	suite.RedisMock = redisMock
-	suite.Stores["Redis"] = NewRedisStore(redisMock.Addr(), "", 0)
+	suite.Stores["Redis"] = NewRedisStore(redisMock.Addr(), "", 0, false)
 }
 
 func (suite *StoreTestSuite) TearDownSuite() {
@@ -74,6 +74,28 @@ func (suite *StoreTestSuite) TestAllStores() {
 	}
 }
 
+func (suite *StoreTestSuite) TestRedisPing() {
+	store := suite.Stores["Redis"].(*RedisStore)
+	suite.Nil(store.Ping(), "able to ping redis")
+
+	unreachable := NewRedisStore("127.0.0.1:1", "", 0, false)
+	suite.NotNil(unreachable.Ping(), "error pinging unreachable redis")
+}
+
+func (suite *StoreTestSuite) TestRedisInvalidationMessages() {
+	instanceID, key, ok := decodeInvalidation(encodeInvalidation("abc", "org1/repo1"))
+	suite.True(ok)
+	suite.Equal("abc", instanceID)
+	suite.Equal("org1/repo1", key)
+
+	_, key, ok = decodeInvalidation(encodeInvalidation("abc", ""))
+	suite.True(ok, "able to decode the root repo")
+	suite.Equal("", key)
+
+	_, _, ok = decodeInvalidation("garbage")
+	suite.False(ok, "invalid message is rejected")
+}
+
 func TestStoreTestSuite(t *testing.T) {
 	suite.Run(t, new(StoreTestSuite))
 }
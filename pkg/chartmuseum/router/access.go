@@ -0,0 +1,229 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	pathutil "path"
+	"strings"
+	"sync"
+	"syscall"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	// an access rule identity matching any authenticated identity
+	accessRuleAnyIdentity = "*"
+)
+
+type (
+	/*
+		accessRules restricts which repos each identity may pull from and push to,
+		as loaded from a file such as:
+
+			rules:
+			- identity: team-a-ci
+			  repos: ["teamA/*"]
+			  actions: [pull, push]
+			- identity: "*"
+			  repos: ["public/*"]
+			  actions: [pull]
+
+		Repos are matched with path.Match patterns, and a pattern of "*" matches every repo.
+		An identity is a basic auth username, the subject of a bearer token or the common name
+		of a client certificate, and "*" matches any of them
+	*/
+	accessRules struct {
+		Path   string
+		Logger *cm_logger.Logger
+		mu     sync.RWMutex
+		rules  []accessRule
+	}
+
+	accessRulesFile struct {
+		Rules []accessRule `json:"rules"`
+	}
+
+	accessRule struct {
+		Identity string   `json:"identity"`
+		Repos    []string `json:"repos"`
+		Actions  []action `json:"actions"`
+	}
+)
+
+func newAccessRules(path string, logger *cm_logger.Logger) *accessRules {
+	return &accessRules{
+		Path:   path,
+		Logger: logger,
+	}
+}
+
+// load reads the rules file and replaces the current rules. On failure the
+// current rules are kept
+func (rules *accessRules) load() error {
+	content, err := ioutil.ReadFile(rules.Path)
+	if err != nil {
+		return err
+	}
+
+	var file accessRulesFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("could not parse access rules from %s: %s", rules.Path, err)
+	}
+	for i, rule := range file.Rules {
+		if rule.Identity == "" {
+			return fmt.Errorf("access rule %d in %s has no identity", i+1, rules.Path)
+		}
+		if err := checkRepoPatterns(rule.Repos); err != nil {
+			return fmt.Errorf("access rule %d in %s has an %s", i+1, rules.Path, err)
+		}
+		for _, act := range rule.Actions {
+			if !isRepoAction(act) {
+				return fmt.Errorf("access rule %d in %s has an unknown action %q", i+1, rules.Path, act)
+			}
+		}
+	}
+
+	rules.mu.Lock()
+	rules.rules = file.Rules
+	rules.mu.Unlock()
+	return nil
+}
+
+// watch reloads the rules file every time SIGHUP is received, until stop is closed
+func (rules *accessRules) watch(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+			if err := rules.load(); err != nil {
+				rules.Logger.Errorw("Error reloading access rules, keeping current rules",
+					"path", rules.Path,
+					"error", err.Error(),
+				)
+				continue
+			}
+			rules.Logger.Infow("Reloaded access rules",
+				"path", rules.Path,
+			)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// allowed reports whether a rule lets identity perform act on repo
+func (rules *accessRules) allowed(identity string, repo string, act action) bool {
+	if identity == "" {
+		return false
+	}
+	rules.mu.RLock()
+	defer rules.mu.RUnlock()
+	for _, rule := range rules.rules {
+		if rule.Identity != identity && rule.Identity != accessRuleAnyIdentity {
+			continue
+		}
+		if !rule.allowsAction(act) {
+			continue
+		}
+		if repoMatchesAny(rule.Repos, repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoMatchesAny reports whether repo matches one of the path.Match patterns, where
+// "*" on its own matches every repo
+func repoMatchesAny(patterns []string, repo string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		if matched, _ := pathutil.Match(pattern, repo); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRepoPatterns returns an error for the first malformed repo pattern
+func checkRepoPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := pathutil.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repo pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (rule accessRule) allowsAction(act action) bool {
+	for _, a := range rule.Actions {
+		if a == act {
+			return true
+		}
+	}
+	return false
+}
+
+// accessRuleIdentity returns the identity the access rules are checked against, or false
+// if the request is allowed without credentials, in which case the rules do not apply
+func (router *Router) accessRuleIdentity(request *http.Request, act action, repo string) (string, bool) {
+	if act == RepoPullAction && router.isAnonymousPullAllowed(repo) {
+		return "", false
+	}
+	if router.AnonymousGet && isReadMethod(request.Method) {
+		return "", false
+	}
+
+	if router.ClientCertAuth {
+		if clientCN := verifiedClientCommonName(request); clientCN != "" {
+			return clientCN, true
+		}
+	}
+
+	if !router.basicAuthEnabled() && router.BearerAuthHeader == "" {
+		// no auth is configured, so there is nobody to check the rules for
+		return "", false
+	}
+	if router.requestAuthScheme(request) == authSchemeBasic {
+		if username, _, ok := request.BasicAuth(); ok && router.isValidBasicAuth(request) {
+			return username, true
+		}
+		return "", true
+	}
+	if authHeader := request.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		token, isValid := validateJWT(strings.TrimPrefix(authHeader, "Bearer "), router)
+		if isValid {
+			if claims, ok := token.Claims.(jwt.MapClaims); ok {
+				sub, _ := claims["sub"].(string)
+				return sub, true
+			}
+		}
+	}
+	return "", true
+}
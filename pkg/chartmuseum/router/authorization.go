@@ -18,7 +18,7 @@ package router
 
 import (
 	"crypto/rsa"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -32,91 +32,250 @@ func isRepoAction(act action) bool {
 	return act == RepoPullAction || act == RepoPushAction
 }
 
-func generateBasicAuthHeader(username string, password string) string {
-	base := username + ":" + password
-	basicAuthHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte(base))
-	return basicAuthHeader
+// isAnonymousPullAllowed reports whether repo can be pulled from without credentials, either
+// because all pulls are anonymous or because it is one of the anonymous repos
+func (router *Router) isAnonymousPullAllowed(repo string) bool {
+	return router.ReadOnlyAnonymous || repoMatchesAny(router.AnonymousRepos, repo)
 }
 
-func (router *Router) authorizeRequest(request *http.Request) (bool, map[string]string) {
-	authorized := false
-	responseHeaders := map[string]string{}
-
-	// BasicAuthHeader is only set on the router if ChartMuseum is configured to use
-	// basic auth protection. If not set, the server and all its routes are wide open.
-	if router.BasicAuthHeader != "" {
-		if router.AnonymousGet && request.Method == "GET" {
-			authorized = true
-		} else if request.Header.Get("Authorization") == router.BasicAuthHeader {
-			authorized = true
-		} else {
-			responseHeaders["WWW-Authenticate"] = "Basic realm=\"ChartMuseum\""
+// HEAD is treated like GET, so that anonymous GET also covers existence checks
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// authorizeRequest reports whether a request may perform act on repo, along with the
+// authenticated identity (the client certificate CN, basic auth username or token subject,
+// "" for anonymous requests) and the headers to respond with
+func (router *Router) authorizeRequest(request *http.Request, act action, repo string) (bool, string, http.Header) {
+	responseHeaders := http.Header{}
+
+	// a client certificate verified against the configured CA is enough for any repo action
+	if router.ClientCertAuth {
+		if clientCN := verifiedClientCommonName(request); clientCN != "" {
+			observeAuth(authSchemeClientCert, true)
+			return true, clientCN, responseHeaders
 		}
-	} else if router.BearerAuthHeader != "" {
-		// used to escape spaces in service name
-		queryString := url.PathEscape("service=" + router.AuthService)
+	}
+
+	// basic auth users are only configured on the router if ChartMuseum is configured to use
+	// basic auth protection. If there are none, and bearer auth is not enabled either, the
+	// server and all its routes are wide open.
+	basicAuth, bearerAuth := router.basicAuthEnabled(), router.BearerAuthHeader != ""
+	if act == systemDebugAction && !basicAuth && !bearerAuth {
+		// the profiling routes are never open: with client certificate auth only, a request
+		// without a verified certificate has no credentials left to be checked
+		observeAuth(authSchemeClientCert, false)
+		return false, "", responseHeaders
+	}
+	if (!basicAuth && !bearerAuth) || (router.AnonymousGet && isReadMethod(request.Method) && act != systemDebugAction) {
+		observeAuth(authSchemeAnonymous, true)
+		return true, "", responseHeaders
+	}
 
-		if router.AnonymousGet && request.Method == "GET" {
-			authorized = true
+	scheme := router.requestAuthScheme(request)
+	var authorized bool
+	var identity, challenge string
+	if scheme == authSchemeBasic {
+		authorized, identity, challenge = router.authorizeBasicAuth(request)
+	} else {
+		authorized, identity, challenge = router.authorizeBearerAuth(request, act, repo)
+	}
+
+	// with both schemes enabled, the challenge also offers the scheme the client did not try
+	if challenge != "" && basicAuth && bearerAuth {
+		if scheme == authSchemeBasic {
+			responseHeaders.Add("WWW-Authenticate", challenge)
+			responseHeaders.Add("WWW-Authenticate", router.bearerAuthChallenge())
 		} else {
-			if request.Header.Get("Authorization") != "" {
-				splitToken := strings.Split(request.Header.Get("Authorization"), "Bearer ")
-				_, isValid := validateJWT(splitToken[1], router)
-				if isValid {
-					authorized = true
-				} else {
-					responseHeaders["WWW-Authenticate"] = "Bearer realm=\"" + router.AuthRealm + "?" + queryString + "\""
-				}
-			} else {
-				responseHeaders["WWW-Authenticate"] = "Bearer realm=\"" + router.AuthRealm + "?" + queryString + "\""
-			}
+			responseHeaders.Add("WWW-Authenticate", basicAuthChallenge(router.BasicAuthRealm))
+			responseHeaders.Add("WWW-Authenticate", challenge)
 		}
-	} else {
-		authorized = true
+	} else if challenge != "" {
+		responseHeaders.Set("WWW-Authenticate", challenge)
+	}
+
+	observeAuth(scheme, authorized)
+	return authorized, identity, responseHeaders
+}
+
+// requestAuthScheme returns the scheme a request is authenticated with. With both basic and
+// bearer auth enabled, requests carrying basic auth credentials are checked against the basic
+// auth users only, and any other request as a bearer token
+func (router *Router) requestAuthScheme(request *http.Request) string {
+	if !router.basicAuthEnabled() {
+		return authSchemeBearer
+	}
+	if router.BearerAuthHeader == "" {
+		return authSchemeBasic
+	}
+	if _, _, ok := request.BasicAuth(); ok {
+		return authSchemeBasic
+	}
+	return authSchemeBearer
+}
+
+// authorizeBasicAuth checks the basic auth credentials of a request, returning the username
+// and, if the request is not authorized, the challenge to respond with
+func (router *Router) authorizeBasicAuth(request *http.Request) (bool, string, string) {
+	if !router.isValidBasicAuth(request) {
+		return false, "", basicAuthChallenge(router.BasicAuthRealm)
+	}
+	username, _, _ := request.BasicAuth()
+	return true, username, ""
+}
+
+// authorizeBearerAuth checks the bearer token of a request, which must have the push scope for
+// repo to push, returning the token subject and, if the request is not authorized, the
+// challenge to respond with
+func (router *Router) authorizeBearerAuth(request *http.Request, act action, repo string) (bool, string, string) {
+	if request.Header.Get("Authorization") == "" {
+		return false, "", router.bearerAuthChallenge()
+	}
+	splitToken := strings.Split(request.Header.Get("Authorization"), "Bearer ")
+	token, isValid := validateJWT(splitToken[len(splitToken)-1], router)
+	if !isValid {
+		return false, "", router.bearerAuthChallenge("error", "invalid_token")
+	}
+	if act == RepoPushAction && !tokenHasScope(token, repo, RepoPushAction) {
+		// ask for a token with the push scope for this repo
+		return false, "", router.bearerAuthChallenge("scope", requiredScope(repo))
+	}
+	identity := ""
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		identity, _ = claims["sub"].(string)
+	}
+	return true, identity, ""
+}
+
+// basicAuthChallenge is the WWW-Authenticate header asking for basic auth credentials
+func basicAuthChallenge(realm string) string {
+	return "Basic realm=" + quoteChallengeParam(realm)
+}
+
+// bearerAuthChallenge is the WWW-Authenticate header pointing clients at the auth server
+// for a token, followed by extra name and value pairs (e.g. the scope the token needs)
+func (router *Router) bearerAuthChallenge(extra ...string) string {
+	challenge := fmt.Sprintf("Bearer realm=%s,service=%s",
+		quoteChallengeParam(router.AuthRealm), quoteChallengeParam(router.AuthService))
+	for i := 0; i+1 < len(extra); i += 2 {
+		challenge += fmt.Sprintf(",%s=%s", extra[i], quoteChallengeParam(extra[i+1]))
 	}
-	
-	return authorized, responseHeaders
+	return challenge
+}
+
+// quoteChallengeParam quotes a WWW-Authenticate parameter value, escaping quotes and backslashes
+func quoteChallengeParam(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
 }
 
 // verify if JWT is valid by using the rsa public certificate pem
 // currently this only works with RSA key signing
 // TODO: how best to handle many different signing algorithms?
+// Tokens which were valid before are taken from the token cache until they expire
 func validateJWT(t string, router *Router) (*jwt.Token, bool) {
-	valid := false
-
-	key, err := getRSAKey(router.AuthPublicCert)
-	if err != nil {
-		fmt.Println(err)
+	if router.tokenCache != nil {
+		if token, ok := router.tokenCache.get(t); ok {
+			return token, true
+		}
 	}
 
+	valid := false
+
 	token, err := jwt.Parse(t, func(token *jwt.Token) (interface{}, error) {
-		return key, nil
+		if router.jwks != nil {
+			return jwksKeyFunc(token, router.jwks)
+		}
+
+		return getRSAKey(router.AuthPublicCert)
 	})
 	if err != nil {
-		fmt.Println("Token parse error: ", err)
+		router.Logger.Debugw("Invalid bearer token",
+			"error", err.Error(),
+		)
 	} else {
-		fmt.Println("token is valid")
 		valid = true
+		if router.tokenCache != nil {
+			router.tokenCache.add(t, token)
+		}
 	}
 	return token, valid
 }
 
+// select the JWKS key matching the token's kid header
+func jwksKeyFunc(token *jwt.Token, cache *jwksCache) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := cache.key(kid)
+	if !ok {
+		return nil, fmt.Errorf("no JWKS key found for kid \"%s\"", kid)
+	}
+	return key, nil
+}
+
 // https://github.com/dgrijalva/jwt-go/blob/master/rsa_test.go
 func getRSAKey(key []byte) (*rsa.PublicKey, error) {
 	parsedKey, err := jwt.ParseRSAPublicKeyFromPEM(key)
 	if err != nil {
-		fmt.Println("error parsing RSA key from PEM: ", err)
+		return nil, fmt.Errorf("error parsing RSA key from PEM: %s", err)
 	}
 
 	return parsedKey, nil
 }
 
-// Load authorization server public pem file
-// TODO: have this be fetched from a url instead of file
-func loadPublicCertFromFile(certPath string, router *Router) {
-	publicKey, err := ioutil.ReadFile(certPath)
+// publicCertClient fetches the authorization server public pem from --auth-cert-url
+var publicCertClient = &http.Client{Timeout: jwksFetchTimeout}
+
+// loadPublicCert loads the authorization server public pem from the one source configured: a
+// file, an inline PEM string, or an HTTPS URL fetched once at startup. The key is parsed now,
+// so that a bad cert stops the server from starting rather than failing every token
+func loadPublicCert(certPath string, certPem string, certURL string) ([]byte, error) {
+	sources := 0
+	for _, source := range []string{certPath, certPem, certURL} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return nil, errors.New("exactly one of the auth cert path, PEM and URL must be given")
+	}
+
+	var publicKey []byte
+	var err error
+	switch {
+	case certPath != "":
+		publicKey, err = ioutil.ReadFile(certPath)
+	case certPem != "":
+		publicKey = []byte(certPem)
+	default:
+		publicKey, err = fetchPublicCert(certURL)
+	}
 	if err != nil {
-		router.Logger.Fatal("Error reading Public Key")
+		return nil, err
+	}
+	if _, err := jwt.ParseRSAPublicKeyFromPEM(publicKey); err != nil {
+		return nil, fmt.Errorf("error parsing auth public cert: %s", err)
+	}
+	return publicKey, nil
+}
+
+// fetchPublicCert downloads the authorization server public pem, over HTTPS only
+func fetchPublicCert(certURL string) ([]byte, error) {
+	u, err := url.Parse(certURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("auth cert URL must be https: %s", certURL)
+	}
+	resp, err := publicCertClient.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status fetching auth public cert from %s: %d", certURL, resp.StatusCode)
 	}
-	router.AuthPublicCert = publicKey
+	return ioutil.ReadAll(resp.Body)
 }
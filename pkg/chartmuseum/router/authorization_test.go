@@ -0,0 +1,95 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AuthorizationTestSuite struct {
+	suite.Suite
+	PublicCert []byte
+}
+
+func (suite *AuthorizationTestSuite) SetupSuite() {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	suite.Nil(err, "no error generating rsa key")
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	suite.Nil(err, "no error marshalling public key")
+	suite.PublicCert = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func (suite *AuthorizationTestSuite) TestLoadPublicCert() {
+	file, err := ioutil.TempFile("", "chartmuseum-auth-cert-")
+	suite.Nil(err, "no error creating temp file")
+	defer os.Remove(file.Name())
+	_, err = file.Write(suite.PublicCert)
+	suite.Nil(err, "no error writing public cert")
+	file.Close()
+
+	cert, err := loadPublicCert(file.Name(), "", "")
+	suite.Nil(err, "no error loading public cert from file")
+	suite.Equal(suite.PublicCert, cert)
+
+	cert, err = loadPublicCert("", string(suite.PublicCert), "")
+	suite.Nil(err, "no error loading inline public cert")
+	suite.Equal(suite.PublicCert, cert)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cert.pem" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(suite.PublicCert)
+	}))
+	defer server.Close()
+	defaultClient := publicCertClient
+	publicCertClient = server.Client()
+	defer func() { publicCertClient = defaultClient }()
+
+	cert, err = loadPublicCert("", "", server.URL+"/cert.pem")
+	suite.Nil(err, "no error fetching public cert")
+	suite.Equal(suite.PublicCert, cert)
+
+	_, err = loadPublicCert("", "", server.URL+"/missing.pem")
+	suite.NotNil(err, "error fetching a missing public cert")
+
+	_, err = loadPublicCert("", "", "http://auth.example.com/cert.pem")
+	suite.EqualError(err, "auth cert URL must be https: http://auth.example.com/cert.pem")
+
+	_, err = loadPublicCert("", "", "")
+	suite.NotNil(err, "a source must be given")
+	_, err = loadPublicCert(file.Name(), string(suite.PublicCert), "")
+	suite.NotNil(err, "only one source can be given")
+
+	_, err = loadPublicCert("", "not a pem", "")
+	suite.NotNil(err, "invalid public cert is rejected")
+}
+
+func TestAuthorizationTestSuite(t *testing.T) {
+	suite.Run(t, new(AuthorizationTestSuite))
+}
@@ -0,0 +1,163 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type (
+	// basicAuthCredential holds what is needed to check the password of a basic auth user,
+	// without keeping the password itself. Plaintext passwords from the options are kept as
+	// a digest (see passwordDigest), and hashes from an htpasswd file as they are
+	basicAuthCredential struct {
+		mu         sync.RWMutex
+		digest     []byte
+		bcryptHash []byte
+		sha1Hash   []byte
+	}
+)
+
+var (
+	// passwordDigestKey keys the digests of passwords, so that a digest found in memory
+	// cannot be looked up in a table of digests of common passwords, nor checked offline
+	passwordDigestKey = newPasswordDigestKey()
+
+	// checked against when the username is unknown, so that unknown users take as long
+	// to reject as wrong passwords
+	unknownUserCredential = newPlaintextCredential("")
+)
+
+// newPasswordDigestKey returns a random key, new on every start as digests are never saved
+func newPasswordDigestKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func newPlaintextCredential(password string) *basicAuthCredential {
+	return &basicAuthCredential{digest: passwordDigest(password)}
+}
+
+func newBcryptCredential(hash string) *basicAuthCredential {
+	return &basicAuthCredential{bcryptHash: []byte(hash)}
+}
+
+func newSHA1Credential(hash []byte) *basicAuthCredential {
+	return &basicAuthCredential{sha1Hash: hash}
+}
+
+// passwordDigest returns the HMAC-SHA256 of password with passwordDigestKey
+func passwordDigest(password string) []byte {
+	mac := hmac.New(sha256.New, passwordDigestKey)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// loadBasicAuthUsersFile reads user:pass lines from a file of plaintext basic auth users.
+// Everything after the first colon is the password, as is, so passwords may contain any
+// character but a newline
+func loadBasicAuthUsersFile(path string) (map[string]*basicAuthCredential, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	credentials := map[string]*basicAuthCredential{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid entry on line %d of %s: expected user:pass", lineNumber, path)
+		}
+		credentials[parts[0]] = newPlaintextCredential(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// matches compares password with the credential in constant time. Once a password has
+// matched a bcrypt hash its digest is kept, so that bcrypt only runs for new passwords
+func (credential *basicAuthCredential) matches(password string) bool {
+	digest := passwordDigest(password)
+	credential.mu.RLock()
+	known := credential.digest
+	credential.mu.RUnlock()
+	if known != nil && subtle.ConstantTimeCompare(digest, known) == 1 {
+		return true
+	}
+	if credential.sha1Hash != nil {
+		hash := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare(hash[:], credential.sha1Hash) == 1
+	}
+	if credential.bcryptHash == nil {
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(credential.bcryptHash, []byte(password)) != nil {
+		return false
+	}
+	credential.mu.Lock()
+	credential.digest = digest
+	credential.mu.Unlock()
+	return true
+}
+
+// basicAuthEnabled reports whether any basic auth users are configured
+func (router *Router) basicAuthEnabled() bool {
+	return len(router.basicAuthCredentials) > 0 || router.htpasswd != nil
+}
+
+// check the basic auth credentials of the request against every configured basic auth user,
+// including those of the htpasswd file
+func (router *Router) isValidBasicAuth(request *http.Request) bool {
+	username, password, ok := request.BasicAuth()
+	if !ok {
+		return false
+	}
+	credential, known := router.basicAuthCredentials[username]
+	if !known && router.htpasswd != nil {
+		credential, known = router.htpasswd.credential(username)
+	}
+	if !known {
+		unknownUserCredential.matches(password)
+		return false
+	}
+	return credential.matches(password)
+}
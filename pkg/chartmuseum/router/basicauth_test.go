@@ -0,0 +1,151 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type BasicAuthTestSuite struct {
+	suite.Suite
+}
+
+func (suite *BasicAuthTestSuite) writeHtpasswd(content string) string {
+	file, err := ioutil.TempFile("", "htpasswd")
+	suite.Nil(err, "no error creating htpasswd file")
+	defer file.Close()
+	_, err = file.WriteString(content)
+	suite.Nil(err, "no error writing htpasswd file")
+	return file.Name()
+}
+
+func (suite *BasicAuthTestSuite) TestPlaintextCredential() {
+	credential := newPlaintextCredential("pass")
+	suite.True(credential.matches("pass"))
+	suite.False(credential.matches("pas"))
+	suite.False(credential.matches(""))
+
+	digest := sha256.Sum256([]byte("pass"))
+	suite.NotEqual(digest[:], credential.digest, "password digest is keyed")
+}
+
+func (suite *BasicAuthTestSuite) TestBcryptCredential() {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	suite.Nil(err, "no error hashing password")
+
+	credential := newBcryptCredential(string(hash))
+	suite.False(credential.matches("wrong"))
+	suite.Nil(credential.digest, "no digest kept for a wrong password")
+	suite.True(credential.matches("secret"))
+	suite.Equal(passwordDigest("secret"), credential.digest, "digest kept once the password matched")
+	suite.True(credential.matches("secret"))
+	suite.False(credential.matches("wrong"))
+}
+
+func (suite *BasicAuthTestSuite) TestLoadHtpasswdFile() {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	suite.Nil(err, "no error hashing password")
+
+	path := suite.writeHtpasswd(fmt.Sprintf("# users\nalice:%s\n\nbob:%s\n", hash, hash))
+	defer os.Remove(path)
+	credentials, err := loadHtpasswdFile(path)
+	suite.Nil(err, "no error loading htpasswd file")
+	suite.Len(credentials, 2)
+	suite.True(credentials["alice"].matches("secret"))
+
+	path = suite.writeHtpasswd("alice:$apr1$salt$hash\n")
+	defer os.Remove(path)
+	_, err = loadHtpasswdFile(path)
+	suite.NotNil(err, "error loading md5 hashes")
+
+	path = suite.writeHtpasswd("alice\n")
+	defer os.Remove(path)
+	_, err = loadHtpasswdFile(path)
+	suite.NotNil(err, "error loading entry without hash")
+
+	_, err = loadHtpasswdFile("/no/such/htpasswd")
+	suite.NotNil(err, "error loading missing file")
+}
+
+func (suite *BasicAuthTestSuite) TestLoadBasicAuthUsersFile() {
+	path := suite.writeHtpasswd("# users\nalice:pass,with:commas \r\n\nbob:bobpass\n")
+	defer os.Remove(path)
+	credentials, err := loadBasicAuthUsersFile(path)
+	suite.Nil(err, "no error loading users file")
+	suite.Len(credentials, 2)
+	suite.True(credentials["alice"].matches("pass,with:commas "), "password is kept as is")
+	suite.True(credentials["bob"].matches("bobpass"))
+
+	path = suite.writeHtpasswd("alice\n")
+	defer os.Remove(path)
+	_, err = loadBasicAuthUsersFile(path)
+	suite.NotNil(err, "error loading entry without password")
+
+	_, err = loadBasicAuthUsersFile("/no/such/users")
+	suite.NotNil(err, "error loading missing file")
+}
+
+func (suite *BasicAuthTestSuite) TestRouterBasicAuthUsersFile() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+
+	path := suite.writeHtpasswd("alice:pass,word\n")
+	defer os.Remove(path)
+	router := NewRouter(RouterOptions{
+		Logger:             log,
+		BasicAuthUsers:     []string{"bob:bobpass"},
+		BasicAuthUsersFile: path,
+	})
+	defer router.Stop()
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.SetBasicAuth("alice", "pass,word")
+	suite.True(router.isValidBasicAuth(request), "user from the file")
+	request.SetBasicAuth("bob", "bobpass")
+	suite.True(router.isValidBasicAuth(request), "inline user")
+	request.SetBasicAuth("alice", "pass")
+	suite.False(router.isValidBasicAuth(request))
+}
+
+func (suite *BasicAuthTestSuite) TestIsValidBasicAuth() {
+	router := &Router{basicAuthCredentials: map[string]*basicAuthCredential{
+		"user": newPlaintextCredential("pass"),
+	}}
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	suite.False(router.isValidBasicAuth(request), "no credentials")
+	request.SetBasicAuth("user", "pass")
+	suite.True(router.isValidBasicAuth(request))
+	request.SetBasicAuth("user", "wrong")
+	suite.False(router.isValidBasicAuth(request))
+	request.SetBasicAuth("nobody", "pass")
+	suite.False(router.isValidBasicAuth(request), "unknown user")
+}
+
+func TestBasicAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(BasicAuthTestSuite))
+}
@@ -0,0 +1,85 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseCIDRs parses a list of CIDR ranges such as "10.0.0.0/8". A bare IP address
+// is treated as a single host range
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				if ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR \"%s\"", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// networksContain reports whether ip is within any of the given networks
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the connection the request came in on
+func remoteIP(request *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(request.RemoteAddr))
+	if err != nil {
+		host = strings.TrimSpace(request.RemoteAddr)
+	}
+	return net.ParseIP(host)
+}
+
+// isWriteAllowed checks the client address against WriteAllowedCIDRs, if configured.
+// Forwarding headers are only taken into account when sent by a trusted proxy
+func (router *Router) isWriteAllowed(c *gin.Context) bool {
+	if len(router.WriteAllowedNetworks) == 0 {
+		return true
+	}
+	ip := remoteIP(c.Request)
+	if len(router.TrustedProxies) > 0 {
+		ip = net.ParseIP(contextClientIP(c))
+	}
+	return networksContain(router.WriteAllowedNetworks, ip)
+}
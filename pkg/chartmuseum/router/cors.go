@@ -0,0 +1,112 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	defaultCORSAllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+	defaultCORSAllowedHeaders = []string{"Authorization", "Content-Type"}
+)
+
+type (
+	// CORSOptions configure the Access-Control-* headers emitted by the Router
+	CORSOptions struct {
+		AllowedOrigins   []string
+		AllowedMethods   []string
+		AllowedHeaders   []string
+		AllowCredentials bool
+	}
+)
+
+// corsMiddleware adds CORS headers to responses for allowed origins and answers
+// preflight requests directly, without passing them to the masterHandler
+func corsMiddleware(options CORSOptions, contextPath string) gin.HandlerFunc {
+	allowAllOrigins := false
+	for _, origin := range options.AllowedOrigins {
+		if origin == "*" {
+			allowAllOrigins = true
+			break
+		}
+	}
+
+	methods := options.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSAllowedMethods
+	}
+	allowedMethods := strings.Join(methods, ", ")
+
+	headers := options.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSAllowedHeaders
+	}
+	allowedHeaders := strings.Join(headers, ", ")
+
+	return func(c *gin.Context) {
+		origin := c.Request.Header.Get("Origin")
+		if origin == "" || !isCORSOriginAllowed(origin, options.AllowedOrigins, allowAllOrigins) {
+			c.Next()
+			return
+		}
+
+		// requests outside of the context path are not served by ChartMuseum at all
+		path := c.Request.URL.Path
+		if contextPath != "" && path != contextPath && !strings.HasPrefix(path, contextPath+"/") {
+			c.Next()
+			return
+		}
+
+		// the wildcard is not permitted by browsers for credentialed requests
+		if allowAllOrigins && !options.AllowCredentials {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Vary", "Origin")
+		}
+		if options.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		isPreflight := c.Request.Method == http.MethodOptions &&
+			c.Request.Header.Get("Access-Control-Request-Method") != ""
+		if isPreflight {
+			c.Header("Access-Control-Allow-Methods", allowedMethods)
+			c.Header("Access-Control-Allow-Headers", allowedHeaders)
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func isCORSOriginAllowed(origin string, allowedOrigins []string, allowAllOrigins bool) bool {
+	if allowAllOrigins {
+		return true
+	}
+	for _, allowedOrigin := range allowedOrigins {
+		if strings.EqualFold(origin, allowedOrigin) {
+			return true
+		}
+	}
+	return false
+}
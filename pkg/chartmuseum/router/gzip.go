@@ -0,0 +1,116 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// responses smaller than this are not worth compressing
+	gzipMinLength = 1024
+
+	// content types which are already compressed (e.g. .tgz chart packages)
+	gzipSkipContentTypes = []string{
+		"application/x-tar",
+		"application/gzip",
+		"application/x-gzip",
+	}
+)
+
+type (
+	// gzipWriter buffers the response body so its size is known before deciding to compress
+	gzipWriter struct {
+		gin.ResponseWriter
+		buf bytes.Buffer
+	}
+)
+
+// gzipMiddleware compresses response bodies larger than gzipMinLength for clients
+// that send "Accept-Encoding: gzip"
+func gzipMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.Contains(c.Request.Header.Get("Accept-Encoding"), "gzip") || c.Request.Method == "HEAD" {
+			c.Next()
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: c.Writer}
+		c.Writer = gw
+		c.Next()
+		c.Writer = gw.ResponseWriter
+		gw.finish()
+	}
+}
+
+func (gw *gzipWriter) finish() {
+	w := gw.ResponseWriter
+	header := w.Header()
+
+	if gw.buf.Len() < gzipMinLength || header.Get("Content-Encoding") != "" || isCompressedContentType(header.Get("Content-Type")) {
+		w.WriteHeaderNow()
+		w.Write(gw.buf.Bytes())
+		return
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the compressed body differs from the one the strong ETag was computed for
+		header.Set("ETag", "W/"+etag)
+	}
+
+	zw := gzip.NewWriter(w)
+	zw.Write(gw.buf.Bytes())
+	zw.Close()
+}
+
+func (gw *gzipWriter) Write(data []byte) (int, error) {
+	return gw.buf.Write(data)
+}
+
+func (gw *gzipWriter) WriteString(s string) (int, error) {
+	return gw.buf.WriteString(s)
+}
+
+// WriteHeaderNow is deferred until the response has been written
+func (gw *gzipWriter) WriteHeaderNow() {}
+
+// Flush is deferred until the response has been written
+func (gw *gzipWriter) Flush() {}
+
+func (gw *gzipWriter) Size() int {
+	return gw.buf.Len()
+}
+
+func (gw *gzipWriter) Written() bool {
+	return gw.buf.Len() > 0
+}
+
+func isCompressedContentType(contentType string) bool {
+	for _, skip := range gzipSkipContentTypes {
+		if strings.HasPrefix(contentType, skip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const strictTransportSecurityHeader = "Strict-Transport-Security"
+
+var (
+	// headers which describe the response body, and so can only be set by the handler
+	reservedResponseHeaders = []string{
+		"Content-Type",
+		"Content-Length",
+		"Content-Encoding",
+		"Content-Disposition",
+		"Content-Range",
+		"Transfer-Encoding",
+		"Etag",
+		"Last-Modified",
+		"Location",
+	}
+)
+
+// checkResponseHeaders rejects custom response headers which would conflict with the headers
+// set by handlers
+func checkResponseHeaders(headers map[string]string) error {
+	for name := range headers {
+		canonicalName := http.CanonicalHeaderKey(name)
+		for _, reserved := range reservedResponseHeaders {
+			if canonicalName == reserved {
+				return fmt.Errorf("response header %s cannot be configured", name)
+			}
+		}
+	}
+	return nil
+}
+
+// responseHeadersMiddleware adds the configured headers to every response, including errors.
+// They are set before the request is handled, so a handler setting the same header wins.
+// Strict-Transport-Security is only sent over TLS, as browsers ignore it otherwise
+func responseHeadersMiddleware(headers map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for name, value := range headers {
+			if http.CanonicalHeaderKey(name) == strictTransportSecurityHeader && c.Request.TLS == nil {
+				continue
+			}
+			c.Header(name, value)
+		}
+		c.Next()
+	}
+}
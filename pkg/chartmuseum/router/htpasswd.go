@@ -0,0 +1,170 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+)
+
+const (
+	htpasswdCheckInterval = 10 * time.Second
+	htpasswdSHA1Prefix    = "{SHA}"
+)
+
+var bcryptHashPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+type (
+	// htpasswdFile holds the users of an htpasswd file, reloaded whenever the file changes
+	htpasswdFile struct {
+		Path        string
+		Logger      *cm_logger.Logger
+		mu          sync.RWMutex
+		credentials map[string]*basicAuthCredential
+		modTime     time.Time
+	}
+)
+
+func newHtpasswdFile(path string, logger *cm_logger.Logger) *htpasswdFile {
+	return &htpasswdFile{
+		Path:        path,
+		Logger:      logger,
+		credentials: map[string]*basicAuthCredential{},
+	}
+}
+
+// credential returns the credential of a user in the file
+func (file *htpasswdFile) credential(username string) (*basicAuthCredential, bool) {
+	file.mu.RLock()
+	defer file.mu.RUnlock()
+	credential, ok := file.credentials[username]
+	return credential, ok
+}
+
+// load reads the file and replaces the current users. On failure the current
+// users are kept
+func (file *htpasswdFile) load() error {
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return err
+	}
+	credentials, err := loadHtpasswdFile(file.Path)
+	if err != nil {
+		return err
+	}
+
+	file.mu.Lock()
+	file.credentials = credentials
+	file.modTime = info.ModTime()
+	file.mu.Unlock()
+	return nil
+}
+
+// changed reports whether the file was modified since it was last loaded
+func (file *htpasswdFile) changed() bool {
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return false
+	}
+	file.mu.RLock()
+	defer file.mu.RUnlock()
+	return !info.ModTime().Equal(file.modTime)
+}
+
+// run reloads the file every interval in which it changed, until stop is closed
+func (file *htpasswdFile) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !file.changed() {
+				continue
+			}
+			if err := file.load(); err != nil {
+				file.Logger.Errorw("Error reloading htpasswd file, keeping current users",
+					"path", file.Path,
+					"error", err.Error(),
+				)
+				continue
+			}
+			file.Logger.Infow("Reloaded htpasswd file",
+				"path", file.Path,
+			)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// loadHtpasswdFile reads user:hash lines from an htpasswd file. Only bcrypt ("htpasswd -B")
+// and SHA-1 ("htpasswd -s") hashes are supported
+func loadHtpasswdFile(path string) (map[string]*basicAuthCredential, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	credentials := map[string]*basicAuthCredential{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid entry on line %d of %s: expected user:hash", lineNumber, path)
+		}
+		credential, err := htpasswdCredential(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash for user %s in %s: %s", parts[0], path, err)
+		}
+		credentials[parts[0]] = credential
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func htpasswdCredential(hash string) (*basicAuthCredential, error) {
+	if strings.HasPrefix(hash, htpasswdSHA1Prefix) {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, htpasswdSHA1Prefix))
+		if err != nil || len(sum) != sha1.Size {
+			return nil, fmt.Errorf("malformed SHA-1 hash")
+		}
+		return newSHA1Credential(sum), nil
+	}
+	for _, prefix := range bcryptHashPrefixes {
+		if strings.HasPrefix(hash, prefix) {
+			return newBcryptCredential(hash), nil
+		}
+	}
+	return nil, fmt.Errorf("only bcrypt and SHA-1 hashes are supported")
+}
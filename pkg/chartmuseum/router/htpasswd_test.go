@@ -0,0 +1,127 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sha1 of "secret", as written by htpasswd -s
+var testSHA1Hash = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+
+type HtpasswdTestSuite struct {
+	suite.Suite
+	BcryptHash string
+}
+
+func (suite *HtpasswdTestSuite) SetupSuite() {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	suite.Nil(err, "no error hashing password")
+	suite.BcryptHash = string(hash)
+}
+
+func (suite *HtpasswdTestSuite) writeHtpasswd(content string) string {
+	file, err := ioutil.TempFile("", "htpasswd")
+	suite.Nil(err, "no error creating htpasswd file")
+	defer file.Close()
+	_, err = file.WriteString(content)
+	suite.Nil(err, "no error writing htpasswd file")
+	return file.Name()
+}
+
+func (suite *HtpasswdTestSuite) TestSHA1Entries() {
+	path := suite.writeHtpasswd(fmt.Sprintf("alice:%s\nbob:%s\n", suite.BcryptHash, testSHA1Hash))
+	defer os.Remove(path)
+	credentials, err := loadHtpasswdFile(path)
+	suite.Nil(err, "no error loading htpasswd file")
+	suite.True(credentials["bob"].matches("secret"), "sha1 entry")
+	suite.False(credentials["bob"].matches("wrong"))
+
+	path = suite.writeHtpasswd("alice:{SHA}not-base64\n")
+	defer os.Remove(path)
+	_, err = loadHtpasswdFile(path)
+	suite.NotNil(err, "error loading malformed sha1 hash")
+}
+
+func (suite *HtpasswdTestSuite) TestReload() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+
+	path := suite.writeHtpasswd("alice:" + testSHA1Hash + "\n")
+	defer os.Remove(path)
+	file := newHtpasswdFile(path, log)
+	suite.Nil(file.load(), "no error loading htpasswd file")
+	suite.False(file.changed())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go file.run(10*time.Millisecond, stop)
+
+	err = ioutil.WriteFile(path, []byte("alice:"+testSHA1Hash+"\nbob:"+testSHA1Hash+"\n"), 0644)
+	suite.Nil(err, "no error updating htpasswd file")
+	future := time.Now().Add(time.Minute)
+	suite.Nil(os.Chtimes(path, future, future), "no error changing htpasswd file time")
+	loaded := false
+	for i := 0; i < 100 && !loaded; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, loaded = file.credential("bob")
+	}
+	suite.True(loaded, "new user is loaded")
+
+	err = ioutil.WriteFile(path, []byte("invalid\n"), 0644)
+	suite.Nil(err, "no error updating htpasswd file")
+	suite.NotNil(file.load(), "error loading invalid htpasswd file")
+	_, ok := file.credential("alice")
+	suite.True(ok, "users are kept when the file is invalid")
+}
+
+func (suite *HtpasswdTestSuite) TestRouterHtpasswdFile() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+
+	path := suite.writeHtpasswd("alice:" + suite.BcryptHash + "\n")
+	defer os.Remove(path)
+	router := NewRouter(RouterOptions{
+		Logger:            log,
+		Username:          "user",
+		Password:          "pass",
+		BasicAuthHtpasswd: path,
+	})
+	defer router.Stop()
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.SetBasicAuth("alice", "secret")
+	suite.True(router.isValidBasicAuth(request), "htpasswd user")
+	request.SetBasicAuth("user", "pass")
+	suite.True(router.isValidBasicAuth(request), "inline user")
+	request.SetBasicAuth("alice", "pass")
+	suite.False(router.isValidBasicAuth(request))
+}
+
+func TestHtpasswdTestSuite(t *testing.T) {
+	suite.Run(t, new(HtpasswdTestSuite))
+}
@@ -0,0 +1,156 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+)
+
+const (
+	defaultJwksRefreshInterval = 15 * time.Minute
+	jwksFetchTimeout           = 10 * time.Second
+)
+
+type (
+	// jwksCache holds the RSA signing keys published at a JWKS endpoint, by kid
+	jwksCache struct {
+		URL    string
+		Logger *cm_logger.Logger
+		client *http.Client
+		mu     sync.RWMutex
+		keys   map[string]*rsa.PublicKey
+	}
+
+	jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+)
+
+func newJwksCache(url string, logger *cm_logger.Logger) *jwksCache {
+	return &jwksCache{
+		URL:    url,
+		Logger: logger,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		keys:   map[string]*rsa.PublicKey{},
+	}
+}
+
+// key returns the cached key with the given kid
+func (cache *jwksCache) key(kid string) (*rsa.PublicKey, bool) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	key, ok := cache.keys[kid]
+	return key, ok
+}
+
+// refresh fetches the JWKS and replaces the cached keys. On failure the
+// currently cached keys are kept
+func (cache *jwksCache) refresh() error {
+	resp, err := cache.client.Get(cache.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status fetching JWKS from %s: %d", cache.URL, resp.StatusCode)
+	}
+
+	var set jwks
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.rsaPublicKey()
+		if err != nil {
+			cache.Logger.Warnw("Skipping invalid JWKS key",
+				"kid", k.Kid,
+				"error", err.Error(),
+			)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no RSA signing keys found in JWKS from %s", cache.URL)
+	}
+
+	cache.mu.Lock()
+	cache.keys = keys
+	cache.mu.Unlock()
+	return nil
+}
+
+// run refreshes the cached keys every interval until stop is closed
+func (cache *jwksCache) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := cache.refresh(); err != nil {
+				cache.Logger.Errorw("Error refreshing JWKS, keeping cached keys",
+					"url", cache.URL,
+					"error", err.Error(),
+				)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(n) == 0 || len(e) == 0 {
+		return nil, errors.New("missing modulus or exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
@@ -0,0 +1,232 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/suite"
+)
+
+type JwksTestSuite struct {
+	suite.Suite
+	Logger     *cm_logger.Logger
+	PrivateKey *rsa.PrivateKey
+	Server     *httptest.Server
+	Available  bool
+}
+
+func (suite *JwksTestSuite) SetupSuite() {
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+	suite.Logger = logger
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	suite.Nil(err, "no error generating rsa key")
+	suite.PrivateKey = privateKey
+
+	suite.Available = true
+	suite.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !suite.Available {
+			w.WriteHeader(500)
+			return
+		}
+		json.NewEncoder(w).Encode(jwks{Keys: []jwk{{
+			Kty: "RSA",
+			Kid: "key-1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(privateKey.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.PublicKey.E)).Bytes()),
+		}}})
+	}))
+}
+
+func (suite *JwksTestSuite) TearDownSuite() {
+	suite.Server.Close()
+}
+
+func (suite *JwksTestSuite) signToken(kid string) string {
+	return suite.signTokenWithClaims(kid, jwt.MapClaims{"sub": "ci-pusher"})
+}
+
+func (suite *JwksTestSuite) signTokenWithClaims(kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(suite.PrivateKey)
+	suite.Nil(err, "no error signing token")
+	return signed
+}
+
+func (suite *JwksTestSuite) TestRefresh() {
+	suite.Available = true
+	cache := newJwksCache(suite.Server.URL, suite.Logger)
+	suite.Nil(cache.refresh(), "no error fetching jwks")
+
+	key, ok := cache.key("key-1")
+	suite.True(ok, "key cached by kid")
+	suite.Equal(suite.PrivateKey.PublicKey.N, key.N)
+	suite.Equal(suite.PrivateKey.PublicKey.E, key.E)
+
+	suite.Available = false
+	suite.NotNil(cache.refresh(), "error fetching jwks")
+	_, ok = cache.key("key-1")
+	suite.True(ok, "cached keys are kept after a failed refresh")
+	suite.Available = true
+}
+
+func (suite *JwksTestSuite) TestValidateJWT() {
+	suite.Available = true
+	router := &Router{Logger: suite.Logger, jwks: newJwksCache(suite.Server.URL, suite.Logger)}
+	suite.Nil(router.jwks.refresh(), "no error fetching jwks")
+
+	_, valid := validateJWT(suite.signToken("key-1"), router)
+	suite.True(valid, "token signed with known kid is valid")
+
+	_, valid = validateJWT(suite.signToken("key-2"), router)
+	suite.False(valid, "token signed with unknown kid is invalid")
+
+	hmacToken, err := jwt.New(jwt.SigningMethodHS256).SignedString([]byte("secret"))
+	suite.Nil(err, "no error signing token")
+	_, valid = validateJWT(hmacToken, router)
+	suite.False(valid, "token with non-RSA signing method is invalid")
+}
+
+func (suite *JwksTestSuite) TestScopedBearerAuth() {
+	suite.Available = true
+	router := &Router{
+		Logger:           suite.Logger,
+		jwks:             newJwksCache(suite.Server.URL, suite.Logger),
+		BearerAuthHeader: "Bearer",
+		AuthRealm:        "https://auth.example.com/token",
+		AuthService:      "chartmuseum",
+	}
+	suite.Nil(router.jwks.refresh(), "no error fetching jwks")
+
+	newRequest := func(method string, token string) *http.Request {
+		request, _ := http.NewRequest(method, "/", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		return request
+	}
+
+	pullToken := suite.signTokenWithClaims("key-1", jwt.MapClaims{"scope": "repository:myrepo:pull"})
+	pushToken := suite.signTokenWithClaims("key-1", jwt.MapClaims{"scope": "repository:myrepo:pull,push"})
+	accessToken := suite.signTokenWithClaims("key-1", jwt.MapClaims{
+		"access": []map[string]interface{}{{"type": "repository", "name": "myrepo", "actions": []string{"push"}}},
+	})
+
+	authorized, _, _ := router.authorizeRequest(newRequest("GET", pullToken), RepoPullAction, "myrepo")
+	suite.True(authorized, "pull allowed with pull scope")
+
+	authorized, _, headers := router.authorizeRequest(newRequest("POST", pullToken), RepoPushAction, "myrepo")
+	suite.False(authorized, "push denied with pull scope")
+	suite.Equal(`Bearer realm="https://auth.example.com/token",service="chartmuseum",scope="repository:myrepo:push"`,
+		headers.Get("WWW-Authenticate"))
+
+	authorized, _, _ = router.authorizeRequest(newRequest("POST", pushToken), RepoPushAction, "myrepo")
+	suite.True(authorized, "push allowed with push scope")
+
+	authorized, _, _ = router.authorizeRequest(newRequest("POST", pushToken), RepoPushAction, "otherrepo")
+	suite.False(authorized, "push scope is specific to a repo")
+
+	authorized, _, _ = router.authorizeRequest(newRequest("POST", accessToken), RepoPushAction, "myrepo")
+	suite.True(authorized, "push allowed with access claim")
+
+	_, _, headers = router.authorizeRequest(newRequest("POST", pullToken), RepoPushAction, "")
+	suite.Contains(headers.Get("WWW-Authenticate"), `scope="repository:*:push"`, "no repo without multitenancy")
+
+	authorized, _, headers = router.authorizeRequest(newRequest("GET", suite.signToken("key-2")), RepoPullAction, "myrepo")
+	suite.False(authorized, "pull denied with invalid token")
+	suite.Equal(`Bearer realm="https://auth.example.com/token",service="chartmuseum",error="invalid_token"`,
+		headers.Get("WWW-Authenticate"))
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	_, _, headers = router.authorizeRequest(request, RepoPullAction, "myrepo")
+	suite.Equal(`Bearer realm="https://auth.example.com/token",service="chartmuseum"`,
+		headers.Get("WWW-Authenticate"), "challenge without a token")
+}
+
+func (suite *JwksTestSuite) TestBasicAndBearerAuth() {
+	suite.Available = true
+	router := &Router{
+		Logger:           suite.Logger,
+		jwks:             newJwksCache(suite.Server.URL, suite.Logger),
+		BearerAuthHeader: "Bearer",
+		BasicAuthRealm:   "ChartMuseum",
+		AuthRealm:        "https://auth.example.com/token",
+		AuthService:      "chartmuseum",
+		basicAuthCredentials: map[string]*basicAuthCredential{
+			"user": newPlaintextCredential("pass"),
+		},
+	}
+	suite.Nil(router.jwks.refresh(), "no error fetching jwks")
+
+	basicRequest := func(password string) *http.Request {
+		request, _ := http.NewRequest("GET", "/", nil)
+		request.SetBasicAuth("user", password)
+		return request
+	}
+	bearerRequest := func(token string) *http.Request {
+		request, _ := http.NewRequest("GET", "/", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		return request
+	}
+	basicChallenge := `Basic realm="ChartMuseum"`
+	bearerChallenge := `Bearer realm="https://auth.example.com/token",service="chartmuseum"`
+
+	authorized, identity, _ := router.authorizeRequest(basicRequest("pass"), RepoPullAction, "myrepo")
+	suite.True(authorized, "basic auth accepted")
+	suite.Equal("user", identity)
+
+	authorized, identity, _ = router.authorizeRequest(bearerRequest(suite.signToken("key-1")), RepoPullAction, "myrepo")
+	suite.True(authorized, "bearer auth accepted")
+	suite.Equal("ci-pusher", identity)
+
+	authorized, _, headers := router.authorizeRequest(basicRequest("wrong"), RepoPullAction, "myrepo")
+	suite.False(authorized, "invalid basic auth credentials denied")
+	suite.Equal([]string{basicChallenge, bearerChallenge}, headers["Www-Authenticate"], "both schemes advertised")
+
+	authorized, _, headers = router.authorizeRequest(bearerRequest(suite.signToken("key-2")), RepoPullAction, "myrepo")
+	suite.False(authorized, "invalid token denied")
+	suite.Equal([]string{basicChallenge, bearerChallenge + `,error="invalid_token"`}, headers["Www-Authenticate"])
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	authorized, _, headers = router.authorizeRequest(request, RepoPullAction, "myrepo")
+	suite.False(authorized, "credentials required")
+	suite.Equal([]string{basicChallenge, bearerChallenge}, headers["Www-Authenticate"], "both schemes advertised")
+
+	identity, _ = router.accessRuleIdentity(basicRequest("pass"), RepoPullAction, "myrepo")
+	suite.Equal("user", identity, "access rules apply to basic auth users")
+	identity, _ = router.accessRuleIdentity(bearerRequest(suite.signToken("key-1")), RepoPullAction, "myrepo")
+	suite.Equal("ci-pusher", identity, "access rules apply to token subjects")
+}
+
+func TestJwksTestSuite(t *testing.T) {
+	suite.Run(t, new(JwksTestSuite))
+}
@@ -0,0 +1,64 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// suggested wait before retrying a write rejected during maintenance
+	maintenanceRetryAfterSeconds = 60
+)
+
+// SetMaintenance turns maintenance mode on or off. In maintenance mode, pushes and deletes
+// are rejected with a 503 while pulls are still served, e.g. while storage is backed up
+func (router *Router) SetMaintenance(on bool) {
+	var flag int32
+	if on {
+		flag = 1
+	}
+	if atomic.SwapInt32(&router.maintenance, flag) != flag {
+		router.Logger.Infow("Maintenance mode changed",
+			"maintenance", on,
+		)
+	}
+}
+
+// Maintenance reports whether the router is in maintenance mode
+func (router *Router) Maintenance() bool {
+	return atomic.LoadInt32(&router.maintenance) == 1
+}
+
+// watchMaintenanceSignal toggles maintenance mode every time SIGUSR1 is received, until
+// stop is closed
+func (router *Router) watchMaintenanceSignal(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+			router.SetMaintenance(!router.Maintenance())
+		case <-stop:
+			return
+		}
+	}
+}
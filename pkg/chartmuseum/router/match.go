@@ -62,16 +62,24 @@ func match(routes []*Route, method string, url string, contextPath string, depth
 		}
 	}
 
-	if url == "/health" && method == http.MethodGet {
+	// server info routes (e.g. /health, /readiness) are never nested under a repo
+	if method == http.MethodGet {
 		for _, route := range routes {
-			if route.Path == "/health" {
+			if route.Action == SystemInfoAction && route.Path == url {
 				return route, nil
 			}
 		}
 	}
 
-	isApiRoute := strings.HasPrefix(url, "/api")
-	if isApiRoute {
+	// routes under /api and (when registered) the OCI distribution API under /v2 take the repo
+	// after their prefix, e.g. /api/myrepo/charts or /v2/myrepo/mychart/manifests/0.1.0
+	var routePrefix string
+	if strings.HasPrefix(url, "/api") {
+		routePrefix = "/api"
+	} else if strings.HasPrefix(url, OCIPathPrefix) && hasOCIRoutes(routes) {
+		routePrefix = strings.TrimSuffix(OCIPathPrefix, "/")
+	}
+	if routePrefix != "" {
 		startIndex = 2
 	} else {
 		startIndex = 1
@@ -82,14 +90,17 @@ func match(routes []*Route, method string, url string, contextPath string, depth
 
 	if numParts >= depth+startIndex {
 		repoParts := pathSplit[startIndex : depth+startIndex]
-		if len(repoParts) == depth {
+		// the repo must be followed by a route path, so that e.g. /myorg/index.yaml is not taken
+		// as the welcome page (/) of a repo "myorg/index.yaml" with --depth=2
+		rest := strings.Join(pathSplit[depth+startIndex:], "/")
+		if len(repoParts) == depth && rest != "" {
 			tryRepoRoutes = true
 			repo = strings.Join(repoParts, "/")
-			noRepoPath = "/" + strings.Join(pathSplit[depth+startIndex:], "/")
+			noRepoPath = "/" + rest
 			repoPath = "/:repo" + noRepoPath
-			if isApiRoute {
-				repoPath = "/api" + repoPath
-				noRepoPath = "/api" + noRepoPath
+			if routePrefix != "" {
+				repoPath = routePrefix + repoPath
+				noRepoPath = routePrefix + noRepoPath
 			}
 			noRepoPathSplit = strings.Split(noRepoPath, "/")
 			numNoRepoPathParts = len(noRepoPathSplit)
@@ -129,3 +140,35 @@ func match(routes []*Route, method string, url string, contextPath string, depth
 
 	return nil, nil
 }
+
+// matchVariableDepth matches a route like match does, but with a repo of any depth from
+// minDepth up, rather than of exactly one depth. Routes only differ by the path after the
+// repo, so the repo is the shortest prefix for which the rest of the path matches a route,
+// e.g. "myorg/myteam/myproject" for /myorg/myteam/myproject/charts/mychart-0.1.0.tgz
+func matchVariableDepth(routes []*Route, method string, url string, contextPath string, minDepth int) (*Route, []gin.Param) {
+	maxDepth := strings.Count(url, "/")
+	if maxDepth < minDepth {
+		maxDepth = minDepth // routes without a repo, such as /
+	}
+	for depth := minDepth; depth <= maxDepth; depth++ {
+		if route, params := match(routes, method, url, contextPath, depth); route != nil {
+			return route, params
+		}
+	}
+	return nil, nil
+}
+
+// hasOCIRoutes reports whether any of the routes belong to the OCI distribution API, so
+// that a repo named "v2" keeps working when the OCI routes are not registered
+func hasOCIRoutes(routes []*Route) bool {
+	for _, route := range routes {
+		if isOCIRoute(route) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOCIRoute(route *Route) bool {
+	return strings.HasPrefix(route.Path, OCIPathPrefix)
+}
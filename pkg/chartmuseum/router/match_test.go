@@ -193,6 +193,102 @@ func (suite *MatchTestSuite) TestMatch() {
 	}
 }
 
+func (suite *MatchTestSuite) TestMatchOCI() {
+	noop := func(c *gin.Context) {}
+	routes := []*Route{
+		{"GET", "/v2/", noop, RepoPullAction},
+		{"GET", "/:repo/index.yaml", noop, RepoPullAction},
+		{"GET", "/v2/:repo/:name/manifests/:reference", noop, RepoPullAction},
+		{"POST", "/v2/:repo/:name/blobs/uploads/", noop, RepoPushAction},
+		{"PUT", "/v2/:repo/:name/blobs/uploads/:uuid", noop, RepoPushAction},
+	}
+
+	for depth := 0; depth <= 2; depth++ {
+		var repo string
+		switch depth {
+		case 1:
+			repo = "myrepo"
+		case 2:
+			repo = "myorg/myrepo"
+		}
+
+		for _, contextPath := range []string{"", "/x"} {
+			route, params := match(routes, "GET", contextPath+"/v2/", contextPath, depth)
+			suite.Equal(routes[0], route, "GET /v2/")
+			suite.Nil(params)
+
+			r := pathutil.Join("/", contextPath, "v2", repo, "mychart/manifests/0.1.0")
+			route, params = match(routes, "GET", r, contextPath, depth)
+			suite.Equal(routes[2], route, "GET %s", r)
+			suite.Equal([]gin.Param{{"name", "mychart"}, {"reference", "0.1.0"}, {"repo", repo}}, params)
+
+			r = pathutil.Join("/", contextPath, "v2", repo, "mychart/blobs/uploads") + "/"
+			route, params = match(routes, "POST", r, contextPath, depth)
+			suite.Equal(routes[3], route, "POST %s", r)
+			suite.Equal([]gin.Param{{"name", "mychart"}, {"repo", repo}}, params)
+
+			r = pathutil.Join("/", contextPath, "v2", repo, "mychart/blobs/uploads/abc123")
+			route, params = match(routes, "PUT", r, contextPath, depth)
+			suite.Equal(routes[4], route, "PUT %s", r)
+			suite.Equal([]gin.Param{{"name", "mychart"}, {"uuid", "abc123"}, {"repo", repo}}, params)
+		}
+	}
+
+	// without OCI routes, a repo named v2 is an ordinary repo
+	route, params := match(routes[1:2], "GET", "/v2/index.yaml", "", 1)
+	suite.Equal(routes[1], route, "GET /v2/index.yaml without OCI routes")
+	suite.Equal([]gin.Param{{"repo", "v2"}}, params)
+}
+
+func (suite *MatchTestSuite) TestMatchVariableDepth() {
+	noop := func(c *gin.Context) {}
+	routes := []*Route{
+		{"GET", "/health", noop, SystemInfoAction},
+		{"GET", "/:repo/index.yaml", noop, RepoPullAction},
+		{"GET", "/:repo/charts/:filename", noop, RepoPullAction},
+		{"GET", "/api/:repo/charts/:name", noop, RepoPullAction},
+		{"GET", "/api/:repo/charts/:name/:version", noop, RepoPullAction},
+	}
+
+	for _, repo := range []string{"myrepo", "myorg/myrepo", "myorg/myteam/myproject"} {
+		r := pathutil.Join("/", repo, "index.yaml")
+		route, params := matchVariableDepth(routes, "GET", r, "", 1)
+		suite.Equal(routes[1], route, "GET %s", r)
+		suite.Equal([]gin.Param{{"repo", repo}}, params)
+
+		r = pathutil.Join("/x", repo, "charts/mychart-0.1.0.tgz")
+		route, params = matchVariableDepth(routes, "GET", r, "/x", 1)
+		suite.Equal(routes[2], route, "GET %s", r)
+		suite.Equal([]gin.Param{{"filename", "mychart-0.1.0.tgz"}, {"repo", repo}}, params)
+
+		r = pathutil.Join("/api", repo, "charts/mychart")
+		route, params = matchVariableDepth(routes, "GET", r, "", 1)
+		suite.Equal(routes[3], route, "GET %s", r)
+		suite.Equal([]gin.Param{{"name", "mychart"}, {"repo", repo}}, params)
+
+		r = pathutil.Join("/api", repo, "charts/mychart/0.1.0")
+		route, params = matchVariableDepth(routes, "GET", r, "", 1)
+		suite.Equal(routes[4], route, "GET %s", r)
+		suite.Equal([]gin.Param{{"name", "mychart"}, {"version", "0.1.0"}, {"repo", repo}}, params)
+	}
+
+	rootRoutes := append([]*Route{{"GET", "/", noop, RepoPullAction}}, routes...)
+	route, _ := matchVariableDepth(rootRoutes, "GET", "/myorg/index.yaml", "", 2)
+	suite.Nil(route, "no welcome page for a repo taking up the whole path")
+	route, _ = matchVariableDepth(rootRoutes, "GET", "/", "", 2)
+	suite.Equal(rootRoutes[0], route, "GET /")
+
+	route, params := matchVariableDepth(routes, "GET", "/health", "", 1)
+	suite.Equal(routes[0], route, "GET /health")
+	suite.Nil(params)
+
+	route, _ = matchVariableDepth(routes, "GET", "/index.yaml", "", 1)
+	suite.Nil(route, "no repo shallower than the minimum depth")
+	route, params = matchVariableDepth(routes, "GET", "/index.yaml", "", 0)
+	suite.Equal(routes[1], route, "GET /index.yaml with a minimum depth of 0")
+	suite.Equal([]gin.Param{{"repo", ""}}, params)
+}
+
 func TestMatchTestSuite(t *testing.T) {
 	suite.Run(t, new(MatchTestSuite))
 }
@@ -0,0 +1,199 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Requests per tenant (repo), for use with multitenancy
+	tenantRequestCounterVec *prometheus.CounterVec
+	// Authentication attempts, partitioned by scheme and result
+	authCounterVec *prometheus.CounterVec
+	// 401 responses to requests without valid credentials
+	unauthorizedCounter prometheus.Counter
+	// Time taken by route handlers, partitioned by the action of the route and status class.
+	// Unlike the request_duration_seconds summary of ginprometheus, this tells pulls from pushes
+	requestDurationHistogramVec *prometheus.HistogramVec
+	// Chart uploads currently being handled
+	uploadsInFlightGauge prometheus.Gauge
+
+	metricsLock      sync.Mutex
+	metricsNamespace string
+	metricsSubsystem string
+	// set once a router with metrics enabled registered the authentication and request duration metrics
+	optionalMetricsRegistered bool
+)
+
+const (
+	authSchemeBasic      = "basic"
+	authSchemeBearer     = "bearer"
+	authSchemeClientCert = "clientcert"
+	authSchemeAnonymous  = "anonymous"
+)
+
+func init() {
+	SetMetricsPrefix("", "")
+}
+
+// SetMetricsPrefix creates the router metrics under namespace ("chartmuseum" if empty) and
+// subsystem, in place of the ones registered before. The HTTP request metrics of ginprometheus
+// get the same prefix from RouterOptions. It is called on startup, before any router is created
+func SetMetricsPrefix(namespace string, subsystem string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	if tenantRequestCounterVec != nil {
+		if namespace == metricsNamespace && subsystem == metricsSubsystem {
+			return
+		}
+		for _, collector := range []prometheus.Collector{tenantRequestCounterVec, uploadsInFlightGauge,
+			authCounterVec, unauthorizedCounter, requestDurationHistogramVec} {
+			prometheus.Unregister(collector)
+		}
+	}
+	metricsNamespace, metricsSubsystem = namespace, subsystem
+	tenantRequestCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tenant_requests_total",
+			Help:      "How many HTTP requests processed, partitioned by tenant, status code, HTTP method and url",
+		},
+		[]string{"tenant", "code", "method", "url"},
+	)
+	authCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "auth_total",
+			Help:      "How many requests were authenticated, partitioned by scheme (basic, bearer, clientcert or anonymous) and result (success or failure)",
+		},
+		[]string{"result", "scheme"},
+	)
+	unauthorizedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "unauthorized_responses_total",
+			Help:      "How many requests were rejected with a 401 for lack of valid credentials",
+		},
+	)
+	requestDurationHistogramVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "handler_duration_seconds",
+			Help:      "Time taken to handle a request, partitioned by route action (pull, push, sysinfo, ...) and status class (2xx, 4xx, ...)",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"action", "status_class"},
+	)
+	uploadsInFlightGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "uploads_in_flight",
+			Help:      "Current number of chart uploads being handled",
+		},
+	)
+	prometheus.MustRegister(tenantRequestCounterVec, uploadsInFlightGauge)
+	if optionalMetricsRegistered {
+		prometheus.MustRegister(authCounterVec, unauthorizedCounter, requestDurationHistogramVec)
+	}
+}
+
+// registerMetrics registers the authentication and request duration metrics, which are
+// only exposed when metrics are enabled. Routers created after the first share them
+func registerMetrics() {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if !optionalMetricsRegistered {
+		prometheus.MustRegister(authCounterVec, unauthorizedCounter, requestDurationHistogramVec)
+		optionalMetricsRegistered = true
+	}
+}
+
+// observeAuth counts the outcome of authenticating a request with scheme
+func observeAuth(scheme string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	authCounterVec.WithLabelValues(result, scheme).Inc()
+}
+
+// metricsPrefix returns the prefix of the HTTP request metrics, "chartmuseum" by default.
+// ginprometheus only takes a subsystem, which is why the namespace is prepended to it
+func metricsPrefix(namespace string, subsystem string) string {
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	if subsystem == "" {
+		return namespace
+	}
+	return namespace + "_" + subsystem
+}
+
+// observeRequestDuration records how long the handler of a route with act took to respond
+// with status
+func observeRequestDuration(act action, status int, duration time.Duration) {
+	statusClass := strconv.Itoa(status/100) + "xx"
+	requestDurationHistogramVec.WithLabelValues(string(act), statusClass).Observe(duration.Seconds())
+}
+
+// tenantMetricsMiddleware counts requests by tenant once they have been handled
+// by the masterHandler. Only the tenants reported by KnownTenant, if set, are counted
+func (router *Router) tenantMetricsMiddleware(c *gin.Context) {
+	c.Next()
+
+	tenant, ok := mapURLToTenant(c)
+	if !ok {
+		return
+	}
+	if router.KnownTenant != nil && !router.KnownTenant(tenant) {
+		return
+	}
+	tenantRequestCounterVec.WithLabelValues(
+		tenant,
+		strconv.Itoa(c.Writer.Status()),
+		c.Request.Method,
+		mapURLWithParamsBackToRouteTemplate(c),
+	).Inc()
+}
+
+/*
+mapURLToTenant returns the tenant of a request, i.e. the repo (the first Depth path segments)
+of the route matched by the masterHandler. Requests which did not match a repo route,
+as well as 404s, are not counted. Any path can still name a repo, more so with variable
+depth, which is why the middleware also leaves out the tenants KnownTenant does not know.
+*/
+func mapURLToTenant(c *gin.Context) (string, bool) {
+	tenant := c.Param("repo")
+	if tenant == "" || c.Writer.Status() == 404 {
+		return "", false
+	}
+	return tenant, true
+}
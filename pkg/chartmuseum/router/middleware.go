@@ -18,6 +18,8 @@ package router
 
 import (
 	"fmt"
+	"net"
+	"regexp"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -31,27 +33,119 @@ import (
 var (
 	requestCount         int64
 	requestServedMessage = "Request served"
+
+	// the request ID is read from this header if present, and always sent back in it
+	defaultRequestIDHeader = "X-Request-Id"
+
+	// an incoming request ID is only kept if it matches, since it is logged and sent back as is.
+	// Anything else, e.g. an overlong ID or one with spaces or control characters, is replaced
+	requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+	// fields logged for each request when RouterOptions.AccessLogFields is empty
+	defaultAccessLogFields = []string{"path", "comment", "latency", "clientIP", "method", "statusCode"}
+
+	// all fields which can be included in the access log. Request headers other
+	// than User-Agent are deliberately left out, so credentials are never logged
+	accessLogFieldFuncs = map[string]func(c *gin.Context, latency time.Duration) interface{}{
+		"path": func(c *gin.Context, latency time.Duration) interface{} {
+			return c.Request.URL.Path
+		},
+		"comment": func(c *gin.Context, latency time.Duration) interface{} {
+			return c.Errors.ByType(gin.ErrorTypePrivate).String()
+		},
+		"latency": func(c *gin.Context, latency time.Duration) interface{} {
+			return latency
+		},
+		"clientIP": func(c *gin.Context, latency time.Duration) interface{} {
+			return contextClientIP(c)
+		},
+		"method": func(c *gin.Context, latency time.Duration) interface{} {
+			return c.Request.Method
+		},
+		"statusCode": func(c *gin.Context, latency time.Duration) interface{} {
+			return c.Writer.Status()
+		},
+		"bytes": func(c *gin.Context, latency time.Duration) interface{} {
+			return c.Writer.Size()
+		},
+		"tenant": func(c *gin.Context, latency time.Duration) interface{} {
+			return c.Param("repo")
+		},
+		"userAgent": func(c *gin.Context, latency time.Duration) interface{} {
+			return c.Request.UserAgent()
+		},
+	}
 )
 
-func requestWrapper(logger *cm_logger.Logger) func(c *gin.Context) {
+// accessLogSampler picks which successful requests are logged: one in every, starting with
+// the first. Other requests are always logged
+type accessLogSampler struct {
+	every uint64
+	count uint64
+}
+
+func newAccessLogSampler(every int) *accessLogSampler {
+	if every < 1 {
+		every = 1
+	}
+	return &accessLogSampler{every: uint64(every)}
+}
+
+func (sampler *accessLogSampler) logged(status int) bool {
+	if sampler.every == 1 || status < 200 || status > 299 {
+		return true
+	}
+	return (atomic.AddUint64(&sampler.count, 1)-1)%sampler.every == 0
+}
+
+// checkAccessLogFields returns an error for any field not in accessLogFieldFuncs
+func checkAccessLogFields(fields []string) error {
+	for _, field := range fields {
+		if _, ok := accessLogFieldFuncs[field]; !ok {
+			return fmt.Errorf("invalid access log field \"%s\"", field)
+		}
+	}
+	return nil
+}
+
+func requestWrapper(logger *cm_logger.Logger, trustedProxies []*net.IPNet, trustedPlatform string, accessLogFields []string, accessLogSampling int, requestIDHeader string) func(c *gin.Context) {
+	if len(accessLogFields) == 0 {
+		accessLogFields = defaultAccessLogFields
+	}
+	if requestIDHeader == "" {
+		requestIDHeader = defaultRequestIDHeader
+	}
+	sampler := newAccessLogSampler(accessLogSampling)
+	platformHeader := trustedPlatformHeader(trustedPlatform)
+
 	return func(c *gin.Context) {
-		setupContext(c)
+		start := time.Now()
+		setupContext(c, requestIDHeader)
+		clientIP := platformClientIP(c, platformHeader, trustedProxies)
+		if clientIP == "" {
+			clientIP = resolveClientIP(c, trustedProxies)
+		}
+		c.Set("clientip", clientIP)
 
 		reqPath := c.Request.URL.Path
 		logger.Debugc(c, fmt.Sprintf("Incoming request: %s", reqPath))
-		start := time.Now()
 
 		c.Next()
 
+		latency := time.Since(start)
 		status := c.Writer.Status()
+		// metrics are recorded by middleware of their own, so they still count requests not logged
+		if !sampler.logged(status) {
+			return
+		}
+
+		var meta []interface{}
+		for _, field := range accessLogFields {
+			meta = append(meta, field, accessLogFieldFuncs[field](c, latency))
+		}
 
-		meta := []interface{}{
-			"path", reqPath,
-			"comment", c.Errors.ByType(gin.ErrorTypePrivate).String(),
-			"latency", time.Now().Sub(start),
-			"clientIP", c.ClientIP(),
-			"method", c.Request.Method,
-			"statusCode", status,
+		if clientCN, exists := c.Get("clientcn"); exists {
+			meta = append(meta, "clientCN", clientCN)
 		}
 
 		switch {
@@ -65,13 +159,21 @@ func requestWrapper(logger *cm_logger.Logger) func(c *gin.Context) {
 	}
 }
 
-func setupContext(c *gin.Context) {
+func setupContext(c *gin.Context, requestIDHeader string) {
 	reqCount := strconv.FormatInt(atomic.AddInt64(&requestCount, 1), 10)
 	c.Set("requestcount", reqCount)
-	reqID := c.Request.Header.Get("X-Request-Id")
-	if reqID == "" {
+	reqID := c.Request.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(reqID) {
 		reqID = uuid.NewV4().String()
 	}
 	c.Set("requestid", reqID)
-	c.Writer.Header().Set("X-Request-Id", reqID)
+	c.Writer.Header().Set(requestIDHeader, reqID)
+	if clientCN := verifiedClientCommonName(c.Request); clientCN != "" {
+		c.Set("clientcn", clientCN)
+	}
+}
+
+// RequestID returns the ID of the request, either as given by the client (if valid) or generated
+func RequestID(c *gin.Context) string {
+	return c.GetString("requestid")
 }
@@ -0,0 +1,72 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// pprofPathPrefix is where the profiling routes are served, outside of the context path
+	// like the metrics route, since the pprof index links to the profiles by this path
+	pprofPathPrefix = "/debug/pprof"
+)
+
+// systemDebugAction is for the profiling routes, which require credentials for every
+// request, even the GET requests let through anonymously by AnonymousGet
+var systemDebugAction action = "sysdebug"
+
+// registerPprofRoutes serves the net/http/pprof handlers. They are registered on the engine
+// itself, so requests for them never reach masterHandler
+func (router *Router) registerPprofRoutes() {
+	router.GET(pprofPathPrefix+"/*profile", router.pprofHandler)
+	router.POST(pprofPathPrefix+"/*profile", router.pprofHandler)
+}
+
+func (router *Router) pprofHandler(c *gin.Context) {
+	authorized, identity, responseHeaders := router.authorizeRequest(c.Request, systemDebugAction, "")
+	for key, values := range responseHeaders {
+		for _, value := range values {
+			c.Writer.Header().Add(key, value)
+		}
+	}
+	if !authorized {
+		unauthorizedCounter.Inc()
+		router.errorResponder(c, 401, "unauthorized")
+		return
+	}
+	if identity != "" {
+		c.Set(IdentityContextKey, identity)
+	}
+
+	switch strings.TrimPrefix(c.Param("profile"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// the index, and the named profiles (heap, goroutine, ...)
+		pprof.Index(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// TrustedPlatformCloudflare takes the client IP from the CF-Connecting-IP header
+	TrustedPlatformCloudflare = "cloudflare"
+	// TrustedPlatformGCP takes the client IP from the X-Appengine-Remote-Addr header
+	TrustedPlatformGCP = "gcp"
+)
+
+// trustedPlatformHeaders are the headers the client IP is set in by each platform
+var trustedPlatformHeaders = map[string]string{
+	TrustedPlatformCloudflare: "CF-Connecting-IP",
+	TrustedPlatformGCP:        "X-Appengine-Remote-Addr",
+}
+
+// trustedPlatformHeader returns the header the client IP is taken from for a trusted platform,
+// which is either one of the platforms known or the name of a header. "" trusts no platform
+func trustedPlatformHeader(platform string) string {
+	if header, ok := trustedPlatformHeaders[strings.ToLower(platform)]; ok {
+		return header
+	}
+	return platform
+}
+
+/*
+platformClientIP returns the address of the client set by the platform ChartMuseum runs
+behind (e.g. Cloudflare) in platformHeader, or "" if there is none.
+
+Unlike X-Forwarded-For, the header holds the client IP only, and is taken from any request
+when no trusted proxies are configured, as gin does. Otherwise it is only honored when the
+request arrived from a trusted proxy.
+*/
+func platformClientIP(c *gin.Context, platformHeader string, trustedProxies []*net.IPNet) string {
+	if platformHeader == "" {
+		return ""
+	}
+	if len(trustedProxies) > 0 && !networksContain(trustedProxies, remoteIP(c.Request)) {
+		return ""
+	}
+	if ip := net.ParseIP(strings.TrimSpace(c.Request.Header.Get(platformHeader))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+/*
+resolveClientIP returns the address of the client which made the request.
+
+With no trusted proxies configured, gin's c.ClientIP() is used as-is, which
+trusts X-Forwarded-For and X-Real-Ip from anyone.
+
+Otherwise the forwarding headers are only honored when the request arrived from
+a trusted proxy. X-Forwarded-For is walked from right to left, skipping trusted
+proxies, and the first address that isn't trusted is the client.
+*/
+func resolveClientIP(c *gin.Context, trustedProxies []*net.IPNet) string {
+	if len(trustedProxies) == 0 {
+		return c.ClientIP()
+	}
+
+	remote := remoteIP(c.Request)
+	if remote == nil {
+		return strings.TrimSpace(c.Request.RemoteAddr)
+	}
+	if !networksContain(trustedProxies, remote) {
+		return remote.String()
+	}
+
+	forwardedFor := strings.Split(c.Request.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if ip == nil {
+			break
+		}
+		if !networksContain(trustedProxies, ip) {
+			return ip.String()
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(c.Request.Header.Get("X-Real-Ip"))); ip != nil {
+		return ip.String()
+	}
+
+	return remote.String()
+}
+
+// ClientIP returns the client IP of a request, as resolved by the router from the trusted
+// platform header or forwarding headers, rather than c.ClientIP()
+func ClientIP(c *gin.Context) string {
+	return contextClientIP(c)
+}
+
+// contextClientIP returns the client IP resolved by requestWrapper
+func contextClientIP(c *gin.Context) string {
+	if clientIP, exists := c.Get("clientip"); exists {
+		return clientIP.(string)
+	}
+	return c.ClientIP()
+}
@@ -0,0 +1,122 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProxyTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ProxyTestSuite) newContext(remoteAddr string, forwardedFor string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("GET", "/", nil)
+	c.Request.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		c.Request.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	return c
+}
+
+func (suite *ProxyTestSuite) TestResolveClientIP() {
+	// no trusted proxies: gin's default behavior
+	c := suite.newContext("10.0.0.2:1234", "1.2.3.4")
+	suite.Equal("1.2.3.4", resolveClientIP(c, nil))
+
+	trustedProxies, err := parseCIDRs([]string{"10.0.0.0/8"})
+	suite.Nil(err, "no error parsing trusted proxies")
+
+	c = suite.newContext("10.0.0.2:1234", "1.2.3.4")
+	suite.Equal("1.2.3.4", resolveClientIP(c, trustedProxies), "header used from trusted proxy")
+
+	c = suite.newContext("10.0.0.2:1234", "9.9.9.9, 1.2.3.4, 10.0.0.3")
+	suite.Equal("1.2.3.4", resolveClientIP(c, trustedProxies), "spoofed leftmost entries are ignored")
+
+	c = suite.newContext("5.6.7.8:1234", "1.2.3.4")
+	suite.Equal("5.6.7.8", resolveClientIP(c, trustedProxies), "header ignored from untrusted address")
+
+	c = suite.newContext("10.0.0.2:1234", "")
+	suite.Equal("10.0.0.2", resolveClientIP(c, trustedProxies))
+}
+
+func (suite *ProxyTestSuite) TestPlatformClientIP() {
+	suite.Equal("CF-Connecting-IP", trustedPlatformHeader(TrustedPlatformCloudflare))
+	suite.Equal("X-Appengine-Remote-Addr", trustedPlatformHeader(TrustedPlatformGCP))
+	suite.Equal("True-Client-IP", trustedPlatformHeader("True-Client-IP"), "custom header")
+
+	c := suite.newContext("10.0.0.2:1234", "9.9.9.9")
+	c.Request.Header.Set("CF-Connecting-IP", "1.2.3.4")
+	suite.Equal("1.2.3.4", platformClientIP(c, "CF-Connecting-IP", nil), "platform header used without trusted proxies")
+	suite.Equal("", platformClientIP(c, "", nil), "no platform trusted by default")
+	suite.Equal("", platformClientIP(c, "X-Appengine-Remote-Addr", nil), "header of another platform ignored")
+
+	trustedProxies, err := parseCIDRs([]string{"10.0.0.0/8"})
+	suite.Nil(err, "no error parsing trusted proxies")
+	suite.Equal("1.2.3.4", platformClientIP(c, "CF-Connecting-IP", trustedProxies), "platform header used from trusted proxy")
+
+	c = suite.newContext("5.6.7.8:1234", "")
+	c.Request.Header.Set("CF-Connecting-IP", "1.2.3.4")
+	suite.Equal("", platformClientIP(c, "CF-Connecting-IP", trustedProxies), "platform header ignored from untrusted address")
+
+	c = suite.newContext("10.0.0.2:1234", "")
+	c.Request.Header.Set("CF-Connecting-IP", "not an ip")
+	suite.Equal("", platformClientIP(c, "CF-Connecting-IP", nil), "invalid address ignored")
+}
+
+func (suite *ProxyTestSuite) TestWriteAllowedBehindProxy() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	router := NewRouter(RouterOptions{
+		Logger:            log,
+		WriteAllowedCIDRs: []string{"192.168.0.0/16"},
+		TrustedProxies:    []string{"10.0.0.0/8"},
+	})
+	router.SetRoutes([]*Route{
+		{"POST", "/api/charts", func(c *gin.Context) {
+			c.Data(201, "text/html", []byte("201"))
+		}, RepoPushAction},
+	})
+
+	c := suite.newContext("10.0.0.2:1234", "192.168.1.1")
+	c.Request.Method = "POST"
+	c.Request.URL.Path = "/api/charts"
+	router.HandleContext(c)
+	suite.Equal(201, c.Writer.Status())
+
+	c = suite.newContext("5.6.7.8:1234", "192.168.1.1")
+	c.Request.Method = "POST"
+	c.Request.URL.Path = "/api/charts"
+	router.HandleContext(c)
+	suite.Equal(403, c.Writer.Status(), "forwarded address from untrusted client is ignored")
+}
+
+func TestProxyTestSuite(t *testing.T) {
+	suite.Run(t, new(ProxyTestSuite))
+}
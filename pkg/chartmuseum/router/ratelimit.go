@@ -0,0 +1,108 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// idle buckets are pruned once this many identities are being tracked
+	rateLimitMaxBuckets = 10000
+)
+
+type (
+	// rateLimiter is a token bucket rate limiter with one bucket per identity
+	rateLimiter struct {
+		rate    float64
+		burst   float64
+		mu      sync.Mutex
+		buckets map[string]*tokenBucket
+		now     func() time.Time
+	}
+
+	tokenBucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// allow takes a token from the identity's bucket. If none are left, it returns false
+// along with the time to wait until the next token is available
+func (limiter *rateLimiter) allow(identity string) (bool, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	bucket, ok := limiter.buckets[identity]
+	if !ok {
+		if len(limiter.buckets) >= rateLimitMaxBuckets {
+			limiter.prune(now)
+		}
+		bucket = &tokenBucket{tokens: limiter.burst, last: now}
+		limiter.buckets[identity] = bucket
+	}
+
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune drops buckets which would have refilled completely, since they are
+// indistinguishable from a new bucket
+func (limiter *rateLimiter) prune(now time.Time) {
+	for identity, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rate >= limiter.burst {
+			delete(limiter.buckets, identity)
+		}
+	}
+}
+
+// retryAfterSeconds rounds a wait up to a whole number of seconds for the Retry-After header
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Max(1, math.Ceil(wait.Seconds())))
+}
+
+// requestIdentity returns the key used for rate limiting: the identity the request was
+// authorized for (see Identity), or the client IP for anonymous requests. Credentials are
+// never read here, so that a request cannot pick its bucket with a forged username or token
+func requestIdentity(identity string, clientIP string) string {
+	if identity != "" {
+		return "identity:" + identity
+	}
+	return "ip:" + clientIP
+}
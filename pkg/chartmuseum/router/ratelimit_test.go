@@ -0,0 +1,76 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RateLimitTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RateLimitTestSuite) TestAllow() {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.allow("ci")
+		suite.True(allowed, "request within burst is allowed")
+	}
+	allowed, wait := limiter.allow("ci")
+	suite.False(allowed, "request over burst is rejected")
+	suite.Equal(500*time.Millisecond, wait)
+	suite.Equal(1, retryAfterSeconds(wait))
+
+	allowed, _ = limiter.allow("someone-else")
+	suite.True(allowed, "identities have separate buckets")
+
+	now = now.Add(500 * time.Millisecond)
+	allowed, _ = limiter.allow("ci")
+	suite.True(allowed, "token refilled after wait")
+	allowed, _ = limiter.allow("ci")
+	suite.False(allowed)
+
+	limiter = newRateLimiter(5, 0)
+	suite.Equal(float64(5), limiter.burst, "burst defaults to the rate")
+}
+
+func (suite *RateLimitTestSuite) TestPrune() {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(1, 1)
+	limiter.now = func() time.Time { return now }
+
+	limiter.allow("a")
+	limiter.allow("b")
+	now = now.Add(time.Second)
+	limiter.prune(now)
+	suite.Empty(limiter.buckets, "refilled buckets are pruned")
+}
+
+func (suite *RateLimitTestSuite) TestRequestIdentity() {
+	suite.Equal("ip:10.0.0.1", requestIdentity("", "10.0.0.1"))
+	suite.Equal("identity:alice", requestIdentity("alice", "10.0.0.1"))
+}
+
+func TestRateLimitTestSuite(t *testing.T) {
+	suite.Run(t, new(RateLimitTestSuite))
+}
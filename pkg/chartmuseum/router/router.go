@@ -17,57 +17,164 @@ limitations under the License.
 package router
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
 
-	"github.com/gin-contrib/size"
 	"github.com/gin-gonic/gin"
 	"github.com/zsais/go-gin-prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type (
 	// Router handles all incoming HTTP requests
 	Router struct {
 		*gin.Engine
-		Logger           *cm_logger.Logger
-		Routes           []*Route
-		TlsCert          string
-		TlsKey           string
-		ContextPath      string
-		BasicAuthHeader  string
-		BearerAuthHeader string
-		AnonymousGet     bool
-		Depth            int
-		AuthType         string
-		AuthRealm        string
-		AuthService      string
-		AuthIssuer       string
-		AuthPublicCert   []byte
+		Logger               *cm_logger.Logger
+		Routes               []*Route
+		ListenHost           string
+		ListenSocket         string
+		TlsCert              string
+		TlsKey               string
+		TlsConfig            *tls.Config
+		ClientCertAuth       bool
+		EnableH2C            bool
+		ContextPath          string
+		TrailingSlash        string
+		BearerAuthHeader     string
+		BasicAuthRealm       string
+		AnonymousGet         bool
+		ReadOnlyAnonymous    bool
+		AnonymousRepos       []string
+		Depth                int
+		VariableDepth        bool
+		AuthType             string
+		AuthRealm            string
+		AuthService          string
+		AuthIssuer           string
+		AuthPublicCert       []byte
+		ShutdownTimeout      time.Duration
+		ReadHeaderTimeout    time.Duration
+		ReadTimeout          time.Duration
+		WriteTimeout         time.Duration
+		IdleTimeout          time.Duration
+		WriteAllowedNetworks []*net.IPNet
+		TrustedProxies       []*net.IPNet
+		Version              string
+		Revision             string
+		StartTime            time.Time
+		// AllowedChartNames is the pattern the name of each chart pushed must match, if set
+		AllowedChartNames *regexp.Regexp
+		// KnownTenant reports whether requests to a repo are counted by tenant, if set. It keeps
+		// the tenant label of the request metrics to actual repos, rather than any path requested
+		KnownTenant          func(repo string) bool
+		errorResponder       ErrorResponder
+		basicAuthCredentials map[string]*basicAuthCredential
+		htpasswd             *htpasswdFile
+		jwks                 *jwksCache
+		tokenCache           *tokenCache
+		accessRules          *accessRules
+		rateLimiter          *rateLimiter
+		uploadSlots          chan struct{}
+		uploadSizeLimit      int64
+		requestSizeLimit     int64
+		stopChan             chan struct{}
+		stopOnce             *sync.Once
+		// requestTimeout applies to requests to all but requestTimeoutSkipPaths, see handler
+		requestTimeout          time.Duration
+		requestTimeoutSkipPaths []string
+		// maintenance is 1 in maintenance mode, read and written atomically
+		maintenance int32
 	}
 
 	// RouterOptions are options for constructing a Router
 	RouterOptions struct {
-		Logger        *cm_logger.Logger
-		Username      string
-		Password      string
-		ContextPath   string
-		TlsCert       string
-		TlsKey        string
-		PathPrefix    string
-		EnableMetrics bool
-		AnonymousGet  bool
-		Depth         int
-		MaxUploadSize int
-		BearerAuth    bool
-		AuthType      string
-		AuthRealm     string
-		AuthService   string
-		AuthIssuer    string
-		AuthCertPath  string
+		Logger                *cm_logger.Logger
+		Username              string
+		Password              string
+		BasicAuthUsers        []string
+		BasicAuthUsersFile    string
+		BasicAuthHtpasswd     string
+		BasicAuthRealm        string
+		ContextPath           string
+		ListenHost            string
+		ListenSocket          string
+		TlsCert               string
+		TlsKey                string
+		TlsMinVersion         string
+		TlsCipherSuites       []string
+		TlsCACert             string
+		TlsClientAuth         string
+		EnableH2C             bool
+		PathPrefix            string
+		EnableMetrics         bool
+		MetricsNamespace      string
+		MetricsSubsystem      string
+		MetricsPath           string
+		EnablePprof           bool
+		TrailingSlash         string
+		AllowedChartNameRegex string
+		AnonymousGet          bool
+		ReadOnlyAnonymous     bool
+		AnonymousRepos        []string
+		Depth                 int
+		VariableDepth         bool
+		MaxUploadSize         int
+		MaxRequestSize        int
+		MaxConcurrentUploads  int
+		BearerAuth            bool
+		AuthType              string
+		AuthRealm             string
+		AuthService           string
+		AuthIssuer            string
+		AuthCertPath          string
+		AuthCertPem           string
+		AuthCertUrl           string
+		AuthJwksUrl           string
+		AuthJwksRefresh       time.Duration
+		AuthTokenCacheSize    int
+		AccessRulesFile       string
+		CORS                  CORSOptions
+		ShutdownTimeout       time.Duration
+		RequestTimeout        time.Duration
+		ReadHeaderTimeout     time.Duration
+		ReadTimeout           time.Duration
+		WriteTimeout          time.Duration
+		IdleTimeout           time.Duration
+		GzipEnabled           bool
+		RateLimit             float64
+		RateLimitBurst        int
+		WriteAllowedCIDRs     []string
+		TrustedProxies        []string
+		TrustedPlatform       string
+		AccessLogFields       []string
+		AccessLogSampling     int
+		RequestIDHeader       string
+		ResponseHeaders       map[string]string
+		Version               string
+		Revision              string
+		ErrorResponder        ErrorResponder
 	}
 
+	// ErrorResponder writes the response for a request rejected by the router itself, i.e. with
+	// no matching route (404), from a network not allowed to write (403), without valid
+	// credentials (401), over the rate limit (429) or over the concurrent upload limit (503).
+	// It may write a different status
+	ErrorResponder func(c *gin.Context, status int, message string)
+
 	// Route represents an application route
 	Route struct {
 		Method  string
@@ -79,44 +186,226 @@ type (
 	action string
 )
 
+const (
+	defaultMetricsNamespace  = "chartmuseum"
+	defaultMetricsPath       = "/metrics"
+	defaultShutdownTimeout   = 10 * time.Second
+	defaultBasicAuthRealm    = "ChartMuseum"
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultReadTimeout       = 5 * time.Minute
+	defaultWriteTimeout      = 5 * time.Minute
+	defaultIdleTimeout       = 2 * time.Minute
+
+	// suggested wait before retrying an upload rejected by MaxConcurrentUploads
+	uploadRetryAfterSeconds = 5
+
+	// OCIPathPrefix is the path prefix of the OCI distribution API routes
+	OCIPathPrefix = "/v2/"
+
+	// DistributionAPIVersionHeader is set on every OCI distribution API response
+	DistributionAPIVersionHeader = "Docker-Distribution-Api-Version"
+
+	// RouteContextKey is the gin context key of the *Route matched by the masterHandler
+	RouteContextKey = "route"
+
+	// RouteTemplateContextKey is the gin context key of the path template of the matched
+	// route, with the context path, e.g. "/api/:repo/charts/:name/:version"
+	RouteTemplateContextKey = "routetemplate"
+
+	// IdentityContextKey is the gin context key of the identity a request was authorized
+	// for: the client certificate CN, basic auth username or bearer token subject
+	IdentityContextKey = "identity"
+)
+
 var (
 	RepoPullAction   action = "pull"
 	RepoPushAction   action = "push"
 	SystemInfoAction action = "sysinfo"
+	// SystemReadAction is for server-wide information which, unlike SystemInfoAction
+	// (health checks), requires the same credentials as pulling from a repo
+	SystemReadAction action = "sysread"
+	// SystemAdminAction is for server-wide changes, which require the same credentials as
+	// pushing to every repo
+	SystemAdminAction action = "sysadmin"
 )
 
 // NewRouter creates a new Router instance
 func NewRouter(options RouterOptions) *Router {
+	trustedProxies, err := parseCIDRs(options.TrustedProxies)
+	if err != nil {
+		options.Logger.Fatal(err)
+	}
+
+	if err := checkAccessLogFields(options.AccessLogFields); err != nil {
+		options.Logger.Fatal(err)
+	}
+
+	if err := checkResponseHeaders(options.ResponseHeaders); err != nil {
+		options.Logger.Fatal(err)
+	}
+
+	if options.TrailingSlash == "" {
+		options.TrailingSlash = TrailingSlashStrict
+	}
+	if err := checkTrailingSlash(options.TrailingSlash); err != nil {
+		options.Logger.Fatal(err)
+	}
+
+	var allowedChartNames *regexp.Regexp
+	if options.AllowedChartNameRegex != "" {
+		allowedChartNames, err = regexp.Compile(options.AllowedChartNameRegex)
+		if err != nil {
+			options.Logger.Fatal(fmt.Errorf("invalid allowed chart name regex: %s", err))
+		}
+	}
+
 	gin.SetMode(gin.ReleaseMode)
 	engine := gin.New()
 	engine.Use(gin.Recovery())
-	engine.Use(requestWrapper(options.Logger))
-	engine.Use(limits.RequestSizeLimiter(int64(options.MaxUploadSize)))
+	engine.Use(requestWrapper(options.Logger, trustedProxies, options.TrustedPlatform, options.AccessLogFields, options.AccessLogSampling, options.RequestIDHeader))
+
+	if len(options.ResponseHeaders) > 0 {
+		engine.Use(responseHeadersMiddleware(options.ResponseHeaders))
+	}
+
+	if len(options.CORS.AllowedOrigins) > 0 {
+		engine.Use(corsMiddleware(options.CORS, options.ContextPath))
+	}
+
+	if options.GzipEnabled {
+		engine.Use(gzipMiddleware())
+	}
+
+	metricsPath := options.MetricsPath
+	if metricsPath == "" {
+		metricsPath = defaultMetricsPath
+	}
+
+	// metrics scrapes and readiness probes have their own timeouts
+	requestTimeoutSkipPaths := []string{metricsPath, options.ContextPath + "/readiness"}
+	if options.EnablePprof {
+		// CPU profiles and traces are taken over as many seconds as asked for
+		requestTimeoutSkipPaths = append(requestTimeoutSkipPaths, pprofPathPrefix+"/profile", pprofPathPrefix+"/trace")
+	}
 
 	if options.EnableMetrics {
-		p := ginprometheus.NewPrometheus("chartmuseum")
+		p := ginprometheus.NewPrometheus(metricsPrefix(options.MetricsNamespace, options.MetricsSubsystem))
+		p.MetricsPath = metricsPath
 		p.ReqCntURLLabelMappingFn = mapURLWithParamsBackToRouteTemplate
 		p.Use(engine)
+		registerMetrics()
 	}
 
 	router := &Router{
-		Engine:       engine,
-		Routes:       []*Route{},
-		Logger:       options.Logger,
-		TlsCert:      options.TlsCert,
-		TlsKey:       options.TlsKey,
-		ContextPath:  options.ContextPath,
-		AnonymousGet: options.AnonymousGet,
-		Depth:        options.Depth,
+		Engine:            engine,
+		Routes:            []*Route{},
+		Logger:            options.Logger,
+		ListenHost:        options.ListenHost,
+		ListenSocket:      options.ListenSocket,
+		TlsCert:           options.TlsCert,
+		TlsKey:            options.TlsKey,
+		EnableH2C:         options.EnableH2C,
+		ContextPath:       options.ContextPath,
+		TrailingSlash:     options.TrailingSlash,
+		BasicAuthRealm:    options.BasicAuthRealm,
+		AnonymousGet:      options.AnonymousGet,
+		ReadOnlyAnonymous: options.ReadOnlyAnonymous,
+		AnonymousRepos:    options.AnonymousRepos,
+		Depth:             options.Depth,
+		VariableDepth:     options.VariableDepth,
+		ShutdownTimeout:   options.ShutdownTimeout,
+		ReadHeaderTimeout: options.ReadHeaderTimeout,
+		ReadTimeout:       options.ReadTimeout,
+		WriteTimeout:      options.WriteTimeout,
+		IdleTimeout:       options.IdleTimeout,
+		TrustedProxies:    trustedProxies,
+		Version:           options.Version,
+		Revision:          options.Revision,
+		StartTime:         time.Now(),
+		AllowedChartNames: allowedChartNames,
+		errorResponder:    options.ErrorResponder,
+		stopChan:          make(chan struct{}),
+		stopOnce:          &sync.Once{},
+
+		requestTimeout:          options.RequestTimeout,
+		requestTimeoutSkipPaths: requestTimeoutSkipPaths,
 	}
 
+	if options.EnableMetrics && (options.Depth > 0 || options.VariableDepth) {
+		engine.Use(router.tenantMetricsMiddleware)
+	}
+
+	if router.ShutdownTimeout <= 0 {
+		router.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	// without timeouts, slow clients could hold connections open indefinitely
+	if router.ReadHeaderTimeout <= 0 {
+		router.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if router.ReadTimeout <= 0 {
+		router.ReadTimeout = defaultReadTimeout
+	}
+	if router.WriteTimeout <= 0 {
+		router.WriteTimeout = defaultWriteTimeout
+	}
+	if router.IdleTimeout <= 0 {
+		router.IdleTimeout = defaultIdleTimeout
+	}
+
+	if router.BasicAuthRealm == "" {
+		router.BasicAuthRealm = defaultBasicAuthRealm
+	}
+
+	if router.errorResponder == nil {
+		router.errorResponder = DefaultErrorResponder
+	}
+
+	if err := checkRepoPatterns(router.AnonymousRepos); err != nil {
+		router.Logger.Fatal(err)
+	}
+
+	writeAllowedNetworks, err := parseCIDRs(options.WriteAllowedCIDRs)
+	if err != nil {
+		router.Logger.Fatal(err)
+	}
+	router.WriteAllowedNetworks = writeAllowedNetworks
+
+	// chart uploads get MaxUploadSize, everything else the (usually tighter) MaxRequestSize
+	maxRequestSize := options.MaxRequestSize
+	if maxRequestSize <= 0 {
+		maxRequestSize = options.MaxUploadSize
+	}
+	router.uploadSizeLimit = int64(options.MaxUploadSize)
+	router.requestSizeLimit = int64(maxRequestSize)
+
+	if options.RateLimit > 0 {
+		router.rateLimiter = newRateLimiter(options.RateLimit, options.RateLimitBurst)
+	}
+
+	if options.MaxConcurrentUploads > 0 {
+		router.uploadSlots = make(chan struct{}, options.MaxConcurrentUploads)
+	}
+
+	// h2c is plaintext HTTP/2, for use behind a proxy which terminates TLS
+	if router.EnableH2C && router.TlsCert != "" {
+		router.Logger.Fatal("Cannot enable h2c together with TLS")
+	}
+
+	tlsConfig, err := newTLSConfig(options)
+	if err != nil {
+		router.Logger.Fatal(err)
+	}
+	router.TlsConfig = tlsConfig
+	router.ClientCertAuth = tlsConfig != nil && tlsConfig.ClientAuth != tls.NoClientCert
+
 	// if BearerAuth is true, looks for required inputs.
 	// example input:
 	// --bearer-auth=true
-	// --auth-realm="https://127.0.0.1:5001/auth" 
-	// --auth-service="chartmuseum" 
+	// --auth-realm="https://127.0.0.1:5001/auth"
+	// --auth-service="chartmuseum"
 	// --auth-issuer="Acme auth server"
-	// --auth-cert-path="./certs/authorization-server-cert.pem"
+	// --auth-cert-path="./certs/authorization-server-cert.pem" (or --auth-cert-pem, --auth-cert-url)
 	if options.BearerAuth {
 		if options.AuthRealm == "" {
 			router.Logger.Fatal("Missing Auth Realm")
@@ -127,8 +416,8 @@ func NewRouter(options RouterOptions) *Router {
 		if options.AuthIssuer == "" {
 			router.Logger.Fatal("Missing Auth Issuer")
 		}
-		if options.AuthCertPath == "" {
-			router.Logger.Fatal("Missing Auth Server Public Cert Path")
+		if options.AuthCertPath == "" && options.AuthCertPem == "" && options.AuthCertUrl == "" && options.AuthJwksUrl == "" {
+			router.Logger.Fatal("Missing Auth Server Public Cert Path, PEM, URL or JWKS URL")
 		}
 		if options.AuthType != "token" {
 			router.Logger.Fatal("Invalid auth type: only accept token auth")
@@ -138,14 +427,85 @@ func NewRouter(options RouterOptions) *Router {
 		router.AuthService = options.AuthService
 		router.AuthIssuer = options.AuthIssuer
 
-		// loads certificate from file
-		loadPublicCertFromFile(options.AuthCertPath, router)
+		if options.AuthJwksUrl != "" {
+			// keys are fetched now and then kept up to date in the background,
+			// so that the auth server can rotate them without a restart
+			router.jwks = newJwksCache(options.AuthJwksUrl, router.Logger)
+			if err := router.jwks.refresh(); err != nil {
+				router.Logger.Errorw("Error fetching JWKS",
+					"url", options.AuthJwksUrl,
+					"error", err.Error(),
+				)
+			}
+			refreshInterval := options.AuthJwksRefresh
+			if refreshInterval <= 0 {
+				refreshInterval = defaultJwksRefreshInterval
+			}
+			go router.jwks.run(refreshInterval, router.stopChan)
+		} else {
+			publicCert, err := loadPublicCert(options.AuthCertPath, options.AuthCertPem, options.AuthCertUrl)
+			if err != nil {
+				router.Logger.Fatal(fmt.Errorf("error loading auth public cert: %s", err))
+			}
+			router.AuthPublicCert = publicCert
+		}
+
+		// validated tokens are kept until they expire, unless the cache is disabled
+		if options.AuthTokenCacheSize > 0 {
+			router.tokenCache = newTokenCache(options.AuthTokenCacheSize)
+		}
 
 		router.BearerAuthHeader = "Bearer"
 	}
 
+	if options.BasicAuthHtpasswd != "" {
+		// users are loaded now, and again whenever the file changes
+		router.htpasswd = newHtpasswdFile(options.BasicAuthHtpasswd, router.Logger)
+		if err := router.htpasswd.load(); err != nil {
+			router.Logger.Fatal(err)
+		}
+		go router.htpasswd.run(htpasswdCheckInterval, router.stopChan)
+	}
+
+	router.basicAuthCredentials = map[string]*basicAuthCredential{}
+
 	if options.Username != "" && options.Password != "" {
-		router.BasicAuthHeader = generateBasicAuthHeader(options.Username, options.Password)
+		router.basicAuthCredentials[options.Username] = newPlaintextCredential(options.Password)
+	}
+
+	// each entry is expected in the form "user:pass"
+	for _, entry := range options.BasicAuthUsers {
+		credentials := strings.SplitN(entry, ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" || credentials[1] == "" {
+			router.Logger.Fatal("Invalid basic auth user entry: expected user:pass")
+		}
+		router.basicAuthCredentials[credentials[0]] = newPlaintextCredential(credentials[1])
+	}
+
+	if options.BasicAuthUsersFile != "" {
+		credentials, err := loadBasicAuthUsersFile(options.BasicAuthUsersFile)
+		if err != nil {
+			router.Logger.Fatal(err)
+		}
+		for username, credential := range credentials {
+			router.basicAuthCredentials[username] = credential
+		}
+	}
+
+	if options.AccessRulesFile != "" {
+		// rules are loaded now, and again on SIGHUP so that they can be changed without a restart
+		router.accessRules = newAccessRules(options.AccessRulesFile, router.Logger)
+		if err := router.accessRules.load(); err != nil {
+			router.Logger.Fatal(err)
+		}
+		go router.accessRules.watch(router.stopChan)
+	}
+
+	if options.EnablePprof {
+		if !router.basicAuthEnabled() && router.BearerAuthHeader == "" && !router.ClientCertAuth {
+			router.Logger.Fatal("Cannot enable pprof without basic, bearer or client certificate auth")
+		}
+		router.registerPprofRoutes()
 	}
 
 	router.NoRoute(router.masterHandler)
@@ -153,54 +513,383 @@ func NewRouter(options RouterOptions) *Router {
 	return router
 }
 
+// handler returns the engine as it is served, behind the request timeout if there is one
+func (router *Router) handler() http.Handler {
+	var handler http.Handler = router.Engine
+	if router.requestTimeout > 0 {
+		handler = requestTimeoutHandler(handler, router.requestTimeout, router.requestTimeoutSkipPaths)
+	}
+	return handler
+}
+
+// newHTTPServer creates the server Start serves the router with, over TLS or not
+func (router *Router) newHTTPServer(port int) *http.Server {
+	handler := router.handler()
+	if router.EnableH2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	return &http.Server{
+		Addr:              net.JoinHostPort(router.ListenHost, strconv.Itoa(port)),
+		Handler:           handler,
+		TLSConfig:         router.TlsConfig,
+		ReadHeaderTimeout: router.ReadHeaderTimeout,
+		ReadTimeout:       router.ReadTimeout,
+		WriteTimeout:      router.WriteTimeout,
+		IdleTimeout:       router.IdleTimeout,
+	}
+}
+
+// Start serves HTTP(S) on the given port until Stop is called or SIGINT/SIGTERM is received,
+// then waits up to ShutdownTimeout for in-flight requests to finish. It listens on ListenHost,
+// or on all interfaces if it is empty. With ListenSocket, it listens on that Unix domain
+// socket instead, and port is ignored. SIGUSR1 toggles maintenance mode meanwhile
 func (router *Router) Start(port int) {
-	router.Logger.Infow("Starting ChartMuseum",
-		"port", port,
-	)
-	if router.TlsCert != "" && router.TlsKey != "" {
-		router.Logger.Fatal(router.RunTLS(fmt.Sprintf(":%d", port), router.TlsCert, router.TlsKey))
+	if router.ListenSocket != "" {
+		router.Logger.Infow("Starting ChartMuseum",
+			"socket", router.ListenSocket,
+		)
 	} else {
-		router.Logger.Fatal(router.Run(fmt.Sprintf(":%d", port)))
+		router.Logger.Infow("Starting ChartMuseum",
+			"host", router.ListenHost,
+			"port", port,
+		)
 	}
+
+	server := router.newHTTPServer(port)
+	go router.watchMaintenanceSignal(router.stopChan)
+
+	errChan := make(chan error, 1)
+	serveTLS := router.TlsCert != "" && router.TlsKey != ""
+	if router.ListenSocket != "" {
+		listener, err := listenUnixSocket(router.ListenSocket)
+		if err != nil {
+			router.Logger.Fatal(err)
+			return
+		}
+		defer func() {
+			if err := removeUnixSocket(router.ListenSocket); err != nil {
+				router.Logger.Errorw("Error removing socket",
+					"socket", router.ListenSocket,
+					"error", err.Error(),
+				)
+			}
+		}()
+		go func() {
+			if serveTLS {
+				errChan <- server.ServeTLS(listener, router.TlsCert, router.TlsKey)
+			} else {
+				errChan <- server.Serve(listener)
+			}
+		}()
+	} else {
+		go func() {
+			if serveTLS {
+				errChan <- server.ListenAndServeTLS(router.TlsCert, router.TlsKey)
+			} else {
+				errChan <- server.ListenAndServe()
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errChan:
+		router.Logger.Fatal(err)
+		return
+	case sig := <-signals:
+		router.Logger.Infow("Received signal, shutting down",
+			"signal", sig.String(),
+		)
+	case <-router.stopChan:
+		router.Logger.Info("Stop requested, shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), router.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		router.Logger.Errorw("Error during graceful shutdown",
+			"error", err.Error(),
+		)
+		return
+	}
+	router.Logger.Info("ChartMuseum stopped")
+}
+
+// Stop triggers a graceful shutdown of a started Router
+func (router *Router) Stop() {
+	router.stopOnce.Do(func() {
+		close(router.stopChan)
+	})
+}
+
+// Done returns a channel which is closed once Stop has been called
+func (router *Router) Done() <-chan struct{} {
+	return router.stopChan
 }
 
-// SetRoutes applies list of routes
+// SetRoutes applies list of routes. Like gin, it panics if a method and path are registered
+// twice, as only the first of the routes would ever be matched
 func (router *Router) SetRoutes(routes []*Route) {
+	registered := map[string]bool{}
+	for _, route := range routes {
+		key := route.Method + " " + route.Path
+		if registered[key] {
+			panic(fmt.Sprintf("route %s is registered twice", key))
+		}
+		registered[key] = true
+	}
 	router.Routes = routes
 }
 
+// match finds the route of a request, with repos of exactly Depth path segments, or of at
+// least Depth segments with VariableDepth
+func (router *Router) match(method string, url string) (*Route, []gin.Param) {
+	if router.VariableDepth {
+		return matchVariableDepth(router.Routes, method, url, router.ContextPath, router.Depth)
+	}
+	return match(router.Routes, method, url, router.ContextPath, router.Depth)
+}
+
+// IsValidRepo reports whether requests for repo could be matched to a route, for a repo given
+// other than in the path, e.g. in a query parameter: it has Depth path segments (at least
+// Depth with VariableDepth), none of them empty, "." or ".."
+func (router *Router) IsValidRepo(repo string) bool {
+	if repo == "" {
+		return router.Depth == 0
+	}
+	segments := strings.Split(repo, "/")
+	if len(segments) < router.Depth || (len(segments) > router.Depth && !router.VariableDepth) {
+		return false
+	}
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// AuthorizeRepoPush checks that a request, already authorized for the repo of its route, may
+// also push to another repo, e.g. the repo a chart is copied to. It goes through the same checks
+// as a push route: networks allowed to write, credentials, access rules and maintenance mode.
+// If the request may not push to repo, the response is written and false returned
+func (router *Router) AuthorizeRepoPush(c *gin.Context, repo string) bool {
+	if !router.isWriteAllowed(c) {
+		router.errorResponder(c, 403, "forbidden")
+		return false
+	}
+	authorized, _, responseHeaders := router.authorizeRequest(c.Request, RepoPushAction, repo)
+	if !authorized {
+		for key, values := range responseHeaders {
+			for _, value := range values {
+				c.Writer.Header().Add(key, value)
+			}
+		}
+		unauthorizedCounter.Inc()
+		router.errorResponder(c, 401, "unauthorized")
+		return false
+	}
+	if router.accessRules != nil {
+		if identity, ok := router.accessRuleIdentity(c.Request, RepoPushAction, repo); ok &&
+			!router.accessRules.allowed(identity, repo, RepoPushAction) {
+			router.errorResponder(c, 403, "forbidden")
+			return false
+		}
+	}
+	if router.Maintenance() {
+		c.Header("Retry-After", strconv.Itoa(maintenanceRetryAfterSeconds))
+		router.errorResponder(c, 503, "read-only for maintenance")
+		return false
+	}
+	return true
+}
+
 // all incoming requests are passed through this handler
 func (router *Router) masterHandler(c *gin.Context) {
-	route, params := match(router.Routes, c.Request.Method, c.Request.URL.Path, router.ContextPath, router.Depth)
+	route, params := router.match(c.Request.Method, c.Request.URL.Path)
 	if route == nil {
-		c.JSON(404, gin.H{"error": "not found"})
+		var redirected bool
+		if route, params, redirected = router.matchTrailingSlash(c); redirected {
+			return
+		}
+	}
+	if route == nil {
+		router.errorResponder(c, 404, "not found")
 		return
 	}
 	c.Params = params
+	c.Set(RouteContextKey, route)
+	c.Set(RouteTemplateContextKey, router.ContextPath+routeTemplate(route, c.Param("repo")))
 
-	if isRepoAction(route.Action) {
+	if isOCIRoute(route) {
+		c.Header(DistributionAPIVersionHeader, "registry/2.0")
+	}
 
+	var body *limitedBody
+	if route.Action == RepoPushAction {
+		body = limitRequestBody(c, uploadSizeLimitName, router.uploadSizeLimit)
+	} else {
+		body = limitRequestBody(c, requestSizeLimitName, router.requestSizeLimit)
+	}
 
-		authorized, responseHeaders := router.authorizeRequest(c.Request)
-		for key, value := range responseHeaders {
-			c.Header(key, value)
+	if (route.Action == RepoPushAction || route.Action == SystemAdminAction) && !router.isWriteAllowed(c) {
+		router.errorResponder(c, 403, "forbidden")
+		return
+	}
+
+	if isRepoAction(route.Action) || route.Action == SystemReadAction || route.Action == SystemAdminAction {
+		// server admin is authorized as a push to every repo
+		act, repo := route.Action, c.Param("repo")
+		if act == SystemAdminAction {
+			act, repo = RepoPushAction, ""
 		}
-		if !authorized {
-			c.JSON(401, gin.H{"error": "unauthorized"})
-			return
+
+		// with ReadOnlyAnonymous, pulls never need credentials (whatever the method),
+		// and neither do pulls from AnonymousRepos. Pushes go through the usual checks
+		if act == RepoPullAction && router.isAnonymousPullAllowed(repo) {
+			observeAuth(authSchemeAnonymous, true)
+		} else {
+			authorized, identity, responseHeaders := router.authorizeRequest(c.Request, act, repo)
+			for key, values := range responseHeaders {
+				for _, value := range values {
+					c.Writer.Header().Add(key, value)
+				}
+			}
+			if !authorized {
+				unauthorizedCounter.Inc()
+				router.errorResponder(c, 401, "unauthorized")
+				return
+			}
+			if identity != "" {
+				c.Set(IdentityContextKey, identity)
+			}
 		}
+
+		// access rules only restrict repo actions, for requests made with credentials
+		if router.accessRules != nil && isRepoAction(act) {
+			if identity, ok := router.accessRuleIdentity(c.Request, act, repo); ok &&
+				!router.accessRules.allowed(identity, repo, act) {
+				router.errorResponder(c, 403, "forbidden")
+				return
+			}
+		}
+
+		if router.rateLimiter != nil {
+			allowed, wait := router.rateLimiter.allow(requestIdentity(Identity(c), contextClientIP(c)))
+			if !allowed {
+				c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+				router.errorResponder(c, 429, "too many requests")
+				return
+			}
+		}
+	}
+
+	if route.Action == RepoPushAction && router.Maintenance() {
+		c.Header("Retry-After", strconv.Itoa(maintenanceRetryAfterSeconds))
+		router.errorResponder(c, 503, "read-only for maintenance")
+		return
 	}
 
+	if route.Action == RepoPushAction {
+		// uploads are streamed or spooled to storage, so only so many are handled at once
+		if router.uploadSlots != nil {
+			select {
+			case router.uploadSlots <- struct{}{}:
+				defer func() { <-router.uploadSlots }()
+			default:
+				c.Header("Retry-After", strconv.Itoa(uploadRetryAfterSeconds))
+				router.errorResponder(c, 503, "too many concurrent uploads")
+				return
+			}
+		}
+		uploadsInFlightGauge.Inc()
+		defer uploadsInFlightGauge.Dec()
+	}
+
+	// a body with a Content-Length over the limit is rejected before anything is read,
+	// while a body found too large while reading leaves the handler to give up without
+	// responding
+	if body.err != nil {
+		router.rejectTooLargeRequest(c, body.err)
+		return
+	}
+	start := time.Now()
 	route.Handler(c)
+	if body.err != nil && !c.Writer.Written() {
+		router.rejectTooLargeRequest(c, body.err)
+	}
+	observeRequestDuration(route.Action, c.Writer.Status(), time.Since(start))
+}
+
+// MatchedRoute returns the route matched by the masterHandler for a request, if any
+func MatchedRoute(c *gin.Context) (*Route, bool) {
+	if value, exists := c.Get(RouteContextKey); exists {
+		route, ok := value.(*Route)
+		return route, ok
+	}
+	return nil, false
+}
+
+// RouteTemplate returns the path template of the route matched by the masterHandler for
+// a request, or "" if none matched
+func RouteTemplate(c *gin.Context) string {
+	return c.GetString(RouteTemplateContextKey)
+}
+
+// Identity returns the identity a request was authorized for, or "" for anonymous requests
+func Identity(c *gin.Context) string {
+	return c.GetString(IdentityContextKey)
+}
+
+// routeTemplate returns the path of a route as requested for the given repo. Without
+// multitenancy, repo routes are requested for the root repo, without their ":repo" segment
+func routeTemplate(route *Route, repo string) string {
+	if repo == "" {
+		return strings.Replace(route.Path, "/:repo", "", 1)
+	}
+	return route.Path
+}
+
+// DefaultErrorResponder responds with {"error": message}, or on the OCI registry routes with
+// the error format of the distribution spec, which registry clients expect
+func DefaultErrorResponder(c *gin.Context, status int, message string) {
+	if route, ok := MatchedRoute(c); ok && isOCIRoute(route) {
+		c.JSON(status, gin.H{"errors": []gin.H{{"code": ociErrorCode(status), "message": message}}})
+		return
+	}
+	c.JSON(status, gin.H{"error": message})
+}
+
+// ociErrorCode returns the distribution spec error code for a request rejected by the router
+func ociErrorCode(status int) string {
+	switch status {
+	case 401:
+		return "UNAUTHORIZED"
+	case 403:
+		return "DENIED"
+	case 429:
+		return "TOOMANYREQUESTS"
+	case 503:
+		return "UNAVAILABLE"
+	}
+	return "UNKNOWN"
 }
 
 /*
 mapURLWithParamsBackToRouteTemplate is a valid ginprometheus ReqCntURLLabelMappingFn.
 For every route containing parameters (e.g. `/charts/:filename`, `/api/charts/:name/:version`, etc)
 the actual parameter values will be replaced by their name, to minimize the cardinality of the
-`chartmuseum_requests_total{url=..}` Prometheus counter.
+`chartmuseum_requests_total{url=..}` Prometheus counter. The template of the route matched by
+the masterHandler is used when there is one.
 */
 func mapURLWithParamsBackToRouteTemplate(c *gin.Context) string {
+	if template := RouteTemplate(c); template != "" {
+		return template
+	}
 	url := c.Request.URL.String()
 	for _, p := range c.Params {
 		re := regexp.MustCompile(fmt.Sprintf(`(^.*?)/\b%s\b(.*$)`, regexp.QuoteMeta(p.Value)))
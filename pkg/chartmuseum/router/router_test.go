@@ -17,15 +17,28 @@ limitations under the License.
 package router
 
 import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	pathutil "path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 
 	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
 
 	"github.com/gin-gonic/gin"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
 	"net/http/httptest"
 )
 
@@ -85,6 +98,10 @@ func (suite *RouterTestSuite) TestRouterHandleContext() {
 		Depth:  3,
 	})
 	router.SetRoutes(testRoutes)
+	suite.Panics(func() {
+		router.SetRoutes(append(testRoutes, testRoutes[0]))
+	}, "route registered twice")
+	suite.Len(router.Routes, len(testRoutes), "routes are kept after a route registered twice")
 
 	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
 	testContext.Request, _ = http.NewRequest("GET", "/", nil)
@@ -174,6 +191,58 @@ func (suite *RouterTestSuite) TestRouterHandleContext() {
 	basicAuthRouter.HandleContext(testContext)
 	suite.Equal(200, testContext.Writer.Status())
 
+	// Test basic auth (multiple users)
+	multiUserBasicAuthRouter := NewRouter(RouterOptions{
+		Logger:         log,
+		Depth:          0,
+		Username:       "testuser",
+		Password:       "testpass",
+		BasicAuthUsers: []string{"otheruser:otherpass", "thirduser:pass:with:colons"},
+	})
+	multiUserBasicAuthRouter.SetRoutes(testRoutes)
+
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/", nil)
+	testContext.Request.SetBasicAuth("testuser", "testpass")
+	multiUserBasicAuthRouter.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status())
+
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/", nil)
+	testContext.Request.SetBasicAuth("otheruser", "otherpass")
+	multiUserBasicAuthRouter.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status())
+
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/", nil)
+	testContext.Request.SetBasicAuth("thirduser", "pass:with:colons")
+	multiUserBasicAuthRouter.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status())
+
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/", nil)
+	testContext.Request.SetBasicAuth("otheruser", "testpass")
+	multiUserBasicAuthRouter.HandleContext(testContext)
+	suite.Equal(401, testContext.Writer.Status())
+
+	// Test basic auth (verified client certificate)
+	basicAuthRouter.ClientCertAuth = true
+
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/", nil)
+	testContext.Request.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ci-pusher"}}}},
+	}
+	basicAuthRouter.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status())
+	suite.Equal("ci-pusher", testContext.GetString("clientcn"))
+
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/", nil)
+	testContext.Request.TLS = &tls.ConnectionState{}
+	basicAuthRouter.HandleContext(testContext)
+	suite.Equal(401, testContext.Writer.Status())
+
 	// Test basic auth (anonymous get)
 	basicAuthRouterAnonGet := NewRouter(RouterOptions{
 		Logger:       log,
@@ -190,6 +259,1610 @@ func (suite *RouterTestSuite) TestRouterHandleContext() {
 	suite.Equal(200, testContext.Writer.Status())
 }
 
+func (suite *RouterTestSuite) TestRouterCORS() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/api/:repo/charts", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+	}
+
+	// No origins configured, no CORS headers
+	router := NewRouter(RouterOptions{
+		Logger: log,
+	})
+	router.SetRoutes(testRoutes)
+
+	testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/api/charts", nil)
+	testContext.Request.Header.Set("Origin", "https://dashboard.example.com")
+	router.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status())
+	suite.Equal("", testContext.Writer.Header().Get("Access-Control-Allow-Origin"))
+
+	corsRouter := NewRouter(RouterOptions{
+		Logger:      log,
+		ContextPath: "/my/crazy/path",
+		CORS: CORSOptions{
+			AllowedOrigins:   []string{"https://dashboard.example.com"},
+			AllowCredentials: true,
+		},
+	})
+	corsRouter.SetRoutes(testRoutes)
+
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/my/crazy/path/api/charts", nil)
+	testContext.Request.Header.Set("Origin", "https://dashboard.example.com")
+	corsRouter.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status())
+	suite.Equal("https://dashboard.example.com", testContext.Writer.Header().Get("Access-Control-Allow-Origin"))
+	suite.Equal("true", testContext.Writer.Header().Get("Access-Control-Allow-Credentials"))
+
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("OPTIONS", "/my/crazy/path/api/charts", nil)
+	testContext.Request.Header.Set("Origin", "https://dashboard.example.com")
+	testContext.Request.Header.Set("Access-Control-Request-Method", "GET")
+	corsRouter.HandleContext(testContext)
+	suite.Equal(204, testContext.Writer.Status())
+	suite.Equal("GET, HEAD, POST, PUT, DELETE", testContext.Writer.Header().Get("Access-Control-Allow-Methods"))
+
+	// preflight outside of the context path is not answered
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("OPTIONS", "/api/charts", nil)
+	testContext.Request.Header.Set("Origin", "https://dashboard.example.com")
+	testContext.Request.Header.Set("Access-Control-Request-Method", "GET")
+	corsRouter.HandleContext(testContext)
+	suite.Equal(404, testContext.Writer.Status())
+
+	// unknown origin gets no CORS headers
+	testContext, _ = gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/my/crazy/path/api/charts", nil)
+	testContext.Request.Header.Set("Origin", "https://evil.example.com")
+	corsRouter.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status())
+	suite.Equal("", testContext.Writer.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func (suite *RouterTestSuite) TestRouterRequestTimeout() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	slowDone := make(chan struct{})
+	testRoutes := []*Route{
+		{"GET", "/fast", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"GET", "/slow", func(c *gin.Context) {
+			defer close(slowDone)
+			time.Sleep(200 * time.Millisecond)
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"GET", "/readiness", func(c *gin.Context) {
+			time.Sleep(200 * time.Millisecond)
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemInfoAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:         log,
+		RequestTimeout: 50 * time.Millisecond,
+	})
+	router.SetRoutes(testRoutes)
+	handler := router.handler()
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/fast", nil)
+	handler.ServeHTTP(recorder, req)
+	suite.Equal(200, recorder.Code)
+	suite.Equal("200", recorder.Body.String())
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/slow", nil)
+	handler.ServeHTTP(recorder, req)
+	suite.Equal(503, recorder.Code)
+	suite.Equal(`{"error":"request timeout"}`, recorder.Body.String())
+	<-slowDone // the handler keeps running in the background
+
+	// readiness is not subject to the request timeout
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/readiness", nil)
+	handler.ServeHTTP(recorder, req)
+	suite.Equal(200, recorder.Code)
+}
+
+func (suite *RouterTestSuite) TestRouterGzip() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	bigBody := []byte(strings.Repeat("apiVersion: v1\n", 1000))
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Header("ETag", `"abc"`)
+			c.Data(200, "application/x-yaml", bigBody)
+		}, RepoPullAction},
+		{"GET", "/charts/:filename", func(c *gin.Context) {
+			c.Data(200, "application/x-tar", bigBody)
+		}, RepoPullAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:      log,
+		GzipEnabled: true,
+		Username:    "testuser",
+		Password:    "testpass",
+	})
+	router.SetRoutes(testRoutes)
+
+	recorder := httptest.NewRecorder()
+	testContext, _ := gin.CreateTestContext(recorder)
+	testContext.Request, _ = http.NewRequest("GET", "/index.yaml", nil)
+	testContext.Request.Header.Set("Accept-Encoding", "gzip")
+	testContext.Request.SetBasicAuth("testuser", "testpass")
+	router.HandleContext(testContext)
+	suite.Equal(200, recorder.Code)
+	suite.Equal("gzip", recorder.Header().Get("Content-Encoding"))
+	suite.Equal("Accept-Encoding", recorder.Header().Get("Vary"))
+	suite.Equal(`W/"abc"`, recorder.Header().Get("ETag"), "ETag is weakened for the compressed body")
+	gzipReader, err := gzip.NewReader(recorder.Body)
+	suite.Nil(err, "no error reading gzipped body")
+	content, err := ioutil.ReadAll(gzipReader)
+	suite.Nil(err, "no error decompressing body")
+	suite.Equal(bigBody, content)
+
+	// no Accept-Encoding
+	recorder = httptest.NewRecorder()
+	testContext, _ = gin.CreateTestContext(recorder)
+	testContext.Request, _ = http.NewRequest("GET", "/index.yaml", nil)
+	testContext.Request.SetBasicAuth("testuser", "testpass")
+	router.HandleContext(testContext)
+	suite.Equal(200, recorder.Code)
+	suite.Equal("", recorder.Header().Get("Content-Encoding"))
+	suite.Equal(`"abc"`, recorder.Header().Get("ETag"))
+	suite.Equal(bigBody, recorder.Body.Bytes())
+
+	// chart packages are already compressed
+	recorder = httptest.NewRecorder()
+	testContext, _ = gin.CreateTestContext(recorder)
+	testContext.Request, _ = http.NewRequest("GET", "/charts/mychart-0.1.0.tgz", nil)
+	testContext.Request.Header.Set("Accept-Encoding", "gzip")
+	testContext.Request.SetBasicAuth("testuser", "testpass")
+	router.HandleContext(testContext)
+	suite.Equal(200, recorder.Code)
+	suite.Equal("", recorder.Header().Get("Content-Encoding"))
+	suite.Equal(bigBody, recorder.Body.Bytes())
+
+	// small 401 body is left alone
+	recorder = httptest.NewRecorder()
+	testContext, _ = gin.CreateTestContext(recorder)
+	testContext.Request, _ = http.NewRequest("GET", "/index.yaml", nil)
+	testContext.Request.Header.Set("Accept-Encoding", "gzip")
+	router.HandleContext(testContext)
+	suite.Equal(401, recorder.Code)
+	suite.Equal("", recorder.Header().Get("Content-Encoding"))
+	suite.Equal(`{"error":"unauthorized"}`, strings.TrimSpace(recorder.Body.String()))
+}
+
+func (suite *RouterTestSuite) TestRouterRateLimit() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"GET", "/health", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemInfoAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:         log,
+		RateLimit:      1,
+		RateLimitBurst: 2,
+		BasicAuthUsers: []string{"alice:alicepass", "bob:bobpass"},
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(path string, username string, password string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		testContext, _ := gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest("GET", path, nil)
+		testContext.Request.RemoteAddr = "10.0.0.1:12345"
+		testContext.Request.SetBasicAuth(username, password)
+		router.HandleContext(testContext)
+		return recorder
+	}
+
+	suite.Equal(200, doRequest("/index.yaml", "alice", "alicepass").Code)
+	suite.Equal(200, doRequest("/index.yaml", "alice", "alicepass").Code)
+	recorder := doRequest("/index.yaml", "alice", "alicepass")
+	suite.Equal(429, recorder.Code, "alice is over the burst")
+	suite.Equal("1", recorder.Header().Get("Retry-After"))
+
+	// other users have their own bucket, even from the same IP
+	suite.Equal(200, doRequest("/index.yaml", "bob", "bobpass").Code)
+
+	// failed authentication is not counted against the user
+	suite.Equal(401, doRequest("/index.yaml", "bob", "wrongpass").Code)
+	suite.Equal(200, doRequest("/index.yaml", "bob", "bobpass").Code)
+
+	// system routes are not rate limited
+	for i := 0; i < 5; i++ {
+		suite.Equal(200, doRequest("/health", "alice", "alicepass").Code)
+	}
+
+	// anonymous requests are limited by client IP, whatever credentials they carry
+	router = NewRouter(RouterOptions{
+		Logger:         log,
+		RateLimit:      1,
+		RateLimitBurst: 2,
+		BasicAuthUsers: []string{"alice:alicepass"},
+		AnonymousGet:   true,
+	})
+	router.SetRoutes(testRoutes)
+	suite.Equal(200, doRequest("/index.yaml", "mallory", "x").Code)
+	suite.Equal(200, doRequest("/index.yaml", "eve", "x").Code)
+	suite.Equal(429, doRequest("/index.yaml", "trudy", "x").Code, "forged usernames share the IP bucket")
+}
+
+func (suite *RouterTestSuite) TestRouterMaxConcurrentUploads() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"POST", "/api/charts", func(c *gin.Context) {
+			if c.Query("block") != "" {
+				entered <- struct{}{}
+				<-release
+			}
+			c.Data(201, "text/html", []byte("201"))
+		}, RepoPushAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:               log,
+		MaxUploadSize:        1024,
+		MaxConcurrentUploads: 1,
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		testContext, _ := gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest(method, path, nil)
+		router.HandleContext(testContext)
+		return recorder
+	}
+	inFlight := func() float64 {
+		metric := &dto.Metric{}
+		suite.Nil(uploadsInFlightGauge.Write(metric), "no error reading gauge")
+		return metric.GetGauge().GetValue()
+	}
+
+	done := make(chan int)
+	go func() {
+		done <- doRequest("POST", "/api/charts?block=1").Code
+	}()
+	<-entered
+	suite.Equal(float64(1), inFlight(), "one upload in flight")
+
+	recorder := doRequest("POST", "/api/charts")
+	suite.Equal(503, recorder.Code, "second upload is over the limit")
+	suite.Equal("5", recorder.Header().Get("Retry-After"))
+	suite.Equal(200, doRequest("GET", "/index.yaml").Code, "pulls are not limited")
+
+	close(release)
+	suite.Equal(201, <-done)
+	suite.Equal(float64(0), inFlight(), "no uploads in flight")
+	suite.Equal(201, doRequest("POST", "/api/charts").Code, "slot released")
+}
+
+func (suite *RouterTestSuite) TestRouterWriteAllowedCIDRs() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"POST", "/api/charts", func(c *gin.Context) {
+			c.Data(201, "text/html", []byte("201"))
+		}, RepoPushAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:            log,
+		WriteAllowedCIDRs: []string{"10.0.0.0/8", "192.168.1.10"},
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(method string, path string, remoteAddr string) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest(method, path, nil)
+		testContext.Request.RemoteAddr = remoteAddr
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+
+	suite.Equal(201, doRequest("POST", "/api/charts", "10.1.2.3:5000"))
+	suite.Equal(201, doRequest("POST", "/api/charts", "192.168.1.10:5000"))
+	suite.Equal(403, doRequest("POST", "/api/charts", "192.168.1.11:5000"))
+	suite.Equal(200, doRequest("GET", "/index.yaml", "192.168.1.11:5000"), "pulls are not restricted")
+
+	_, err = parseCIDRs([]string{"10.0.0.0/33"})
+	suite.NotNil(err, "error parsing invalid CIDR")
+	_, err = parseCIDRs([]string{"not-an-ip"})
+	suite.NotNil(err, "error parsing invalid CIDR")
+}
+
+func (suite *RouterTestSuite) TestRouterReadOnlyAnonymous() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/health", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemInfoAction},
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"POST", "/api/charts", func(c *gin.Context) {
+			c.Data(201, "text/html", []byte("201"))
+		}, RepoPushAction},
+	}
+
+	for _, anonymousGet := range []bool{false, true} {
+		router := NewRouter(RouterOptions{
+			Logger:            log,
+			Username:          "user",
+			Password:          "pass",
+			ReadOnlyAnonymous: true,
+			AnonymousGet:      anonymousGet,
+		})
+		router.SetRoutes(testRoutes)
+
+		doRequest := func(method string, path string, withAuth bool) int {
+			testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+			testContext.Request, _ = http.NewRequest(method, path, nil)
+			if withAuth {
+				testContext.Request.SetBasicAuth("user", "pass")
+			}
+			router.HandleContext(testContext)
+			return testContext.Writer.Status()
+		}
+
+		suite.Equal(200, doRequest("GET", "/health", false))
+		suite.Equal(200, doRequest("GET", "/index.yaml", false))
+		suite.Equal(200, doRequest("GET", "/index.yaml", true))
+		suite.Equal(401, doRequest("POST", "/api/charts", false))
+		suite.Equal(201, doRequest("POST", "/api/charts", true))
+	}
+}
+
+func (suite *RouterTestSuite) TestRouterAnonymousRepos() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/:repo/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"POST", "/api/:repo/charts", func(c *gin.Context) {
+			c.Data(201, "text/html", []byte("201"))
+		}, RepoPushAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:         log,
+		Username:       "user",
+		Password:       "pass",
+		Depth:          2,
+		AnonymousRepos: []string{"org1/public", "org2/*"},
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(method string, path string, withAuth bool) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest(method, path, nil)
+		if withAuth {
+			testContext.Request.SetBasicAuth("user", "pass")
+		}
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+
+	suite.Equal(200, doRequest("GET", "/org1/public/index.yaml", false), "anonymous pull from a public repo")
+	suite.Equal(200, doRequest("GET", "/org2/repo/index.yaml", false), "anonymous pull from a repo matching a pattern")
+	suite.Equal(401, doRequest("GET", "/org1/private/index.yaml", false), "other repos require auth")
+	suite.Equal(200, doRequest("GET", "/org1/private/index.yaml", true))
+	suite.Equal(401, doRequest("POST", "/api/org1/public/charts", false), "pushes to a public repo require auth")
+	suite.Equal(201, doRequest("POST", "/api/org1/public/charts", true))
+}
+
+func (suite *RouterTestSuite) TestRouterSystemReadAction() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/health", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemInfoAction},
+		{"GET", "/api/repos", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemReadAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:            log,
+		Username:          "user",
+		Password:          "pass",
+		Depth:             2,
+		ReadOnlyAnonymous: true,
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(path string, withAuth bool) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest("GET", path, nil)
+		if withAuth {
+			testContext.Request.SetBasicAuth("user", "pass")
+		}
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+
+	suite.Equal(200, doRequest("/health", false), "system info needs no credentials")
+	suite.Equal(401, doRequest("/api/repos", false), "system read needs credentials, even with anonymous pulls")
+	suite.Equal(200, doRequest("/api/repos", true))
+}
+
+func (suite *RouterTestSuite) TestRouterMaintenance() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	ok := func(c *gin.Context) {
+		c.Data(200, "text/html", []byte("200"))
+	}
+	var router *Router
+	testRoutes := []*Route{
+		{"GET", "/:repo/index.yaml", ok, RepoPullAction},
+		{"POST", "/api/:repo/charts", ok, RepoPushAction},
+		{"DELETE", "/api/:repo/charts/:name/:version", ok, RepoPushAction},
+		{"POST", "/api/maintenance", func(c *gin.Context) {
+			router.SetMaintenance(c.Query("enabled") == "true")
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemAdminAction},
+	}
+
+	router = NewRouter(RouterOptions{
+		Logger:   log,
+		Username: "user",
+		Password: "pass",
+		Depth:    1,
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(method string, path string, withAuth bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		testContext, _ := gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest(method, path, nil)
+		if withAuth {
+			testContext.Request.SetBasicAuth("user", "pass")
+		}
+		router.HandleContext(testContext)
+		return recorder
+	}
+
+	suite.False(router.Maintenance(), "not in maintenance mode by default")
+	suite.Equal(401, doRequest("POST", "/api/maintenance?enabled=true", false).Code, "admin needs credentials")
+	suite.Equal(200, doRequest("POST", "/api/maintenance?enabled=true", true).Code)
+	suite.True(router.Maintenance(), "maintenance mode turned on")
+
+	res := doRequest("POST", "/api/myrepo/charts", true)
+	suite.Equal(503, res.Code, "pushes are rejected in maintenance mode")
+	suite.Equal("60", res.Header().Get("Retry-After"))
+	suite.Equal(503, doRequest("DELETE", "/api/myrepo/charts/mychart/0.1.0", true).Code, "deletes are rejected in maintenance mode")
+	suite.Equal(200, doRequest("GET", "/myrepo/index.yaml", true).Code, "pulls are served in maintenance mode")
+
+	suite.Equal(200, doRequest("POST", "/api/maintenance?enabled=false", true).Code, "maintenance mode can be turned off")
+	suite.False(router.Maintenance())
+	suite.Equal(200, doRequest("POST", "/api/myrepo/charts", true).Code, "pushes are accepted again")
+}
+
+func (suite *RouterTestSuite) TestRouterAccessRules() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	rulesFile, err := ioutil.TempFile("", "access-rules")
+	suite.Nil(err, "no error creating access rules file")
+	defer os.Remove(rulesFile.Name())
+	writeRules := func(content string) {
+		err := ioutil.WriteFile(rulesFile.Name(), []byte(content), 0644)
+		suite.Nil(err, "no error writing access rules file")
+	}
+	writeRules(`
+rules:
+- identity: teama
+  repos: ["teamA/*"]
+  actions: [pull, push]
+- identity: teama
+  repos: ["teamB/*"]
+  actions: [pull]
+- identity: "*"
+  repos: ["public/*"]
+  actions: [pull]
+`)
+
+	testRoutes := []*Route{
+		{"GET", "/:repo/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"POST", "/api/:repo/charts", func(c *gin.Context) {
+			c.Data(201, "text/html", []byte("201"))
+		}, RepoPushAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:          log,
+		BasicAuthUsers:  []string{"teama:pass", "teamb:pass"},
+		Depth:           2,
+		AccessRulesFile: rulesFile.Name(),
+	})
+	router.SetRoutes(testRoutes)
+	defer router.Stop()
+
+	doRequest := func(method string, path string, username string) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest(method, path, nil)
+		if username != "" {
+			testContext.Request.SetBasicAuth(username, "pass")
+		}
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+
+	suite.Equal(200, doRequest("GET", "/teamA/charts/index.yaml", "teama"))
+	suite.Equal(201, doRequest("POST", "/api/teamA/charts/charts", "teama"))
+	suite.Equal(200, doRequest("GET", "/teamB/charts/index.yaml", "teama"))
+	suite.Equal(403, doRequest("POST", "/api/teamB/charts/charts", "teama"), "teama can only pull from teamB")
+	suite.Equal(403, doRequest("GET", "/teamA/charts/index.yaml", "teamb"), "no rule for teamb on teamA")
+	suite.Equal(200, doRequest("GET", "/public/charts/index.yaml", "teamb"), "any identity can pull from public")
+	suite.Equal(403, doRequest("POST", "/api/public/charts/charts", "teamb"))
+	suite.Equal(401, doRequest("GET", "/teamA/charts/index.yaml", ""), "credentials are checked before the rules")
+
+	// rules are replaced on reload, and kept if the file is invalid
+	writeRules(`
+rules:
+- identity: teamb
+  repos: ["*"]
+  actions: [pull]
+`)
+	suite.Nil(router.accessRules.load(), "no error reloading access rules")
+	suite.Equal(403, doRequest("GET", "/teamA/charts/index.yaml", "teama"))
+	suite.Equal(200, doRequest("GET", "/teamA/charts/index.yaml", "teamb"))
+
+	writeRules(`
+rules:
+- identity: teamb
+  repos: ["*"]
+  actions: [delete]
+`)
+	suite.NotNil(router.accessRules.load(), "error reloading access rules with an unknown action")
+	suite.Equal(200, doRequest("GET", "/teamA/charts/index.yaml", "teamb"), "previous rules are kept")
+
+	// requests allowed without credentials are not subject to the rules
+	writeRules(`
+rules:
+- identity: teamb
+  repos: ["*"]
+  actions: [pull]
+`)
+	anonymousRouter := NewRouter(RouterOptions{
+		Logger:            log,
+		BasicAuthUsers:    []string{"teama:pass"},
+		Depth:             2,
+		ReadOnlyAnonymous: true,
+		AccessRulesFile:   rulesFile.Name(),
+	})
+	anonymousRouter.SetRoutes(testRoutes)
+	defer anonymousRouter.Stop()
+	testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/teamA/charts/index.yaml", nil)
+	testContext.Request.SetBasicAuth("teama", "pass")
+	anonymousRouter.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status())
+}
+
+func (suite *RouterTestSuite) TestRouterResponseHeaders() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "application/x-yaml", []byte("apiVersion: v1"))
+		}, RepoPullAction},
+		{"GET", "/", func(c *gin.Context) {
+			c.Header("X-Frame-Options", "SAMEORIGIN")
+			c.Data(200, "text/html", []byte("<html></html>"))
+		}, SystemInfoAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger: log,
+		ResponseHeaders: map[string]string{
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "DENY",
+			"Strict-Transport-Security": "max-age=31536000",
+		},
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(path string, overTLS bool) http.Header {
+		recorder := httptest.NewRecorder()
+		testContext, _ := gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest("GET", path, nil)
+		if overTLS {
+			testContext.Request.TLS = &tls.ConnectionState{}
+		}
+		router.HandleContext(testContext)
+		return recorder.Header()
+	}
+
+	headers := doRequest("/index.yaml", false)
+	suite.Equal("nosniff", headers.Get("X-Content-Type-Options"))
+	suite.Equal("DENY", headers.Get("X-Frame-Options"))
+	suite.Equal("application/x-yaml", headers.Get("Content-Type"), "handler content type is kept")
+	suite.Empty(headers.Get("Strict-Transport-Security"), "no HSTS without TLS")
+
+	headers = doRequest("/index.yaml", true)
+	suite.Equal("max-age=31536000", headers.Get("Strict-Transport-Security"), "HSTS over TLS")
+
+	headers = doRequest("/", false)
+	suite.Equal("SAMEORIGIN", headers.Get("X-Frame-Options"), "header set by the handler wins")
+
+	headers = doRequest("/nothing/here", false)
+	suite.Equal("nosniff", headers.Get("X-Content-Type-Options"), "headers on error responses")
+
+	suite.NotNil(checkResponseHeaders(map[string]string{"content-type": "text/plain"}), "content type cannot be configured")
+	suite.Nil(checkResponseHeaders(map[string]string{"Content-Security-Policy": "default-src 'none'"}))
+}
+
+func (suite *RouterTestSuite) TestRouterBasicAuthChallenge() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+	}
+
+	challenge := func(realm string) (int, string) {
+		router := NewRouter(RouterOptions{
+			Logger:         log,
+			Username:       "user",
+			Password:       "pass",
+			BasicAuthRealm: realm,
+		})
+		router.SetRoutes(testRoutes)
+		recorder := httptest.NewRecorder()
+		testContext, _ := gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest("GET", "/index.yaml", nil)
+		router.HandleContext(testContext)
+		return recorder.Code, recorder.Header().Get("WWW-Authenticate")
+	}
+
+	code, header := challenge("")
+	suite.Equal(401, code)
+	suite.Equal(`Basic realm="ChartMuseum"`, header, "default realm")
+
+	_, header = challenge(`Acme "charts"`)
+	suite.Equal(`Basic realm="Acme \"charts\""`, header, "configured realm is quoted")
+}
+
+func (suite *RouterTestSuite) TestRouterAuthMetrics() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:   log,
+		Username: "user",
+		Password: "pass",
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(password string) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest("GET", "/index.yaml", nil)
+		testContext.Request.SetBasicAuth("user", password)
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+	authCount := func(result string, scheme string) float64 {
+		metric := &dto.Metric{}
+		suite.Nil(authCounterVec.WithLabelValues(result, scheme).Write(metric), "no error reading counter")
+		return metric.GetCounter().GetValue()
+	}
+	unauthorizedCount := func() float64 {
+		metric := &dto.Metric{}
+		suite.Nil(unauthorizedCounter.Write(metric), "no error reading counter")
+		return metric.GetCounter().GetValue()
+	}
+
+	successes := authCount("success", authSchemeBasic)
+	failures := authCount("failure", authSchemeBasic)
+	unauthorized := unauthorizedCount()
+
+	suite.Equal(200, doRequest("pass"))
+	suite.Equal(401, doRequest("wrong"))
+	suite.Equal(401, doRequest("wrong"))
+
+	suite.Equal(successes+1, authCount("success", authSchemeBasic))
+	suite.Equal(failures+2, authCount("failure", authSchemeBasic))
+	suite.Equal(unauthorized+2, unauthorizedCount())
+}
+
+func (suite *RouterTestSuite) TestRouterRequestDurationMetrics() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"POST", "/api/charts", func(c *gin.Context) {
+			c.JSON(409, gin.H{"error": "file already exists"})
+		}, RepoPushAction},
+	}
+
+	router := NewRouter(RouterOptions{Logger: log})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(method string, path string) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest(method, path, nil)
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+	observations := func(act action, statusClass string) uint64 {
+		metric := &dto.Metric{}
+		histogram := requestDurationHistogramVec.WithLabelValues(string(act), statusClass)
+		suite.Nil(histogram.Write(metric), "no error reading histogram")
+		return metric.GetHistogram().GetSampleCount()
+	}
+
+	pulls := observations(RepoPullAction, "2xx")
+	failedPushes := observations(RepoPushAction, "4xx")
+
+	suite.Equal(200, doRequest("GET", "/index.yaml"))
+	suite.Equal(409, doRequest("POST", "/api/charts"))
+	suite.Equal(404, doRequest("GET", "/nothing-here"))
+
+	suite.Equal(pulls+1, observations(RepoPullAction, "2xx"), "pull observed")
+	suite.Equal(failedPushes+1, observations(RepoPushAction, "4xx"), "failed push observed by status class")
+}
+
+func (suite *RouterTestSuite) TestRouterMetricsOptions() {
+	suite.Equal("chartmuseum", metricsPrefix("", ""), "default prefix is unchanged")
+	suite.Equal("cm", metricsPrefix("cm", ""))
+	suite.Equal("cm_frontend", metricsPrefix("cm", "frontend"))
+	suite.Equal("chartmuseum_frontend", metricsPrefix("", "frontend"))
+
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	SetMetricsPrefix("cmtest", "")
+	defer SetMetricsPrefix("", "")
+	router := NewRouter(RouterOptions{
+		Logger:           log,
+		EnableMetrics:    true,
+		MetricsNamespace: "cmtest",
+		MetricsPath:      "/internal/metrics",
+	})
+	router.SetRoutes([]*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+	})
+
+	doRequest := func(path string) (int, string) {
+		recorder := httptest.NewRecorder()
+		testContext, _ := gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest("GET", path, nil)
+		router.HandleContext(testContext)
+		return testContext.Writer.Status(), recorder.Body.String()
+	}
+
+	status, _ := doRequest("/index.yaml")
+	suite.Equal(200, status)
+	status, body := doRequest("/internal/metrics")
+	suite.Equal(200, status, "metrics served at the configured path")
+	suite.Contains(body, "cmtest_requests_total", "request metrics use the configured namespace")
+	suite.Contains(body, "cmtest_handler_duration_seconds", "handler metrics use the configured namespace")
+	suite.Contains(body, "cmtest_uploads_in_flight", "router metrics use the configured namespace")
+	suite.NotContains(body, "chartmuseum_handler_duration_seconds", "default handler metrics are replaced")
+	status, _ = doRequest("/metrics")
+	suite.Equal(404, status, "metrics not served at the default path")
+}
+
+func (suite *RouterTestSuite) TestRouterPprof() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	router := NewRouter(RouterOptions{
+		Logger:       log,
+		Username:     "user",
+		Password:     "pass",
+		AnonymousGet: true,
+		EnablePprof:  true,
+	})
+	router.SetRoutes([]*Route{
+		{"GET", "/:repo/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+	})
+
+	doRequest := func(path string, password string) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest("GET", path, nil)
+		if password != "" {
+			testContext.Request.SetBasicAuth("user", password)
+		}
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+
+	suite.Equal(401, doRequest("/debug/pprof/", ""), "profiles never served anonymously")
+	suite.Equal(401, doRequest("/debug/pprof/heap", "wrong"))
+	suite.Equal(200, doRequest("/debug/pprof/", "pass"))
+	suite.Equal(200, doRequest("/debug/pprof/goroutine", "pass"))
+	suite.Equal(200, doRequest("/debug/pprof/cmdline", "pass"))
+	suite.Equal(200, doRequest("/index.yaml", ""), "other routes still matched by the router")
+
+	router = NewRouter(RouterOptions{Logger: log})
+	suite.Equal(404, doRequest("/debug/pprof/", ""), "profiles off by default")
+
+	// with client certificate auth only, a certificate is needed even when it is optional
+	router.ClientCertAuth = true
+	router.registerPprofRoutes()
+	suite.Equal(401, doRequest("/debug/pprof/", ""), "no certificate is not anonymous access")
+	testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/debug/pprof/", nil)
+	testContext.Request.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ops"}}}},
+	}
+	router.HandleContext(testContext)
+	suite.Equal(200, testContext.Writer.Status(), "verified certificate")
+}
+
+func (suite *RouterTestSuite) TestRouterTrailingSlash() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/api/:repo/charts", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"POST", "/api/:repo/charts", func(c *gin.Context) {
+			c.Data(201, "text/html", []byte("201"))
+		}, RepoPushAction},
+	}
+
+	doRequest := func(mode string, method string, path string) *httptest.ResponseRecorder {
+		router := NewRouter(RouterOptions{
+			Logger:        log,
+			ContextPath:   "/ctx",
+			Depth:         1,
+			TrailingSlash: mode,
+		})
+		router.SetRoutes(testRoutes)
+		recorder := httptest.NewRecorder()
+		testContext, _ := gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest(method, path, nil)
+		router.HandleContext(testContext)
+		return recorder
+	}
+
+	suite.Equal(200, doRequest("", "GET", "/ctx/api/myrepo/charts").Code)
+	suite.Equal(404, doRequest("", "GET", "/ctx/api/myrepo/charts/").Code, "strict by default")
+	suite.Equal(404, doRequest(TrailingSlashStrict, "GET", "/ctx/api/myrepo/charts/").Code)
+
+	suite.Equal(200, doRequest(TrailingSlashStrip, "GET", "/ctx/api/myrepo/charts/").Code)
+	suite.Equal(201, doRequest(TrailingSlashStrip, "POST", "/ctx/api/myrepo/charts//").Code)
+	suite.Equal(404, doRequest(TrailingSlashStrip, "GET", "/ctx/api/myrepo/nothing/").Code)
+
+	res := doRequest(TrailingSlashRedirect, "GET", "/ctx/api/myrepo/charts/?offset=1")
+	suite.Equal(301, res.Code)
+	suite.Equal("/ctx/api/myrepo/charts?offset=1", res.Header().Get("Location"), "query is kept")
+	res = doRequest(TrailingSlashRedirect, "POST", "/ctx/api/myrepo/charts/")
+	suite.Equal(308, res.Code, "method kept for writes")
+	suite.Equal("/ctx/api/myrepo/charts", res.Header().Get("Location"))
+	suite.Equal(404, doRequest(TrailingSlashRedirect, "GET", "/ctx/api/myrepo/nothing/").Code,
+		"no redirect to a path which is not found either")
+
+	suite.NotNil(checkTrailingSlash("lenient"))
+}
+
+func (suite *RouterTestSuite) TestRouterRequestSizeLimits() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	readBody := func(c *gin.Context) {
+		if _, err := ioutil.ReadAll(c.Request.Body); err != nil {
+			return
+		}
+		c.Data(200, "text/html", []byte("200"))
+	}
+	testRoutes := []*Route{
+		{"POST", "/api/charts", readBody, RepoPushAction},
+		{"POST", "/api/search", readBody, RepoPullAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:         log,
+		MaxUploadSize:  100,
+		MaxRequestSize: 10,
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(path string, size int) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest("POST", path, strings.NewReader(strings.Repeat("x", size)))
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+
+	suite.Equal(200, doRequest("/api/charts", 50), "upload under MaxUploadSize")
+	suite.Equal(413, doRequest("/api/charts", 150), "upload over MaxUploadSize")
+	suite.Equal(200, doRequest("/api/search", 5), "request under MaxRequestSize")
+	suite.Equal(413, doRequest("/api/search", 50), "request over MaxRequestSize")
+
+	// the size of the body is known from its Content-Length, or found out while reading it
+	recorder := httptest.NewRecorder()
+	testContext, _ := gin.CreateTestContext(recorder)
+	testContext.Request, _ = http.NewRequest("POST", "/api/charts", strings.NewReader(strings.Repeat("x", 150)))
+	router.HandleContext(testContext)
+	suite.Equal(413, recorder.Code)
+	suite.Equal(`{"error":"request body of 150 bytes exceeds the max upload size of 100 bytes"}`,
+		strings.TrimSpace(recorder.Body.String()))
+
+	recorder = httptest.NewRecorder()
+	testContext, _ = gin.CreateTestContext(recorder)
+	testContext.Request, _ = http.NewRequest("POST", "/api/charts", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 150))))
+	testContext.Request.ContentLength = -1
+	router.HandleContext(testContext)
+	suite.Equal(413, recorder.Code)
+	suite.Equal(`{"error":"request body exceeds the max upload size of 100 bytes"}`,
+		strings.TrimSpace(recorder.Body.String()))
+}
+
+func (suite *RouterTestSuite) TestAccessLogFields() {
+	suite.Nil(checkAccessLogFields(nil), "no error with default fields")
+	suite.Nil(checkAccessLogFields([]string{"method", "path", "statusCode", "latency", "bytes", "clientIP", "tenant"}))
+	suite.NotNil(checkAccessLogFields([]string{"authorization"}), "error with unknown field")
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("GET", "/myrepo/index.yaml", nil)
+	c.Request.Header.Set("User-Agent", "Helm/2.9.1")
+	c.Params = gin.Params{gin.Param{"repo", "myrepo"}}
+	c.Data(200, "text/html", []byte("200"))
+	suite.Equal("myrepo", accessLogFieldFuncs["tenant"](c, 0))
+	suite.Equal(3, accessLogFieldFuncs["bytes"](c, 0))
+	suite.Equal("Helm/2.9.1", accessLogFieldFuncs["userAgent"](c, 0))
+	suite.Equal(time.Second, accessLogFieldFuncs["latency"](c, time.Second))
+}
+
+func (suite *RouterTestSuite) TestAccessLogSampling() {
+	sampler := newAccessLogSampler(0)
+	for i := 0; i < 3; i++ {
+		suite.True(sampler.logged(200), "every request logged without sampling")
+	}
+
+	sampler = newAccessLogSampler(3)
+	var logged []bool
+	for i := 0; i < 7; i++ {
+		logged = append(logged, sampler.logged(200))
+	}
+	suite.Equal([]bool{true, false, false, true, false, false, true}, logged, "one in 3 successful requests logged")
+	for _, status := range []int{304, 404, 500} {
+		suite.True(sampler.logged(status), "%d always logged", status)
+	}
+	suite.False(sampler.logged(201), "successful requests still sampled")
+}
+
+func (suite *RouterTestSuite) TestRouterRequestID() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	var handlerRequestID string
+	testRoutes := []*Route{
+		{"GET", "/health", func(c *gin.Context) {
+			handlerRequestID = RequestID(c)
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemInfoAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:          log,
+		RequestIDHeader: "X-Correlation-Id",
+	})
+	router.SetRoutes(testRoutes)
+
+	recorder := httptest.NewRecorder()
+	testContext, _ := gin.CreateTestContext(recorder)
+	testContext.Request, _ = http.NewRequest("GET", "/health", nil)
+	testContext.Request.Header.Set("X-Correlation-Id", "abc-123")
+	router.HandleContext(testContext)
+	suite.Equal("abc-123", recorder.Header().Get("X-Correlation-Id"), "incoming request ID echoed back")
+	suite.Equal("abc-123", handlerRequestID, "request ID available to handler")
+	suite.Equal("", recorder.Header().Get("X-Request-Id"))
+
+	recorder = httptest.NewRecorder()
+	testContext, _ = gin.CreateTestContext(recorder)
+	testContext.Request, _ = http.NewRequest("GET", "/health", nil)
+	router.HandleContext(testContext)
+	suite.NotEmpty(recorder.Header().Get("X-Correlation-Id"), "request ID generated")
+	suite.Equal(recorder.Header().Get("X-Correlation-Id"), handlerRequestID)
+
+	for _, invalid := range []string{strings.Repeat("a", 129), "abc 123", "abc\x00123", "<script>"} {
+		recorder = httptest.NewRecorder()
+		testContext, _ = gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest("GET", "/health", nil)
+		testContext.Request.Header.Set("X-Correlation-Id", invalid)
+		router.HandleContext(testContext)
+		requestID := recorder.Header().Get("X-Correlation-Id")
+		suite.NotEqual(invalid, requestID, fmt.Sprintf("invalid request ID %q replaced", invalid))
+		suite.Len(requestID, 36, "UUID generated for invalid request ID")
+		suite.Equal(requestID, handlerRequestID)
+	}
+}
+
+func (suite *RouterTestSuite) TestRouterErrorResponder() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	testRoutes := []*Route{
+		{"GET", "/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+		{"POST", "/api/charts", func(c *gin.Context) {
+			c.Data(201, "text/html", []byte("201"))
+		}, RepoPushAction},
+	}
+
+	doRequest := func(router *Router, method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		testContext, _ := gin.CreateTestContext(recorder)
+		testContext.Request, _ = http.NewRequest(method, path, nil)
+		testContext.Request.RemoteAddr = "192.168.1.11:5000"
+		router.HandleContext(testContext)
+		return recorder
+	}
+
+	// the default responder keeps the original error bodies
+	router := NewRouter(RouterOptions{
+		Logger:            log,
+		Username:          "user",
+		Password:          "pass",
+		WriteAllowedCIDRs: []string{"10.0.0.0/8"},
+	})
+	router.SetRoutes(testRoutes)
+
+	recorder := doRequest(router, "GET", "/nope")
+	suite.Equal(404, recorder.Code)
+	suite.Equal(`{"error":"not found"}`, strings.TrimSpace(recorder.Body.String()))
+	recorder = doRequest(router, "GET", "/index.yaml")
+	suite.Equal(401, recorder.Code)
+	suite.Equal(`{"error":"unauthorized"}`, strings.TrimSpace(recorder.Body.String()))
+	recorder = doRequest(router, "POST", "/api/charts")
+	suite.Equal(403, recorder.Code)
+	suite.Equal(`{"error":"forbidden"}`, strings.TrimSpace(recorder.Body.String()))
+
+	router = NewRouter(RouterOptions{
+		Logger:            log,
+		Username:          "user",
+		Password:          "pass",
+		WriteAllowedCIDRs: []string{"10.0.0.0/8"},
+		ErrorResponder: func(c *gin.Context, status int, message string) {
+			if status == 403 {
+				status = 404
+			}
+			c.JSON(status, gin.H{"code": status, "message": message, "request_id": RequestID(c)})
+		},
+	})
+	router.SetRoutes(testRoutes)
+
+	recorder = doRequest(router, "GET", "/nope")
+	suite.Equal(404, recorder.Code)
+	suite.Equal(`{"code":404,"message":"not found","request_id":"`+recorder.Header().Get("X-Request-Id")+`"}`,
+		strings.TrimSpace(recorder.Body.String()))
+	recorder = doRequest(router, "GET", "/index.yaml")
+	suite.Equal(401, recorder.Code)
+	suite.Contains(recorder.Body.String(), `"message":"unauthorized"`)
+	suite.NotEmpty(recorder.Header().Get("WWW-Authenticate"), "auth challenge still sent")
+	recorder = doRequest(router, "POST", "/api/charts")
+	suite.Equal(404, recorder.Code, "responder can change the status")
+	suite.Contains(recorder.Body.String(), `"message":"forbidden"`)
+}
+
+func (suite *RouterTestSuite) TestRouterStartStop() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	router := NewRouter(RouterOptions{
+		Logger:          log,
+		ShutdownTimeout: time.Second,
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		router.Start(0)
+		close(stopped)
+	}()
+
+	router.Stop()
+	router.Stop() // calling twice is safe
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		suite.Fail("router did not stop after Stop()")
+	}
+}
+
+func (suite *RouterTestSuite) TestHTTPServerTimeouts() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	server := NewRouter(RouterOptions{Logger: log}).newHTTPServer(8080)
+	suite.Equal(defaultReadHeaderTimeout, server.ReadHeaderTimeout, "read header timeout by default")
+	suite.Equal(defaultReadTimeout, server.ReadTimeout, "read timeout by default")
+	suite.Equal(defaultWriteTimeout, server.WriteTimeout, "write timeout by default")
+	suite.Equal(defaultIdleTimeout, server.IdleTimeout, "idle timeout by default")
+
+	server = NewRouter(RouterOptions{
+		Logger:            log,
+		ReadHeaderTimeout: time.Second,
+		ReadTimeout:       2 * time.Second,
+		WriteTimeout:      3 * time.Second,
+		IdleTimeout:       4 * time.Second,
+		EnableH2C:         true,
+	}).newHTTPServer(8080)
+	suite.Equal(":8080", server.Addr)
+	suite.Equal(time.Second, server.ReadHeaderTimeout)
+	suite.Equal(2*time.Second, server.ReadTimeout)
+	suite.Equal(3*time.Second, server.WriteTimeout)
+	suite.Equal(4*time.Second, server.IdleTimeout)
+}
+
+func (suite *RouterTestSuite) TestRouterListenHost() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	router := NewRouter(RouterOptions{
+		Logger:          log,
+		ListenHost:      "127.0.0.1",
+		ShutdownTimeout: time.Second,
+	})
+	router.SetRoutes([]*Route{
+		{"GET", "/health", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemInfoAction},
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Nil(err, "no error finding a free port")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		router.Start(port)
+		close(stopped)
+	}()
+	defer func() {
+		router.Stop()
+		<-stopped
+	}()
+
+	healthURL := fmt.Sprintf("http://127.0.0.1:%d/health", port)
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		if res, err = http.Get(healthURL); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	suite.Nil(err, "no error requesting the listen host")
+	if err == nil {
+		res.Body.Close()
+		suite.Equal(200, res.StatusCode)
+	}
+}
+
+func (suite *RouterTestSuite) TestRouterListenSocket() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	dir, err := ioutil.TempDir("", "chartmuseum-socket")
+	suite.Nil(err, "no error creating temp directory")
+	defer os.RemoveAll(dir)
+	socketPath := pathutil.Join(dir, "chartmuseum.sock")
+
+	// a socket file left behind by a process which is gone
+	stale, err := net.Listen("unix", socketPath)
+	suite.Nil(err, "no error creating stale socket")
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	router := NewRouter(RouterOptions{
+		Logger:          log,
+		ListenSocket:    socketPath,
+		ShutdownTimeout: time.Second,
+	})
+	router.SetRoutes([]*Route{
+		{"GET", "/health", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemInfoAction},
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		router.Start(0)
+		close(stopped)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network string, addr string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+	}
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		if res, err = client.Get("http://chartmuseum/health"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	suite.Nil(err, "no error requesting over the socket")
+	if err == nil {
+		res.Body.Close()
+		suite.Equal(200, res.StatusCode)
+	}
+
+	_, err = listenUnixSocket(socketPath)
+	suite.NotNil(err, "error listening on a socket in use")
+
+	router.Stop()
+	<-stopped
+	_, err = os.Stat(socketPath)
+	suite.True(os.IsNotExist(err), "socket is removed on shutdown")
+
+	regularFile := pathutil.Join(dir, "regular")
+	suite.Nil(ioutil.WriteFile(regularFile, []byte("data"), 0644), "no error writing file")
+	_, err = listenUnixSocket(regularFile)
+	suite.NotNil(err, "error listening on a path which is not a socket")
+	_, err = os.Stat(regularFile)
+	suite.Nil(err, "file which is not a socket is left alone")
+}
+
+func (suite *RouterTestSuite) TestRouterH2C() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	router := NewRouter(RouterOptions{
+		Logger:          log,
+		EnableH2C:       true,
+		ShutdownTimeout: time.Second,
+	})
+	router.SetRoutes([]*Route{
+		{"GET", "/health", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte(c.Request.Proto))
+		}, SystemInfoAction},
+	})
+	suite.True(router.EnableH2C)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.Nil(err, "no error finding a free port")
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		router.Start(port)
+		close(stopped)
+	}()
+	defer func() {
+		router.Stop()
+		<-stopped
+	}()
+
+	// prior knowledge h2c: HTTP/2 frames straight over a plain TCP connection
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	url := fmt.Sprintf("http://127.0.0.1:%d/health", port)
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get(url); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	suite.Nil(err, "no error making h2c request")
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	suite.Equal(200, resp.StatusCode)
+	suite.Equal("HTTP/2.0", resp.Proto)
+	suite.Equal("HTTP/2.0", string(body), "request served over HTTP/2")
+}
+
+func (suite *RouterTestSuite) TestRouterRouteTemplate() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	var matched *Route
+	var template string
+	testRoutes := []*Route{
+		{"GET", "/health", func(c *gin.Context) {
+			matched, _ = MatchedRoute(c)
+			template = RouteTemplate(c)
+			c.Data(200, "text/html", []byte("200"))
+		}, SystemInfoAction},
+		{"GET", "/api/:repo/charts/:name/:version", func(c *gin.Context) {
+			matched, _ = MatchedRoute(c)
+			template = RouteTemplate(c)
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+	}
+
+	for _, test := range []struct {
+		depth       int
+		contextPath string
+		path        string
+		route       *Route
+		template    string
+	}{
+		{0, "", "/health", testRoutes[0], "/health"},
+		{0, "", "/api/charts/mychart/0.1.0", testRoutes[1], "/api/charts/:name/:version"},
+		{2, "", "/api/org1/repo1/charts/mychart/0.1.0", testRoutes[1], "/api/:repo/charts/:name/:version"},
+		{1, "/v1/helm", "/v1/helm/api/repo1/charts/mychart/0.1.0", testRoutes[1], "/v1/helm/api/:repo/charts/:name/:version"},
+	} {
+		router := NewRouter(RouterOptions{
+			Logger:      log,
+			Depth:       test.depth,
+			ContextPath: test.contextPath,
+		})
+		router.SetRoutes(testRoutes)
+
+		matched, template = nil, ""
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest("GET", test.path, nil)
+		router.HandleContext(testContext)
+		suite.Equal(200, testContext.Writer.Status(), test.path)
+		suite.Equal(test.route, matched, test.path)
+		suite.Equal(test.template, template, test.path)
+		suite.Equal(test.template, mapURLWithParamsBackToRouteTemplate(testContext), test.path)
+	}
+
+	router := NewRouter(RouterOptions{Logger: log})
+	router.SetRoutes(testRoutes)
+	testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+	testContext.Request, _ = http.NewRequest("GET", "/nothing", nil)
+	router.HandleContext(testContext)
+	suite.Equal(404, testContext.Writer.Status())
+	_, ok := MatchedRoute(testContext)
+	suite.False(ok, "no route matched")
+	suite.Equal("", RouteTemplate(testContext))
+}
+
+func (suite *RouterTestSuite) TestRouterIdentity() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	var identity string
+	testRoutes := []*Route{
+		{"GET", "/:repo/index.yaml", func(c *gin.Context) {
+			identity = Identity(c)
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+	}
+
+	router := NewRouter(RouterOptions{
+		Logger:         log,
+		Username:       "user",
+		Password:       "pass",
+		AnonymousRepos: []string{"public"},
+		Depth:          1,
+	})
+	router.SetRoutes(testRoutes)
+
+	doRequest := func(path string, withAuth bool) int {
+		identity = ""
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest("GET", path, nil)
+		if withAuth {
+			testContext.Request.SetBasicAuth("user", "pass")
+		}
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+
+	suite.Equal(200, doRequest("/myrepo/index.yaml", true))
+	suite.Equal("user", identity, "basic auth username")
+	suite.Equal(200, doRequest("/public/index.yaml", false))
+	suite.Equal("", identity, "no identity for anonymous pulls")
+}
+
+func (suite *RouterTestSuite) TestMapURLToTenant() {
+	tests := []struct {
+		path   string
+		params gin.Params
+		status int
+		tenant string
+		ok     bool
+	}{
+		{"/index.yaml", nil, 200, "", false},
+		{"/myrepo/index.yaml", gin.Params{gin.Param{"repo", "myrepo"}}, 200, "myrepo", true},
+		{"/api/org1/repoa/charts/foo", gin.Params{gin.Param{"name", "foo"}, gin.Param{"repo", "org1/repoa"}}, 200, "org1/repoa", true},
+		{"/notarepo/whatever", gin.Params{gin.Param{"repo", "notarepo"}}, 404, "", false},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", tt.path, nil)
+		c.Params = tt.params
+		c.Writer.WriteHeader(tt.status)
+		tenant, ok := mapURLToTenant(c)
+		suite.Equal(tt.tenant, tenant)
+		suite.Equal(tt.ok, ok)
+	}
+}
+
+func (suite *RouterTestSuite) TestTenantMetricsKnownTenant() {
+	log, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug:   true,
+		LogJSON: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	router := NewRouter(RouterOptions{
+		Logger:        log,
+		EnableMetrics: true,
+		Depth:         1,
+	})
+	router.KnownTenant = func(repo string) bool {
+		return repo == "knownrepo"
+	}
+	router.SetRoutes([]*Route{
+		{"GET", "/:repo/index.yaml", func(c *gin.Context) {
+			c.Data(200, "text/html", []byte("200"))
+		}, RepoPullAction},
+	})
+
+	doRequest := func(path string) int {
+		testContext, _ := gin.CreateTestContext(httptest.NewRecorder())
+		testContext.Request, _ = http.NewRequest("GET", path, nil)
+		router.HandleContext(testContext)
+		return testContext.Writer.Status()
+	}
+	requests := func(tenant string) float64 {
+		metric := &dto.Metric{}
+		counter := tenantRequestCounterVec.WithLabelValues(tenant, "200", "GET", "/:repo/index.yaml")
+		suite.Nil(counter.Write(metric), "no error reading counter")
+		return metric.GetCounter().GetValue()
+	}
+
+	known := requests("knownrepo")
+	suite.Equal(200, doRequest("/knownrepo/index.yaml"))
+	suite.Equal(200, doRequest("/unknownrepo/index.yaml"))
+	suite.Equal(known+1, requests("knownrepo"), "request to known tenant counted")
+	suite.Equal(float64(0), requests("unknownrepo"), "request to unknown tenant not counted")
+}
+
 func (suite *RouterTestSuite) TestMapURLWithParamsBackToRouteTemplate() {
 	tests := []struct {
 		ctx    *gin.Context
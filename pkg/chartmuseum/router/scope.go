@@ -0,0 +1,102 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	scopeResourceType = "repository"
+	scopeAnyRepo      = "*"
+)
+
+// requiredScope is the scope a token needs to perform a push on the given repo,
+// e.g. "repository:myorg/myrepo:push"
+func requiredScope(repo string) string {
+	if repo == "" {
+		repo = scopeAnyRepo
+	}
+	return fmt.Sprintf("%s:%s:%s", scopeResourceType, repo, RepoPushAction)
+}
+
+/*
+tokenHasScope checks the token's claims for an action on a repo. Both styles of claim are accepted:
+
+	"scope": "repository:myrepo:pull,push repository:otherrepo:pull"
+	"access": [{"type": "repository", "name": "myrepo", "actions": ["pull", "push"]}]
+
+A repo name of "*" matches any repo.
+*/
+func tokenHasScope(token *jwt.Token, repo string, act action) bool {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return false
+	}
+
+	if scope, ok := claims["scope"].(string); ok {
+		for _, entry := range strings.Fields(scope) {
+			parts := strings.Split(entry, ":")
+			if len(parts) < 3 || parts[0] != scopeResourceType {
+				continue
+			}
+			// repo names may themselves contain a ":", actions are always last
+			name := strings.Join(parts[1:len(parts)-1], ":")
+			if scopeMatches(name, strings.Split(parts[len(parts)-1], ","), repo, act) {
+				return true
+			}
+		}
+	}
+
+	if access, ok := claims["access"].([]interface{}); ok {
+		for _, entry := range access {
+			item, ok := entry.(map[string]interface{})
+			if !ok || item["type"] != scopeResourceType {
+				continue
+			}
+			name, _ := item["name"].(string)
+			var actions []string
+			if list, ok := item["actions"].([]interface{}); ok {
+				for _, a := range list {
+					if s, ok := a.(string); ok {
+						actions = append(actions, s)
+					}
+				}
+			}
+			if scopeMatches(name, actions, repo, act) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func scopeMatches(name string, actions []string, repo string, act action) bool {
+	if name != scopeAnyRepo && name != repo {
+		return false
+	}
+	for _, a := range actions {
+		if a == string(act) || a == scopeAnyRepo {
+			return true
+		}
+	}
+	return false
+}
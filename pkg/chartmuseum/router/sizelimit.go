@@ -0,0 +1,107 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	uploadSizeLimitName  = "max upload size"
+	requestSizeLimitName = "max request size"
+)
+
+type (
+	// limitedBody is a request body which fails once more than limit bytes are read.
+	// Unlike http.MaxBytesReader, it leaves the response and the connection alone: the
+	// error is added to the context so that handlers give up, and the masterHandler
+	// then answers with a 413
+	limitedBody struct {
+		io.ReadCloser
+		c         *gin.Context
+		limitName string
+		limit     int64
+		remaining int64
+		err       *requestTooLargeError
+	}
+
+	requestTooLargeError struct {
+		limitName string
+		limit     int64
+		size      int64 // -1 if the size of the body is not known
+	}
+)
+
+// limitRequestBody replaces the body of the request with a limitedBody. A body which
+// is already known to be too large from its Content-Length fails straight away
+func limitRequestBody(c *gin.Context, limitName string, limit int64) *limitedBody {
+	if c.Request.Body == nil {
+		c.Request.Body = http.NoBody
+	}
+	body := &limitedBody{
+		ReadCloser: c.Request.Body,
+		c:          c,
+		limitName:  limitName,
+		limit:      limit,
+		remaining:  limit,
+	}
+	if c.Request.ContentLength > limit {
+		body.err = &requestTooLargeError{limitName: limitName, limit: limit, size: c.Request.ContentLength}
+	}
+	c.Request.Body = body
+	return body
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	if body.err != nil {
+		return 0, body.err
+	}
+	if int64(len(p)) > body.remaining+1 {
+		p = p[:body.remaining+1]
+	}
+	n, err := body.ReadCloser.Read(p)
+	if int64(n) <= body.remaining {
+		body.remaining -= int64(n)
+		return n, err
+	}
+	n = int(body.remaining)
+	body.remaining = 0
+	body.err = &requestTooLargeError{limitName: body.limitName, limit: body.limit, size: -1}
+	body.c.Error(body.err)
+	return n, body.err
+}
+
+func (err *requestTooLargeError) Error() string {
+	if err.size >= 0 {
+		return fmt.Sprintf("request body of %d bytes exceeds the %s of %d bytes", err.size, err.limitName, err.limit)
+	}
+	return fmt.Sprintf("request body exceeds the %s of %d bytes", err.limitName, err.limit)
+}
+
+// rejectTooLargeRequest answers a request with a body over its limit
+func (router *Router) rejectTooLargeRequest(c *gin.Context, err *requestTooLargeError) {
+	router.Logger.Warnc(c, "Rejected request over the size limit",
+		"limit", err.limit,
+		"size", err.size,
+		"path", c.Request.URL.Path,
+	)
+	router.errorResponder(c, 413, err.Error())
+}
@@ -0,0 +1,72 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// TrailingSlashStrict matches paths exactly, so that /api/charts/ is not found (the default)
+	TrailingSlashStrict = "strict"
+	// TrailingSlashStrip matches paths as if they had no trailing slash
+	TrailingSlashStrip = "strip"
+	// TrailingSlashRedirect redirects paths with a trailing slash to the path without it
+	TrailingSlashRedirect = "redirect"
+)
+
+// checkTrailingSlash returns an error if mode is not one of the trailing slash modes
+func checkTrailingSlash(mode string) error {
+	switch mode {
+	case TrailingSlashStrict, TrailingSlashStrip, TrailingSlashRedirect:
+		return nil
+	}
+	return fmt.Errorf("invalid trailing slash mode %q: expected %s, %s or %s",
+		mode, TrailingSlashStrict, TrailingSlashStrip, TrailingSlashRedirect)
+}
+
+// matchTrailingSlash finds the route of a request which was not found because of the trailing
+// slash of its path, as configured by TrailingSlash. It reports whether the request was
+// redirected instead
+func (router *Router) matchTrailingSlash(c *gin.Context) (*Route, []gin.Param, bool) {
+	if router.TrailingSlash == TrailingSlashStrict {
+		return nil, nil, false
+	}
+	path := strings.TrimRight(c.Request.URL.Path, "/")
+	if path == c.Request.URL.Path || path == "" {
+		return nil, nil, false
+	}
+	route, params := router.match(c.Request.Method, path)
+	if route == nil || router.TrailingSlash == TrailingSlashStrip {
+		return route, params, false
+	}
+
+	location := *c.Request.URL
+	location.Path = path
+	location.RawPath = ""
+	// a 308 keeps the method and body of the request, which clients change after a 301
+	status := http.StatusPermanentRedirect
+	if isReadMethod(c.Request.Method) {
+		status = http.StatusMovedPermanently
+	}
+	c.Redirect(status, location.String())
+	return nil, nil, true
+}
@@ -0,0 +1,53 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const socketProbeTimeout = time.Second
+
+// listenUnixSocket listens on a Unix domain socket at path. A socket file left behind by a
+// process which is gone is removed first, while a socket still accepting connections, or
+// any other kind of file, is left alone and reported as an error
+func listenUnixSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("cannot listen on %s: file exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, socketProbeTimeout); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot listen on %s: socket is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("could not remove stale socket %s: %s", path, err)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// removeUnixSocket removes the socket file at path once the listener is closed
+func removeUnixSocket(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	requestTimeoutResponseBody = []byte(`{"error":"request timeout"}`)
+)
+
+type (
+	// timeoutWriter buffers the response of a handler, status included, so that nothing
+	// reaches the client if the request times out before the handler is finished. Only one
+	// of the buffered response and the timeout response is written
+	timeoutWriter struct {
+		mu       sync.Mutex
+		header   http.Header
+		buf      bytes.Buffer
+		code     int
+		timedOut bool
+	}
+)
+
+/*
+requestTimeoutHandler serves requests with a context.WithTimeout derived from the request
+context. If the deadline is exceeded, a 503 is returned immediately and anything the
+handler writes afterwards is discarded.
+
+Like http.TimeoutHandler, it wraps the whole engine rather than being a gin middleware:
+the handler gets a response writer of its own and gin a context of its own, so nothing
+is shared with the timeout response while the handler keeps running. Handlers that keep
+running past the timeout should watch c.Request.Context().
+*/
+func requestTimeoutHandler(handler http.Handler, timeout time.Duration, skipPaths []string) http.Handler {
+	skip := map[string]bool{}
+	for _, path := range skipPaths {
+		skip[path] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if skip[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{header: http.Header{}}
+		done := make(chan struct{})
+		panicChan := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicChan <- p
+				}
+			}()
+			handler.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			// re-panic in the request goroutine, as http.TimeoutHandler does
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			dst := w.Header()
+			for key, values := range tw.header {
+				dst[key] = values
+			}
+			if tw.code == 0 {
+				tw.code = 200
+			}
+			w.WriteHeader(tw.code)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(requestTimeoutResponseBody)))
+			w.WriteHeader(503)
+			w.Write(requestTimeoutResponseBody)
+		}
+	})
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		// discarded; returning an error would only make gin panic in the handler
+		return len(data), nil
+	}
+	if tw.code == 0 {
+		tw.code = 200
+	}
+	return tw.buf.Write(data)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.code != 0 {
+		return
+	}
+	tw.code = code
+}
+
+// Flush is deferred until the handler has finished
+func (tw *timeoutWriter) Flush() {}
@@ -0,0 +1,83 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TLSTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TLSTestSuite) TestNewTLSConfig() {
+	tlsConfig, err := newTLSConfig(RouterOptions{})
+	suite.Nil(err, "no error with empty tls options")
+	suite.Nil(tlsConfig, "go defaults used with empty tls options")
+
+	tlsConfig, err = newTLSConfig(RouterOptions{TlsMinVersion: "1.2"})
+	suite.Nil(err, "no error with tls min version 1.2")
+	suite.Equal(uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	suite.Empty(tlsConfig.CipherSuites)
+
+	tlsConfig, err = newTLSConfig(RouterOptions{TlsMinVersion: "TLS1.1"})
+	suite.Nil(err, "no error with tls min version TLS1.1")
+	suite.Equal(uint16(tls.VersionTLS11), tlsConfig.MinVersion)
+
+	tlsConfig, err = newTLSConfig(RouterOptions{
+		TlsCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " tls_ecdhe_rsa_with_aes_256_gcm_sha384"},
+	})
+	suite.Nil(err, "no error with valid cipher suites")
+	suite.Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, tlsConfig.CipherSuites)
+
+	_, err = newTLSConfig(RouterOptions{TlsMinVersion: "1.9"})
+	suite.NotNil(err, "error with invalid tls min version")
+
+	_, err = newTLSConfig(RouterOptions{TlsCipherSuites: []string{"TLS_FAKE_CIPHER"}})
+	suite.NotNil(err, "error with invalid cipher suite")
+
+	_, err = newTLSConfig(RouterOptions{TlsClientAuth: "sometimes"})
+	suite.NotNil(err, "error with invalid client auth mode")
+
+	_, err = newTLSConfig(RouterOptions{TlsClientAuth: "require"})
+	suite.NotNil(err, "error with client auth but no ca cert")
+
+	_, err = newTLSConfig(RouterOptions{TlsClientAuth: "require", TlsCACert: "../../../testdata/pgp/NOTE.txt"})
+	suite.NotNil(err, "error with client auth and ca cert without certificates")
+}
+
+func (suite *TLSTestSuite) TestVerifiedClientCommonName() {
+	request, _ := http.NewRequest("GET", "/", nil)
+	suite.Equal("", verifiedClientCommonName(request), "no common name without tls")
+
+	request.TLS = &tls.ConnectionState{}
+	suite.Equal("", verifiedClientCommonName(request), "no common name without verified chains")
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ci-pusher"}}
+	request.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	suite.Equal("ci-pusher", verifiedClientCommonName(request))
+}
+
+func TestTLSTestSuite(t *testing.T) {
+	suite.Run(t, new(TLSTestSuite))
+}
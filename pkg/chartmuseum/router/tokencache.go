@@ -0,0 +1,116 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+type (
+	// tokenCache keeps up to size validated bearer tokens, least recently used first out,
+	// so that a token seen again is not verified again. Tokens are kept until they expire,
+	// and tokens without an expiry are never kept
+	tokenCache struct {
+		size    int
+		mu      sync.Mutex
+		entries map[[sha256.Size]byte]*list.Element
+		order   *list.List
+		now     func() time.Time
+	}
+
+	tokenCacheEntry struct {
+		key     [sha256.Size]byte
+		token   *jwt.Token
+		expires time.Time
+	}
+)
+
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		entries: map[[sha256.Size]byte]*list.Element{},
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// get returns the validated token for a raw token, if it is cached and has not expired
+func (cache *tokenCache) get(raw string) (*jwt.Token, bool) {
+	key := sha256.Sum256([]byte(raw))
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*tokenCacheEntry)
+	if !cache.now().Before(entry.expires) {
+		cache.remove(element)
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	return entry.token, true
+}
+
+// add caches a validated token until its expiry
+func (cache *tokenCache) add(raw string, token *jwt.Token) {
+	expires, ok := tokenExpiry(token)
+	if !ok || !cache.now().Before(expires) {
+		return
+	}
+	key := sha256.Sum256([]byte(raw))
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&tokenCacheEntry{key: key, token: token, expires: expires})
+	for cache.order.Len() > cache.size {
+		cache.remove(cache.order.Back())
+	}
+}
+
+func (cache *tokenCache) remove(element *list.Element) {
+	cache.order.Remove(element)
+	delete(cache.entries, element.Value.(*tokenCacheEntry).key)
+}
+
+// tokenExpiry returns the time from the exp claim of a token
+func tokenExpiry(token *jwt.Token) (time.Time, bool) {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return time.Time{}, false
+	}
+	switch exp := claims["exp"].(type) {
+	case float64:
+		return time.Unix(int64(exp), 0), true
+	case json.Number:
+		seconds, err := exp.Int64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(seconds, 0), true
+	}
+	return time.Time{}, false
+}
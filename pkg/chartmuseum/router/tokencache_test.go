@@ -0,0 +1,90 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/suite"
+)
+
+type TokenCacheTestSuite struct {
+	suite.Suite
+}
+
+func tokenExpiringAt(expires time.Time) *jwt.Token {
+	return &jwt.Token{Claims: jwt.MapClaims{"exp": float64(expires.Unix())}}
+}
+
+func (suite *TokenCacheTestSuite) TestGetAndExpiry() {
+	now := time.Unix(1000, 0)
+	cache := newTokenCache(10)
+	cache.now = func() time.Time { return now }
+
+	token := tokenExpiringAt(now.Add(time.Minute))
+	cache.add("token", token)
+	cached, ok := cache.get("token")
+	suite.True(ok, "token is cached")
+	suite.Equal(token, cached)
+
+	_, ok = cache.get("other")
+	suite.False(ok, "unknown token is not cached")
+
+	now = now.Add(time.Minute)
+	_, ok = cache.get("token")
+	suite.False(ok, "token is evicted at expiry")
+	suite.Len(cache.entries, 0)
+
+	cache.add("expired", tokenExpiringAt(now.Add(-time.Second)))
+	_, ok = cache.get("expired")
+	suite.False(ok, "expired token is not cached")
+
+	cache.add("noexp", &jwt.Token{Claims: jwt.MapClaims{"sub": "ci"}})
+	_, ok = cache.get("noexp")
+	suite.False(ok, "token without expiry is not cached")
+
+	cache.add("number", &jwt.Token{Claims: jwt.MapClaims{"exp": json.Number("3000")}})
+	_, ok = cache.get("number")
+	suite.True(ok, "exp claim as a json number")
+}
+
+func (suite *TokenCacheTestSuite) TestLeastRecentlyUsedEviction() {
+	now := time.Unix(1000, 0)
+	cache := newTokenCache(2)
+	cache.now = func() time.Time { return now }
+
+	cache.add("a", tokenExpiringAt(now.Add(time.Hour)))
+	cache.add("b", tokenExpiringAt(now.Add(time.Hour)))
+	_, ok := cache.get("a")
+	suite.True(ok)
+	cache.add("c", tokenExpiringAt(now.Add(time.Hour)))
+
+	_, ok = cache.get("b")
+	suite.False(ok, "least recently used token is evicted")
+	_, ok = cache.get("a")
+	suite.True(ok)
+	_, ok = cache.get("c")
+	suite.True(ok)
+	suite.Equal(2, cache.order.Len())
+}
+
+func TestTokenCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(TokenCacheTestSuite))
+}
@@ -17,12 +17,17 @@ limitations under the License.
 package chartmuseum
 
 import (
+	"fmt"
+	"io"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/helm/chartmuseum/pkg/cache"
 	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
 	cm_router "github.com/helm/chartmuseum/pkg/chartmuseum/router"
 	mt "github.com/helm/chartmuseum/pkg/chartmuseum/server/multitenant"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
 	"github.com/helm/chartmuseum/pkg/storage"
 )
 
@@ -30,34 +35,117 @@ type (
 	// ServerOptions are options for constructing a Server
 	ServerOptions struct {
 		StorageBackend         storage.Backend
+		StorageBackendType     string
+		TenantStorageBackends  map[string]storage.Backend
+		StoragePrefix          string
+		StorageLayout          string
 		ExternalCacheStore     cache.Store
 		ChartURL               string
+		ExternalURL            string
+		ChartURLTemplate       string
 		TlsCert                string
 		TlsKey                 string
+		TlsMinVersion          string
+		TlsCipherSuites        []string
+		TlsCACert              string
+		TlsClientAuth          string
+		EnableH2C              bool
 		Username               string
 		Password               string
+		BasicAuthUsers         []string
+		BasicAuthUsersFile     string
+		BasicAuthHtpasswd      string
+		BasicAuthRealm         string
 		ChartPostFormFieldName string
 		ProvPostFormFieldName  string
 		ContextPath            string
+		ListenHost             string
+		ListenSocket           string
 		LogJSON                bool
 		Debug                  bool
 		EnableAPI              bool
 		UseStatefiles          bool
 		AllowOverwrite         bool
 		AllowForceOverwrite    bool
+		ValidateCharts         bool
 		EnableMetrics          bool
+		MetricsNamespace       string
+		MetricsSubsystem       string
+		MetricsPath            string
+		EnablePprof            bool
+		TrailingSlash          string
+		AllowedChartNameRegex  string
 		AnonymousGet           bool
+		ReadOnlyAnonymous      bool
+		AnonymousRepos         []string
 		GenIndex               bool
 		MaxStorageObjects      int
+		MaxVersionsPerChart    int
+		IgnoreChartNameCase    bool
 		IndexLimit             int
 		Depth                  int
+		VariableDepth          bool
 		MaxUploadSize          int
+		MaxChartSize           int
+		MaxRequestSize         int
+		MaxConcurrentUploads   int
+		StorageRetryAttempts   int
+		StorageRetryDelay      int
+		ReadinessTimeout       int
+		ShutdownTimeout        int
+		RequestTimeout         int
+		ReadHeaderTimeout      int
+		ReadTimeout            int
+		WriteTimeout           int
+		IdleTimeout            int
+		EnableGzip             bool
+		RateLimit              int
+		RateLimitBurst         int
+		WriteAllowedCIDRs      []string
+		TrustedProxies         []string
+		TrustedPlatform        string
+		AccessLogFields        []string
+		AccessLogSampling      int
+		RequestIDHeader        string
+		ResponseHeaders        []string
+		Version                string
+		Revision               string
 		BearerAuth             bool
 		AuthType               string
 		AuthRealm              string
 		AuthService            string
 		AuthIssuer             string
 		AuthCertPath           string
+		AuthCertPem            string
+		AuthCertUrl            string
+		AuthJwksUrl            string
+		AuthJwksRefresh        int
+		AuthTokenCacheSize     int
+		AccessRules            string
+		CORSAllowedOrigins     []string
+		CORSAllowedMethods     []string
+		CORSAllowedHeaders     []string
+		CORSAllowCredentials   bool
+		WebhookURLs            []string
+		WebhookSecret          string
+		RetentionKeepVersions  int
+		RetentionMaxAge        int
+		RetentionInterval      int
+		RetentionDryRun        bool
+		ReindexInterval        int
+		ReindexJitter          int
+		IndexReconcileInterval int
+		CacheTTL               int
+		PresignedRedirect      bool
+		PresignedURLExpiry     int
+		UpstreamRepoURL        string
+		EnableOCI              bool
+		IndexSigningKeyring    string
+		IndexSigningKey        string
+		IndexSigningPassphrase string
+		IndexVersionOrder      string
+		PushAnnotations        []string
+		AuditLog               string
 	}
 
 	// Server is a generic interface for web servers
@@ -81,41 +169,278 @@ func NewServer(options ServerOptions) (Server, error) {
 		contextPath = "/" + contextPath
 	}
 
+	responseHeaders, err := parseResponseHeaders(options.ResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	// every metric gets the prefix of the HTTP request metrics
+	cm_router.SetMetricsPrefix(options.MetricsNamespace, options.MetricsSubsystem)
+	mt.SetMetricsPrefix(options.MetricsNamespace, options.MetricsSubsystem)
+	cm_repo.SetMetricsPrefix(options.MetricsNamespace, options.MetricsSubsystem)
+	storage.SetMetricsPrefix(options.MetricsNamespace, options.MetricsSubsystem)
+
 	router := cm_router.NewRouter(cm_router.RouterOptions{
-		Logger:        logger,
-		Username:      options.Username,
-		Password:      options.Password,
-		ContextPath:   contextPath,
-		TlsCert:       options.TlsCert,
-		TlsKey:        options.TlsKey,
-		EnableMetrics: options.EnableMetrics,
-		AnonymousGet:  options.AnonymousGet,
-		Depth:         options.Depth,
-		MaxUploadSize: options.MaxUploadSize,
-		BearerAuth:    options.BearerAuth,
-		AuthType:      options.AuthType,
-		AuthRealm:     options.AuthRealm,
-		AuthService:   options.AuthService,
-		AuthIssuer:    options.AuthIssuer,
-		AuthCertPath:  options.AuthCertPath,
+		Logger:                logger,
+		Username:              options.Username,
+		Password:              options.Password,
+		BasicAuthUsers:        options.BasicAuthUsers,
+		BasicAuthUsersFile:    options.BasicAuthUsersFile,
+		BasicAuthHtpasswd:     options.BasicAuthHtpasswd,
+		BasicAuthRealm:        options.BasicAuthRealm,
+		ContextPath:           contextPath,
+		ListenHost:            options.ListenHost,
+		ListenSocket:          options.ListenSocket,
+		TlsCert:               options.TlsCert,
+		TlsKey:                options.TlsKey,
+		TlsMinVersion:         options.TlsMinVersion,
+		TlsCipherSuites:       options.TlsCipherSuites,
+		TlsCACert:             options.TlsCACert,
+		TlsClientAuth:         options.TlsClientAuth,
+		EnableH2C:             options.EnableH2C,
+		EnableMetrics:         options.EnableMetrics,
+		MetricsNamespace:      options.MetricsNamespace,
+		MetricsSubsystem:      options.MetricsSubsystem,
+		MetricsPath:           options.MetricsPath,
+		EnablePprof:           options.EnablePprof,
+		TrailingSlash:         options.TrailingSlash,
+		AllowedChartNameRegex: options.AllowedChartNameRegex,
+		AnonymousGet:          options.AnonymousGet,
+		ReadOnlyAnonymous:     options.ReadOnlyAnonymous,
+		AnonymousRepos:        options.AnonymousRepos,
+		Depth:                 options.Depth,
+		VariableDepth:         options.VariableDepth,
+		MaxUploadSize:         options.MaxUploadSize,
+		MaxRequestSize:        options.MaxRequestSize,
+		MaxConcurrentUploads:  options.MaxConcurrentUploads,
+		BearerAuth:            options.BearerAuth,
+		AuthType:              options.AuthType,
+		AuthRealm:             options.AuthRealm,
+		AuthService:           options.AuthService,
+		AuthIssuer:            options.AuthIssuer,
+		AuthCertPath:          options.AuthCertPath,
+		AuthCertPem:           options.AuthCertPem,
+		AuthCertUrl:           options.AuthCertUrl,
+		AuthJwksUrl:           options.AuthJwksUrl,
+		AuthJwksRefresh:       time.Duration(options.AuthJwksRefresh) * time.Second,
+		AuthTokenCacheSize:    options.AuthTokenCacheSize,
+		AccessRulesFile:       options.AccessRules,
+		ShutdownTimeout:       time.Duration(options.ShutdownTimeout) * time.Second,
+		RequestTimeout:        time.Duration(options.RequestTimeout) * time.Second,
+		ReadHeaderTimeout:     time.Duration(options.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:           time.Duration(options.ReadTimeout) * time.Second,
+		WriteTimeout:          time.Duration(options.WriteTimeout) * time.Second,
+		IdleTimeout:           time.Duration(options.IdleTimeout) * time.Second,
+		GzipEnabled:           options.EnableGzip,
+		RateLimit:             float64(options.RateLimit),
+		RateLimitBurst:        options.RateLimitBurst,
+		WriteAllowedCIDRs:     options.WriteAllowedCIDRs,
+		TrustedProxies:        options.TrustedProxies,
+		TrustedPlatform:       options.TrustedPlatform,
+		AccessLogFields:       options.AccessLogFields,
+		AccessLogSampling:     options.AccessLogSampling,
+		RequestIDHeader:       options.RequestIDHeader,
+		ResponseHeaders:       responseHeaders,
+		Version:               options.Version,
+		Revision:              options.Revision,
+		CORS: cm_router.CORSOptions{
+			AllowedOrigins:   options.CORSAllowedOrigins,
+			AllowedMethods:   options.CORSAllowedMethods,
+			AllowedHeaders:   options.CORSAllowedHeaders,
+			AllowCredentials: options.CORSAllowCredentials,
+		},
 	})
 
+	layout, err := storage.NewKeyLayout(options.StorageLayout)
+	if err != nil {
+		return nil, err
+	}
+	newLayoutBackend := func(rawBackend storage.Backend) (storage.Backend, error) {
+		layoutBackend, err := storage.NewLayoutBackend(rawBackend, options.StoragePrefix, layout)
+		if err != nil {
+			return nil, err
+		}
+		return layoutBackend, layoutBackend.CheckLayout()
+	}
+	backend, err := newLayoutBackend(options.StorageBackend)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.TenantStorageBackends) > 0 {
+		backend, err = newTenantBackend(backend, options.TenantStorageBackends, options.Depth,
+			options.VariableDepth, newLayoutBackend)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.StorageRetryAttempts > 1 {
+		backend = storage.NewRetryBackend(backend, options.StorageBackendType, storage.RetryOptions{
+			MaxAttempts: options.StorageRetryAttempts,
+			BaseDelay:   time.Duration(options.StorageRetryDelay) * time.Millisecond,
+			OnRetry: func(operation string, attempt int, delay time.Duration, err error) {
+				logger.Debugw("Retrying storage request",
+					"operation", operation,
+					"attempt", attempt,
+					"delay", delay.String(),
+					"error", err.Error(),
+				)
+			},
+		})
+	}
+	if options.EnableMetrics {
+		backend = storage.NewInstrumentedBackend(backend, options.StorageBackendType)
+	}
+
+	var indexSigner *cm_repo.IndexSigner
+	if options.IndexSigningKeyring != "" {
+		indexSigner, err = cm_repo.NewIndexSigner(options.IndexSigningKeyring, options.IndexSigningKey, options.IndexSigningPassphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	versionOrder, err := cm_repo.NewVersionOrder(options.IndexVersionOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	var chartURLTemplate *cm_repo.ChartURLTemplate
+	if options.ChartURLTemplate != "" {
+		chartURLTemplate, err = cm_repo.NewChartURLTemplate(options.ChartURLTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pushAnnotations, err := parsePushAnnotations(options.PushAnnotations)
+	if err != nil {
+		return nil, err
+	}
+
+	auditLog, err := openAuditLog(options.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheStore := options.ExternalCacheStore
+	if pinger, ok := cacheStore.(cache.Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			logger.Warnw("External cache is unreachable, falling back to in-memory cache",
+				"error", err.Error(),
+			)
+			cacheStore = nil
+		}
+	}
+
 	server, err := mt.NewMultiTenantServer(mt.MultiTenantServerOptions{
 		Logger:                 logger,
 		Router:                 router,
-		StorageBackend:         options.StorageBackend,
-		ExternalCacheStore:     options.ExternalCacheStore,
+		StorageBackend:         backend,
+		ExternalCacheStore:     cacheStore,
 		ChartURL:               strings.TrimSuffix(options.ChartURL, "/"),
+		ExternalURL:            options.ExternalURL,
+		ChartURLTemplate:       chartURLTemplate,
 		ChartPostFormFieldName: options.ChartPostFormFieldName,
 		ProvPostFormFieldName:  options.ProvPostFormFieldName,
 		MaxStorageObjects:      options.MaxStorageObjects,
+		MaxVersionsPerChart:    options.MaxVersionsPerChart,
+		MaxChartSize:           options.MaxChartSize,
+		IgnoreChartNameCase:    options.IgnoreChartNameCase,
 		IndexLimit:             options.IndexLimit,
 		GenIndex:               options.GenIndex,
 		EnableAPI:              options.EnableAPI,
 		UseStatefiles:          options.UseStatefiles,
 		AllowOverwrite:         options.AllowOverwrite,
 		AllowForceOverwrite:    options.AllowForceOverwrite,
+		ValidateCharts:         options.ValidateCharts,
+		ReadinessTimeout:       time.Duration(options.ReadinessTimeout) * time.Second,
+		WebhookURLs:            options.WebhookURLs,
+		WebhookSecret:          options.WebhookSecret,
+		RetentionKeepVersions:  options.RetentionKeepVersions,
+		RetentionMaxAge:        time.Duration(options.RetentionMaxAge) * time.Second,
+		RetentionInterval:      time.Duration(options.RetentionInterval) * time.Second,
+		RetentionDryRun:        options.RetentionDryRun,
+		ReindexInterval:        time.Duration(options.ReindexInterval) * time.Second,
+		ReindexJitter:          time.Duration(options.ReindexJitter) * time.Second,
+		IndexReconcileInterval: time.Duration(options.IndexReconcileInterval) * time.Second,
+		CacheTTL:               time.Duration(options.CacheTTL) * time.Second,
+		PresignedRedirect:      options.PresignedRedirect,
+		PresignedURLExpiry:     time.Duration(options.PresignedURLExpiry) * time.Second,
+		UpstreamRepoURL:        options.UpstreamRepoURL,
+		EnableOCI:              options.EnableOCI,
+		IndexSigner:            indexSigner,
+		IndexVersionOrder:      versionOrder,
+		PushAnnotations:        pushAnnotations,
+		AuditLog:               auditLog,
+		BuildIndexOnListen:     true,
 	})
 
 	return server, err
 }
+
+// parseResponseHeaders parses headers given as "Name: value"
+func parseResponseHeaders(entries []string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("invalid response header %q: expected \"Name: value\"", entry)
+		}
+		headers[name] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// parsePushAnnotations parses annotations given as "key=value"
+func parsePushAnnotations(entries []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid push annotation %q: expected \"key=value\"", entry)
+		}
+		annotations[key] = strings.TrimSpace(parts[1])
+	}
+	return annotations, nil
+}
+
+// newTenantBackend keeps the repos of each tenant in its own backend, laid out like the
+// default backend. A tenant is a repo prefix, so repos need to be nested (see --depth and
+// --variable-depth)
+func newTenantBackend(defaultBackend storage.Backend, tenantBackends map[string]storage.Backend, depth int,
+	variableDepth bool, newLayoutBackend func(storage.Backend) (storage.Backend, error)) (storage.Backend, error) {
+	if depth == 0 && !variableDepth {
+		return nil, fmt.Errorf("storage tenants need repos nested below them, with a depth of at least 1")
+	}
+	tenants := map[string]storage.Backend{}
+	for prefix, tenantBackend := range tenantBackends {
+		if levels := len(strings.Split(strings.Trim(prefix, "/"), "/")); levels > depth && !variableDepth {
+			return nil, fmt.Errorf("storage tenant %q is nested deeper than the depth of %d", prefix, depth)
+		}
+		backend, err := newLayoutBackend(tenantBackend)
+		if err != nil {
+			return nil, fmt.Errorf("storage tenant %q: %s", prefix, err)
+		}
+		tenants[prefix] = backend
+	}
+	return storage.NewTenantBackend(defaultBackend, tenants)
+}
+
+// openAuditLog opens the file audit entries are appended to, "-" being stdout. There is no
+// audit log if path is empty
+func openAuditLog(path string) (io.Writer, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return os.Stdout, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %s", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	pathutil "path"
+	"strings"
+	"time"
+
+	cm_router "github.com/helm/chartmuseum/pkg/chartmuseum/router"
+
+	"github.com/ghodss/yaml"
+	"github.com/gin-gonic/gin"
+	helm_repo "k8s.io/helm/pkg/repo"
+)
+
+const (
+	// chartAnnotationsSuffix is appended to the name of a chart package for the object
+	// holding the annotations added to it on push
+	chartAnnotationsSuffix = ".annotations"
+
+	pushAnnotationIdentity = "{identity}"
+	pushAnnotationTime     = "{time}"
+)
+
+// pushAnnotations returns the annotations to add to the chart pushed by a request, with
+// {identity} replaced by the identity the request was authorized for, and {time} by the
+// current time. It returns nil if no push annotations are configured
+func (server *MultiTenantServer) pushAnnotations(c *gin.Context) map[string]string {
+	if len(server.PushAnnotations) == 0 {
+		return nil
+	}
+	replacer := strings.NewReplacer(
+		pushAnnotationIdentity, cm_router.Identity(c),
+		pushAnnotationTime, time.Now().UTC().Format(time.RFC3339),
+	)
+	annotations := map[string]string{}
+	for key, value := range server.PushAnnotations {
+		annotations[key] = replacer.Replace(value)
+	}
+	return annotations
+}
+
+func chartAnnotationsPath(repo string, filename string) string {
+	return pathutil.Join(repo, filename+chartAnnotationsSuffix)
+}
+
+// storeChartAnnotations stores the annotations of a chart package, if it has any. They are
+// stored once the package itself is, see storeChartSidecars. A package overwritten by one
+// without annotations loses those of the package it replaced
+func (server *MultiTenantServer) storeChartAnnotations(repo string, filename string, annotations map[string]string, overwritten bool) error {
+	if len(annotations) == 0 {
+		if overwritten {
+			// ignore error here, the package replaced may have had no annotations
+			server.StorageBackend.DeleteObject(chartAnnotationsPath(repo, filename))
+		}
+		return nil
+	}
+	content, err := yaml.Marshal(annotations)
+	if err != nil {
+		return err
+	}
+	return server.StorageBackend.PutObject(chartAnnotationsPath(repo, filename), content)
+}
+
+// removeChartAnnotations removes the annotations stored for a chart package whose upload
+// was undone
+func (server *MultiTenantServer) removeChartAnnotations(repo string, filename string, annotations map[string]string) {
+	if len(annotations) > 0 {
+		server.StorageBackend.DeleteObject(chartAnnotationsPath(repo, filename))
+	}
+}
+
+// chartAnnotations reads the annotations stored for a chart package. A package which was
+// pushed without annotations has none
+func (server *MultiTenantServer) chartAnnotations(repo string, filename string) map[string]string {
+	object, err := server.StorageBackend.GetObject(chartAnnotationsPath(repo, filename))
+	if err != nil {
+		return nil
+	}
+	annotations := map[string]string{}
+	if err := yaml.Unmarshal(object.Content, &annotations); err != nil {
+		return nil
+	}
+	return annotations
+}
+
+// withAnnotations returns chartVersion with annotations merged into its metadata, taking
+// precedence over the annotations from its Chart.yaml. The metadata is copied, as it
+// may be shared with a spooled upload
+func withAnnotations(chartVersion *helm_repo.ChartVersion, annotations map[string]string) *helm_repo.ChartVersion {
+	if len(annotations) == 0 {
+		return chartVersion
+	}
+	meta := *chartVersion.Metadata
+	meta.Annotations = map[string]string{}
+	for key, value := range chartVersion.Metadata.Annotations {
+		meta.Annotations[key] = value
+	}
+	for key, value := range annotations {
+		meta.Annotations[key] = value
+	}
+	merged := *chartVersion
+	merged.Metadata = &meta
+	return &merged
+}
@@ -17,11 +17,18 @@ limitations under the License.
 package multitenant
 
 import (
+	"fmt"
+	"net/url"
 	pathutil "path/filepath"
+	"sort"
+	"strings"
 
 	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+	cm_storage "github.com/helm/chartmuseum/pkg/storage"
 
+	"github.com/Masterminds/semver"
+	helm_chart "k8s.io/helm/pkg/proto/hapi/chart"
 	helm_repo "k8s.io/helm/pkg/repo"
 )
 
@@ -33,18 +40,184 @@ func (server *MultiTenantServer) getAllCharts(log cm_logger.LoggingFn, repo stri
 	return indexFile.Entries, nil
 }
 
+// chartListQueryParams are the query params accepted when listing charts
+var chartListQueryParams = map[string]bool{
+	"offset":     true,
+	"limit":      true,
+	"annotation": true,
+	"keyword":    true,
+}
+
+type chartVersionFilter func(*helm_repo.ChartVersion) bool
+
+/*
+parseChartFilters builds filters from the query params of a chart listing request, e.g.
+
+	?annotation=team=payments&keyword=database
+
+Each param may be given more than once. Unknown params are rejected.
+*/
+func parseChartFilters(query url.Values) ([]chartVersionFilter, *HTTPError) {
+	var filters []chartVersionFilter
+	for key, values := range query {
+		if !chartListQueryParams[key] {
+			return nil, &HTTPError{400, fmt.Sprintf("unknown query parameter \"%s\": must be one of annotation, keyword, offset, limit", key)}
+		}
+		for _, value := range values {
+			switch key {
+			case "annotation":
+				parts := strings.SplitN(value, "=", 2)
+				if len(parts) != 2 || parts[0] == "" {
+					return nil, &HTTPError{400, fmt.Sprintf("invalid annotation filter \"%s\": expected key=value", value)}
+				}
+				annotationKey, annotationValue := parts[0], parts[1]
+				filters = append(filters, func(chartVersion *helm_repo.ChartVersion) bool {
+					return chartVersion.Annotations[annotationKey] == annotationValue
+				})
+			case "keyword":
+				keyword := value
+				filters = append(filters, func(chartVersion *helm_repo.ChartVersion) bool {
+					for _, k := range chartVersion.Keywords {
+						if k == keyword {
+							return true
+						}
+					}
+					return false
+				})
+			}
+		}
+	}
+	return filters, nil
+}
+
+// filterCharts keeps the chart versions matching all filters, dropping charts left with no versions
+func filterCharts(allCharts map[string]helm_repo.ChartVersions, filters []chartVersionFilter) map[string]helm_repo.ChartVersions {
+	if len(filters) == 0 {
+		return allCharts
+	}
+	filtered := map[string]helm_repo.ChartVersions{}
+	for name, chartVersions := range allCharts {
+		var matched helm_repo.ChartVersions
+		for _, chartVersion := range chartVersions {
+			isMatch := true
+			for _, filter := range filters {
+				if !filter(chartVersion) {
+					isMatch = false
+					break
+				}
+			}
+			if isMatch {
+				matched = append(matched, chartVersion)
+			}
+		}
+		if len(matched) > 0 {
+			filtered[name] = matched
+		}
+	}
+	return filtered
+}
+
+// paginateCharts returns the charts from offset to offset+limit, ordered by name,
+// along with the total number of charts. A limit of 0 returns all charts from offset
+func paginateCharts(allCharts map[string]helm_repo.ChartVersions, offset int, limit int) (map[string]helm_repo.ChartVersions, int) {
+	names := make([]string, 0, len(allCharts))
+	for name := range allCharts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	total := len(names)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+
+	page := map[string]helm_repo.ChartVersions{}
+	for _, name := range names[offset:end] {
+		page[name] = allCharts[name]
+	}
+	return page, total
+}
+
+// searchCharts returns the latest version of each chart whose name, description or keywords
+// contain query (case-insensitive), sorted by name. A limit of 0 returns all matches
+func (server *MultiTenantServer) searchCharts(log cm_logger.LoggingFn, repo string, query string, limit int) ([]*helm_repo.ChartVersion, *HTTPError) {
+	allCharts, err := server.getAllCharts(log, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	query = strings.ToLower(query)
+	results := []*helm_repo.ChartVersion{}
+	for _, chartVersions := range allCharts {
+		if len(chartVersions) == 0 {
+			continue
+		}
+		latest := chartVersions[0]
+		if chartVersionMatchesQuery(latest, query) {
+			results = append(results, latest)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func chartVersionMatchesQuery(chartVersion *helm_repo.ChartVersion, query string) bool {
+	if strings.Contains(strings.ToLower(chartVersion.Name), query) ||
+		strings.Contains(strings.ToLower(chartVersion.Description), query) {
+		return true
+	}
+	for _, keyword := range chartVersion.Keywords {
+		if strings.Contains(strings.ToLower(keyword), query) {
+			return true
+		}
+	}
+	return false
+}
+
 func (server *MultiTenantServer) getChart(log cm_logger.LoggingFn, repo string, name string) (helm_repo.ChartVersions, *HTTPError) {
 	allCharts, err := server.getAllCharts(log, repo)
 	if err != nil {
 		return nil, err
 	}
-	chart := allCharts[name]
+	chart := allCharts[server.chartName(allCharts, name)]
 	if chart == nil {
 		return nil, &HTTPError{404, "chart not found"}
 	}
 	return chart, nil
 }
 
+// chartName returns the name of the chart in entries that name refers to. With
+// IgnoreChartNameCase, a name not found is matched with a chart name differing only by
+// case, unless several do
+func (server *MultiTenantServer) chartName(entries map[string]helm_repo.ChartVersions, name string) string {
+	if _, ok := entries[name]; ok || !server.IgnoreChartNameCase {
+		return name
+	}
+	match := name
+	found := 0
+	for entryName := range entries {
+		if strings.EqualFold(entryName, name) {
+			match = entryName
+			found++
+		}
+	}
+	if found != 1 {
+		return name
+	}
+	return match
+}
+
 func (server *MultiTenantServer) getChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) (*helm_repo.ChartVersion, *HTTPError) {
 	indexFile, err := server.getIndexFile(log, repo)
 	if err != nil {
@@ -53,7 +226,7 @@ func (server *MultiTenantServer) getChartVersion(log cm_logger.LoggingFn, repo s
 	if version == "latest" {
 		version = ""
 	}
-	chartVersion, getErr := indexFile.Get(name, version)
+	chartVersion, getErr := indexFile.Get(server.chartName(indexFile.Entries, name), version)
 	if getErr != nil {
 		return nil, &HTTPError{404, getErr.Error()}
 	}
@@ -65,53 +238,118 @@ func (server *MultiTenantServer) deleteChartVersion(log cm_logger.LoggingFn, rep
 	log(cm_logger.DebugLevel, "Deleting package from storage",
 		"package", filename,
 	)
+	var digest string
+	if server.webhooks != nil {
+		// the digest is sent along with the delete event, so it is taken from the cached index
+		// before the chart version is removed from it
+		digest = server.cachedChartVersionDigest(log, repo, name, version)
+	}
 	deleteObjErr := server.StorageBackend.DeleteObject(filename)
 	if deleteObjErr != nil {
 		return &HTTPError{404, deleteObjErr.Error()}
 	}
 	provFilename := pathutil.Join(repo, cm_repo.ProvenanceFilenameFromNameVersion(name, version))
 	server.StorageBackend.DeleteObject(provFilename) // ignore error here, may be no prov file
+	// nor here, the chart may have been pushed without annotations, or put in storage directly
+	server.StorageBackend.DeleteObject(chartAnnotationsPath(repo, pathutil.Base(filename)))
+	server.removeChartPushTime(repo, pathutil.Base(filename))
+	server.updateIndexEntry(log, repo, &helm_repo.ChartVersion{
+		Metadata: &helm_chart.Metadata{Name: name, Version: version},
+	}, true)
+	server.notifyChartDeleted(repo, name, version, digest)
 	return nil
 }
 
-func (server *MultiTenantServer) uploadChartPackage(log cm_logger.LoggingFn, repo string, content []byte, force bool) *HTTPError {
-	filename, err := cm_repo.ChartPackageFilenameFromContent(content)
+// cachedChartVersionDigest returns the digest of a chart version in the cached index of repo,
+// without bringing the index up to date with storage, or "" if it is not in there
+func (server *MultiTenantServer) cachedChartVersionDigest(log cm_logger.LoggingFn, repo string, name string, version string) string {
+	entry, err := server.initCacheEntry(log, repo)
 	if err != nil {
-		return &HTTPError{500, err.Error()}
+		return ""
 	}
-	if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
-		_, err = server.StorageBackend.GetObject(pathutil.Join(repo, filename))
-		if err == nil {
-			return &HTTPError{409, "file already exists"}
-		}
+	chartVersion, getErr := entry.RepoIndex.Get(name, version)
+	if getErr != nil {
+		return ""
 	}
-	limitReached, err := server.checkStorageLimit(repo, filename, force)
+	return chartVersion.Digest
+}
+
+// deleteChartVersions deletes every version of a chart matching the semver constraint, or
+// every version of the chart if the constraint is nil.
+// A failure does not stop the remaining versions from being deleted, the versions which
+// could not be deleted are returned along with their errors
+func (server *MultiTenantServer) deleteChartVersions(log cm_logger.LoggingFn, repo string, name string, constraint *semver.Constraints) ([]string, map[string]string, *HTTPError) {
+	chart, err := server.getChart(log, repo, name)
 	if err != nil {
-		return &HTTPError{500, err.Error()}
+		return nil, nil, err
 	}
-	if limitReached {
-		return &HTTPError{507, "repo has reached storage limit"}
+	deleted := []string{}
+	failed := map[string]string{}
+	for _, chartVersion := range chart {
+		if constraint != nil {
+			version, parseErr := semver.NewVersion(chartVersion.Version)
+			if parseErr != nil || !constraint.Check(version) {
+				continue
+			}
+		}
+		if deleteErr := server.deleteChartVersion(log, repo, name, chartVersion.Version); deleteErr != nil {
+			failed[chartVersion.Version] = deleteErr.Message
+			continue
+		}
+		deleted = append(deleted, chartVersion.Version)
 	}
-	log(cm_logger.DebugLevel,"Adding package to storage",
-		"package", filename,
-	)
-	err = server.StorageBackend.PutObject(pathutil.Join(repo, filename), content)
-	if err != nil {
-		return &HTTPError{500, err.Error()}
+	return deleted, failed, nil
+}
+
+// verifyChartDigest returns a 400 if the client sent the expected sha256 digest of a chart
+// package and it does not match the digest of the received content. Nothing is checked if
+// expected is empty
+func (server *MultiTenantServer) verifyChartDigest(log cm_logger.LoggingFn, repo string, digest string, expected string) *HTTPError {
+	if expected == "" {
+		return nil
+	}
+	expected = strings.ToLower(strings.TrimPrefix(expected, "sha256:"))
+	if digest != expected {
+		log(cm_logger.WarnLevel, "Chart package does not match expected digest",
+			"repo", repo,
+			"expected", expected,
+			"digest", digest,
+		)
+		chartDigestMismatchCounterVec.WithLabelValues(repo).Inc()
+		return &HTTPError{400, fmt.Sprintf("chart package digest %s does not match expected digest %s", digest, expected)}
 	}
 	return nil
 }
 
+// chartVersionStored adds a newly stored chart version to the repo index and sends
+// out a push notification
+func (server *MultiTenantServer) chartVersionStored(log cm_logger.LoggingFn, repo string, chartVersion *helm_repo.ChartVersion) {
+	server.updateIndexEntry(log, repo, chartVersion, false)
+	server.notifyChartPushed(repo, chartVersion)
+}
+
+// chartPackageLocation returns the url a chart version pushed to repo is downloaded from, for
+// the Location header: its url in index.yaml, from the root of the server if it is relative
+func (server *MultiTenantServer) chartPackageLocation(repo string, name string, version string) string {
+	index := &cm_repo.Index{
+		RepoName:         repo,
+		ChartURL:         server.repositoryChartURL(repo),
+		ChartURLTemplate: server.ChartURLTemplate,
+	}
+	location := index.ChartPackageURL(name, version)
+	if !strings.HasPrefix(location, "/") && !strings.Contains(location, "://") {
+		location = "/" + pathutil.Join(repo, location)
+	}
+	return location
+}
+
 func (server *MultiTenantServer) uploadProvenanceFile(log cm_logger.LoggingFn, repo string, content []byte, force bool) *HTTPError {
 	filename, err := cm_repo.ProvenanceFilenameFromContent(content)
 	if err != nil {
 		return &HTTPError{500, err.Error()}
 	}
-	if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
-		_, err = server.StorageBackend.GetObject(pathutil.Join(repo, filename))
-		if err == nil {
-			return &HTTPError{409, "file already exists"}
-		}
+	if _, overwriteErr := server.checkOverwrite(log, pathutil.Join(repo, filename), force); overwriteErr != nil {
+		return overwriteErr
 	}
 	limitReached, err := server.checkStorageLimit(repo, filename, force)
 	if err != nil {
@@ -130,12 +368,89 @@ func (server *MultiTenantServer) uploadProvenanceFile(log cm_logger.LoggingFn, r
 	return nil
 }
 
+// checkOverwrite returns a 409 if the object already exists and may not be overwritten,
+// otherwise overwrites are allowed but logged as a warning. It reports whether the object
+// exists, i.e. is overwritten
+func (server *MultiTenantServer) checkOverwrite(log cm_logger.LoggingFn, path string, force bool) (bool, *HTTPError) {
+	if !server.objectExists(path) {
+		return false, nil // nothing to overwrite
+	}
+	if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
+		return true, &HTTPError{409, "file already exists"}
+	}
+	log(cm_logger.WarnLevel, "Overwriting existing object in storage",
+		"object", path,
+		"force", force,
+	)
+	return true, nil
+}
+
+// objectExists reports whether an object is in storage, without fetching it from the backends
+// which can look it up
+func (server *MultiTenantServer) objectExists(path string) bool {
+	if stater, ok := server.StorageBackend.(cm_storage.Stater); ok {
+		if _, err := stater.StatObject(path); err != cm_storage.ErrStatNotSupported {
+			return err == nil
+		}
+	}
+	_, err := server.StorageBackend.GetObject(path)
+	return err == nil
+}
+
+// checkVersionLimit returns a 409 if storing the chart version would give the chart more versions
+// in the repo than MaxVersionsPerChart. Every repo is limited on its own, and a version which is
+// already in the index is overwritten rather than added, so it is always let through
+func (server *MultiTenantServer) checkVersionLimit(log cm_logger.LoggingFn, repo string, name string, version string) *HTTPError {
+	if server.MaxVersionsPerChart <= 0 {
+		return nil
+	}
+	index, err := server.getIndexFile(log, repo)
+	if err != nil {
+		return err
+	}
+	versions := index.Entries[name]
+	for _, chartVersion := range versions {
+		if chartVersion.Version == version {
+			return nil
+		}
+	}
+	if len(versions) >= server.MaxVersionsPerChart {
+		log(cm_logger.WarnLevel, "Chart has reached the max number of versions",
+			"repo", repo,
+			"chart", name,
+			"versions", len(versions),
+		)
+		return &HTTPError{409, fmt.Sprintf("chart %s already has %d versions, the maximum per chart", name, len(versions))}
+	}
+	return nil
+}
+
+// checkChartName returns a 400 if the chart name does not match the allowed chart name regex
+func (server *MultiTenantServer) checkChartName(log cm_logger.LoggingFn, repo string, name string) *HTTPError {
+	allowed := server.Router.AllowedChartNames
+	if allowed == nil || allowed.MatchString(name) {
+		return nil
+	}
+	log(cm_logger.WarnLevel, "Chart name not allowed",
+		"repo", repo,
+		"chart", name,
+	)
+	return &HTTPError{400, fmt.Sprintf("chart name %s does not match the allowed chart name regex %s", name, allowed.String())}
+}
+
 func (server *MultiTenantServer) checkStorageLimit(repo string, filename string, force bool) (bool, error) {
 	if server.MaxStorageObjects > 0 {
-		allObjects, err := server.StorageBackend.ListObjects(repo)
+		listedObjects, err := server.StorageBackend.ListObjects(repo)
 		if err != nil {
 			return false, err
 		}
+		// the objects stored alongside chart packages do not count
+		var allObjects []cm_storage.Object
+		for _, object := range listedObjects {
+			if !isChartSidecar(object.Path) {
+				allObjects = append(allObjects, object)
+			}
+		}
 		if len(allObjects) >= server.MaxStorageObjects {
 			limitReached := true
 			if server.AllowOverwrite || (server.AllowForceOverwrite && force) {
@@ -0,0 +1,156 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	cm_router "github.com/helm/chartmuseum/pkg/chartmuseum/router"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+	cm_storage "github.com/helm/chartmuseum/pkg/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// auditChartsContextKey holds the chart versions a write request is about, as noted by its handler
+	auditChartsContextKey = "auditcharts"
+	// auditedContextKey is set once the request got to the handler of an audited route
+	auditedContextKey = "audited"
+
+	auditResultSuccess = "success"
+	auditResultFailure = "failure"
+)
+
+type (
+	// auditLog writes an entry for each push and delete, as JSON lines
+	auditLog struct {
+		mu      sync.Mutex
+		encoder *json.Encoder
+	}
+
+	auditEntry struct {
+		Time      time.Time           `json:"time"`
+		RequestID string              `json:"requestID"`
+		Identity  string              `json:"identity,omitempty"`
+		ClientIP  string              `json:"clientIP"`
+		Method    string              `json:"method"`
+		Route     string              `json:"route"`
+		Repo      string              `json:"repo"`
+		Charts    []auditChartVersion `json:"charts,omitempty"`
+		Status    int                 `json:"status"`
+		Result    string              `json:"result"`
+	}
+
+	auditChartVersion struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+)
+
+func newAuditLog(writer io.Writer) *auditLog {
+	return &auditLog{encoder: json.NewEncoder(writer)}
+}
+
+func (audit *auditLog) write(entry auditEntry) error {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	return audit.encoder.Encode(entry)
+}
+
+// audited wraps the handler of a write route, so that an audit entry is written once the
+// request is handled. Requests only get to the handler once they are authorized
+func (server *MultiTenantServer) audited(handler gin.HandlerFunc) gin.HandlerFunc {
+	if server.audit == nil {
+		return handler
+	}
+	return func(c *gin.Context) {
+		c.Set(auditedContextKey, true)
+		handler(c)
+	}
+}
+
+// auditMiddleware writes the audit entry of a request to an audited route once the router is
+// done with it, so that the entry has the status it was answered with, even when the router
+// answers for the handler (e.g. with a 413 for a body found too large)
+func (server *MultiTenantServer) auditMiddleware(c *gin.Context) {
+	c.Next()
+	if c.GetBool(auditedContextKey) {
+		server.writeAuditEntry(c)
+	}
+}
+
+func (server *MultiTenantServer) writeAuditEntry(c *gin.Context) {
+	status := c.Writer.Status()
+	entry := auditEntry{
+		Time:      time.Now().UTC(),
+		RequestID: cm_router.RequestID(c),
+		Identity:  cm_router.Identity(c),
+		ClientIP:  cm_router.ClientIP(c),
+		Method:    c.Request.Method,
+		Route:     cm_router.RouteTemplate(c),
+		Repo:      c.Param("repo"),
+		Status:    status,
+		Result:    auditResultSuccess,
+	}
+	if status >= 400 {
+		entry.Result = auditResultFailure
+	}
+	if charts, ok := c.Get(auditChartsContextKey); ok {
+		entry.Charts = charts.([]auditChartVersion)
+	} else if name := c.Param("name"); name != "" {
+		version := c.Param("version")
+		if version == "" {
+			version = c.Param("reference") // OCI manifests are pushed by tag
+		}
+		entry.Charts = []auditChartVersion{{Name: name, Version: version}}
+	}
+	if err := server.audit.write(entry); err != nil {
+		server.Logger.Errorc(c, "Could not write audit entry",
+			"error", err.Error(),
+		)
+	}
+}
+
+// auditChartVersion notes a chart version the write request is about, for its audit entry
+func (server *MultiTenantServer) auditChartVersion(c *gin.Context, name string, version string) {
+	if server.audit == nil {
+		return
+	}
+	var charts []auditChartVersion
+	if noted, ok := c.Get(auditChartsContextKey); ok {
+		charts = noted.([]auditChartVersion)
+	}
+	c.Set(auditChartsContextKey, append(charts, auditChartVersion{Name: name, Version: version}))
+}
+
+// auditChartFile notes the chart version of a chart package or provenance file, by its filename
+func (server *MultiTenantServer) auditChartFile(c *gin.Context, filename string) {
+	if server.audit == nil {
+		return
+	}
+	filename = strings.TrimSuffix(filename, ".prov")
+	chartVersion, err := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{Path: filename})
+	if err != nil {
+		return
+	}
+	server.auditChartVersion(c, chartVersion.Name, chartVersion.Version)
+}
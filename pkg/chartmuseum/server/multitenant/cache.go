@@ -33,14 +33,15 @@ _.-'  \        ( \___
 */
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "github.com/helm/chartmuseum/pkg/repo"
 	cm_storage "github.com/helm/chartmuseum/pkg/storage"
 	pathutil "path"
 	"sync"
+	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/gin-gonic/gin"
@@ -52,9 +53,18 @@ type (
 		// cryptic JSON field names to minimize size saved in cache
 		RepoName  string         `json:"a"`
 		RepoIndex *cm_repo.Index `json:"b"`
+		// modification times in storage of the chart packages in the index, by filename, which
+		// changes in storage are detected by. The created time of a chart version is when it
+		// was pushed, and is only compared with storage for packages missing here
+		ModTimes map[string]time.Time `json:"c,omitempty"`
 	}
 )
 
+const (
+	// index regeneration workers used when IndexLimit is not set
+	defaultIndexWorkers = 64
+)
+
 var (
 	EntrySavedMessage             = "Entry saved in cache store"
 	CouldNotSaveEntryErrorMessage = "Could not save entry in cache store"
@@ -75,7 +85,7 @@ func (server *MultiTenantServer) primeCache() error {
 // getChartList fetches from the server and accumulates concurrent requests to be fulfilled all at once.
 func (server *MultiTenantServer) getChartList(log cm_logger.LoggingFn, repo string) <-chan fetchedObjects {
 	ch := make(chan fetchedObjects, 1)
-	tenant := server.Tenants[repo]
+	tenant := server.getTenant(repo)
 
 	tenant.FetchedObjectsLock.Lock()
 	tenant.FetchedObjectsChans = append(tenant.FetchedObjectsChans, ch)
@@ -101,16 +111,18 @@ func (server *MultiTenantServer) getChartList(log cm_logger.LoggingFn, repo stri
 	return ch
 }
 
-func (server *MultiTenantServer) regenerateRepositoryIndex(log cm_logger.LoggingFn, entry *cacheEntry, diff cm_storage.ObjectSliceDiff) <-chan indexRegeneration {
+// regenerateRepositoryIndex applies diff to the index of entry. Chart versions read from storage
+// keep the created time they have in previous, as long as their package is the same
+func (server *MultiTenantServer) regenerateRepositoryIndex(log cm_logger.LoggingFn, entry *cacheEntry, previous *cm_repo.Index, diff cm_storage.ObjectSliceDiff) <-chan indexRegeneration {
 	ch := make(chan indexRegeneration, 1)
-	tenant := server.Tenants[entry.RepoName]
+	tenant := server.getTenant(entry.RepoName)
 
 	tenant.RegenerationLock.Lock()
 	tenant.RegeneratedIndexesChans = append(tenant.RegeneratedIndexesChans, ch)
 
 	if len(tenant.RegeneratedIndexesChans) == 1 {
 		tenant.RegenerationLock.Unlock()
-		index, err := server.regenerateRepositoryIndexWorker(log, entry, diff)
+		index, err := server.regenerateRepositoryIndexWorker(log, entry, previous, diff)
 		tenant.RegenerationLock.Lock()
 		for _, riCh := range tenant.RegeneratedIndexesChans {
 			riCh <- indexRegeneration{index, err}
@@ -123,18 +135,17 @@ func (server *MultiTenantServer) regenerateRepositoryIndex(log cm_logger.Logging
 	return ch
 }
 
-func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.LoggingFn, entry *cacheEntry, diff cm_storage.ObjectSliceDiff) (*cm_repo.Index, error) {
+func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.LoggingFn, entry *cacheEntry, previous *cm_repo.Index, diff cm_storage.ObjectSliceDiff) (*cm_repo.Index, error) {
 	repo := entry.RepoName
 
 	log(cm_logger.DebugLevel, "Regenerating index.yaml",
 		"repo", repo,
 	)
-	index := &cm_repo.Index{
-		IndexFile: entry.RepoIndex.IndexFile,
-		RepoName:  repo,
-		Raw:       entry.RepoIndex.Raw,
-		ChartURL:  entry.RepoIndex.ChartURL,
-	}
+	// the cached index may be served while it is regenerated, so a copy of it is changed
+	index := entry.RepoIndex.Clone()
+	index.RepoName = repo
+	index.VersionOrder = server.IndexVersionOrder
+	index.ChartURLTemplate = server.ChartURLTemplate
 
 	for _, object := range diff.Removed {
 		err := server.removeIndexObject(log, repo, index, object)
@@ -144,14 +155,14 @@ func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.L
 	}
 
 	for _, object := range diff.Updated {
-		err := server.updateIndexObject(log, repo, index, object)
+		err := server.updateIndexObject(log, repo, index, previous, object)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	// Parallelize retrieval of added objects to improve speed
-	err := server.addIndexObjectsAsync(log, repo, index, diff.Added)
+	err := server.addIndexObjectsAsync(log, repo, index, previous, diff.Added)
 	if err != nil {
 		return nil, err
 	}
@@ -165,8 +176,9 @@ func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.L
 		"repo", repo,
 	)
 
-	entry.RepoIndex = index
-	err = server.saveCacheEntry(log, entry)
+	regenerated := entry.withIndex(index)
+	regenerated.updateModTimes(diff)
+	err = server.saveCacheEntry(log, regenerated)
 	return index, err
 }
 
@@ -180,12 +192,20 @@ func (server *MultiTenantServer) fetchChartsInStorage(log cm_logger.LoggingFn, r
 	}
 
 	// filter out storage objects that dont have extension used for chart packages (.tgz)
+	// every object counts towards the storage used by the repo, not only chart packages
+	var size int64
 	filteredObjects := []cm_storage.Object{}
+	sidecars := map[string]bool{}
 	for _, object := range allObjects {
+		size += object.Size
 		if object.HasExtension(cm_repo.ChartPackageFileExtension) {
 			filteredObjects = append(filteredObjects, object)
+		} else if isChartSidecar(object.Path) {
+			sidecars[object.Path] = true
 		}
 	}
+	server.setStorageUsage(log, repo, size)
+	server.setChartSidecars(repo, sidecars)
 
 	return filteredObjects, nil
 }
@@ -204,11 +224,12 @@ func (server *MultiTenantServer) removeIndexObject(log cm_logger.LoggingFn, repo
 	return nil
 }
 
-func (server *MultiTenantServer) updateIndexObject(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, object cm_storage.Object) error {
+func (server *MultiTenantServer) updateIndexObject(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, previous *cm_repo.Index, object cm_storage.Object) error {
 	chartVersion, err := server.getObjectChartVersion(repo, object, true)
 	if err != nil {
 		return server.checkInvalidChartPackageError(log, repo, object, err, "updated")
 	}
+	chartVersion.Created = pushTime(previous, chartVersion)
 	log(cm_logger.DebugLevel, "Updating chart in index",
 		"repo", repo,
 		"name", chartVersion.Name,
@@ -218,72 +239,107 @@ func (server *MultiTenantServer) updateIndexObject(log cm_logger.LoggingFn, repo
 	return nil
 }
 
-func (server *MultiTenantServer) addIndexObjectsAsync(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, objects []cm_storage.Object) error {
+func (server *MultiTenantServer) addIndexObjectsAsync(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, previous *cm_repo.Index, objects []cm_storage.Object) error {
 	numObjects := len(objects)
 	if numObjects == 0 {
 		return nil
 	}
 
+	numWorkers := server.IndexLimit
+	if numWorkers <= 0 {
+		numWorkers = defaultIndexWorkers
+	}
+	if numWorkers > numObjects {
+		numWorkers = numObjects
+	}
+
 	log(cm_logger.DebugLevel, "Loading charts packages from storage (this could take awhile)",
 		"repo", repo,
 		"total", numObjects,
+		"workers", numWorkers,
 	)
 
-	type cvResult struct {
-		cv  *helm_repo.ChartVersion
-		err error
+	// Results are stored by position, so that entries are added to the index in the same
+	// order regardless of which fetch completes first
+	chartVersions := make([]*helm_repo.ChartVersion, numObjects)
+	errs := make([]error, numObjects)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				chartVersions[i], errs[i] = server.loadIndexObject(log, repo, objects[i])
+			}
+		}()
 	}
 
-	cvChan := make(chan cvResult)
-
-	// Provide a mechanism to short-circuit object downloads in case of error
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	for _, object := range objects {
-		go func(o cm_storage.Object) {
-			if server.IndexLimit != 0 {
-				// Limit parallelism to the index-limit parameter value
-				// if there are more than IndexLimit concurrent fetches, this send will block
-				server.Limiter <- struct{}{}
-				// once work is over, read one Limiter channel item to allow other workers to continue
-				defer func() { <-server.Limiter }()
-			}
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				chartVersion, err := server.getObjectChartVersion(repo, o, true)
-				if err != nil {
-					err = server.checkInvalidChartPackageError(log, repo, o, err, "added")
-					if err != nil {
-						cancel()
-					}
-				}
-				cvChan <- cvResult{chartVersion, err}
+	for i := range objects {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// an index missing the chart packages which could not be fetched would be served as if
+	// they were gone, so the index is not changed until they can all be fetched
+	var failed int
+	var firstErr error
+	for _, err := range errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
 			}
-		}(object)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not load %d of %d chart packages from storage: %s", failed, numObjects, firstErr)
 	}
 
-	for validCount := 0; validCount < numObjects; validCount++ {
-		cvRes := <-cvChan
-		if cvRes.err != nil {
-			return cvRes.err
-		}
-		if cvRes.cv == nil {
+	for _, chartVersion := range chartVersions {
+		if chartVersion == nil {
 			continue
 		}
+		chartVersion.Created = pushTime(previous, chartVersion)
 		log(cm_logger.DebugLevel, "Adding chart to index",
 			"repo", repo,
-			"name", cvRes.cv.Name,
-			"version", cvRes.cv.Version,
+			"name", chartVersion.Name,
+			"version", chartVersion.Version,
 		)
-		index.AddEntry(cvRes.cv)
+		index.AddEntry(chartVersion)
 	}
 
 	return nil
 }
 
+// loadIndexObject fetches a chart package and extracts its metadata. An invalid package is
+// logged and nil is returned, so that one bad package does not stop the index from being
+// regenerated. A failure to fetch the package is logged and returned
+func (server *MultiTenantServer) loadIndexObject(log cm_logger.LoggingFn, repo string, object cm_storage.Object) (*helm_repo.ChartVersion, error) {
+	if server.IndexLimit != 0 {
+		// Limit parallelism across all tenants to the index-limit parameter value
+		// if there are more than IndexLimit concurrent fetches, this send will block
+		server.Limiter <- struct{}{}
+		// once work is over, read one Limiter channel item to allow other workers to continue
+		defer func() { <-server.Limiter }()
+	}
+	chartVersion, err := server.getObjectChartVersion(repo, object, true)
+	if err != nil {
+		err = server.checkInvalidChartPackageError(log, repo, object, err, "added")
+		if err != nil {
+			log(cm_logger.ErrorLevel, "Could not load chart package from storage",
+				"repo", repo,
+				"package", object.Path,
+				"error", err.Error(),
+			)
+		}
+		return nil, err
+	}
+	return chartVersion, nil
+}
+
 func (server *MultiTenantServer) getObjectChartVersion(repo string, object cm_storage.Object, load bool) (*helm_repo.ChartVersion, error) {
 	op := object.Path
 	if load {
@@ -297,7 +353,78 @@ func (server *MultiTenantServer) getObjectChartVersion(repo string, object cm_st
 			return nil, cm_repo.ErrorInvalidChartPackage
 		}
 	}
-	return cm_repo.ChartVersionFromStorageObject(object)
+	chartVersion, err := cm_repo.ChartVersionFromStorageObject(object)
+	if err != nil || !load {
+		return chartVersion, err
+	}
+	// the sidecars are only fetched if the listing found them, most packages having neither
+	if server.hasChartSidecar(repo, op+chartPushTimeSuffix) {
+		if pushed, ok := server.chartPushTime(repo, op); ok {
+			chartVersion.Created = pushed
+		}
+	}
+	// annotations added on push are not in the package, so they are read alongside it, even
+	// once the option is no longer set
+	var annotations map[string]string
+	if server.hasChartSidecar(repo, op+chartAnnotationsSuffix) {
+		annotations = server.chartAnnotations(repo, op)
+	}
+	return withAnnotations(chartVersion, annotations), nil
+}
+
+// pushTime returns the created time of chartVersion, read from storage: the created time in the
+// previous index if the package is the same, which is when it was pushed, or else the push time
+// stored alongside the package, or the time the package was last modified in storage
+func pushTime(previous *cm_repo.Index, chartVersion *helm_repo.ChartVersion) time.Time {
+	if previous == nil || previous.IndexFile == nil {
+		return chartVersion.Created
+	}
+	for _, previousVersion := range previous.Entries[chartVersion.Name] {
+		if previousVersion.Version == chartVersion.Version && previousVersion.Digest == chartVersion.Digest &&
+			!previousVersion.Created.IsZero() {
+			return previousVersion.Created
+		}
+	}
+	return chartVersion.Created
+}
+
+// withIndex returns a copy of entry with index in place of its index, so that the entry can be
+// replaced in the cache store without changing the one other requests may be reading
+func (entry *cacheEntry) withIndex(index *cm_repo.Index) *cacheEntry {
+	modTimes := make(map[string]time.Time, len(entry.ModTimes))
+	for path, modTime := range entry.ModTimes {
+		modTimes[path] = modTime
+	}
+	return &cacheEntry{
+		RepoName:  entry.RepoName,
+		RepoIndex: index,
+		ModTimes:  modTimes,
+	}
+}
+
+// updateModTimes records the modification times of the chart packages added or updated by
+// diff, and forgets those of packages no longer in the index
+func (entry *cacheEntry) updateModTimes(diff cm_storage.ObjectSliceDiff) {
+	if entry.ModTimes == nil {
+		entry.ModTimes = map[string]time.Time{}
+	}
+	for _, object := range diff.Updated {
+		entry.ModTimes[object.Path] = object.LastModified
+	}
+	for _, object := range diff.Added {
+		entry.ModTimes[object.Path] = object.LastModified
+	}
+	indexed := map[string]bool{}
+	for _, chartVersions := range entry.RepoIndex.Entries {
+		for _, chartVersion := range chartVersions {
+			indexed[cm_repo.StorageObjectFromChartVersion(chartVersion).Path] = true
+		}
+	}
+	for path := range entry.ModTimes {
+		if !indexed[path] {
+			delete(entry.ModTimes, path)
+		}
+	}
 }
 
 func (server *MultiTenantServer) checkInvalidChartPackageError(log cm_logger.LoggingFn, repo string, object cm_storage.Object, err error, action string) error {
@@ -312,6 +439,31 @@ func (server *MultiTenantServer) checkInvalidChartPackageError(log cm_logger.Log
 	return err
 }
 
+// getTenant returns the internals of repo, or nil if its cache entry was never initialized
+func (server *MultiTenantServer) getTenant(repo string) *tenantInternals {
+	server.TenantCacheKeyLock.Lock()
+	defer server.TenantCacheKeyLock.Unlock()
+	return server.Tenants[repo]
+}
+
+// isKnownTenant reports whether repo was initialized and had charts in its index as last cached,
+// so that requests to repos which do not exist, whatever their depth, are not counted by tenant
+func (server *MultiTenantServer) isKnownTenant(repo string) bool {
+	tenant := server.getTenant(repo)
+	return tenant != nil && tenant.HasCharts
+}
+
+// initTenant returns the internals of repo, initializing its cache entry if it never was
+func (server *MultiTenantServer) initTenant(log cm_logger.LoggingFn, repo string) (*tenantInternals, error) {
+	if tenant := server.getTenant(repo); tenant != nil {
+		return tenant, nil
+	}
+	if _, err := server.initCacheEntry(log, repo); err != nil {
+		return nil, err
+	}
+	return server.getTenant(repo), nil
+}
+
 func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo string) (*cacheEntry, error) {
 	var entry *cacheEntry
 	var content []byte
@@ -324,6 +476,7 @@ func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo st
 		server.Tenants[repo] = &tenantInternals{
 			FetchedObjectsLock: &sync.Mutex{},
 			RegenerationLock:   &sync.Mutex{},
+			LastRebuilt:        time.Now(),
 		}
 	}
 
@@ -372,15 +525,26 @@ func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo st
 		if err != nil {
 			return nil, err
 		}
+
+		// the index may have been built by another instance sharing the cache store
+		entry.RepoIndex.UpdateMetrics()
 	}
 
+	server.Tenants[repo].HasCharts = len(entry.RepoIndex.Entries) > 0
 	return entry, nil
 }
 
 func (server *MultiTenantServer) saveCacheEntry(log cm_logger.LoggingFn, entry *cacheEntry) error {
 	repo := entry.RepoName
+	server.TenantCacheKeyLock.Lock()
+	if tenant, ok := server.Tenants[repo]; ok {
+		tenant.HasCharts = len(entry.RepoIndex.Entries) > 0
+	}
+	server.TenantCacheKeyLock.Unlock()
 	if server.ExternalCacheStore == nil {
+		server.TenantCacheKeyLock.Lock()
 		server.InternalCacheStore[repo] = entry
+		server.TenantCacheKeyLock.Unlock()
 		log(cm_logger.DebugLevel, EntrySavedMessage,
 			"repo", repo,
 		)
@@ -399,12 +563,13 @@ func (server *MultiTenantServer) saveCacheEntry(log cm_logger.LoggingFn, entry *
 			log(cm_logger.DebugLevel, EntrySavedMessage,
 				"repo", repo,
 			)
+			server.publishCacheEntry(log, repo)
 		}
 	}
 	return nil
 }
 
-func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, repo string) *cm_repo.Index {
+func (server *MultiTenantServer) repositoryChartURL(repo string) string {
 	var chartURL string
 	if server.ChartURL != "" {
 		chartURL = server.ChartURL
@@ -412,39 +577,95 @@ func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, rep
 			chartURL = chartURL + "/" + repo
 		}
 	}
+	return chartURL
+}
 
+// emptyRepositoryIndex returns an index with no charts, ignoring any statefile
+func (server *MultiTenantServer) emptyRepositoryIndex(repo string) *cm_repo.Index {
 	serverInfo := &cm_repo.ServerInfo{
 		ContextPath: server.Router.ContextPath,
 	}
+	return cm_repo.NewIndex(server.repositoryChartURL(repo), repo, serverInfo)
+}
 
+func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, repo string) *cm_repo.Index {
 	if !server.UseStatefiles {
-		return cm_repo.NewIndex(chartURL, repo, serverInfo)
+		return server.emptyRepositoryIndex(repo)
 	}
 
 	objectPath := pathutil.Join(repo, cm_repo.StatefileFilename)
 	object, err := server.StorageBackend.GetObject(objectPath)
 	if err != nil {
-		return cm_repo.NewIndex(chartURL, repo, serverInfo)
+		return server.emptyRepositoryIndex(repo)
 	}
+	chartURL := server.repositoryChartURL(repo)
 
+	raw, token := splitStatefile(object.Content)
 	indexFile := &cm_repo.IndexFile{}
-	err = yaml.Unmarshal(object.Content, indexFile)
+	err = yaml.Unmarshal(raw, indexFile)
 	if err != nil {
 		log(cm_logger.WarnLevel, "index-cache.yaml found but could not be parsed",
 			"repo", repo,
 			"error", err.Error(),
 		)
-		return cm_repo.NewIndex(chartURL, repo, serverInfo)
+		return server.emptyRepositoryIndex(repo)
 	}
 
 	log(cm_logger.DebugLevel, "index-cache.yaml loaded",
 		"repo", repo,
 	)
+	// the index is trusted only as long as storage still matches the token saved with it.
+	// This is called by initCacheEntry with the tenant lock held, so the tenant is read directly
+	tenant := server.Tenants[repo]
+	tenant.FetchedObjectsLock.Lock()
+	tenant.StorageToken = token
+	tenant.FetchedObjectsLock.Unlock()
 
 	return &cm_repo.Index{
 		IndexFile: indexFile,
 		RepoName: repo,
-		Raw: object.Content,
+		Raw: raw,
 		ChartURL: chartURL,
 	}
 }
+
+// publishCacheEntry tells other replicas sharing the external cache that the entry for repo
+// has changed, so that they check storage again on their next index request
+func (server *MultiTenantServer) publishCacheEntry(log cm_logger.LoggingFn, repo string) {
+	if server.cacheNotifier == nil {
+		return
+	}
+	if err := server.cacheNotifier.Publish(repo); err != nil {
+		log(cm_logger.WarnLevel, "Could not publish cache invalidation",
+			"repo", repo,
+			"error", err.Error(),
+		)
+	}
+}
+
+// invalidateTenant is called when another replica has changed the cache entry for repo.
+// Local state is no longer trusted, and the index is reconciled with storage right away, in
+// the background, rather than on the next index request
+func (server *MultiTenantServer) invalidateTenant(repo string) {
+	tenant := server.getTenant(repo)
+	if tenant == nil {
+		return
+	}
+	tenant.FetchedObjectsLock.Lock()
+	tenant.LastReconciled = time.Time{}
+	tenant.StorageToken = ""
+	tenant.FetchedObjectsLock.Unlock()
+	server.Logger.Debugw("Cache entry invalidated by another instance",
+		"repo", repo,
+	)
+	go func() {
+		log := server.Logger.ContextLoggingFn(&gin.Context{})
+		// an index unchanged by the reconciliation is not saved, so not published again
+		if _, err := server.getIndexFile(log, repo); err != nil {
+			log(cm_logger.WarnLevel, "Could not regenerate index invalidated by another instance",
+				"repo", repo,
+				"error", err.Message,
+			)
+		}
+	}()
+}
@@ -18,19 +18,34 @@ package multitenant
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
+	"mime"
 	"net/http"
 	pathutil "path"
+	"strconv"
+	"strings"
+	"time"
 
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+	cm_storage "github.com/helm/chartmuseum/pkg/storage"
+
+	"github.com/Masterminds/semver"
+)
+
+const (
+	contentSHA256Header = "X-Content-SHA256"
+	chartDigestHeader   = "X-Chart-Digest"
 )
 
 var (
 	objectSavedResponse   = gin.H{"saved": true}
 	objectDeletedResponse = gin.H{"deleted": true}
-	healthCheckResponse   = gin.H{"healthy": true}
+	readinessResponse     = gin.H{"ready": true}
 	welcomePageHTML       = []byte(`<!DOCTYPE html>
 <html>
 <head>
@@ -67,18 +82,43 @@ type (
 type (
 	chartOrProvenanceFile struct {
 		filename string
-		content  []byte
-		field    string // file was extracted from this form field
+		upload   *fileUpload // spooled to disk, only chart packages have metadata
+		field    string      // file was extracted from this form field
+		// overwritten is set if a file is already stored under filename
+		overwritten bool
 	}
-	filenameFromContentFn func([]byte) (string, error)
 )
 
 func (server *MultiTenantServer) getWelcomePageHandler(c *gin.Context) {
 	c.Data(200, "text/html", welcomePageHTML)
 }
 
+// getHealthCheckHandler reports build info and uptime, without touching storage
 func (server *MultiTenantServer) getHealthCheckHandler(c *gin.Context) {
-	c.JSON(200, healthCheckResponse)
+	uptime := time.Since(server.Router.StartTime)
+	c.JSON(200, gin.H{
+		"healthy":        true,
+		"version":        server.Router.Version,
+		"revision":       server.Router.Revision,
+		"uptime":         (uptime - uptime%time.Second).String(),
+		"uptime_seconds": int64(uptime.Seconds()),
+		"routes":         len(server.Router.Routes),
+		"maintenance":    server.Router.Maintenance(),
+	})
+}
+
+func (server *MultiTenantServer) getReadinessCheckHandler(c *gin.Context) {
+	if server.initialIndexBuilding() {
+		c.JSON(503, gin.H{"ready": false, "error": "the index is being built"})
+		return
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	err := server.checkStorageReadiness(log)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"ready": false, "error": err.Message})
+		return
+	}
+	c.JSON(200, readinessResponse)
 }
 
 func (server *MultiTenantServer) getIndexFileRequestHandler(c *gin.Context) {
@@ -89,30 +129,255 @@ func (server *MultiTenantServer) getIndexFileRequestHandler(c *gin.Context) {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
+	if checkIndexNotModified(c, indexFile, indexETag(indexFile)) {
+		return
+	}
 	c.Data(200, indexFileContentType, indexFile.Raw)
 }
 
+func (server *MultiTenantServer) getIndexJSONFileRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	indexFile, err := server.getIndexFile(log, repo)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	if checkIndexNotModified(c, indexFile, indexJSONETag(indexFile)) {
+		return
+	}
+	content, err := server.indexJSON(log, repo, indexFile)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.Data(200, indexJSONFileContentType, content)
+}
+
+// checkIndexNotModified sets the caching headers of an index response, and answers with a 304
+// if the client already has this version of the index
+func checkIndexNotModified(c *gin.Context, indexFile *cm_repo.Index, etag string) bool {
+	lastModified := indexFile.Generated.UTC()
+	c.Header("ETag", etag)
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+	if indexNotModified(c.Request, etag, lastModified) {
+		c.Status(304)
+		return true
+	}
+	return false
+}
+
+func (server *MultiTenantServer) getIndexSignatureRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	signature, err := server.getIndexSignature(log, repo)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.Header("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(signature)))
+	c.Data(200, provenanceFileContentType, signature)
+}
+
+func (server *MultiTenantServer) invalidateCacheRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	start := time.Now()
+	index, err := server.rebuildIndex(log, repo)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	versions := 0
+	for _, chartVersions := range index.Entries {
+		versions += len(chartVersions)
+	}
+	c.JSON(200, gin.H{
+		"rebuilt":  true,
+		"charts":   len(index.Entries),
+		"versions": versions,
+		"duration": time.Since(start).Seconds(),
+	})
+}
+
+func (server *MultiTenantServer) getReposRequestHandler(c *gin.Context) {
+	log := server.Logger.ContextLoggingFn(c)
+	repos, err := server.listRepos(log)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, gin.H{"repos": repos})
+}
+
+func (server *MultiTenantServer) postMaintenanceRequestHandler(c *gin.Context) {
+	enabled, err := strconv.ParseBool(c.Query("enabled"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "enabled=true or enabled=false is required"})
+		return
+	}
+	server.Router.SetMaintenance(enabled)
+	c.JSON(200, gin.H{"maintenance": enabled})
+}
+
+func (server *MultiTenantServer) getRepoStatsRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	stats, err := server.getRepoStats(log, repo)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, stats)
+}
+
 func (server *MultiTenantServer) getStorageObjectRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
 	filename := c.Param("filename")
 	log := server.Logger.ContextLoggingFn(c)
+	if url, ok := server.getStorageObjectRedirect(log, repo, filename); ok {
+		countChartPull(repo, filename)
+		c.Redirect(302, url)
+		return
+	}
 	storageObject, err := server.getStorageObject(log, repo, filename)
+	if err != nil && err.Status == 404 && server.upstream != nil && strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) {
+		storageObject, err = server.getUpstreamChartPackage(log, repo, filename)
+	}
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
-	c.Data(200, storageObject.ContentType, storageObject.Content)
+	setStorageObjectHeaders(c, filename, storageObject)
+	if !strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) {
+		c.Data(200, storageObject.ContentType, storageObject.Content)
+		return
+	}
+	serveChartPackage(c, storageObject)
+	if c.Writer.Status() == 200 {
+		countChartPull(repo, filename) // resumed downloads and 304s are not counted again
+	}
+}
+
+// serveChartPackage answers with the chart package, or the byte ranges of it asked for with
+// Range (206), so that interrupted downloads of large packages can be resumed. If-Range,
+// If-None-Match and If-Modified-Since are checked against the ETag and last modified time
+// of the package. Ranges are served from the copy of the package already read from storage
+func serveChartPackage(c *gin.Context, storageObject *StorageObject) {
+	c.Header("Content-Type", storageObject.ContentType)
+	http.ServeContent(c.Writer, c.Request, "", storageObject.LastModified, bytes.NewReader(storageObject.Content))
+}
+
+// headStorageObjectRequestHandler answers with the headers of a download, from the object as
+// stat'd in storage rather than read from it. The digest of a chart package, and so its ETag, is
+// the one in the index, and a provenance file only has an ETag if it had to be read after all
+func (server *MultiTenantServer) headStorageObjectRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	filename := c.Param("filename")
+	log := server.Logger.ContextLoggingFn(c)
+	if !strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) && !strings.HasSuffix(filename, cm_repo.ProvenanceFileExtension) {
+		c.Status(500)
+		return
+	}
+	storageObject, err := server.statStorageObject(log, repo, filename)
+	if err != nil {
+		c.Status(err.Status)
+		return
+	}
+	c.Header("Content-Type", storageObject.ContentType)
+	if storageObject.Content != nil {
+		c.Header("Content-Length", strconv.Itoa(len(storageObject.Content)))
+		setStorageObjectHeaders(c, filename, storageObject)
+	} else {
+		c.Header("Content-Length", strconv.FormatInt(storageObject.Size, 10))
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": pathutil.Base(filename)}))
+		if digest := server.chartPackageDigest(log, repo, filename); digest != "" {
+			c.Header("ETag", fmt.Sprintf(`"%s"`, digest))
+			c.Header(chartDigestHeader, digest)
+		}
+	}
+	if strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) {
+		c.Header("Accept-Ranges", "bytes")
+	}
+	if !storageObject.LastModified.IsZero() {
+		c.Header("Last-Modified", storageObject.LastModified.UTC().Format(http.TimeFormat))
+	}
+	c.Status(200)
 }
 
 func (server *MultiTenantServer) getAllChartsRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
+	filters, filterErr := parseChartFilters(c.Request.URL.Query())
+	if filterErr != nil {
+		c.JSON(filterErr.Status, gin.H{"error": filterErr.Message})
+		return
+	}
+	offsetStr, paginateOffset := c.GetQuery("offset")
+	limitStr, paginateLimit := c.GetQuery("limit")
+	offset, limit := 0, 0
+	if paginateOffset {
+		var convErr error
+		offset, convErr = strconv.Atoi(offsetStr)
+		if convErr != nil || offset < 0 {
+			c.JSON(400, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+	}
+	if paginateLimit {
+		var convErr error
+		limit, convErr = strconv.Atoi(limitStr)
+		if convErr != nil || limit < 0 {
+			c.JSON(400, gin.H{"error": "limit must be a non-negative integer"})
+			return
+		}
+	}
 	log := server.Logger.ContextLoggingFn(c)
 	allCharts, err := server.getAllCharts(log, repo)
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
-	c.JSON(200, allCharts)
+	allCharts = filterCharts(allCharts, filters)
+	if !paginateOffset && !paginateLimit {
+		c.JSON(200, allCharts)
+		return
+	}
+
+	// JSON object keys are always sorted by name, so pages are stable
+	page, total := paginateCharts(allCharts, offset, limit)
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	if limit > 0 && offset+limit < total {
+		next := *c.Request.URL
+		query := next.Query()
+		query.Set("offset", strconv.Itoa(offset+limit))
+		query.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = query.Encode()
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+	}
+	c.JSON(200, page)
+}
+
+func (server *MultiTenantServer) searchChartsRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	query := c.Query("q")
+	limit := 0
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var convErr error
+		limit, convErr = strconv.Atoi(limitStr)
+		if convErr != nil || limit < 0 {
+			c.JSON(400, gin.H{"error": "limit must be a non-negative integer"})
+			return
+		}
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	results, err := server.searchCharts(log, repo, query, limit)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, results)
 }
 
 func (server *MultiTenantServer) getChartRequestHandler(c *gin.Context) {
@@ -137,9 +402,24 @@ func (server *MultiTenantServer) getChartVersionRequestHandler(c *gin.Context) {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
+	c.Header("ETag", fmt.Sprintf(`"%s"`, chartVersion.Digest))
 	c.JSON(200, chartVersion)
 }
 
+func (server *MultiTenantServer) headChartVersionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	chartVersion, err := server.getChartVersion(log, repo, name, version)
+	if err != nil {
+		c.Status(err.Status)
+		return
+	}
+	c.Header("ETag", fmt.Sprintf(`"%s"`, chartVersion.Digest))
+	c.Status(200)
+}
+
 func (server *MultiTenantServer) deleteChartVersionRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
 	name := c.Param("name")
@@ -153,6 +433,39 @@ func (server *MultiTenantServer) deleteChartVersionRequestHandler(c *gin.Context
 	c.JSON(200, objectDeletedResponse)
 }
 
+func (server *MultiTenantServer) deleteChartVersionsRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	// without a semver constraint, every version of the chart is deleted
+	var constraint *semver.Constraints
+	if semverQuery := c.Query("semver"); semverQuery != "" {
+		var err error
+		constraint, err = semver.NewConstraint(semverQuery)
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("invalid semver constraint: %s", err)})
+			return
+		}
+	}
+	if c.Query("confirm") != "true" {
+		c.JSON(400, gin.H{"error": "confirm=true is required to delete more than one chart version at once"})
+		return
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	deleted, failed, httpErr := server.deleteChartVersions(log, repo, name, constraint)
+	if httpErr != nil {
+		c.JSON(httpErr.Status, gin.H{"error": httpErr.Message})
+		return
+	}
+	for _, version := range deleted {
+		server.auditChartVersion(c, name, version)
+	}
+	status := 200
+	if len(failed) > 0 {
+		status = 500
+	}
+	c.JSON(status, gin.H{"deleted": deleted, "failed": failed})
+}
+
 func (server *MultiTenantServer) postRequestHandler(c *gin.Context) {
 	if c.ContentType() == "multipart/form-data" {
 		server.postPackageAndProvenanceRequestHandler(c) // new route handling form-based chart and/or prov files
@@ -163,24 +476,142 @@ func (server *MultiTenantServer) postRequestHandler(c *gin.Context) {
 
 func (server *MultiTenantServer) postPackageRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
-	content, getContentErr := c.GetRawData()
-	if getContentErr != nil {
+	upload, readErr := readChartUpload(c.Request.Body)
+	if readErr != nil {
 		if len(c.Errors) > 0 {
 			return // this is a "request too large"
 		}
-		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", getContentErr)})
+		err := server.invalidChartError(readErr)
+		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
+	defer upload.Close()
+	meta := upload.meta
+	server.auditChartVersion(c, meta.Name, meta.Version)
 	log := server.Logger.ContextLoggingFn(c)
-	_, force := c.GetQuery("force")
-	err := server.uploadChartPackage(log, repo, content, force)
+	force := forceQuery(c)
+	if preconditions := pushPreconditionsFromRequest(c.Request); !preconditions.empty() {
+		path := pathutil.Join(repo, cm_repo.ChartPackageFilenameFromNameVersion(meta.Name, meta.Version))
+		unlock := server.pushLocks.lock(path)
+		defer unlock()
+		if err := server.checkPushPreconditions(log, path, preconditions); err != nil {
+			c.JSON(err.Status, gin.H{"error": err.Message})
+			return
+		}
+		force = force || preconditions.overwrites()
+	}
+	overwritten, err := server.pushChartUpload(log, repo, upload, digestQuery(c), force, server.pushAnnotations(c))
 	if err != nil {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	server.chartPushed(c, repo, meta.Name, meta.Version, overwritten)
+}
+
+// putChartVersionRequestHandler stores the chart package in the request body as the chart
+// version addressed by the URL, which must be the name and version of the package. Putting the
+// package already stored there again changes nothing, and is answered with a 200
+func (server *MultiTenantServer) putChartVersionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	upload, readErr := readChartUpload(c.Request.Body)
+	if readErr != nil {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
+		err := server.invalidChartError(readErr)
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
+	defer upload.Close()
+	meta := upload.meta
+	if meta.Name != name || meta.Version != version {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("chart package is %s version %s, not %s version %s",
+			meta.Name, meta.Version, name, version)})
+		return
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	path := pathutil.Join(repo, cm_repo.ChartPackageFilenameFromNameVersion(name, version))
+	unlock := server.pushLocks.lock(path)
+	defer unlock()
+	force := forceQuery(c)
+	if preconditions := pushPreconditionsFromRequest(c.Request); !preconditions.empty() {
+		if err := server.checkPushPreconditions(log, path, preconditions); err != nil {
+			c.JSON(err.Status, gin.H{"error": err.Message})
+			return
+		}
+		force = force || preconditions.overwrites()
+	}
+	if object, err := server.StorageBackend.GetObject(path); err == nil {
+		// the package is compared with the one stored as a whole, so it is spooled first
+		if spoolErr := upload.spool(); spoolErr != nil {
+			if len(c.Errors) > 0 {
+				return // this is a "request too large"
+			}
+			c.JSON(400, gin.H{"error": spoolErr.Error()})
+			return
+		}
+		if fmt.Sprintf("%x", sha256.Sum256(object.Content)) == upload.digest {
+			if err := server.verifyChartDigest(log, repo, upload.digest, digestQuery(c)); err != nil {
+				c.JSON(err.Status, gin.H{"error": err.Message})
+				return
+			}
+			server.chartPushed(c, repo, name, version, true)
+			return
+		}
+	}
+	overwritten, err := server.pushChartUpload(log, repo, upload, digestQuery(c), force, server.pushAnnotations(c))
+	if err != nil {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	server.chartPushed(c, repo, name, version, overwritten)
+}
+
+// chartPushed answers a chart package push with a 201, or a 200 if a chart package already
+// stored was overwritten, and the url the chart package is downloaded from in Location
+func (server *MultiTenantServer) chartPushed(c *gin.Context, repo string, name string, version string, overwritten bool) {
+	c.Header("Location", server.chartPackageLocation(repo, name, version))
+	if overwritten {
+		c.JSON(200, objectSavedResponse)
+		return
+	}
 	c.JSON(201, objectSavedResponse)
 }
 
+// postValidateChartRequestHandler answers whether a push of the chart package would be
+// accepted, with a report of every problem found. Nothing is stored
+func (server *MultiTenantServer) postValidateChartRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	upload, filename, spoolErr := server.spoolChartToValidate(c)
+	if spoolErr != nil {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
+		if spoolErr == errNoChartToValidate {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("%s", spoolErr)})
+			return
+		}
+		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", spoolErr)})
+		return
+	}
+	defer upload.Close()
+	log := server.Logger.ContextLoggingFn(c)
+	report := server.validateSpooledChartPackage(log, repo, upload, filename, digestQuery(c), forceQuery(c), pushPreconditionsFromRequest(c.Request))
+	if !report.Valid {
+		c.JSON(400, report)
+		return
+	}
+	c.JSON(200, report)
+}
+
 func (server *MultiTenantServer) postProvenanceFileRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
 	content, getContentErr := c.GetRawData()
@@ -191,8 +622,11 @@ func (server *MultiTenantServer) postProvenanceFileRequestHandler(c *gin.Context
 		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", getContentErr)})
 		return
 	}
+	if filename, filenameErr := cm_repo.ProvenanceFilenameFromContent(content); filenameErr == nil {
+		server.auditChartFile(c, filename)
+	}
 	log := server.Logger.ContextLoggingFn(c)
-	_, force := c.GetQuery("force")
+	force := forceQuery(c)
 	err := server.uploadProvenanceFile(log, repo, content, force)
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
@@ -203,13 +637,22 @@ func (server *MultiTenantServer) postProvenanceFileRequestHandler(c *gin.Context
 
 func (server *MultiTenantServer) postPackageAndProvenanceRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
-	_, force := c.GetQuery("force")
-
-	cpFiles, status, err := server.getChartAndProvFiles(c.Request, repo, force)
+	preconditions := pushPreconditionsFromRequest(c.Request)
+	// a failed If-Match is caught below, before anything is stored
+	force := forceQuery(c) || preconditions.overwrites()
+	log := server.Logger.ContextLoggingFn(c)
+	cpFiles, status, err := server.getChartAndProvFiles(c.Request)
 	if status != 200 {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
 		c.JSON(status, gin.H{"error": fmt.Sprintf("%s", err)})
 		return
 	}
+	defer closeChartAndProvFiles(cpFiles)
+	for filename := range cpFiles {
+		server.auditChartFile(c, filename)
+	}
 
 	if len(cpFiles) == 0 {
 		if len(c.Errors) > 0 {
@@ -222,92 +665,279 @@ func (server *MultiTenantServer) postPackageAndProvenanceRequestHandler(c *gin.C
 		return
 	}
 
+	if err := verifyChartAndProvFiles(cpFiles); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+
+	for _, ppf := range cpFiles {
+		meta := ppf.upload.meta
+		if meta == nil {
+			continue
+		}
+		if err := server.verifyChartDigest(log, repo, ppf.upload.digest, digestQuery(c)); err != nil {
+			c.JSON(err.Status, gin.H{"error": err.Message})
+			return
+		}
+		if err := server.checkChartName(log, repo, meta.Name); err != nil {
+			c.JSON(err.Status, gin.H{"error": err.Message})
+			return
+		}
+		if err := server.checkVersionLimit(log, repo, meta.Name, meta.Version); err != nil {
+			c.JSON(err.Status, gin.H{"error": err.Message})
+			return
+		}
+	}
+
+	if !preconditions.empty() {
+		var paths []string
+		for _, ppf := range cpFiles {
+			if ppf.upload.meta != nil {
+				paths = append(paths, pathutil.Join(repo, ppf.filename))
+			}
+		}
+		unlock := server.pushLocks.lock(paths...)
+		defer unlock()
+		for _, path := range paths {
+			if err := server.checkPushPreconditions(log, path, preconditions); err != nil {
+				c.JSON(err.Status, gin.H{"error": err.Message})
+				return
+			}
+		}
+	}
+
+	// only once the preconditions are met, so that a failed If-None-Match is a 412, not a 409
+	for _, ppf := range cpFiles {
+		overwritten, status, err := server.validateChartOrProv(log, repo, ppf.filename, force)
+		if err != nil {
+			c.JSON(status, gin.H{"error": fmt.Sprintf("%s", err)})
+			return
+		}
+		ppf.overwritten = overwritten
+	}
+
 	// At this point input is presumed valid, we now proceed to store it
 	// Undo transaction if there is an error
+	annotations := server.pushAnnotations(c)
+	pushed := time.Now()
 	var storedFiles []*chartOrProvenanceFile
 	for _, ppf := range cpFiles {
 		server.Logger.Debugc(c, "Adding file to storage (form field)",
 			"filename", ppf.filename,
 			"field", ppf.field,
 		)
-		err := server.StorageBackend.PutObject(pathutil.Join(repo, ppf.filename), ppf.content)
+		err := server.putSpooledObject(pathutil.Join(repo, ppf.filename), ppf.upload)
 		if err == nil {
+			if ppf.upload.meta != nil {
+				server.storeChartSidecars(log, repo, ppf.filename, pushed, annotations, ppf.overwritten)
+			}
 			storedFiles = append(storedFiles, ppf)
 		} else {
 			// Clean up what's already been saved
 			for _, ppf := range storedFiles {
-				server.StorageBackend.DeleteObject(ppf.filename)
+				server.StorageBackend.DeleteObject(pathutil.Join(repo, ppf.filename))
+				if ppf.upload.meta != nil {
+					server.removeChartAnnotations(repo, ppf.filename, annotations)
+					server.removeChartPushTime(repo, ppf.filename)
+				}
 			}
 			c.JSON(500, gin.H{"error": fmt.Sprintf("%s", err)})
 			return
 		}
 	}
+	for _, ppf := range storedFiles {
+		if ppf.upload.meta != nil {
+			server.chartUploadStored(log, repo, ppf.filename, ppf.upload, pushed, annotations)
+		}
+	}
+	for _, ppf := range storedFiles {
+		if meta := ppf.upload.meta; meta != nil {
+			server.chartPushed(c, repo, meta.Name, meta.Version, ppf.overwritten)
+			return
+		}
+	}
+	// a provenance file on its own
+	if len(storedFiles) == 1 && storedFiles[0].overwritten {
+		c.JSON(200, objectSavedResponse)
+		return
+	}
 	c.JSON(201, objectSavedResponse)
 }
 
-func (server *MultiTenantServer) getChartAndProvFiles(req *http.Request, repo string, force bool) (map[string]*chartOrProvenanceFile, int, error) {
-	type fieldFuncPair struct {
-		field string
-		fn    filenameFromContentFn
+// getChartAndProvFiles reads the chart packages and provenance files of a multipart form, part
+// by part, spooling them to disk. On success, the caller must close the returned files
+func (server *MultiTenantServer) getChartAndProvFiles(req *http.Request) (map[string]*chartOrProvenanceFile, int, error) {
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, 400, err
 	}
 
-	ffp := []fieldFuncPair{
-		{defaultFormField, cm_repo.ChartPackageFilenameFromContent},
-		{server.ChartPostFormFieldName, cm_repo.ChartPackageFilenameFromContent},
-		{defaultProvField, cm_repo.ProvenanceFilenameFromContent},
-		{server.ProvPostFormFieldName, cm_repo.ProvenanceFilenameFromContent},
+	cpFiles := make(map[string]*chartOrProvenanceFile)
+	fail := func(status int, err error) (map[string]*chartOrProvenanceFile, int, error) {
+		closeChartAndProvFiles(cpFiles)
+		return nil, status, err
 	}
 
-	cpFiles := make(map[string]*chartOrProvenanceFile)
-	for _, ff := range ffp {
-		content, err := extractContentFromRequest(req, ff.field)
-		if err != nil {
-			return nil, 500, err
-		}
-		if content == nil {
-			continue
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
 		}
-		filename, err := ff.fn(content)
 		if err != nil {
-			return nil, 400, err
+			return fail(500, err)
 		}
-		if _, ok := cpFiles[filename]; ok {
+		if part.FileName() == "" {
+			continue // not a file
+		}
+
+		var ppf *chartOrProvenanceFile
+		switch part.FormName() {
+		case defaultFormField, server.ChartPostFormFieldName:
+			// the rest of the form is only read once the part is, so it is spooled
+			upload, err := readChartUpload(part)
+			if err == nil {
+				if err = upload.spool(); err != nil {
+					upload.Close()
+				}
+			}
+			if err != nil {
+				return fail(400, err)
+			}
+			if sizeErr := server.checkChartSize(upload); sizeErr != nil {
+				upload.Close()
+				return fail(sizeErr.Status, errors.New(sizeErr.Message))
+			}
+			meta := upload.meta
+			if server.ValidateCharts {
+				if err := cm_repo.ValidateChartMetadata(meta, part.FileName()); err != nil {
+					upload.Close()
+					return fail(400, err)
+				}
+			}
+			filename := cm_repo.ChartPackageFilenameFromNameVersion(meta.Name, meta.Version)
+			ppf = &chartOrProvenanceFile{filename: filename, upload: upload, field: part.FormName()}
+		case defaultProvField, server.ProvPostFormFieldName:
+			upload, err := spoolUpload(part)
+			if err != nil {
+				return fail(500, err)
+			}
+			content, err := upload.readAll()
+			if err != nil {
+				upload.Close()
+				return fail(500, err)
+			}
+			filename, err := cm_repo.ProvenanceFilenameFromContent(content)
+			if err != nil {
+				upload.Close()
+				return fail(400, err)
+			}
+			ppf = &chartOrProvenanceFile{filename: filename, upload: upload, field: part.FormName()}
+		default:
 			continue
 		}
-		if status, err := server.validateChartOrProv(repo, filename, force); err != nil {
-			return nil, status, err
+
+		if _, ok := cpFiles[ppf.filename]; ok {
+			closeChartAndProvFiles(map[string]*chartOrProvenanceFile{ppf.filename: ppf})
+			continue
 		}
-		cpFiles[filename] = &chartOrProvenanceFile{filename, content, ff.field}
+		cpFiles[ppf.filename] = ppf
 	}
 
 	return cpFiles, 200, nil
 }
 
-func extractContentFromRequest(req *http.Request, field string) ([]byte, error) {
-	file, header, _ := req.FormFile(field)
-	if file == nil || header == nil {
-		return nil, nil // field is not present
+// verifyChartAndProvFiles checks that a provenance file uploaded together with a
+// chart package belongs to that package and lists its digest
+func verifyChartAndProvFiles(cpFiles map[string]*chartOrProvenanceFile) error {
+	var chart, prov *chartOrProvenanceFile
+	for _, ppf := range cpFiles {
+		if ppf.upload.meta == nil {
+			prov = ppf
+		} else {
+			chart = ppf
+		}
+	}
+	if chart == nil || prov == nil {
+		return nil
+	}
+	if prov.filename != chart.filename+".prov" {
+		return fmt.Errorf("provenance file %s does not belong to chart package %s", prov.filename, chart.filename)
 	}
-	buf := bytes.NewBuffer(nil)
-	_, err := io.Copy(buf, file)
+	content, err := prov.upload.readAll()
 	if err != nil {
-		return nil, err // IO error
+		return err
 	}
-	return buf.Bytes(), nil
+	return cm_repo.VerifyProvenanceChartDigest(content, chart.filename, chart.upload.digest)
 }
 
-func (server *MultiTenantServer) validateChartOrProv(repo, filename string, force bool) (int, error) {
+// closeChartAndProvFiles removes the spooled files
+func closeChartAndProvFiles(cpFiles map[string]*chartOrProvenanceFile) {
+	for _, ppf := range cpFiles {
+		ppf.upload.Close()
+	}
+}
+
+func (server *MultiTenantServer) validateChartOrProv(log cm_logger.LoggingFn, repo, filename string, force bool) (bool, int, error) {
 	var f string
 	if repo == "" {
 		f = filename
 	} else {
 		f = repo + "/" + filename
 	}
-	if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
-		_, err := server.StorageBackend.GetObject(f)
-		if err == nil {
-			return 409, fmt.Errorf("%s already exists", f) // conflict
-		}
+	overwritten, err := server.checkOverwrite(log, f, force)
+	if err != nil {
+		return overwritten, err.Status, fmt.Errorf("%s already exists", f) // conflict
+	}
+	return overwritten, 200, nil
+}
+
+// setStorageObjectHeaders describes a chart package or provenance file download, so that
+// clients can save it under its own name and check the digest of a chart package without
+// reading the body
+func setStorageObjectHeaders(c *gin.Context, filename string, storageObject *StorageObject) {
+	c.Header("ETag", objectETag(storageObject.Content))
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": pathutil.Base(filename)}))
+	if strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) {
+		c.Header(chartDigestHeader, fmt.Sprintf("%x", sha256.Sum256(storageObject.Content)))
+	}
+}
+
+// chartPackageDigest returns the digest in the index of repo of the chart package filename, or ""
+// if it is not a chart package in the index
+func (server *MultiTenantServer) chartPackageDigest(log cm_logger.LoggingFn, repo string, filename string) string {
+	if !strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) {
+		return ""
+	}
+	chartVersion, err := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{Path: filename})
+	if err != nil {
+		return ""
+	}
+	indexed, httpErr := server.getChartVersion(log, repo, chartVersion.Name, chartVersion.Version)
+	if httpErr != nil {
+		return ""
+	}
+	return indexed.Digest
+}
+
+// digestQuery returns the expected sha256 digest of an uploaded chart package, from
+// the X-Content-SHA256 header or the "sha256" query param
+func digestQuery(c *gin.Context) string {
+	if digest := c.Request.Header.Get(contentSHA256Header); digest != "" {
+		return digest
+	}
+	return c.Query("sha256")
+}
+
+// forceQuery reports whether the request asks to overwrite existing files,
+// with either "?force" or "?force=true"
+func forceQuery(c *gin.Context) bool {
+	value, ok := c.GetQuery("force")
+	if !ok {
+		return false
+	}
+	if value == "" {
+		return true
 	}
-	return 200, nil
+	force, err := strconv.ParseBool(value)
+	return err == nil && force
 }
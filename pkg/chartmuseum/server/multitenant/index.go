@@ -17,15 +17,30 @@ limitations under the License.
 package multitenant
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
 	pathutil "path"
+	"strings"
+	"time"
 
 	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "github.com/helm/chartmuseum/pkg/repo"
 	cm_storage "github.com/helm/chartmuseum/pkg/storage"
+
+	"github.com/ghodss/yaml"
+	helm_repo "k8s.io/helm/pkg/repo"
+)
+
+const (
+	// statefileTokenPrefix starts the first line of an index-cache.yaml saved with a change token
+	statefileTokenPrefix = "# storage-token: "
 )
 
 var (
-	indexFileContentType = "application/x-yaml"
+	indexFileContentType     = "application/x-yaml"
+	indexJSONFileContentType = "application/json"
 )
 
 func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo string) (*cm_repo.Index, *HTTPError) {
@@ -38,6 +53,28 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 		return nil, &HTTPError{500, errStr}
 	}
 
+	if server.rebuildDue(repo) {
+		// only one request rebuilds the index, the others are served the cached one meanwhile
+		if !server.claimRebuild(repo, true) {
+			log(cm_logger.DebugLevel, "Cached index expired, serving it while it is rebuilt",
+				"repo", repo,
+			)
+			return entry.RepoIndex, nil
+		}
+		defer server.releaseRebuild(repo)
+		log(cm_logger.DebugLevel, "Cached index expired, rebuilding it from storage",
+			"repo", repo,
+		)
+		return server.rebuildIndex(log, repo)
+	}
+
+	if !server.reconcileDue(repo) {
+		log(cm_logger.DebugLevel, "Skipping reconciliation between cache and storage",
+			"repo", repo,
+		)
+		return entry.RepoIndex, nil
+	}
+
 	fo := <-server.getChartList(log, repo)
 
 	if fo.err != nil {
@@ -47,6 +84,16 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 		)
 		return nil, &HTTPError{500, errStr}
 	}
+	server.markReconciled(repo)
+
+	// storage is still listed in full, the token only spares comparing it with the index
+	token := cm_storage.ChangeToken(fo.objects)
+	if server.storageUnchanged(repo, token) {
+		log(cm_logger.DebugLevel, "No change in storage since the index was built",
+			"repo", repo,
+		)
+		return entry.RepoIndex, nil
+	}
 
 	objects := server.getRepoObjectSlice(entry)
 	diff := cm_storage.GetObjectSliceDiff(objects, fo.objects)
@@ -56,6 +103,11 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 		log(cm_logger.DebugLevel, "No change detected between cache and storage",
 			"repo", repo,
 		)
+		server.setStorageToken(repo, token)
+		if server.UseStatefiles {
+			// record the token, so that the next start does not compare again
+			go server.saveStatefile(log, repo, entry.RepoIndex.Raw, token)
+		}
 		return entry.RepoIndex, nil
 	}
 
@@ -63,8 +115,10 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 		"repo", repo,
 	)
 
-	ir := <-server.regenerateRepositoryIndex(log, entry, diff)
+	start := time.Now()
+	ir := <-server.regenerateRepositoryIndex(log, entry, entry.RepoIndex, diff)
 	newRepoIndex := ir.index
+	indexRegenerationHistogramVec.WithLabelValues(repo, "reconcile").Observe(time.Since(start).Seconds())
 
 	if ir.err != nil {
 		errStr := ir.err.Error()
@@ -73,18 +127,264 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 		)
 		return newRepoIndex, &HTTPError{500, errStr}
 	}
+	server.setStorageToken(repo, token)
 
 	if server.UseStatefiles {
 		// Dont wait, save index-cache.yaml to storage in the background.
 		// It is not crucial if this does not succeed, we will just log any errors
-		go server.saveStatefile(log, repo, ir.index.Raw)
+		go server.saveStatefile(log, repo, ir.index.Raw, token)
 	}
 
 	return ir.index, nil
 }
 
-func (server *MultiTenantServer) saveStatefile(log cm_logger.LoggingFn, repo string, content []byte) {
-	err := server.StorageBackend.PutObject(pathutil.Join(repo, cm_repo.StatefileFilename), content)
+// updateIndexEntry applies a single pushed or deleted chart version to the cached index,
+// instead of rescanning storage. This is only done when the index is reconciled with storage
+// periodically, otherwise the next request picks up the change anyway
+func (server *MultiTenantServer) updateIndexEntry(log cm_logger.LoggingFn, repo string, chartVersion *helm_repo.ChartVersion, deleted bool) {
+	if server.IndexReconcileInterval <= 0 {
+		return
+	}
+
+	start := time.Now()
+	entry, err := server.initCacheEntry(log, repo)
+	if err != nil {
+		log(cm_logger.WarnLevel, "Could not update index, it will be updated on the next reconciliation",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return
+	}
+
+	tenant := server.getTenant(repo)
+	tenant.RegenerationLock.Lock()
+	defer tenant.RegenerationLock.Unlock()
+
+	// the next reconciliation picks up the change in storage, and compares it in full
+	server.setStorageToken(repo, "")
+	// the cached index may be served meanwhile, so a copy of it is changed and then replaces it
+	index := entry.RepoIndex.Clone()
+	index.VersionOrder = server.IndexVersionOrder
+	index.ChartURLTemplate = server.ChartURLTemplate
+	entry = entry.withIndex(index)
+	// the package is read again on the next reconciliation, since its modification time in
+	// storage is not known. Its push time is kept as long as the package is the same
+	delete(entry.ModTimes, cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version))
+	if deleted {
+		index.RemoveEntry(chartVersion)
+	} else if index.HasEntry(chartVersion) {
+		index.UpdateEntry(chartVersion)
+	} else {
+		index.AddEntry(chartVersion)
+	}
+
+	err = index.Regenerate()
+	if err == nil {
+		err = server.saveCacheEntry(log, entry)
+	}
+	if err != nil {
+		log(cm_logger.WarnLevel, "Could not update index, it will be updated on the next reconciliation",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return
+	}
+	indexRegenerationHistogramVec.WithLabelValues(repo, "incremental").Observe(time.Since(start).Seconds())
+
+	log(cm_logger.DebugLevel, "index.yaml updated",
+		"repo", repo,
+		"name", chartVersion.Name,
+		"version", chartVersion.Version,
+	)
+
+	if server.UseStatefiles {
+		go server.saveStatefile(log, repo, index.Raw, "")
+	}
+}
+
+// rebuildIndex discards the cached index of repo and builds it again from every chart
+// package in storage, for when charts were changed in storage without going through
+// ChartMuseum, or the cache entry cannot be trusted. The regeneration lock is held
+// throughout, so that no other change to the index is made while it is rebuilt
+func (server *MultiTenantServer) rebuildIndex(log cm_logger.LoggingFn, repo string) (*cm_repo.Index, *HTTPError) {
+	// make sure the tenant is set up. Push times are kept from the index being replaced
+	previous, err := server.initCacheEntry(log, repo)
+	if err != nil {
+		errStr := err.Error()
+		log(cm_logger.ErrorLevel, errStr,
+			"repo", repo,
+		)
+		return nil, &HTTPError{500, errStr}
+	}
+
+	tenant := server.getTenant(repo)
+	tenant.RegenerationLock.Lock()
+	defer tenant.RegenerationLock.Unlock()
+
+	fo := <-server.getChartList(log, repo)
+	if fo.err != nil {
+		errStr := fo.err.Error()
+		log(cm_logger.ErrorLevel, errStr,
+			"repo", repo,
+		)
+		return nil, &HTTPError{500, errStr}
+	}
+	server.markReconciled(repo)
+
+	entry := &cacheEntry{
+		RepoName:  repo,
+		RepoIndex: server.emptyRepositoryIndex(repo),
+	}
+	diff := cm_storage.GetObjectSliceDiff([]cm_storage.Object{}, fo.objects)
+
+	log(cm_logger.DebugLevel, "Rebuilding index.yaml",
+		"repo", repo,
+	)
+
+	start := time.Now()
+	// the regeneration is not shared with other requests, which expect their own diff applied
+	index, err := server.regenerateRepositoryIndexWorker(log, entry, previous.RepoIndex, diff)
+	indexRegenerationHistogramVec.WithLabelValues(repo, "rebuild").Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		errStr := err.Error()
+		log(cm_logger.ErrorLevel, errStr,
+			"repo", repo,
+		)
+		return index, &HTTPError{500, errStr}
+	}
+
+	tenant.FetchedObjectsLock.Lock()
+	tenant.LastRebuilt = time.Now()
+	tenant.FetchedObjectsLock.Unlock()
+	token := cm_storage.ChangeToken(fo.objects)
+	server.setStorageToken(repo, token)
+
+	if server.UseStatefiles {
+		go server.saveStatefile(log, repo, index.Raw, token)
+	}
+
+	return index, nil
+}
+
+// rebuildDue reports whether the cached index of repo is older than the cache TTL
+func (server *MultiTenantServer) rebuildDue(repo string) bool {
+	if server.CacheTTL <= 0 {
+		return false
+	}
+	tenant := server.getTenant(repo)
+	tenant.FetchedObjectsLock.Lock()
+	defer tenant.FetchedObjectsLock.Unlock()
+	return time.Since(tenant.LastRebuilt) >= server.CacheTTL
+}
+
+// claimRebuild marks the index of repo as being rebuilt, unless it already is or, with
+// expiredOnly, was rebuilt since the cache TTL passed. It reports whether the caller is to
+// rebuild it, and then releaseRebuild once done
+func (server *MultiTenantServer) claimRebuild(repo string, expiredOnly bool) bool {
+	tenant := server.getTenant(repo)
+	tenant.FetchedObjectsLock.Lock()
+	defer tenant.FetchedObjectsLock.Unlock()
+	if tenant.Rebuilding || (expiredOnly && time.Since(tenant.LastRebuilt) < server.CacheTTL) {
+		return false
+	}
+	tenant.Rebuilding = true
+	return true
+}
+
+func (server *MultiTenantServer) releaseRebuild(repo string) {
+	tenant := server.getTenant(repo)
+	tenant.FetchedObjectsLock.Lock()
+	tenant.Rebuilding = false
+	tenant.FetchedObjectsLock.Unlock()
+}
+
+// reconcileDue reports whether the cached index of repo should be compared with storage
+func (server *MultiTenantServer) reconcileDue(repo string) bool {
+	if server.IndexReconcileInterval <= 0 {
+		return true
+	}
+	tenant := server.getTenant(repo)
+	tenant.FetchedObjectsLock.Lock()
+	defer tenant.FetchedObjectsLock.Unlock()
+	return time.Since(tenant.LastReconciled) >= server.IndexReconcileInterval
+}
+
+func (server *MultiTenantServer) markReconciled(repo string) {
+	tenant := server.getTenant(repo)
+	tenant.FetchedObjectsLock.Lock()
+	tenant.LastReconciled = time.Now()
+	tenant.FetchedObjectsLock.Unlock()
+}
+
+// storageUnchanged reports whether the chart packages in storage are the ones the cached
+// index of repo was built from, going by their change token
+func (server *MultiTenantServer) storageUnchanged(repo string, token string) bool {
+	tenant := server.getTenant(repo)
+	tenant.FetchedObjectsLock.Lock()
+	defer tenant.FetchedObjectsLock.Unlock()
+	return tenant.StorageToken != "" && tenant.StorageToken == token
+}
+
+func (server *MultiTenantServer) setStorageToken(repo string, token string) {
+	tenant := server.getTenant(repo)
+	tenant.FetchedObjectsLock.Lock()
+	tenant.StorageToken = token
+	tenant.FetchedObjectsLock.Unlock()
+}
+
+// indexETag returns a strong ETag for the raw index.yaml
+func indexETag(index *cm_repo.Index) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(index.Raw))
+}
+
+// indexJSONETag is the ETag of index.json, which changes along with index.yaml but differs
+// from it, as the content of the two is not the same
+func indexJSONETag(index *cm_repo.Index) string {
+	return fmt.Sprintf(`"%x-json"`, sha256.Sum256(index.Raw))
+}
+
+// indexJSON converts the index.yaml of an index to JSON. It is converted from the YAML served
+// rather than from the entries of the index, which may be updated in the meantime
+func (server *MultiTenantServer) indexJSON(log cm_logger.LoggingFn, repo string, index *cm_repo.Index) ([]byte, *HTTPError) {
+	content, err := yaml.YAMLToJSON(index.Raw)
+	if err != nil {
+		errStr := err.Error()
+		log(cm_logger.ErrorLevel, errStr,
+			"repo", repo,
+		)
+		return nil, &HTTPError{500, errStr}
+	}
+	return content, nil
+}
+
+// indexNotModified reports whether a 304 should be returned for a conditional request.
+// If-None-Match takes precedence over If-Modified-Since, and is compared weakly since
+// a compressed response carries a weak version of the ETag
+func indexNotModified(request *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := request.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !lastModified.Truncate(time.Second).After(since) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveStatefile saves the index of repo to index-cache.yaml, along with the change token of the
+// chart packages it was built from, if it is known
+func (server *MultiTenantServer) saveStatefile(log cm_logger.LoggingFn, repo string, content []byte, token string) {
+	err := server.StorageBackend.PutObject(pathutil.Join(repo, cm_repo.StatefileFilename), statefileContent(content, token))
 	if err != nil {
 		log(cm_logger.WarnLevel, "Error saving index-cache.yaml",
 			"repo", repo,
@@ -98,11 +398,37 @@ func (server *MultiTenantServer) saveStatefile(log cm_logger.LoggingFn, repo str
 
 func (server *MultiTenantServer) getRepoObjectSlice(entry *cacheEntry) []cm_storage.Object {
 	var objects []cm_storage.Object
-	for _, entry := range entry.RepoIndex.Entries {
-		for _, chartVersion := range entry {
+	for _, chartVersions := range entry.RepoIndex.Entries {
+		for _, chartVersion := range chartVersions {
 			object := cm_repo.StorageObjectFromChartVersion(chartVersion)
+			if modTime, ok := entry.ModTimes[object.Path]; ok {
+				object.LastModified = modTime
+			}
 			objects = append(objects, object)
 		}
 	}
 	return objects
 }
+
+// statefileContent prepends the change token to the index saved in index-cache.yaml, as a
+// comment so that the file is still a plain index.yaml. Keeping both in one object means
+// they are always written together
+func statefileContent(raw []byte, token string) []byte {
+	if token == "" {
+		return raw
+	}
+	return append([]byte(statefileTokenPrefix+token+"\n"), raw...)
+}
+
+// splitStatefile returns the index saved in index-cache.yaml and the change token saved
+// with it, which is empty if there is none
+func splitStatefile(content []byte) ([]byte, string) {
+	if !bytes.HasPrefix(content, []byte(statefileTokenPrefix)) {
+		return content, ""
+	}
+	end := bytes.IndexByte(content, '\n')
+	if end < 0 {
+		return []byte{}, ""
+	}
+	return content[end+1:], string(content[len(statefileTokenPrefix):end])
+}
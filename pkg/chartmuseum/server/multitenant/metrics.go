@@ -0,0 +1,135 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"strings"
+
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Chart versions deleted (or only logged, in dry-run mode) by the retention policy
+	retentionPrunedCounterVec *prometheus.CounterVec
+	// Time taken to bring a repo index up to date, either by reconciling it with
+	// storage, by applying a single push or delete, or by rebuilding it from scratch
+	indexRegenerationHistogramVec *prometheus.HistogramVec
+	// Chart package uploads rejected because the received content did not match the expected digest
+	chartDigestMismatchCounterVec *prometheus.CounterVec
+	// Storage used by each repo, summed up whenever the repo is listed to bring its index up to date
+	storageBytesGaugeVec *prometheus.GaugeVec
+	// Chart package downloads, by chart name only (not version) to keep the number of series manageable
+	chartPullsCounterVec *prometheus.CounterVec
+	// When the index of a repo was last rebuilt by the background reindex, to alert on stale indexes
+	indexLastReindexGaugeVec *prometheus.GaugeVec
+
+	metricsNamespace string
+	metricsSubsystem string
+)
+
+func init() {
+	SetMetricsPrefix("", "")
+}
+
+// SetMetricsPrefix creates the server metrics under namespace ("chartmuseum" if empty) and
+// subsystem, in place of the ones registered before. It is called on startup, before the
+// server is created
+func SetMetricsPrefix(namespace string, subsystem string) {
+	if namespace == "" {
+		namespace = "chartmuseum"
+	}
+	collectors := func() []prometheus.Collector {
+		return []prometheus.Collector{retentionPrunedCounterVec, indexRegenerationHistogramVec, chartDigestMismatchCounterVec,
+			storageBytesGaugeVec, chartPullsCounterVec, indexLastReindexGaugeVec}
+	}
+	if retentionPrunedCounterVec != nil {
+		if namespace == metricsNamespace && subsystem == metricsSubsystem {
+			return
+		}
+		for _, collector := range collectors() {
+			prometheus.Unregister(collector)
+		}
+	}
+	metricsNamespace, metricsSubsystem = namespace, subsystem
+	retentionPrunedCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "retention_pruned_chart_versions_total",
+			Help:      "Number of chart versions pruned by the retention policy",
+		},
+		[]string{"repo", "dry_run"},
+	)
+	indexRegenerationHistogramVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "index_regeneration_duration_seconds",
+			Help:      "Time taken to regenerate a repo index",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"repo", "mode"},
+	)
+	chartDigestMismatchCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "chart_digest_mismatches_total",
+			Help:      "Number of chart package uploads rejected for not matching the expected digest",
+		},
+		[]string{"repo"},
+	)
+	storageBytesGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "storage_bytes",
+			Help:      "Total size of the objects stored in a repo, as of its last listing",
+		},
+		[]string{"repo"},
+	)
+	chartPullsCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "chart_pulls_total",
+			Help:      "Number of chart package downloads",
+		},
+		[]string{"repo", "name"},
+	)
+	indexLastReindexGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "index_last_reindex_timestamp_seconds",
+			Help:      "Unix time of the last successful background rebuild of a repo index",
+		},
+		[]string{"repo"},
+	)
+	prometheus.MustRegister(collectors()...)
+}
+
+// countChartPull counts a download of a chart package. Provenance files are not counted
+func countChartPull(repo string, filename string) {
+	if !strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) {
+		return
+	}
+	name, _ := cm_repo.ChartNameVersionFromPackageFilename(filename)
+	chartPullsCounterVec.WithLabelValues(repo, name).Inc()
+}
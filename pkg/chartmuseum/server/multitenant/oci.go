@@ -0,0 +1,413 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	pathutil "path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	ociHelmConfigMediaType      = "application/vnd.cncf.helm.config.v1+json"
+	ociHelmChartMediaType       = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	ociHelmProvenanceMediaType  = "application/vnd.cncf.helm.chart.provenance.v1.prov"
+	ociContentDigestHeader      = "Docker-Content-Digest"
+	ociUploadUUIDHeader         = "Docker-Upload-UUID"
+	ociStorageDirectory         = ".oci"
+	ociMaxManifestSize          = 4 * 1024 * 1024
+	ociUploadTTL                = time.Hour
+	ociErrorBlobUnknown         = "BLOB_UNKNOWN"
+	ociErrorBlobUploadUnknown   = "BLOB_UPLOAD_UNKNOWN"
+	ociErrorDigestInvalid       = "DIGEST_INVALID"
+	ociErrorManifestBlobUnknown = "MANIFEST_BLOB_UNKNOWN"
+	ociErrorManifestInvalid     = "MANIFEST_INVALID"
+	ociErrorManifestUnknown     = "MANIFEST_UNKNOWN"
+	ociErrorNameInvalid         = "NAME_INVALID"
+	ociErrorTagInvalid          = "TAG_INVALID"
+	ociErrorUnsupported         = "UNSUPPORTED"
+)
+
+var (
+	ociDigestRegexp = regexp.MustCompile("^sha256:[a-f0-9]{64}$")
+	// repository names and tags as defined by the distribution spec
+	ociNameRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	ociTagRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+type (
+	// ociRegistry keeps track of blob uploads which have been started but not completed.
+	// Uploads not completed within ociUploadTTL are forgotten
+	ociRegistry struct {
+		uploadsLock *sync.Mutex
+		uploads     map[string]ociUpload // by upload UUID
+		now         func() time.Time
+	}
+
+	ociUpload struct {
+		name    string // OCI repository name
+		started time.Time
+	}
+
+	ociDescriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int64  `json:"size"`
+	}
+
+	ociManifest struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType,omitempty"`
+		Config        ociDescriptor   `json:"config"`
+		Layers        []ociDescriptor `json:"layers"`
+	}
+)
+
+func newOCIRegistry() *ociRegistry {
+	return &ociRegistry{
+		uploadsLock: &sync.Mutex{},
+		uploads:     map[string]ociUpload{},
+		now:         time.Now,
+	}
+}
+
+func (registry *ociRegistry) startUpload(name string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	uuid := hex.EncodeToString(b)
+	registry.uploadsLock.Lock()
+	now := registry.now()
+	registry.prune(now)
+	registry.uploads[uuid] = ociUpload{name: name, started: now}
+	registry.uploadsLock.Unlock()
+	return uuid
+}
+
+// finishUpload removes the upload, returning false if it was not started for name, or has expired
+func (registry *ociRegistry) finishUpload(uuid string, name string) bool {
+	registry.uploadsLock.Lock()
+	defer registry.uploadsLock.Unlock()
+	upload, ok := registry.uploads[uuid]
+	if !ok || upload.name != name {
+		return false
+	}
+	delete(registry.uploads, uuid)
+	return registry.now().Sub(upload.started) < ociUploadTTL
+}
+
+// prune drops the uploads which have expired, so that abandoned uploads are not kept forever
+func (registry *ociRegistry) prune(now time.Time) {
+	for uuid, upload := range registry.uploads {
+		if now.Sub(upload.started) >= ociUploadTTL {
+			delete(registry.uploads, uuid)
+		}
+	}
+}
+
+// ociName is the OCI repository name of a chart, e.g. "myorg/myrepo/mychart"
+func ociName(repo string, name string) string {
+	return pathutil.Join(repo, name)
+}
+
+func ociBlobPath(repo string, digest string) string {
+	return pathutil.Join(repo, ociStorageDirectory, "blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+func ociTagPath(repo string, name string, tag string) string {
+	return pathutil.Join(repo, ociStorageDirectory, "manifests", name, tag)
+}
+
+func ociDigest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+func ociError(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, gin.H{"errors": []gin.H{{"code": code, "message": message}}})
+}
+
+// checkOCIName responds with a NAME_INVALID error if the OCI repository name of a chart is not
+// valid, which also keeps it from reaching outside the repo in storage
+func checkOCIName(c *gin.Context, repo string, name string) bool {
+	if !ociNameRegexp.MatchString(ociName(repo, name)) {
+		ociError(c, 400, ociErrorNameInvalid, "invalid repository name")
+		return false
+	}
+	return true
+}
+
+// checkOCIReference responds with a TAG_INVALID error if a manifest reference is neither a
+// digest nor a valid tag
+func checkOCIReference(c *gin.Context, reference string) bool {
+	if !ociDigestRegexp.MatchString(reference) && !ociTagRegexp.MatchString(reference) {
+		ociError(c, 400, ociErrorTagInvalid, "invalid tag")
+		return false
+	}
+	return true
+}
+
+func (server *MultiTenantServer) ociURL(repo string, name string, parts ...string) string {
+	return pathutil.Join(append([]string{server.Router.ContextPath, "/v2", ociName(repo, name)}, parts...)...)
+}
+
+func (server *MultiTenantServer) getOCIBaseHandler(c *gin.Context) {
+	c.JSON(200, gin.H{})
+}
+
+func (server *MultiTenantServer) postOCIBlobUploadHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	if !checkOCIName(c, repo, name) {
+		return
+	}
+	if digest := c.Query("digest"); digest != "" {
+		server.storeOCIBlob(c, repo, name, digest) // monolithic upload in a single request
+		return
+	}
+	uuid := server.oci.startUpload(ociName(repo, name))
+	c.Header("Location", server.ociURL(repo, name, "blobs", "uploads", uuid))
+	c.Header(ociUploadUUIDHeader, uuid)
+	c.Header("Range", "0-0")
+	c.Status(202)
+}
+
+func (server *MultiTenantServer) putOCIBlobUploadHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	if !checkOCIName(c, repo, name) {
+		return
+	}
+	if !server.oci.finishUpload(c.Param("uuid"), ociName(repo, name)) {
+		ociError(c, 404, ociErrorBlobUploadUnknown, "blob upload unknown to registry")
+		return
+	}
+	server.storeOCIBlob(c, repo, name, c.Query("digest"))
+}
+
+func (server *MultiTenantServer) storeOCIBlob(c *gin.Context, repo string, name string, digest string) {
+	if !ociDigestRegexp.MatchString(digest) {
+		ociError(c, 400, ociErrorDigestInvalid, "digest must be of the form sha256:<hex>")
+		return
+	}
+	content, err := c.GetRawData()
+	if err != nil {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
+		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if ociDigest(content) != digest {
+		ociError(c, 400, ociErrorDigestInvalid, "provided digest did not match uploaded content")
+		return
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	log(cm_logger.DebugLevel, "Adding OCI blob to storage",
+		"repo", repo,
+		"name", name,
+		"digest", digest,
+	)
+	if err := server.StorageBackend.PutObject(ociBlobPath(repo, digest), content); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	c.Header("Location", server.ociURL(repo, name, "blobs", digest))
+	c.Header(ociContentDigestHeader, digest)
+	c.Status(201)
+}
+
+func (server *MultiTenantServer) getOCIBlobHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	digest := c.Param("digest")
+	if !checkOCIName(c, repo, c.Param("name")) {
+		return
+	}
+	if !ociDigestRegexp.MatchString(digest) {
+		ociError(c, 400, ociErrorDigestInvalid, "digest must be of the form sha256:<hex>")
+		return
+	}
+	object, err := server.StorageBackend.GetObject(ociBlobPath(repo, digest))
+	if err != nil {
+		ociError(c, 404, ociErrorBlobUnknown, "blob unknown to registry")
+		return
+	}
+	c.Header(ociContentDigestHeader, digest)
+	if c.Request.Method == "HEAD" {
+		c.Header("Content-Length", strconv.Itoa(len(object.Content)))
+		c.Header("Content-Type", "application/octet-stream")
+		c.Status(200)
+		return
+	}
+	c.Data(200, "application/octet-stream", object.Content)
+}
+
+func (server *MultiTenantServer) getOCIManifestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	reference := c.Param("reference")
+	if !checkOCIName(c, repo, name) || !checkOCIReference(c, reference) {
+		return
+	}
+
+	digest := reference
+	if !ociDigestRegexp.MatchString(reference) {
+		tag, err := server.StorageBackend.GetObject(ociTagPath(repo, name, reference))
+		if err != nil {
+			ociError(c, 404, ociErrorManifestUnknown, "manifest unknown")
+			return
+		}
+		digest = string(tag.Content)
+	}
+	object, err := server.StorageBackend.GetObject(ociBlobPath(repo, digest))
+	if err != nil {
+		ociError(c, 404, ociErrorManifestUnknown, "manifest unknown")
+		return
+	}
+
+	c.Header(ociContentDigestHeader, digest)
+	if c.Request.Method == "HEAD" {
+		c.Header("Content-Length", strconv.Itoa(len(object.Content)))
+		c.Header("Content-Type", ociManifestMediaType)
+		c.Status(200)
+		return
+	}
+	c.Data(200, ociManifestMediaType, object.Content)
+}
+
+// putOCIManifestHandler stores a Helm chart manifest. The chart layer it refers to is
+// also stored as a chart package, so that the chart shows up in index.yaml
+func (server *MultiTenantServer) putOCIManifestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	tag := c.Param("reference")
+	log := server.Logger.ContextLoggingFn(c)
+
+	if !checkOCIName(c, repo, name) {
+		return
+	}
+	if !ociTagRegexp.MatchString(tag) {
+		ociError(c, 400, ociErrorTagInvalid, "manifests must be pushed by a valid tag")
+		return
+	}
+	content, err := c.GetRawData()
+	if err != nil {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
+		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if len(content) > ociMaxManifestSize {
+		ociError(c, 400, ociErrorManifestInvalid, "manifest is too large")
+		return
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(content, &manifest); err != nil || manifest.SchemaVersion != 2 {
+		ociError(c, 400, ociErrorManifestInvalid, "manifest is not a valid OCI image manifest")
+		return
+	}
+	if manifest.Config.MediaType != ociHelmConfigMediaType {
+		ociError(c, 400, ociErrorUnsupported, "only Helm chart artifacts are supported")
+		return
+	}
+
+	var chartLayer, provLayer *ociDescriptor
+	for i, layer := range manifest.Layers {
+		switch layer.MediaType {
+		case ociHelmChartMediaType:
+			chartLayer = &manifest.Layers[i]
+		case ociHelmProvenanceMediaType:
+			provLayer = &manifest.Layers[i]
+		}
+	}
+	if chartLayer == nil {
+		ociError(c, 400, ociErrorManifestInvalid, "manifest has no chart layer")
+		return
+	}
+
+	chartContent, httpErr := server.getOCILayer(repo, chartLayer)
+	if httpErr != nil {
+		ociError(c, httpErr.Status, ociErrorManifestBlobUnknown, httpErr.Message)
+		return
+	}
+	filename, err := cm_repo.ChartPackageFilenameFromContent(chartContent)
+	if err != nil {
+		ociError(c, 400, ociErrorManifestInvalid, err.Error())
+		return
+	}
+	// Helm tags chart versions with "+" replaced by "_", as "+" is not allowed in tags
+	expectedFilename := cm_repo.ChartPackageFilenameFromNameVersion(name, strings.Replace(tag, "_", "+", -1))
+	if filename != expectedFilename {
+		ociError(c, 400, ociErrorNameInvalid, fmt.Sprintf("chart %s does not match %s:%s", filename, ociName(repo, name), tag))
+		return
+	}
+
+	force := forceQuery(c)
+	if httpErr := server.uploadChartPackage(log, repo, bytes.NewReader(chartContent), force, server.pushAnnotations(c)); httpErr != nil {
+		c.JSON(httpErr.Status, gin.H{"error": httpErr.Message})
+		return
+	}
+	if provLayer != nil {
+		provContent, httpErr := server.getOCILayer(repo, provLayer)
+		if httpErr == nil {
+			httpErr = server.uploadProvenanceFile(log, repo, provContent, force)
+		}
+		if httpErr != nil {
+			c.JSON(httpErr.Status, gin.H{"error": httpErr.Message})
+			return
+		}
+	}
+
+	digest := ociDigest(content)
+	if err := server.StorageBackend.PutObject(ociBlobPath(repo, digest), content); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	if err := server.StorageBackend.PutObject(ociTagPath(repo, name, tag), []byte(digest)); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", err)})
+		return
+	}
+	c.Header("Location", server.ociURL(repo, name, "manifests", digest))
+	c.Header(ociContentDigestHeader, digest)
+	c.Status(201)
+}
+
+func (server *MultiTenantServer) getOCILayer(repo string, layer *ociDescriptor) ([]byte, *HTTPError) {
+	if !ociDigestRegexp.MatchString(layer.Digest) {
+		return nil, &HTTPError{400, "invalid layer digest " + layer.Digest}
+	}
+	object, err := server.StorageBackend.GetObject(ociBlobPath(repo, layer.Digest))
+	if err != nil {
+		return nil, &HTTPError{400, "layer blob " + layer.Digest + " has not been uploaded"}
+	}
+	return object.Content, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+)
+
+const (
+	// number of locks object paths are spread over when checking push preconditions
+	objectLockStripes = 64
+)
+
+type (
+	// pushPreconditions are the If-Match and If-None-Match headers of a chart package push.
+	// The ETag of a chart package is its quoted sha256 digest, as listed in index.yaml
+	pushPreconditions struct {
+		ifMatch     string
+		ifNoneMatch string
+	}
+
+	// objectLocks serializes precondition checks and writes to the same object path
+	objectLocks struct {
+		stripes [objectLockStripes]sync.Mutex
+	}
+)
+
+func pushPreconditionsFromRequest(request *http.Request) pushPreconditions {
+	return pushPreconditions{
+		ifMatch:     strings.TrimSpace(request.Header.Get("If-Match")),
+		ifNoneMatch: strings.TrimSpace(request.Header.Get("If-None-Match")),
+	}
+}
+
+// empty reports whether the push is unconditional
+func (preconditions pushPreconditions) empty() bool {
+	return preconditions.ifMatch == "" && preconditions.ifNoneMatch == ""
+}
+
+// overwrites reports whether the push asks to replace an existing chart package with a
+// given digest, in which case it counts as a forced overwrite
+func (preconditions pushPreconditions) overwrites() bool {
+	return preconditions.ifMatch != ""
+}
+
+// lock locks paths until the returned function is called. Locks are always taken in the
+// same order, so that pushes of several objects cannot deadlock
+func (locks *objectLocks) lock(paths ...string) func() {
+	var stripes []int
+	seen := map[int]bool{}
+	for _, path := range paths {
+		hash := fnv.New32a()
+		hash.Write([]byte(path))
+		stripe := int(hash.Sum32() % objectLockStripes)
+		if !seen[stripe] {
+			seen[stripe] = true
+			stripes = append(stripes, stripe)
+		}
+	}
+	sort.Ints(stripes)
+	for _, stripe := range stripes {
+		locks.stripes[stripe].Lock()
+	}
+	return func() {
+		for _, stripe := range stripes {
+			locks.stripes[stripe].Unlock()
+		}
+	}
+}
+
+// objectETag returns a strong ETag for the content of a storage object
+func objectETag(content []byte) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(content))
+}
+
+// checkPushPreconditions compares the chart package stored at path with the preconditions,
+// returning a 412 if they are not met. The caller must hold the lock for path until the
+// chart package is stored, so that no other push gets in between
+func (server *MultiTenantServer) checkPushPreconditions(log cm_logger.LoggingFn, path string, preconditions pushPreconditions) *HTTPError {
+	var etag string
+	object, err := server.StorageBackend.GetObject(path)
+	exists := err == nil
+	if exists {
+		etag = objectETag(object.Content)
+	}
+
+	if preconditions.ifMatch != "" && (!exists || !etagListMatches(preconditions.ifMatch, etag, false)) {
+		log(cm_logger.DebugLevel, "Push precondition failed",
+			"object", path,
+			"ifMatch", preconditions.ifMatch,
+			"etag", etag,
+		)
+		if !exists {
+			return &HTTPError{412, "precondition failed: file does not exist"}
+		}
+		return &HTTPError{412, fmt.Sprintf("precondition failed: file has ETag %s", etag)}
+	}
+
+	if preconditions.ifNoneMatch != "" && exists && etagListMatches(preconditions.ifNoneMatch, etag, true) {
+		log(cm_logger.DebugLevel, "Push precondition failed",
+			"object", path,
+			"ifNoneMatch", preconditions.ifNoneMatch,
+			"etag", etag,
+		)
+		return &HTTPError{412, "precondition failed: file already exists"}
+	}
+
+	return nil
+}
+
+// etagListMatches reports whether etag is in a list of ETags from an If-Match or If-None-Match
+// header, or the list is "*". Weak ETags only match with weak comparison. A bare sha256 digest,
+// optionally prefixed with "sha256:", is accepted in place of a quoted ETag
+func etagListMatches(list string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if !strings.HasPrefix(candidate, `"`) {
+			candidate = fmt.Sprintf(`"%s"`, strings.ToLower(strings.TrimPrefix(candidate, "sha256:")))
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	pathutil "path"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+	cm_storage "github.com/helm/chartmuseum/pkg/storage"
+
+	"github.com/gin-gonic/gin"
+	helm_repo "k8s.io/helm/pkg/repo"
+)
+
+// promoteChartVersionRequestHandler copies a chart version to the repo given by the "to" query
+// parameter. The route only needs a pull from the repo of the chart, and the request must also
+// be allowed to push to the other repo
+func (server *MultiTenantServer) promoteChartVersionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	dstRepo := c.Query("to")
+	if dstRepo == repo || !server.Router.IsValidRepo(dstRepo) {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("cannot promote from repo %q to repo %q", repo, dstRepo)})
+		return
+	}
+	if !server.Router.AuthorizeRepoPush(c, dstRepo) {
+		return
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	err := server.promoteChartVersion(log, repo, dstRepo, c.Param("name"), c.Param("version"), forceQuery(c))
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(201, objectSavedResponse)
+}
+
+// promoteChartVersion copies a chart package from the index of repo, along with its provenance
+// file and annotations, to dstRepo, where it goes through the same checks as a push. The copy
+// is added to the index of dstRepo as pushed now
+func (server *MultiTenantServer) promoteChartVersion(log cm_logger.LoggingFn, repo string, dstRepo string, name string, version string, force bool) *HTTPError {
+	chartVersion, err := server.getChartVersion(log, repo, name, version)
+	if err != nil {
+		return err
+	}
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)
+	dstPath := pathutil.Join(dstRepo, filename)
+	unlock := server.pushLocks.lock(dstPath)
+	defer unlock()
+	if chartNameErr := server.checkChartName(log, dstRepo, chartVersion.Name); chartNameErr != nil {
+		return chartNameErr
+	}
+	overwritten, overwriteErr := server.checkOverwrite(log, dstPath, force)
+	if overwriteErr != nil {
+		return overwriteErr
+	}
+	if versionLimitErr := server.checkVersionLimit(log, dstRepo, chartVersion.Name, chartVersion.Version); versionLimitErr != nil {
+		return versionLimitErr
+	}
+	limitReached, limitErr := server.checkStorageLimit(dstRepo, filename, force)
+	if limitErr != nil {
+		return &HTTPError{500, limitErr.Error()}
+	}
+	if limitReached {
+		return &HTTPError{507, "repo has reached storage limit"}
+	}
+
+	log(cm_logger.DebugLevel, "Copying package in storage",
+		"package", filename,
+		"from", repo,
+		"to", dstRepo,
+	)
+	pushed := time.Now()
+	if copyErr := server.copyObject(pathutil.Join(repo, filename), dstPath); copyErr != nil {
+		return &HTTPError{500, copyErr.Error()}
+	}
+	provFilename := cm_repo.ProvenanceFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)
+	// ignore error here, may be no prov file
+	server.copyObject(pathutil.Join(repo, provFilename), pathutil.Join(dstRepo, provFilename))
+	// the annotations and push time go once the package is copied, as on push
+	server.storeChartSidecars(log, dstRepo, filename, pushed, server.chartAnnotations(repo, filename), overwritten)
+
+	meta := *chartVersion.Metadata
+	server.chartVersionStored(log, dstRepo, &helm_repo.ChartVersion{
+		URLs:     []string{fmt.Sprintf("charts/%s", filename)},
+		Metadata: &meta,
+		Digest:   chartVersion.Digest,
+		Created:  pushed,
+	})
+	return nil
+}
+
+// copyObject copies an object in storage, by the storage backend itself if it can, otherwise
+// by reading the object and writing it again
+func (server *MultiTenantServer) copyObject(srcPath string, dstPath string) error {
+	if copier, ok := server.StorageBackend.(cm_storage.Copier); ok {
+		err := copier.CopyObject(srcPath, dstPath)
+		if err != cm_storage.ErrCopyNotSupported {
+			return err
+		}
+	}
+	object, err := server.StorageBackend.GetObject(srcPath)
+	if err != nil {
+		return err
+	}
+	return server.StorageBackend.PutObject(dstPath, object.Content)
+}
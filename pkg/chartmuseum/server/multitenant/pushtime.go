@@ -0,0 +1,109 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	pathutil "path"
+	"strings"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+)
+
+// chartPushTimeSuffix is appended to the name of a chart package for the object holding the
+// time it was pushed
+const chartPushTimeSuffix = ".pushed"
+
+func chartPushTimePath(repo string, filename string) string {
+	return pathutil.Join(repo, filename+chartPushTimeSuffix)
+}
+
+// storeChartPushTime stores the time a chart package is pushed, which is its created time in
+// the index. It is stored once the package itself is, see storeChartSidecars
+func (server *MultiTenantServer) storeChartPushTime(repo string, filename string, pushed time.Time) error {
+	content := []byte(pushed.UTC().Format(time.RFC3339Nano))
+	return server.StorageBackend.PutObject(chartPushTimePath(repo, filename), content)
+}
+
+// removeChartPushTime removes the push time stored for a chart package which was deleted
+func (server *MultiTenantServer) removeChartPushTime(repo string, filename string) {
+	server.StorageBackend.DeleteObject(chartPushTimePath(repo, filename))
+}
+
+// chartPushTime reads the push time stored for a chart package. There is none for a package
+// put in storage directly, or pushed before push times were stored
+func (server *MultiTenantServer) chartPushTime(repo string, filename string) (time.Time, bool) {
+	object, err := server.StorageBackend.GetObject(chartPushTimePath(repo, filename))
+	if err != nil {
+		return time.Time{}, false
+	}
+	pushed, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(object.Content)))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return pushed, true
+}
+
+// storeChartSidecars stores the push time and annotations of a chart package which has just been
+// stored. They are only written once the package is, so that a failed put leaves the sidecars of
+// the package it was meant to overwrite in place. Should they fail, the package is still in the
+// index with them, until an index rebuilt from storage falls back to its modification time
+func (server *MultiTenantServer) storeChartSidecars(log cm_logger.LoggingFn, repo string, filename string, pushed time.Time, annotations map[string]string, overwritten bool) {
+	if err := server.storeChartPushTime(repo, filename, pushed); err != nil {
+		log(cm_logger.ErrorLevel, "Could not store chart push time",
+			"repo", repo,
+			"package", filename,
+			"error", err.Error(),
+		)
+	}
+	if err := server.storeChartAnnotations(repo, filename, annotations, overwritten); err != nil {
+		log(cm_logger.ErrorLevel, "Could not store chart annotations",
+			"repo", repo,
+			"package", filename,
+			"error", err.Error(),
+		)
+	}
+}
+
+// setChartSidecars records the push times and annotations found by a listing of repo
+func (server *MultiTenantServer) setChartSidecars(repo string, sidecars map[string]bool) {
+	tenant := server.getTenant(repo)
+	if tenant == nil {
+		return
+	}
+	tenant.FetchedObjectsLock.Lock()
+	tenant.ChartSidecars = sidecars
+	tenant.FetchedObjectsLock.Unlock()
+}
+
+// hasChartSidecar reports whether the sidecar at path, relative to repo, may be in storage. Only
+// the sidecars found by the last listing of repo are, or any of them if repo was never listed
+func (server *MultiTenantServer) hasChartSidecar(repo string, path string) bool {
+	tenant := server.getTenant(repo)
+	if tenant == nil {
+		return true
+	}
+	tenant.FetchedObjectsLock.Lock()
+	defer tenant.FetchedObjectsLock.Unlock()
+	return tenant.ChartSidecars == nil || tenant.ChartSidecars[path]
+}
+
+// isChartSidecar reports whether an object is stored alongside a chart package, for its
+// annotations or push time
+func isChartSidecar(path string) bool {
+	return strings.HasSuffix(path, chartAnnotationsSuffix) || strings.HasSuffix(path, chartPushTimeSuffix)
+}
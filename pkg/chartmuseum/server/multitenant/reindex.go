@@ -0,0 +1,102 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+)
+
+type (
+	// reindexSchedule rebuilds every known repo index from storage every Interval, plus a
+	// random delay of up to Jitter, so that replicas sharing storage do not rebuild at once
+	reindexSchedule struct {
+		Interval time.Duration
+		Jitter   time.Duration
+	}
+)
+
+// next returns how long to wait before the next run
+func (schedule *reindexSchedule) next() time.Duration {
+	delay := schedule.Interval
+	if schedule.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(schedule.Jitter)))
+	}
+	return delay
+}
+
+// runReindex rebuilds the known repo indexes on schedule until the router is stopped
+func (server *MultiTenantServer) runReindex(stop <-chan struct{}) {
+	for {
+		timer := time.NewTimer(server.reindex.next())
+		select {
+		case <-timer.C:
+			server.reindexRepos()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// reindexRepos rebuilds the index of every known repo, one after the other
+func (server *MultiTenantServer) reindexRepos() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	for _, repo := range server.knownRepos() {
+		server.reindexRepo(log, repo)
+	}
+}
+
+// reindexRepo rebuilds the index of repo, and records when it last succeeded. A failed
+// rebuild is only logged, the cached index is still served until the next run. It is skipped
+// while a request rebuilds the index after the cache TTL, as requests skip theirs meanwhile
+func (server *MultiTenantServer) reindexRepo(log cm_logger.LoggingFn, repo string) (err *HTTPError) {
+	if _, initErr := server.initCacheEntry(log, repo); initErr != nil {
+		log(cm_logger.ErrorLevel, "Background reindex failed",
+			"repo", repo,
+			"error", initErr.Error(),
+		)
+		return &HTTPError{500, initErr.Error()}
+	}
+	if !server.claimRebuild(repo, false) {
+		log(cm_logger.DebugLevel, "Index is already being rebuilt, skipping background reindex",
+			"repo", repo,
+		)
+		return nil
+	}
+	defer server.releaseRebuild(repo)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = &HTTPError{500, fmt.Sprint(r)}
+		}
+		if err != nil {
+			log(cm_logger.ErrorLevel, "Background reindex failed",
+				"repo", repo,
+				"error", err.Message,
+			)
+			return
+		}
+		indexLastReindexGaugeVec.WithLabelValues(repo).Set(float64(time.Now().Unix()))
+	}()
+	_, err = server.rebuildIndex(log, repo)
+	return err
+}
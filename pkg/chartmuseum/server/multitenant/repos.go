@@ -0,0 +1,170 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	pathutil "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+	cm_storage "github.com/helm/chartmuseum/pkg/storage"
+)
+
+const (
+	// how long the list of repos is reused before storage is scanned again
+	repoListCacheTTL = time.Minute
+)
+
+type (
+	// repoSummary describes a repo found in storage
+	repoSummary struct {
+		Name     string `json:"name"`
+		Charts   int    `json:"charts"`
+		Versions int    `json:"versions"`
+	}
+
+	// repoStats describes the contents of a repo, as of the last time its index was
+	// brought up to date
+	repoStats struct {
+		Name     string `json:"name"`
+		Charts   int    `json:"charts"`
+		Versions int    `json:"versions"`
+		Bytes    int64  `json:"bytes"`
+	}
+
+	// repoListCache keeps the last list of repos, since finding them means listing every
+	// object in storage
+	repoListCache struct {
+		mu     sync.Mutex
+		listed time.Time
+		repos  []repoSummary
+	}
+)
+
+// listRepos returns the repos which have chart packages in storage, at the depth of the
+// router (or deeper, with variable depth), sorted by name
+func (server *MultiTenantServer) listRepos(log cm_logger.LoggingFn) ([]repoSummary, *HTTPError) {
+	cache := server.repoList
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.repos != nil && time.Since(cache.listed) < repoListCacheTTL {
+		return cache.repos, nil
+	}
+
+	lister, ok := server.StorageBackend.(cm_storage.RecursiveLister)
+	if !ok {
+		return nil, &HTTPError{501, cm_storage.ErrRecursiveListNotSupported.Error()}
+	}
+	log(cm_logger.DebugLevel, "Listing repos in storage")
+	objects, err := lister.ListObjectsRecursive("")
+	if err != nil {
+		if err == cm_storage.ErrRecursiveListNotSupported {
+			return nil, &HTTPError{501, err.Error()}
+		}
+		errStr := err.Error()
+		log(cm_logger.ErrorLevel, errStr)
+		return nil, &HTTPError{500, errStr}
+	}
+
+	depth := server.Router.Depth
+	charts := map[string]map[string]bool{}
+	versions := map[string]int{}
+	for _, object := range objects {
+		if !object.HasExtension(cm_repo.ChartPackageFileExtension) {
+			continue
+		}
+		dir, filename := pathutil.Split(object.Path)
+		dir = strings.TrimSuffix(dir, "/")
+		if dirDepth := repoDepth(dir); dirDepth < depth || (dirDepth > depth && !server.Router.VariableDepth) {
+			continue // not in a repo directory
+		}
+		chartVersion, err := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{Path: filename})
+		if err != nil {
+			continue
+		}
+		if charts[dir] == nil {
+			charts[dir] = map[string]bool{}
+		}
+		charts[dir][chartVersion.Name] = true
+		versions[dir]++
+	}
+
+	repos := []repoSummary{}
+	for repo, names := range charts {
+		repos = append(repos, repoSummary{Name: repo, Charts: len(names), Versions: versions[repo]})
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Name < repos[j].Name
+	})
+
+	cache.repos = repos
+	cache.listed = time.Now()
+	return repos, nil
+}
+
+// repoDepth returns the number of path segments of a repo, e.g. 2 for "org/repo"
+func repoDepth(repo string) int {
+	if repo == "" {
+		return 0
+	}
+	return strings.Count(repo, "/") + 1
+}
+
+// getRepoStats counts the charts and chart versions in the index of repo. The storage it
+// uses is the one summed up by the listing which brought the index up to date
+func (server *MultiTenantServer) getRepoStats(log cm_logger.LoggingFn, repo string) (*repoStats, *HTTPError) {
+	index, err := server.getIndexFile(log, repo)
+	if err != nil {
+		return nil, err
+	}
+	stats := &repoStats{Name: repo, Charts: len(index.Entries)}
+	for _, chartVersions := range index.Entries {
+		stats.Versions += len(chartVersions)
+	}
+	tenant, initErr := server.initTenant(log, repo)
+	if initErr != nil {
+		errStr := initErr.Error()
+		log(cm_logger.ErrorLevel, errStr,
+			"repo", repo,
+		)
+		return nil, &HTTPError{500, errStr}
+	}
+	tenant.FetchedObjectsLock.Lock()
+	stats.Bytes = tenant.StorageBytes
+	tenant.FetchedObjectsLock.Unlock()
+	return stats, nil
+}
+
+// setStorageUsage records the total size of the objects listed in repo
+func (server *MultiTenantServer) setStorageUsage(log cm_logger.LoggingFn, repo string, size int64) {
+	tenant, err := server.initTenant(log, repo)
+	if err != nil {
+		log(cm_logger.WarnLevel, "Could not record storage usage",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return
+	}
+	tenant.FetchedObjectsLock.Lock()
+	tenant.StorageBytes = size
+	tenant.FetchedObjectsLock.Unlock()
+	storageBytesGaugeVec.WithLabelValues(repo).Set(float64(size))
+}
@@ -0,0 +1,156 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+)
+
+const (
+	defaultRetentionInterval = time.Hour
+)
+
+type (
+	// retentionPolicy decides which chart versions are pruned. A version is pruned if it is
+	// not one of the KeepVersions newest versions of its chart, or if it is older than MaxAge
+	retentionPolicy struct {
+		KeepVersions int
+		MaxAge       time.Duration
+		Interval     time.Duration
+		DryRun       bool
+	}
+
+	prunedChartVersion struct {
+		name    string
+		version string
+	}
+)
+
+// enabled reports whether the policy would prune anything
+func (policy *retentionPolicy) enabled() bool {
+	return policy.KeepVersions > 0 || policy.MaxAge > 0
+}
+
+// runRetention applies the retention policy every interval until the router is stopped
+func (server *MultiTenantServer) runRetention(stop <-chan struct{}) {
+	interval := server.retention.Interval
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			server.applyRetention()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// applyRetention prunes every known repo, unless storage is not to change (maintenance mode)
+func (server *MultiTenantServer) applyRetention() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	if server.Router.Maintenance() {
+		log(cm_logger.InfoLevel, "Skipping retention policy in maintenance mode")
+		return
+	}
+	for _, repo := range server.knownRepos() {
+		server.pruneRepo(log, repo, time.Now())
+	}
+}
+
+// knownRepos returns the repos background jobs go through: the root repo with Depth 0,
+// otherwise the tenant repos which have been accessed since the server started
+func (server *MultiTenantServer) knownRepos() []string {
+	if server.Router.Depth == 0 && !server.Router.VariableDepth {
+		return []string{""}
+	}
+	var repos []string
+	server.TenantCacheKeyLock.Lock()
+	for repo := range server.Tenants {
+		repos = append(repos, repo)
+	}
+	server.TenantCacheKeyLock.Unlock()
+	return repos
+}
+
+// pruneRepo deletes the chart versions in repo which fall outside the retention policy
+// (or only logs them in dry-run mode), then regenerates the repo index
+func (server *MultiTenantServer) pruneRepo(log cm_logger.LoggingFn, repo string, now time.Time) []prunedChartVersion {
+	index, err := server.getIndexFile(log, repo)
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Retention policy could not load repo index",
+			"repo", repo,
+			"error", err.Message,
+		)
+		return nil
+	}
+
+	// the index served is never changed, pushes and deletes replace it with an updated copy,
+	// so its entries can be gone through while charts are pushed. Entries are sorted newest
+	// version first
+	var candidates []prunedChartVersion
+	for name, chartVersions := range index.Entries {
+		for i, chartVersion := range chartVersions {
+			tooMany := server.retention.KeepVersions > 0 && i >= server.retention.KeepVersions
+			tooOld := server.retention.MaxAge > 0 && now.Sub(chartVersion.Created) > server.retention.MaxAge
+			if tooMany || tooOld {
+				candidates = append(candidates, prunedChartVersion{name, chartVersion.Version})
+			}
+		}
+	}
+
+	dryRun := strconv.FormatBool(server.retention.DryRun)
+	var pruned []prunedChartVersion
+	for _, candidate := range candidates {
+		if server.retention.DryRun {
+			log(cm_logger.InfoLevel, "Retention policy would delete chart version (dry run)",
+				"repo", repo,
+				"name", candidate.name,
+				"version", candidate.version,
+			)
+		} else {
+			if err := server.deleteChartVersion(log, repo, candidate.name, candidate.version); err != nil {
+				log(cm_logger.ErrorLevel, "Retention policy could not delete chart version",
+					"repo", repo,
+					"name", candidate.name,
+					"version", candidate.version,
+					"error", err.Message,
+				)
+				continue
+			}
+			log(cm_logger.InfoLevel, "Retention policy deleted chart version",
+				"repo", repo,
+				"name", candidate.name,
+				"version", candidate.version,
+			)
+		}
+		retentionPrunedCounterVec.WithLabelValues(repo, dryRun).Inc()
+		pruned = append(pruned, candidate)
+	}
+
+	if len(pruned) > 0 && !server.retention.DryRun {
+		server.getIndexFile(log, repo)
+	}
+	return pruned
+}
@@ -26,28 +26,66 @@ func (s *MultiTenantServer) Routes() []*cm_router.Route {
 	serverInfoRoutes := []*cm_router.Route{
 		{"GET", "/", s.getWelcomePageHandler, cm_router.RepoPullAction},
 		{"GET", "/health", s.getHealthCheckHandler, cm_router.SystemInfoAction},
+		{"GET", "/readiness", s.getReadinessCheckHandler, cm_router.SystemInfoAction},
 	}
 
 	helmChartRepositoryRoutes := []*cm_router.Route{
-		{"GET", "/:repo/index.yaml", s.getIndexFileRequestHandler, cm_router.RepoPullAction},
-		{"GET", "/:repo/charts/:filename", s.getStorageObjectRequestHandler, cm_router.RepoPullAction},
+		{"GET", "/:repo/index.yaml", s.indexRequired(s.getIndexFileRequestHandler), cm_router.RepoPullAction},
+		{"GET", "/:repo/index.json", s.indexRequired(s.getIndexJSONFileRequestHandler), cm_router.RepoPullAction},
+		{"GET", "/:repo/charts/:filename", s.indexRequired(s.getStorageObjectRequestHandler), cm_router.RepoPullAction},
+		{"HEAD", "/:repo/charts/:filename", s.indexRequired(s.headStorageObjectRequestHandler), cm_router.RepoPullAction},
+	}
+
+	indexSignatureRoutes := []*cm_router.Route{
+		{"GET", "/:repo/index.yaml.prov", s.indexRequired(s.getIndexSignatureRequestHandler), cm_router.RepoPullAction},
 	}
 
 	chartManipulationRoutes := []*cm_router.Route{
-		{"GET", "/api/:repo/charts", s.getAllChartsRequestHandler, cm_router.RepoPullAction},
-		{"GET", "/api/:repo/charts/:name", s.getChartRequestHandler, cm_router.RepoPullAction},
-		{"GET", "/api/:repo/charts/:name/:version", s.getChartVersionRequestHandler, cm_router.RepoPullAction},
-		{"POST", "/api/:repo/charts", s.postRequestHandler, cm_router.RepoPushAction},
-		{"POST", "/api/:repo/prov", s.postProvenanceFileRequestHandler, cm_router.RepoPushAction},
-		{"DELETE", "/api/:repo/charts/:name/:version", s.deleteChartVersionRequestHandler, cm_router.RepoPushAction},
+		{"GET", "/api/repos", s.getReposRequestHandler, cm_router.SystemReadAction},
+		{"POST", "/api/maintenance", s.postMaintenanceRequestHandler, cm_router.SystemAdminAction},
+		{"GET", "/api/:repo/stats", s.getRepoStatsRequestHandler, cm_router.RepoPullAction},
+		{"GET", "/api/:repo/charts", s.indexRequired(s.getAllChartsRequestHandler), cm_router.RepoPullAction},
+		// must come before /charts/:name so that "search" isn't taken for a chart name
+		{"GET", "/api/:repo/charts/search", s.indexRequired(s.searchChartsRequestHandler), cm_router.RepoPullAction},
+		{"GET", "/api/:repo/charts/:name", s.indexRequired(s.getChartRequestHandler), cm_router.RepoPullAction},
+		{"GET", "/api/:repo/charts/:name/:version", s.indexRequired(s.getChartVersionRequestHandler), cm_router.RepoPullAction},
+		{"HEAD", "/api/:repo/charts/:name/:version", s.indexRequired(s.headChartVersionRequestHandler), cm_router.RepoPullAction},
+		{"POST", "/api/:repo/charts", s.audited(s.postRequestHandler), cm_router.RepoPushAction},
+		{"PUT", "/api/:repo/charts/:name/:version", s.audited(s.putChartVersionRequestHandler), cm_router.RepoPushAction},
+		{"POST", "/api/:repo/charts/validate", s.postValidateChartRequestHandler, cm_router.RepoPushAction},
+		// needs a push to the repo promoted to as well, checked by the handler
+		{"POST", "/api/:repo/charts/:name/:version/promote", s.audited(s.promoteChartVersionRequestHandler), cm_router.RepoPullAction},
+		{"POST", "/api/:repo/prov", s.audited(s.postProvenanceFileRequestHandler), cm_router.RepoPushAction},
+		{"DELETE", "/api/:repo/charts/:name/:version", s.audited(s.deleteChartVersionRequestHandler), cm_router.RepoPushAction},
+		{"DELETE", "/api/:repo/charts/:name", s.audited(s.deleteChartVersionsRequestHandler), cm_router.RepoPushAction},
+		{"POST", "/api/:repo/cache/invalidate", s.invalidateCacheRequestHandler, cm_router.RepoPushAction},
+	}
+
+	ociRoutes := []*cm_router.Route{
+		{"GET", "/v2/", s.getOCIBaseHandler, cm_router.RepoPullAction},
+		{"GET", "/v2/:repo/:name/manifests/:reference", s.getOCIManifestHandler, cm_router.RepoPullAction},
+		{"HEAD", "/v2/:repo/:name/manifests/:reference", s.getOCIManifestHandler, cm_router.RepoPullAction},
+		{"PUT", "/v2/:repo/:name/manifests/:reference", s.audited(s.putOCIManifestHandler), cm_router.RepoPushAction},
+		{"GET", "/v2/:repo/:name/blobs/:digest", s.getOCIBlobHandler, cm_router.RepoPullAction},
+		{"HEAD", "/v2/:repo/:name/blobs/:digest", s.getOCIBlobHandler, cm_router.RepoPullAction},
+		{"POST", "/v2/:repo/:name/blobs/uploads/", s.postOCIBlobUploadHandler, cm_router.RepoPushAction},
+		{"PUT", "/v2/:repo/:name/blobs/uploads/:uuid", s.putOCIBlobUploadHandler, cm_router.RepoPushAction},
 	}
 
 	routes = append(routes, serverInfoRoutes...)
 	routes = append(routes, helmChartRepositoryRoutes...)
 
+	if s.indexSigner != nil {
+		routes = append(routes, indexSignatureRoutes...)
+	}
+
 	if s.APIEnabled {
 		routes = append(routes, chartManipulationRoutes...)
 	}
 
+	if s.oci != nil {
+		routes = append(routes, ociRoutes...)
+	}
+
 	return routes
 }
@@ -18,8 +18,11 @@ package multitenant
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/helm/chartmuseum/pkg/cache"
@@ -36,8 +39,11 @@ var (
 )
 
 const (
-	defaultFormField = "chart"
-	defaultProvField = "prov"
+	defaultFormField        = "chart"
+	defaultProvField        = "prov"
+	defaultReadinessTimeout = 5 * time.Second
+
+	defaultPresignedURLExpiry = 5 * time.Minute
 )
 
 type (
@@ -49,17 +55,41 @@ type (
 		ExternalCacheStore     cache.Store
 		InternalCacheStore     map[string]*cacheEntry
 		MaxStorageObjects      int
+		MaxVersionsPerChart    int
+		MaxChartSize           int
+		IgnoreChartNameCase    bool
 		IndexLimit             int
 		AllowOverwrite         bool
 		AllowForceOverwrite    bool
+		ValidateCharts         bool
 		APIEnabled             bool
 		UseStatefiles          bool
 		ChartURL               string
 		ChartPostFormFieldName string
 		ProvPostFormFieldName  string
+		ReadinessTimeout       time.Duration
+		IndexReconcileInterval time.Duration
+		CacheTTL               time.Duration
+		PresignedRedirect      bool
+		PresignedURLExpiry     time.Duration
+		IndexVersionOrder      cm_repo.VersionOrder
+		ChartURLTemplate       *cm_repo.ChartURLTemplate
+		PushAnnotations        map[string]string
 		Limiter                chan struct{}
 		Tenants                map[string]*tenantInternals
 		TenantCacheKeyLock     *sync.Mutex
+		webhooks               *webhookNotifier
+		audit                  *auditLog
+		cacheNotifier          cache.Notifier
+		oci                    *ociRegistry
+		retention              *retentionPolicy
+		reindex                *reindexSchedule
+		indexSigner            *indexSigner
+		pushLocks              *objectLocks
+		repoList               *repoListCache
+		upstream               *upstreamRepo
+		buildIndexOnListen     bool
+		initialIndexBuild      int32 // set while the initial index is built, see startInitialIndexBuild
 	}
 
 	// MultiTenantServerOptions are options for constructing a MultiTenantServer
@@ -69,15 +99,41 @@ type (
 		StorageBackend         storage.Backend
 		ExternalCacheStore     cache.Store
 		ChartURL               string
+		ExternalURL            string
 		ChartPostFormFieldName string
 		ProvPostFormFieldName  string
 		MaxStorageObjects      int
+		MaxVersionsPerChart    int
+		MaxChartSize           int
+		IgnoreChartNameCase    bool
 		IndexLimit             int
 		GenIndex               bool
 		AllowOverwrite         bool
 		AllowForceOverwrite    bool
+		ValidateCharts         bool
 		EnableAPI              bool
 		UseStatefiles          bool
+		ReadinessTimeout       time.Duration
+		WebhookURLs            []string
+		WebhookSecret          string
+		RetentionKeepVersions  int
+		RetentionMaxAge        time.Duration
+		RetentionInterval      time.Duration
+		RetentionDryRun        bool
+		ReindexInterval        time.Duration
+		ReindexJitter          time.Duration
+		IndexReconcileInterval time.Duration
+		CacheTTL               time.Duration
+		PresignedRedirect      bool
+		PresignedURLExpiry     time.Duration
+		EnableOCI              bool
+		IndexSigner            *cm_repo.IndexSigner
+		IndexVersionOrder      cm_repo.VersionOrder
+		ChartURLTemplate       *cm_repo.ChartURLTemplate
+		PushAnnotations        map[string]string
+		AuditLog               io.Writer
+		BuildIndexOnListen     bool
+		UpstreamRepoURL        string
 	}
 
 	tenantInternals struct {
@@ -85,6 +141,20 @@ type (
 		RegenerationLock        *sync.Mutex
 		FetchedObjectsChans     []chan fetchedObjects
 		RegeneratedIndexesChans []chan indexRegeneration
+		LastReconciled          time.Time
+		LastRebuilt             time.Time
+		// Rebuilding is set while a request rebuilds the index once the cache TTL has passed
+		Rebuilding bool
+		// StorageToken is the change token of the chart packages in storage the cached
+		// index was built from, if it is known to match them
+		StorageToken string
+		// StorageBytes is the total size of the objects in the repo, as of the last listing
+		StorageBytes int64
+		// HasCharts is set if the index last cached had charts, see isKnownTenant
+		HasCharts bool
+		// ChartSidecars holds the paths of the push times and annotations found by the last
+		// listing of the repo, nil until it is listed
+		ChartSidecars map[string]bool
 	}
 
 	fetchedObjects struct {
@@ -101,8 +171,15 @@ type (
 // NewMultiTenantServer creates a new MultiTenantServer instance
 func NewMultiTenantServer(options MultiTenantServerOptions) (*MultiTenantServer, error) {
 	var chartURL string
-	if options.ChartURL != "" {
+	if options.ExternalURL != "" {
+		// the external URL replaces the host and context path entirely, e.g. for a CDN
+		chartURL = strings.TrimSuffix(options.ExternalURL, "/")
+	} else if options.ChartURL != "" {
 		chartURL = options.ChartURL + options.Router.ContextPath
+	} else {
+		// without an absolute URL, links in index.yaml start with the context path so
+		// that they resolve correctly behind a reverse proxy
+		chartURL = options.Router.ContextPath
 	}
 
 	server := &MultiTenantServer{
@@ -112,21 +189,88 @@ func NewMultiTenantServer(options MultiTenantServerOptions) (*MultiTenantServer,
 		ExternalCacheStore:     options.ExternalCacheStore,
 		InternalCacheStore:     map[string]*cacheEntry{},
 		MaxStorageObjects:      options.MaxStorageObjects,
+		MaxVersionsPerChart:    options.MaxVersionsPerChart,
+		MaxChartSize:           options.MaxChartSize,
+		IgnoreChartNameCase:    options.IgnoreChartNameCase,
 		IndexLimit:             options.IndexLimit,
 		ChartURL:               chartURL,
 		ChartPostFormFieldName: options.ChartPostFormFieldName,
 		ProvPostFormFieldName:  options.ProvPostFormFieldName,
 		AllowOverwrite:         options.AllowOverwrite,
 		AllowForceOverwrite:    options.AllowForceOverwrite,
+		ValidateCharts:         options.ValidateCharts,
 		APIEnabled:             options.EnableAPI,
 		UseStatefiles:          options.UseStatefiles,
+		ReadinessTimeout:       options.ReadinessTimeout,
+		IndexReconcileInterval: options.IndexReconcileInterval,
+		CacheTTL:               options.CacheTTL,
+		PresignedRedirect:      options.PresignedRedirect,
+		PresignedURLExpiry:     options.PresignedURLExpiry,
+		IndexVersionOrder:      options.IndexVersionOrder,
+		ChartURLTemplate:       options.ChartURLTemplate,
+		PushAnnotations:        options.PushAnnotations,
 		Limiter:                make(chan struct{}, options.IndexLimit),
 		Tenants:                map[string]*tenantInternals{},
 		TenantCacheKeyLock:     &sync.Mutex{},
+		pushLocks:              &objectLocks{},
+		repoList:               &repoListCache{},
+	}
+
+	if notifier, ok := options.ExternalCacheStore.(cache.Notifier); ok {
+		server.cacheNotifier = notifier
+		notifier.Subscribe(server.invalidateTenant)
+	}
+
+	if options.EnableOCI {
+		server.oci = newOCIRegistry()
+	}
+
+	if len(options.WebhookURLs) > 0 {
+		server.webhooks = newWebhookNotifier(options.WebhookURLs, options.WebhookSecret, options.Logger)
+	}
+
+	if options.UpstreamRepoURL != "" {
+		upstream, err := newUpstreamRepo(options.UpstreamRepoURL)
+		if err != nil {
+			return nil, err
+		}
+		server.upstream = upstream
+	}
+
+	if options.AuditLog != nil {
+		server.audit = newAuditLog(options.AuditLog)
+		server.Router.Use(server.auditMiddleware)
 	}
 
+	if options.IndexSigner != nil {
+		server.indexSigner = newIndexSigner(options.IndexSigner)
+	}
+
+	retention := &retentionPolicy{
+		KeepVersions: options.RetentionKeepVersions,
+		MaxAge:       options.RetentionMaxAge,
+		Interval:     options.RetentionInterval,
+		DryRun:       options.RetentionDryRun,
+	}
+	if retention.enabled() {
+		server.retention = retention
+	}
+
+	if options.ReindexInterval > 0 {
+		server.reindex = &reindexSchedule{
+			Interval: options.ReindexInterval,
+			Jitter:   options.ReindexJitter,
+		}
+	}
+
+	server.Router.KnownTenant = server.isKnownTenant
 	server.Router.SetRoutes(server.Routes())
-	err := server.primeCache()
+	var err error
+	if options.BuildIndexOnListen {
+		server.buildIndexOnListen = true
+	} else {
+		err = server.primeCache()
+	}
 
 	if options.GenIndex && server.Router.Depth == 0 {
 		server.genIndex()
@@ -137,6 +281,15 @@ func NewMultiTenantServer(options MultiTenantServerOptions) (*MultiTenantServer,
 
 // Listen starts the router on a given port
 func (server *MultiTenantServer) Listen(port int) {
+	if server.retention != nil {
+		go server.runRetention(server.Router.Done())
+	}
+	if server.reindex != nil {
+		go server.runReindex(server.Router.Done())
+	}
+	if server.buildIndexOnListen {
+		server.startInitialIndexBuild()
+	}
 	server.Router.Start(port)
 }
 
@@ -18,15 +18,23 @@ package multitenant
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	pathutil "path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -34,9 +42,13 @@ import (
 	cm_router "github.com/helm/chartmuseum/pkg/chartmuseum/router"
 	"github.com/helm/chartmuseum/pkg/storage"
 
+	"github.com/ghodss/yaml"
 	"github.com/gin-gonic/gin"
 	"github.com/helm/chartmuseum/pkg/repo"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/suite"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	helm_repo "k8s.io/helm/pkg/repo"
 )
 
 var maxUploadSize = 1024 * 1024 * 20
@@ -404,7 +416,7 @@ func (suite *MultiTenantServerTestSuite) TestRegenerateRepositoryIndex() {
 
 	objects, err := server.fetchChartsInStorage(log, "")
 	diff := storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, entry.RepoIndex, diff)
 	suite.Nil(err, "no error regenerating repo index")
 
 	newtime := time.Now().Add(1 * time.Hour)
@@ -413,7 +425,7 @@ func (suite *MultiTenantServerTestSuite) TestRegenerateRepositoryIndex() {
 
 	objects, err = server.fetchChartsInStorage(log, "")
 	diff = storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, entry.RepoIndex, diff)
 	suite.Nil(err, "no error regenerating repo index with tarball updated")
 
 	brokenTarballFilename := pathutil.Join(suite.TempDirectory, "brokenchart.tgz")
@@ -422,24 +434,141 @@ func (suite *MultiTenantServerTestSuite) TestRegenerateRepositoryIndex() {
 	defer destFile.Close()
 	objects, err = server.fetchChartsInStorage(log, "")
 	diff = storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, entry.RepoIndex, diff)
 	suite.Nil(err, "error not returned with broken tarball added")
 
 	err = os.Chtimes(brokenTarballFilename, newtime, newtime)
 	suite.Nil(err, "no error changing modtime on broken tarball")
 	objects, err = server.fetchChartsInStorage(log, "")
 	diff = storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, entry.RepoIndex, diff)
 	suite.Nil(err, "error not returned with broken tarball updated")
 
 	err = os.Remove(brokenTarballFilename)
 	suite.Nil(err, "no error removing broken tarball")
 	objects, err = server.fetchChartsInStorage(log, "")
 	diff = storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects)
-	_, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	_, err = server.regenerateRepositoryIndexWorker(log, entry, entry.RepoIndex, diff)
 	suite.Nil(err, "error not returned with broken tarball removed")
 }
 
+func (suite *MultiTenantServerTestSuite) TestAddIndexObjectsAsync() {
+	server := suite.Depth0Server
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+
+	index := repo.NewIndex("", "", &repo.ServerInfo{})
+	objects := []storage.Object{
+		{Path: "missingchart-0.1.0.tgz"},
+		{Path: "mychart-0.1.0.tgz"},
+	}
+	err := server.addIndexObjectsAsync(log, "", index, nil, objects)
+	suite.NotNil(err, "error when an object cannot be fetched")
+	suite.Empty(index.Entries, "no object is added when one cannot be fetched")
+
+	err = server.addIndexObjectsAsync(log, "", index, nil, objects[1:])
+	suite.Nil(err, "no error when every object is fetched")
+	suite.Len(index.Entries["mychart"], 1, "fetched object is added to the index")
+}
+
+// unavailableBackend fails to get chart packages while unavailable is set
+type unavailableBackend struct {
+	storage.Backend
+	unavailable bool
+}
+
+func (b *unavailableBackend) GetObject(path string) (storage.Object, error) {
+	if b.unavailable && strings.HasSuffix(path, ".tgz") {
+		return storage.Object{Path: path}, errors.New("storage unavailable")
+	}
+	return b.Backend.GetObject(path)
+}
+
+// sidecarCountingBackend counts the sidecars fetched from storage
+type sidecarCountingBackend struct {
+	storage.Backend
+	mu      sync.Mutex
+	fetched []string
+}
+
+func (b *sidecarCountingBackend) GetObject(path string) (storage.Object, error) {
+	if isChartSidecar(path) {
+		b.mu.Lock()
+		b.fetched = append(b.fetched, path)
+		b.mu.Unlock()
+	}
+	return b.Backend.GetObject(path)
+}
+
+func (suite *MultiTenantServerTestSuite) TestSidecarsFetchedFromListing() {
+	dir := pathutil.Join(suite.TempDirectory, "sidecars")
+	os.MkdirAll(dir, os.ModePerm)
+	content, err := ioutil.ReadFile(otherTestTarballPath)
+	suite.Nil(err, "no error reading test tarball")
+	suite.Nil(ioutil.WriteFile(pathutil.Join(dir, pathutil.Base(otherTestTarballPath)), content, 0644))
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	backend := &sidecarCountingBackend{Backend: storage.NewLocalFilesystemBackend(dir)}
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         cm_router.NewRouter(cm_router.RouterOptions{Logger: logger}),
+		StorageBackend: backend,
+		IndexLimit:     1,
+	})
+	suite.Nil(err, "no error creating server")
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries, 1)
+	suite.Empty(backend.fetched, "no sidecar fetched for a package put in storage directly")
+
+	suite.Nil(server.storeChartPushTime("", "otherchart-0.1.0.tgz", time.Now()))
+	_, httpErr = server.rebuildIndex(log, "")
+	suite.Nil(httpErr)
+	suite.Equal([]string{"otherchart-0.1.0.tgz" + chartPushTimeSuffix}, backend.fetched, "only the listed sidecar is fetched")
+}
+
+func (suite *MultiTenantServerTestSuite) TestStorageUnavailable() {
+	dir := pathutil.Join(suite.TempDirectory, "unavailable")
+	os.MkdirAll(dir, os.ModePerm)
+	copyFile := func(path string) {
+		content, err := ioutil.ReadFile(path)
+		suite.Nil(err, "no error reading %s", path)
+		suite.Nil(ioutil.WriteFile(pathutil.Join(dir, pathutil.Base(path)), content, 0644))
+	}
+	copyFile(testTarballPath)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	backend := &unavailableBackend{Backend: storage.NewLocalFilesystemBackend(dir)}
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         cm_router.NewRouter(cm_router.RouterOptions{Logger: logger}),
+		StorageBackend: backend,
+		IndexLimit:     1,
+	})
+	suite.Nil(err, "no error creating server")
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries, 1)
+
+	copyFile(otherTestTarballPath)
+	backend.unavailable = true
+	_, httpErr = server.rebuildIndex(log, "")
+	suite.NotNil(httpErr, "error rebuilding the index while storage is unavailable")
+	entry, err := server.initCacheEntry(log, "")
+	suite.Nil(err)
+	suite.Len(entry.RepoIndex.Entries["mychart"], 1, "last good index is kept")
+
+	backend.unavailable = false
+	index, httpErr = server.rebuildIndex(log, "")
+	suite.Nil(httpErr, "no error once storage is available again")
+	suite.Len(index.Entries, 2)
+}
+
 func (suite *MultiTenantServerTestSuite) TestGenIndex() {
 	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
 		Debug:   true,
@@ -462,6 +591,35 @@ func (suite *MultiTenantServerTestSuite) TestGenIndex() {
 	suite.Contains(suite.LastPrinted, "apiVersion:", "--gen-index prints yaml")
 }
 
+func (suite *MultiTenantServerTestSuite) TestKnownTenant() {
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
+		Debug: true,
+	})
+	suite.Nil(err, "no error creating logger")
+
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Depth:         1,
+		EnableMetrics: true,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: suite.Depth0Server.StorageBackend,
+	})
+	suite.Nil(err, "no error creating server")
+	suite.NotNil(router.KnownTenant, "server tells the router which tenants it knows")
+
+	log := logger.ContextLoggingFn(&gin.Context{})
+	suite.False(server.isKnownTenant("org1"), "repo not initialized yet")
+	_, httpErr := server.getIndexFile(log, "org1")
+	suite.Nil(httpErr, "no error getting index of repo with charts")
+	suite.True(server.isKnownTenant("org1"), "repo with charts is known")
+	_, httpErr = server.getIndexFile(log, "notarepo")
+	suite.Nil(httpErr, "no error getting index of repo without charts")
+	suite.False(server.isKnownTenant("notarepo"), "repo without charts is not known")
+}
+
 func (suite *MultiTenantServerTestSuite) TestStatefiles() {
 	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{
 		Debug:   true,
@@ -536,6 +694,61 @@ generated: "2018-05-23T15:14:46-05:00"`)
 	suite.Contains(suite.LastPrinted, "apiVersion:", "--gen-index prints yaml")
 }
 
+func (suite *MultiTenantServerTestSuite) TestStatefileStorageToken() {
+	dir := pathutil.Join(suite.TempDirectory, "statefiletoken")
+	os.MkdirAll(dir, os.ModePerm)
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	suite.Nil(ioutil.WriteFile(pathutil.Join(dir, "mychart-0.1.0.tgz"), content, 0644), "no error storing chart package")
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	backend := storage.NewLocalFilesystemBackend(dir)
+	newServer := func() *MultiTenantServer {
+		router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger})
+		server, err := NewMultiTenantServer(MultiTenantServerOptions{
+			Logger:         logger,
+			Router:         router,
+			StorageBackend: backend,
+			IndexLimit:     1,
+			UseStatefiles:  true,
+		})
+		suite.Nil(err, "no error creating server")
+		return server
+	}
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	objects, err := backend.ListObjects("")
+	suite.Nil(err, "no error listing objects")
+	token := storage.ChangeToken(objects)
+	emptyIndex := []byte("apiVersion: v1\nentries: {}\ngenerated: \"2018-05-23T15:14:46-05:00\"\n")
+
+	raw, savedToken := splitStatefile(statefileContent(emptyIndex, token))
+	suite.Equal(emptyIndex, raw)
+	suite.Equal(token, savedToken)
+	raw, savedToken = splitStatefile(emptyIndex)
+	suite.Equal(emptyIndex, raw, "index-cache.yaml without token")
+	suite.Empty(savedToken)
+
+	// a matching token means index-cache.yaml is used as is, without comparing it with storage
+	statefilePath := pathutil.Join(dir, repo.StatefileFilename)
+	suite.Nil(ioutil.WriteFile(statefilePath, statefileContent(emptyIndex, token), 0644), "no error writing index-cache.yaml")
+	server := newServer()
+	suite.Equal(token, server.Tenants[""].StorageToken)
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Empty(index.Entries, "index from index-cache.yaml is trusted")
+	suite.Equal(emptyIndex, index.Raw, "token is not served in index.yaml")
+
+	// a stale token means index-cache.yaml is compared with storage
+	suite.Nil(ioutil.WriteFile(statefilePath, statefileContent(emptyIndex, "stale"), 0644), "no error writing index-cache.yaml")
+	server = newServer()
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "index is updated from storage")
+	suite.Equal(token, server.Tenants[""].StorageToken, "token is updated")
+}
+
 func (suite *MultiTenantServerTestSuite) TestDisabledServer() {
 	// Test that all /api routes disabled if EnableAPI=false
 	res := suite.doRequest("disabled", "GET", "/api/charts", nil, "")
@@ -560,15 +773,20 @@ func (suite *MultiTenantServerTestSuite) TestDisabledServer() {
 }
 
 func (suite *MultiTenantServerTestSuite) TestOverwriteServer() {
+	// Clear test repo, so that the first upload is not an overwrite
+	suite.doRequest("overwrite", "DELETE", "/api/charts/mychart/0.1.0", nil, "")
+
 	// Check if files can be overwritten
 	content, err := ioutil.ReadFile(testTarballPath)
 	suite.Nil(err, "no error opening test tarball")
 	body := bytes.NewBuffer(content)
 	res := suite.doRequest("overwrite", "POST", "/api/charts", body, "")
 	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Equal("/charts/mychart-0.1.0.tgz", res.Header().Get("Location"), "Location of the chart package")
 	body = bytes.NewBuffer(content)
 	res = suite.doRequest("overwrite", "POST", "/api/charts", body, "")
-	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Equal(200, res.Status(), "200 POST /api/charts overwriting the chart package")
+	suite.Equal("/charts/mychart-0.1.0.tgz", res.Header().Get("Location"), "Location of the chart package")
 
 	content, err = ioutil.ReadFile(testProvfilePath)
 	suite.Nil(err, "no error opening test provenance file")
@@ -581,10 +799,11 @@ func (suite *MultiTenantServerTestSuite) TestOverwriteServer() {
 
 	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
 	res = suite.doRequest("overwrite", "POST", "/api/charts", buf, w.FormDataContentType())
-	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Equal(200, res.Status(), "200 POST /api/charts overwriting the chart package")
 	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
 	res = suite.doRequest("overwrite", "POST", "/api/charts", buf, w.FormDataContentType())
-	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Equal(200, res.Status(), "200 POST /api/charts overwriting the chart package")
+	suite.Equal("/charts/mychart-0.1.0.tgz", res.Header().Get("Location"), "Location of the chart package")
 }
 
 func (suite *MultiTenantServerTestSuite) TestForceOverwriteServer() {
@@ -603,7 +822,13 @@ func (suite *MultiTenantServerTestSuite) TestForceOverwriteServer() {
 	suite.Equal(409, res.Status(), "409 POST /api/charts")
 	body = bytes.NewBuffer(content)
 	res = suite.doRequest("forceoverwrite", "POST", "/api/charts?force", body, "")
-	suite.Equal(201, res.Status(), "201 POST /api/charts?force")
+	suite.Equal(200, res.Status(), "200 POST /api/charts?force")
+	body = bytes.NewBuffer(content)
+	res = suite.doRequest("forceoverwrite", "POST", "/api/charts?force=true", body, "")
+	suite.Equal(200, res.Status(), "200 POST /api/charts?force=true")
+	body = bytes.NewBuffer(content)
+	res = suite.doRequest("forceoverwrite", "POST", "/api/charts?force=false", body, "")
+	suite.Equal(409, res.Status(), "409 POST /api/charts?force=false")
 
 	content, err = ioutil.ReadFile(testProvfilePath)
 	suite.Nil(err, "no error opening test provenance file")
@@ -629,7 +854,139 @@ func (suite *MultiTenantServerTestSuite) TestForceOverwriteServer() {
 	suite.Equal(409, res.Status(), "409 POST /api/charts")
 	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
 	res = suite.doRequest("forceoverwrite", "POST", "/api/charts?force", buf, w.FormDataContentType())
-	suite.Equal(201, res.Status(), "201 POST /api/charts?force")
+	suite.Equal(200, res.Status(), "200 POST /api/charts?force")
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res = suite.doRequest("forceoverwrite", "POST", "/api/charts?force=true", buf, w.FormDataContentType())
+	suite.Equal(200, res.Status(), "200 POST /api/charts?force=true")
+}
+
+// statingBackend counts the chart packages fetched from a backend which can stat them
+type statingBackend struct {
+	*storage.LocalFilesystemBackend
+	mu      sync.Mutex
+	fetched int
+}
+
+func (b *statingBackend) GetObject(path string) (storage.Object, error) {
+	if strings.HasSuffix(path, ".tgz") {
+		b.mu.Lock()
+		b.fetched++
+		b.mu.Unlock()
+	}
+	return b.LocalFilesystemBackend.GetObject(path)
+}
+
+func (suite *MultiTenantServerTestSuite) TestConditionalPush() {
+	dir := pathutil.Join(suite.TempDirectory, "conditional")
+	os.MkdirAll(dir, os.ModePerm)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger, MaxUploadSize: maxUploadSize})
+	backend := &statingBackend{LocalFilesystemBackend: storage.NewLocalFilesystemBackend(dir)}
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:              logger,
+		Router:              router,
+		StorageBackend:      backend,
+		IndexLimit:          1,
+		EnableAPI:           true,
+		AllowForceOverwrite: true,
+	})
+	suite.Nil(err, "no error creating server")
+
+	request := func(method string, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest(method, path, body)
+		for key, value := range headers {
+			c.Request.Header.Set(key, value)
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(content))
+
+	res := request("POST", "/api/charts", bytes.NewBuffer(content), map[string]string{"If-Match": etag})
+	suite.Equal(412, res.Code, "412 POST /api/charts with If-Match for a missing version")
+
+	res = request("POST", "/api/charts", bytes.NewBuffer(content), map[string]string{"If-None-Match": "*"})
+	suite.Equal(201, res.Code, "201 POST /api/charts with If-None-Match for a new version")
+
+	res = request("POST", "/api/charts", bytes.NewBuffer(content), map[string]string{"If-None-Match": "*"})
+	suite.Equal(412, res.Code, "412 POST /api/charts with If-None-Match for an existing version")
+
+	// the index is brought up to date with storage first, which may read the package
+	res = request("GET", "/index.yaml", nil, nil)
+	suite.Equal(200, res.Code, "200 GET /index.yaml")
+	fetched := backend.fetched
+	res = request("HEAD", "/charts/mychart-0.1.0.tgz", nil, nil)
+	suite.Equal(200, res.Code, "200 HEAD /charts/mychart-0.1.0.tgz")
+	suite.Equal(fetched, backend.fetched, "chart package not fetched from storage for a HEAD")
+	suite.Equal(etag, res.Header().Get("ETag"), "chart package ETag is its digest")
+	suite.Equal("attachment; filename=mychart-0.1.0.tgz", res.Header().Get("Content-Disposition"))
+	suite.Equal(fmt.Sprintf("%x", sha256.Sum256(content)), res.Header().Get("X-Chart-Digest"))
+	suite.Equal(strconv.Itoa(len(content)), res.Header().Get("Content-Length"), "length of the chart package as stat'd")
+	suite.NotEmpty(res.Header().Get("Last-Modified"), "modification time of the chart package as stat'd")
+
+	res = request("HEAD", "/charts/mychart-9.9.9.tgz", nil, nil)
+	suite.Equal(404, res.Code, "404 HEAD /charts/mychart-9.9.9.tgz")
+
+	res = request("GET", "/charts/mychart-0.1.0.tgz", nil, nil)
+	suite.Equal(200, res.Code, "200 GET /charts/mychart-0.1.0.tgz")
+	suite.Equal("attachment; filename=mychart-0.1.0.tgz", res.Header().Get("Content-Disposition"))
+	suite.Equal(fmt.Sprintf("%x", sha256.Sum256(content)), res.Header().Get("X-Chart-Digest"))
+	suite.Equal("bytes", res.Header().Get("Accept-Ranges"), "chart package downloads accept ranges")
+
+	res = request("GET", "/charts/mychart-0.1.0.tgz", nil, map[string]string{"Range": "bytes=10-"})
+	suite.Equal(206, res.Code, "206 GET /charts/mychart-0.1.0.tgz with a range")
+	suite.Equal(fmt.Sprintf("bytes 10-%d/%d", len(content)-1, len(content)), res.Header().Get("Content-Range"))
+	suite.Equal(content[10:], res.Body.Bytes(), "rest of the chart package returned")
+
+	res = request("GET", "/charts/mychart-0.1.0.tgz", nil, map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+	suite.Equal(206, res.Code, "206 GET /charts/mychart-0.1.0.tgz with If-Range for the current digest")
+	suite.Equal(content[:10], res.Body.Bytes(), "range of the chart package returned")
+
+	res = request("GET", "/charts/mychart-0.1.0.tgz", nil, map[string]string{"Range": "bytes=0-9", "If-Range": `"0000"`})
+	suite.Equal(200, res.Code, "200 GET /charts/mychart-0.1.0.tgz with If-Range for another digest")
+	suite.Equal(content, res.Body.Bytes(), "whole chart package returned")
+
+	res = request("GET", "/charts/mychart-0.1.0.tgz", nil, map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(content))})
+	suite.Equal(416, res.Code, "416 GET /charts/mychart-0.1.0.tgz with a range past the end")
+
+	res = request("GET", "/charts/mychart-0.1.0.tgz", nil, map[string]string{"If-None-Match": "W/" + etag})
+	suite.Equal(304, res.Code, "304 GET /charts/mychart-0.1.0.tgz with a weak If-None-Match for the current digest")
+
+	res = request("HEAD", "/charts/mychart-0.1.0.tgz", nil, nil)
+	suite.Equal("bytes", res.Header().Get("Accept-Ranges"), "HEAD advertises ranges for chart packages")
+
+	res = request("HEAD", "/api/charts/mychart/0.1.0", nil, nil)
+	suite.Equal(200, res.Code, "200 HEAD /api/charts/mychart/0.1.0")
+	suite.Equal(etag, res.Header().Get("ETag"), "chart version ETag is its digest")
+
+	res = request("POST", "/api/charts", bytes.NewBuffer(content), map[string]string{"If-Match": `"0000"`})
+	suite.Equal(412, res.Code, "412 POST /api/charts with If-Match for another digest")
+
+	res = request("POST", "/api/charts", bytes.NewBuffer(content), map[string]string{"If-Match": "W/" + etag})
+	suite.Equal(412, res.Code, "412 POST /api/charts with a weak If-Match")
+
+	res = request("POST", "/api/charts", bytes.NewBuffer(content), map[string]string{"If-Match": etag})
+	suite.Equal(200, res.Code, "200 POST /api/charts with If-Match for the current digest")
+
+	res = request("POST", "/api/charts", bytes.NewBuffer(content), map[string]string{"If-Match": `"other", sha256:` + strings.Trim(etag, `"`)})
+	suite.Equal(200, res.Code, "200 POST /api/charts with If-Match listing the current digest")
+
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res = request("POST", "/api/charts", buf, map[string]string{"Content-Type": w.FormDataContentType(), "If-None-Match": "*"})
+	suite.Equal(412, res.Code, "412 POST /api/charts form with If-None-Match for an existing version")
+	_, err = server.StorageBackend.GetObject("mychart-0.1.0.tgz.prov")
+	suite.NotNil(err, "provenance file not stored when the precondition fails")
+
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res = request("POST", "/api/charts", buf, map[string]string{"Content-Type": w.FormDataContentType(), "If-Match": etag})
+	suite.Equal(200, res.Code, "200 POST /api/charts form with If-Match for the current digest")
 }
 
 func (suite *MultiTenantServerTestSuite) TestCustomChartURLServer() {
@@ -637,13 +994,117 @@ func (suite *MultiTenantServerTestSuite) TestCustomChartURLServer() {
 	suite.Equal(200, res.Status(), "200 GET /index.yaml")
 }
 
+func (suite *MultiTenantServerTestSuite) TestHealthCheck() {
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:   logger,
+		Username: "user",
+		Password: "pass",
+		Version:  "1.2.3",
+		Revision: "abc1234",
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: suite.Depth0Server.StorageBackend,
+		IndexLimit:     1,
+	})
+	suite.Nil(err, "no error creating server")
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest("GET", "/health", nil)
+	server.Router.HandleContext(c)
+	suite.Equal(200, recorder.Code, "200 GET /health without credentials")
+
+	var health struct {
+		Healthy       bool   `json:"healthy"`
+		Version       string `json:"version"`
+		Revision      string `json:"revision"`
+		Uptime        string `json:"uptime"`
+		UptimeSeconds int64  `json:"uptime_seconds"`
+		Routes        int    `json:"routes"`
+		Maintenance   bool   `json:"maintenance"`
+	}
+	suite.Nil(json.Unmarshal(recorder.Body.Bytes(), &health), "no error decoding health response")
+	suite.True(health.Healthy)
+	suite.Equal("1.2.3", health.Version)
+	suite.Equal("abc1234", health.Revision)
+	suite.NotEmpty(health.Uptime)
+	suite.Equal(len(server.Router.Routes), health.Routes)
+	suite.False(health.Maintenance, "not in maintenance mode")
+}
+
+func (suite *MultiTenantServerTestSuite) TestIndexChartURLs() {
+	newServer := func(name string, contextPath string, depth int, chartURL string, externalURL string) *MultiTenantServer {
+		dir := pathutil.Join(suite.TempDirectory, name)
+		os.MkdirAll(dir, os.ModePerm)
+		logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+		suite.Nil(err, "no error creating logger")
+		router := cm_router.NewRouter(cm_router.RouterOptions{
+			Logger:      logger,
+			ContextPath: contextPath,
+			Depth:       depth,
+		})
+		server, err := NewMultiTenantServer(MultiTenantServerOptions{
+			Logger:         logger,
+			Router:         router,
+			StorageBackend: storage.NewLocalFilesystemBackend(dir),
+			IndexLimit:     1,
+			ChartURL:       chartURL,
+			ExternalURL:    externalURL,
+		})
+		suite.Nil(err, "no error creating server")
+		return server
+	}
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	chartURL := func(server *MultiTenantServer, repo string) string {
+		log := server.Logger.ContextLoggingFn(&gin.Context{})
+		suite.Nil(server.uploadChartPackage(log, repo, bytes.NewReader(content), false, nil))
+		index, httpErr := server.getIndexFile(log, repo)
+		suite.Nil(httpErr)
+		suite.Len(index.Entries["mychart"], 1)
+		return index.Entries["mychart"][0].URLs[0]
+	}
+
+	server := newServer("urls-contextpath", "/x", 0, "", "")
+	url := chartURL(server, "")
+	suite.Equal("/x/charts/mychart-0.1.0.tgz", url, "context path is prepended")
+	suite.Equal(url, server.chartPackageLocation("", "mychart", "0.1.0"), "Location of a push is the chart URL")
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest("GET", url, nil)
+	server.Router.HandleContext(c)
+	suite.Equal(200, recorder.Code, "chart URL from index.yaml is routed")
+
+	server = newServer("urls-depth", "/x", 1, "", "")
+	suite.Equal("/x/myrepo/charts/mychart-0.1.0.tgz", chartURL(server, "myrepo"), "context path and repo are prepended")
+	suite.Equal("/x/myrepo/charts/mychart-0.1.0.tgz", server.chartPackageLocation("myrepo", "mychart", "0.1.0"))
+
+	server = newServer("urls-charturl", "/x", 0, "https://chartmuseum.com", "")
+	suite.Equal("https://chartmuseum.com/x/charts/mychart-0.1.0.tgz", chartURL(server, ""), "chart URL and context path are prepended")
+
+	server = newServer("urls-externalurl", "/x", 0, "https://chartmuseum.com", "https://cdn.example.com/helm/")
+	suite.Equal("https://cdn.example.com/helm/charts/mychart-0.1.0.tgz", chartURL(server, ""), "external URL replaces chart URL and context path")
+	suite.Equal("https://cdn.example.com/helm/charts/mychart-0.1.0.tgz", server.chartPackageLocation("", "mychart", "0.1.0"))
+
+	server = newServer("urls-relative", "", 0, "", "")
+	suite.Equal("charts/mychart-0.1.0.tgz", chartURL(server, ""), "without context path, chart URL stays relative")
+	suite.Equal("/charts/mychart-0.1.0.tgz", server.chartPackageLocation("", "mychart", "0.1.0"), "Location is from the root of the server")
+	suite.Equal("/myrepo/charts/mychart-0.1.0.tgz", server.chartPackageLocation("myrepo", "mychart", "0.1.0"))
+}
+
 func (suite *MultiTenantServerTestSuite) TestMaxObjectsServer() {
 	// Overwrites should still be allowed if limit is reached
+	suite.copyTestFilesTo(suite.TempDirectory)
 	content, err := ioutil.ReadFile(testTarballPath)
 	suite.Nil(err, "no error opening test tarball")
 	body := bytes.NewBuffer(content)
 	res := suite.doRequest("maxobjects", "POST", "/api/charts", body, "")
-	suite.Equal(201, res.Status(), "201 POST /api/charts")
+	suite.Equal(200, res.Status(), "200 POST /api/charts overwriting the chart package")
 
 	content, err = ioutil.ReadFile(testProvfilePath)
 	suite.Nil(err, "no error opening test provenance file")
@@ -665,6 +1126,278 @@ func (suite *MultiTenantServerTestSuite) TestMaxObjectsServer() {
 	suite.Equal(507, res.Status(), "507 POST /api/prov")
 }
 
+func (suite *MultiTenantServerTestSuite) TestMaxChartSize() {
+	dir := pathutil.Join(suite.TempDirectory, "maxchartsize")
+	os.MkdirAll(dir, os.ModePerm)
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+		MaxChartSize:   len(content) - 1,
+	})
+	suite.Nil(err, "no error creating server")
+	push := func(body io.Reader, contentType string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("POST", "/api/charts", body)
+		if contentType != "" {
+			c.Request.Header.Set("Content-Type", contentType)
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	res := push(bytes.NewBuffer(content), "")
+	suite.Equal(413, res.Code, "413 POST /api/charts with a chart package over the max chart size")
+	suite.Equal(fmt.Sprintf(`{"error":"chart package exceeds the max chart size of %d bytes"}`, len(content)-1),
+		strings.TrimSpace(res.Body.String()))
+
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res = push(buf, w.FormDataContentType())
+	suite.Equal(413, res.Code, "413 POST /api/charts form with a chart package over the max chart size")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz.prov"))
+	suite.True(os.IsNotExist(err), "provenance file is not stored either")
+
+	server.MaxChartSize = len(content)
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res = push(buf, w.FormDataContentType())
+	suite.Equal(201, res.Code, "201 POST /api/charts form, the provenance file does not count towards the max chart size")
+}
+
+func (suite *MultiTenantServerTestSuite) TestMaxVersionsPerChart() {
+	dir := pathutil.Join(suite.TempDirectory, "maxversions")
+	os.MkdirAll(dir, os.ModePerm)
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Depth:         1,
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:              logger,
+		Router:              router,
+		StorageBackend:      storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:          1,
+		EnableAPI:           true,
+		AllowForceOverwrite: true,
+		MaxVersionsPerChart: 1,
+	})
+	suite.Nil(err, "no error creating server")
+	push := func(path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("POST", path, body)
+		if contentType != "" {
+			c.Request.Header.Set("Content-Type", contentType)
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	contentV2, err := ioutil.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball")
+
+	res := push("/api/org1/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Code, "201 POST /api/org1/charts")
+
+	res = push("/api/org1/charts", bytes.NewBuffer(contentV2), "")
+	suite.Equal(409, res.Code, "409 POST /api/org1/charts with too many versions")
+	suite.Equal(`{"error":"chart mychart already has 1 versions, the maximum per chart"}`, strings.TrimSpace(res.Body.String()))
+
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{testTarballPathV2})
+	res = push("/api/org1/charts", buf, w.FormDataContentType())
+	suite.Equal(409, res.Code, "409 POST /api/org1/charts form with too many versions")
+
+	res = push("/api/org1/charts?force", bytes.NewBuffer(content), "")
+	suite.Equal(200, res.Code, "existing version can be overwritten")
+
+	res = push("/api/org2/charts", bytes.NewBuffer(contentV2), "")
+	suite.Equal(201, res.Code, "versions are counted per repo")
+}
+
+func (suite *MultiTenantServerTestSuite) TestChartPullMetrics() {
+	dir := pathutil.Join(suite.TempDirectory, "pullmetrics")
+	os.MkdirAll(pathutil.Join(dir, "pulls"), os.ModePerm)
+	suite.copyTestFilesTo(pathutil.Join(dir, "pulls"))
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:       logger,
+		Username:     "user",
+		Password:     "pass",
+		AnonymousGet: true,
+		Depth:        1,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+	})
+	suite.Nil(err, "no error creating server")
+	get := func(path string, authenticated bool) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", path, nil)
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder.Code
+	}
+	pulls := func() float64 {
+		metric := &dto.Metric{}
+		suite.Nil(chartPullsCounterVec.WithLabelValues("pulls", "mychart").Write(metric), "no error reading counter")
+		return metric.GetCounter().GetValue()
+	}
+	pullsBefore := pulls()
+
+	suite.Equal(200, get("/pulls/charts/mychart-0.1.0.tgz", false), "200 anonymous GET of a chart package")
+	suite.Equal(pullsBefore+1, pulls(), "anonymous pull is counted")
+	suite.Equal(200, get("/pulls/charts/mychart-0.1.0.tgz", true), "200 GET of a chart package")
+	suite.Equal(pullsBefore+2, pulls(), "authenticated pull is counted")
+
+	suite.Equal(200, get("/pulls/charts/mychart-0.1.0.tgz.prov", false), "200 GET of a provenance file")
+	suite.Equal(404, get("/pulls/charts/mychart-9.9.9.tgz", false), "404 GET of a missing chart package")
+	suite.Equal(pullsBefore+2, pulls(), "provenance files and missing packages are not counted")
+}
+
+func (suite *MultiTenantServerTestSuite) TestUpstreamRepo() {
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	var chartFetches, indexFetches int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stable/index.yaml":
+			atomic.AddInt32(&indexFetches, 1)
+			fmt.Fprintf(w, "apiVersion: v1\nentries:\n  mychart:\n  - name: mychart\n    version: 0.1.0\n    digest: %x\n    urls:\n    - charts/mychart-0.1.0.tgz\n", sha256.Sum256(content))
+		case "/stable/charts/mychart-0.1.0.tgz":
+			atomic.AddInt32(&chartFetches, 1)
+			w.Write(content)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer upstream.Close()
+
+	dir := pathutil.Join(suite.TempDirectory, "upstream")
+	os.MkdirAll(pathutil.Join(dir, "cache"), os.ModePerm)
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	newServer := func(upstreamURL string) (*MultiTenantServer, error) {
+		router := cm_router.NewRouter(cm_router.RouterOptions{
+			Logger:   logger,
+			Username: "user",
+			Password: "pass",
+			Depth:    1,
+		})
+		return NewMultiTenantServer(MultiTenantServerOptions{
+			Logger:          logger,
+			Router:          router,
+			StorageBackend:  storage.NewLocalFilesystemBackend(dir),
+			IndexLimit:      1,
+			UpstreamRepoURL: upstreamURL,
+		})
+	}
+	get := func(server *MultiTenantServer, path string, authenticated bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", path, nil)
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	server, err := newServer(upstream.URL + "/stable")
+	suite.Nil(err, "no error creating server with an upstream repo")
+
+	res := get(server, "/cache/charts/mychart-0.1.0.tgz", false)
+	suite.Equal(401, res.Code, "401 GET /cache/charts/mychart-0.1.0.tgz without credentials")
+	suite.Equal(int32(0), atomic.LoadInt32(&chartFetches), "nothing fetched upstream without credentials")
+
+	res = get(server, "/cache/charts/mychart-0.1.0.tgz", true)
+	suite.Equal(200, res.Code, "200 GET /cache/charts/mychart-0.1.0.tgz fetched upstream")
+	suite.Equal(content, res.Body.Bytes(), "upstream chart package returned")
+	suite.Equal(int32(1), atomic.LoadInt32(&chartFetches), "chart package fetched upstream")
+	_, err = os.Stat(pathutil.Join(dir, "cache", "mychart-0.1.0.tgz"))
+	suite.Nil(err, "upstream chart package stored")
+
+	res = get(server, "/cache/charts/mychart-0.1.0.tgz", true)
+	suite.Equal(200, res.Code, "200 GET /cache/charts/mychart-0.1.0.tgz from storage")
+	suite.Equal(int32(1), atomic.LoadInt32(&chartFetches), "stored chart package not fetched upstream again")
+
+	res = get(server, "/cache/charts/mychart-9.9.9.tgz", true)
+	suite.Equal(404, res.Code, "404 GET of a chart version missing upstream too")
+	suite.Equal(int32(1), atomic.LoadInt32(&indexFetches), "upstream index is cached")
+	suite.Contains(server.upstream.misses, "mychart-9.9.9.tgz", "missing chart version is remembered")
+
+	// once expired, the upstream index is fetched again
+	server.upstream.now = func() time.Time { return time.Now().Add(upstreamIndexTTL) }
+	res = get(server, "/cache/charts/mychart-9.9.9.tgz", true)
+	suite.Equal(404, res.Code)
+	suite.Equal(int32(2), atomic.LoadInt32(&indexFetches), "expired upstream index is fetched again")
+	server.upstream.now = time.Now
+
+	// concurrent requests for a package missing from storage fetch it once
+	os.MkdirAll(pathutil.Join(dir, "concurrent"), os.ModePerm)
+	fetchesBefore := atomic.LoadInt32(&chartFetches)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			suite.Equal(200, get(server, "/concurrent/charts/mychart-0.1.0.tgz", true).Code)
+		}()
+	}
+	wg.Wait()
+	suite.Equal(fetchesBefore+1, atomic.LoadInt32(&chartFetches), "package fetched upstream once")
+
+	// in maintenance mode, packages are served without being stored
+	os.MkdirAll(pathutil.Join(dir, "readonly"), os.ModePerm)
+	server.Router.SetMaintenance(true)
+	res = get(server, "/readonly/charts/mychart-0.1.0.tgz", true)
+	suite.Equal(200, res.Code, "200 GET in maintenance mode")
+	suite.Equal(content, res.Body.Bytes())
+	_, err = os.Stat(pathutil.Join(dir, "readonly", "mychart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "package not stored in maintenance mode")
+	server.Router.SetMaintenance(false)
+
+	res = get(server, "/cache/charts/mychart-0.1.0.tgz.prov", true)
+	suite.Equal(404, res.Code, "404 GET of a missing provenance file")
+
+	server, err = newServer(upstream.URL + "/missing")
+	suite.Nil(err, "no error creating server with an upstream repo")
+	res = get(server, "/cache/charts/otherchart-0.1.0.tgz", true)
+	suite.Equal(404, res.Code, "404 GET with no upstream index")
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	server, err = newServer(closed.URL)
+	suite.Nil(err, "no error creating server with an upstream repo")
+	res = get(server, "/cache/charts/otherchart-0.1.0.tgz", true)
+	suite.Equal(502, res.Code, "502 GET with an unreachable upstream repo")
+
+	_, err = newServer("ftp://charts.example.com")
+	suite.NotNil(err, "error creating server with an upstream repo which is not http")
+}
+
 func (suite *MultiTenantServerTestSuite) TestMaxUploadSizeServer() {
 	// trigger 413s, "request too large"
 	content, err := ioutil.ReadFile(testTarballPath)
@@ -729,62 +1462,1945 @@ func (suite *MultiTenantServerTestSuite) TestMetrics() {
 	suite.True(strings.Contains(metrics, "chartmuseum_chart_versions_served_total{repo=\"b\"} 0"))
 }
 
-func (suite *MultiTenantServerTestSuite) TestRoutes() {
-	suite.testAllRoutes("", 0)
-	for org, teams := range suite.StorageDirectory {
-		suite.testAllRoutes(org, 1)
-		for team, repos := range teams {
-			suite.testAllRoutes(pathutil.Join(org, team), 2)
-			for _, repo := range repos {
-				suite.testAllRoutes(pathutil.Join(org, team, repo), 3)
-			}
-		}
+func (suite *MultiTenantServerTestSuite) TestPaginateCharts() {
+	allCharts := map[string]helm_repo.ChartVersions{
+		"c": {}, "a": {}, "d": {}, "b": {},
 	}
-}
 
-func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
-	var res gin.ResponseWriter
+	page, total := paginateCharts(allCharts, 0, 2)
+	suite.Equal(4, total)
+	suite.Equal(map[string]helm_repo.ChartVersions{"a": {}, "b": {}}, page)
 
-	stype := fmt.Sprintf("depth%d", depth)
+	page, total = paginateCharts(allCharts, 3, 2)
+	suite.Equal(4, total)
+	suite.Equal(map[string]helm_repo.ChartVersions{"d": {}}, page)
 
-	// GET /
-	res = suite.doRequest(stype, "GET", "/", nil, "")
-	suite.Equal(200, res.Status(), "200 GET /")
+	page, _ = paginateCharts(allCharts, 1, 0)
+	suite.Equal(3, len(page), "no limit returns the rest")
 
-	// GET /health
-	res = suite.doRequest(stype, "GET", "/health", nil, "")
-	suite.Equal(200, res.Status(), "200 GET /health")
+	page, _ = paginateCharts(allCharts, 10, 2)
+	suite.Empty(page, "offset past the end returns no charts")
+}
 
-	var repoPrefix string
-	if repo != "" {
-		repoPrefix = pathutil.Join("/", repo)
-	} else {
-		repoPrefix = ""
+func (suite *MultiTenantServerTestSuite) TestFilterCharts() {
+	newChartVersion := func(name string, version string, keywords []string, annotations map[string]string) *helm_repo.ChartVersion {
+		return &helm_repo.ChartVersion{Metadata: &chart.Metadata{
+			Name:        name,
+			Version:     version,
+			Keywords:    keywords,
+			Annotations: annotations,
+		}}
+	}
+	allCharts := map[string]helm_repo.ChartVersions{
+		"payments-db": {
+			newChartVersion("payments-db", "0.2.0", []string{"database"}, map[string]string{"team": "payments"}),
+			newChartVersion("payments-db", "0.1.0", []string{"database"}, nil),
+		},
+		"payments-api": {
+			newChartVersion("payments-api", "0.1.0", []string{"api"}, map[string]string{"team": "payments"}),
+		},
+		"search-db": {
+			newChartVersion("search-db", "0.1.0", []string{"database"}, map[string]string{"team": "search"}),
+		},
 	}
 
-	// GET /:repo/index.yaml
-	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/index.yaml", repoPrefix), nil, "")
-	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/index.yaml", repoPrefix))
-
-	// Issue #21
-	suite.NotEqual("", res.Header().Get("X-Request-Id"), "X-Request-Id header is present")
-	suite.Equal("", res.Header().Get("X-Blah-Blah-Blah"), "X-Blah-Blah-Blah header is not present")
-
-	// GET /:repo/charts/:filename
-	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart-0.1.0.tgz", repoPrefix), nil, "")
-	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart-0.1.0.tgz", repoPrefix))
-
-	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart-0.1.0.tgz.prov", repoPrefix), nil, "")
-	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart-0.1.0.tgz.prov", repoPrefix))
+	filters, err := parseChartFilters(url.Values{"annotation": {"team=payments"}, "keyword": {"database"}})
+	suite.Nil(err, "no error parsing filters")
+	filtered := filterCharts(allCharts, filters)
+	suite.Equal(1, len(filtered), "filters are combined")
+	suite.Equal(1, len(filtered["payments-db"]), "only matching versions are kept")
+	suite.Equal("0.2.0", filtered["payments-db"][0].Version)
 
-	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart-0.1.0.tgz", repoPrefix), nil, "")
-	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/fakechart-0.1.0.tgz", repoPrefix))
+	filters, err = parseChartFilters(url.Values{"keyword": {"database"}, "limit": {"1"}})
+	suite.Nil(err, "no error parsing filters with pagination")
+	suite.Equal(2, len(filterCharts(allCharts, filters)))
 
-	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart-0.1.0.tgz.prov", repoPrefix), nil, "")
-	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/fakechart-0.1.0.tgz.prov", repoPrefix))
+	_, err = parseChartFilters(url.Values{"owner": {"me"}})
+	suite.NotNil(err, "error with unknown filter")
+	suite.Equal(400, err.Status)
 
-	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart-0.1.0.bad", repoPrefix), nil, "")
-	suite.Equal(500, res.Status(), fmt.Sprintf("500 GET %s/charts/fakechart-0.1.0.bad", repoPrefix))
+	_, err = parseChartFilters(url.Values{"annotation": {"team"}})
+	suite.NotNil(err, "error with annotation filter missing value")
+}
+
+func (suite *MultiTenantServerTestSuite) TestAuditLog() {
+	dir := pathutil.Join(suite.TempDirectory, "audit")
+	os.MkdirAll(dir, os.ModePerm)
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Username:      "user",
+		Password:      "pass",
+		Depth:         1,
+		MaxUploadSize: maxUploadSize,
+	})
+	auditLog := new(bytes.Buffer)
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+		AuditLog:       auditLog,
+	})
+	suite.Nil(err, "no error creating server with audit log")
+
+	request := func(method string, path string, body io.Reader, contentType string, auth bool) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest(method, path, body)
+		if contentType != "" {
+			c.Request.Header.Set("Content-Type", contentType)
+		}
+		if auth {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder.Code
+	}
+	entries := func() []auditEntry {
+		var entries []auditEntry
+		decoder := json.NewDecoder(bytes.NewReader(auditLog.Bytes()))
+		for decoder.More() {
+			var entry auditEntry
+			suite.Nil(decoder.Decode(&entry), "audit entry is json")
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	suite.Equal(401, request("POST", "/api/org1/charts", bytes.NewBuffer(content), "", false), "401 POST /api/org1/charts")
+	suite.Empty(entries(), "unauthorized requests are not audited")
+
+	suite.Equal(201, request("POST", "/api/org1/charts", bytes.NewBuffer(content), "", true), "201 POST /api/org1/charts")
+	suite.Equal(409, request("POST", "/api/org1/charts", bytes.NewBuffer(content), "", true), "409 POST /api/org1/charts")
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{testTarballPathV2})
+	suite.Equal(201, request("POST", "/api/org1/charts", buf, w.FormDataContentType(), true), "201 POST /api/org1/charts form")
+	suite.Equal(200, request("DELETE", "/api/org1/charts/mychart/0.1.0", nil, "", true), "200 DELETE /api/org1/charts/mychart/0.1.0")
+	suite.Equal(200, request("GET", "/api/org1/charts", nil, "", true), "200 GET /api/org1/charts")
+	// without a Content-Length, the body is only found too large once read by the handler
+	tooLarge := io.MultiReader(bytes.NewReader(content), bytes.NewReader(make([]byte, maxUploadSize)))
+	suite.Equal(413, request("POST", "/api/org1/charts", tooLarge, "", true), "413 POST /api/org1/charts")
+
+	logged := entries()
+	suite.Len(logged, 5, "one entry per write request")
+
+	suite.Equal("user", logged[0].Identity)
+	suite.Equal("POST", logged[0].Method)
+	suite.Equal("/api/:repo/charts", logged[0].Route)
+	suite.Equal("org1", logged[0].Repo)
+	suite.Equal([]auditChartVersion{{Name: "mychart", Version: "0.1.0"}}, logged[0].Charts)
+	suite.Equal(201, logged[0].Status)
+	suite.Equal(auditResultSuccess, logged[0].Result)
+	suite.NotEmpty(logged[0].RequestID)
+
+	suite.Equal(409, logged[1].Status)
+	suite.Equal(auditResultFailure, logged[1].Result, "failed pushes are audited")
+
+	suite.Equal([]auditChartVersion{{Name: "mychart", Version: "0.2.0"}}, logged[2].Charts, "charts of form uploads are audited")
+
+	suite.Equal("DELETE", logged[3].Method)
+	suite.Equal("/api/:repo/charts/:name/:version", logged[3].Route)
+	suite.Equal([]auditChartVersion{{Name: "mychart", Version: "0.1.0"}}, logged[3].Charts)
+
+	suite.Equal(413, logged[4].Status, "status answered by the router is audited")
+	suite.Equal(auditResultFailure, logged[4].Result)
+}
+
+func (suite *MultiTenantServerTestSuite) TestWebhooks() {
+	webhookRetryBackoff = time.Millisecond
+	secret := "webhooksecret"
+
+	var attempts int32
+	received := make(chan webhookEvent, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(503) // the first delivery is retried
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		suite.Equal(signWebhookPayload(secret, body), r.Header.Get(webhookSignatureHeader), "webhook is signed")
+		var event webhookEvent
+		suite.Nil(json.Unmarshal(body, &event), "no error decoding webhook event")
+		received <- event
+	}))
+	defer ts.Close()
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	server := &MultiTenantServer{webhooks: newWebhookNotifier([]string{ts.URL}, secret, logger)}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	chartVersion, err := repo.ChartVersionFromStorageObject(storage.Object{Path: "mychart-0.1.0.tgz", Content: content})
+	suite.Nil(err, "no error loading test chart version")
+	server.notifyChartPushed("org1/repo1", chartVersion)
+	server.notifyChartDeleted("org1/repo1", "mychart", "0.1.0", "abc")
+
+	// deliveries are shared by several workers, so events may arrive in any order
+	events := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-received:
+			events[event.Event] = true
+			suite.Equal("org1/repo1", event.Repo)
+			suite.Equal("mychart", event.Name)
+			suite.Equal("0.1.0", event.Version)
+			suite.NotEmpty(event.Digest)
+		case <-time.After(5 * time.Second):
+			suite.Fail("timed out waiting for webhooks")
+		}
+	}
+	suite.Equal(map[string]bool{webhookEventPush: true, webhookEventDelete: true}, events)
+	suite.Equal(int32(3), atomic.LoadInt32(&attempts), "failed delivery was retried")
+}
+
+func (suite *MultiTenantServerTestSuite) TestWebhookDeliveryTimeout() {
+	defer func(timeout time.Duration) { webhookDeliveryTimeout = timeout }(webhookDeliveryTimeout)
+	webhookRetryBackoff = time.Millisecond
+	webhookDeliveryTimeout = time.Second
+
+	// the slow endpoint does not answer until the end of the test
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	received := make(chan struct{}, 10)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer fast.Close()
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	notifier := newWebhookNotifier([]string{slow.URL, fast.URL}, "", logger)
+	server := &MultiTenantServer{webhooks: notifier}
+	server.notifyChartDeleted("org1/repo1", "mychart", "0.1.0", "abc")
+
+	select {
+	case <-received:
+	case <-time.After(webhookDeliveryTimeout / 2):
+		suite.Fail("delivery to the fast webhook is held up by the slow one")
+	}
+
+	start := time.Now()
+	err = notifier.deliver(slow.URL, []byte("{}"))
+	suite.NotNil(err, "delivery to the slow webhook fails")
+	suite.True(time.Since(start) < 2*webhookDeliveryTimeout, "delivery to the slow webhook is given up after the delivery timeout")
+}
+
+func (suite *MultiTenantServerTestSuite) TestDeleteWebhookDigest() {
+	dir := pathutil.Join(suite.TempDirectory, "deletewebhook")
+	os.MkdirAll(dir, os.ModePerm)
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error reading test tarball")
+	err = ioutil.WriteFile(pathutil.Join(dir, pathutil.Base(testTarballPath)), content, 0644)
+	suite.Nil(err, "no error copying test tarball")
+
+	received := make(chan webhookEvent, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		suite.Nil(json.NewDecoder(r.Body).Decode(&event), "no error decoding webhook event")
+		received <- event
+	}))
+	defer ts.Close()
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger})
+	backend := &statingBackend{LocalFilesystemBackend: storage.NewLocalFilesystemBackend(dir)}
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: backend,
+		IndexLimit:     1,
+		WebhookURLs:    []string{ts.URL},
+	})
+	suite.Nil(err, "no error creating server with webhooks")
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	chartVersion, httpErr := server.getChartVersion(log, "", "mychart", "0.1.0")
+	suite.Nil(httpErr)
+	backend.fetched = 0
+
+	suite.Nil(server.deleteChartVersion(log, "", "mychart", "0.1.0"))
+	suite.Equal(0, backend.fetched, "deleted package is not fetched for the delete event")
+
+	select {
+	case event := <-received:
+		suite.Equal(webhookEventDelete, event.Event)
+		suite.Equal(chartVersion.Digest, event.Digest, "delete event carries the digest from the index")
+	case <-time.After(5 * time.Second):
+		suite.Fail("timed out waiting for webhook")
+	}
+}
+
+func (suite *MultiTenantServerTestSuite) TestRetention() {
+	dir := pathutil.Join(suite.TempDirectory, "retention")
+	os.MkdirAll(dir, os.ModePerm)
+	for _, tarballPath := range []string{testTarballPath, testTarballPathV2} {
+		content, err := ioutil.ReadFile(tarballPath)
+		suite.Nil(err, "no error reading test tarball")
+		err = ioutil.WriteFile(pathutil.Join(dir, pathutil.Base(tarballPath)), content, 0644)
+		suite.Nil(err, "no error copying test tarball")
+	}
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:                logger,
+		Router:                router,
+		StorageBackend:        storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:            1,
+		RetentionKeepVersions: 1,
+		RetentionDryRun:       true,
+	})
+	suite.Nil(err, "no error creating server with retention policy")
+	suite.NotNil(server.retention, "retention policy is enabled")
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	pruned := server.pruneRepo(log, "", time.Now())
+	suite.Equal([]prunedChartVersion{{"mychart", "0.1.0"}}, pruned, "dry run reports the old version")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.Nil(err, "dry run does not delete anything")
+
+	server.retention.DryRun = false
+	pruned = server.pruneRepo(log, "", time.Now())
+	suite.Equal([]prunedChartVersion{{"mychart", "0.1.0"}}, pruned, "old version is pruned")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "old version is deleted")
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "index only has the newest version")
+
+	server.retention.KeepVersions = 0
+	server.retention.MaxAge = time.Hour
+	suite.Empty(server.pruneRepo(log, "", time.Now()), "recent versions are kept")
+	pruned = server.pruneRepo(log, "", time.Now().Add(2*time.Hour))
+	suite.Equal([]prunedChartVersion{{"mychart", "0.2.0"}}, pruned, "versions older than max age are pruned")
+
+	// pruning goes through a snapshot of the index, while pushes update the index meanwhile
+	server.IndexReconcileInterval = time.Hour
+	server.retention.DryRun = true
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			chartVersion := &helm_repo.ChartVersion{
+				Metadata: &chart.Metadata{Name: "pushed", Version: fmt.Sprintf("0.%d.0", i)},
+				URLs:     []string{fmt.Sprintf("charts/pushed-0.%d.0.tgz", i)},
+			}
+			server.updateIndexEntry(log, "", chartVersion, false)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		server.pruneRepo(log, "", time.Now())
+	}
+	<-done
+}
+
+func (suite *MultiTenantServerTestSuite) TestInitialIndexBuild() {
+	dir := pathutil.Join(suite.TempDirectory, "initialindex")
+	os.MkdirAll(dir, os.ModePerm)
+	suite.copyTestFilesTo(dir)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:             logger,
+		Router:             router,
+		StorageBackend:     storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:         1,
+		BuildIndexOnListen: true,
+	})
+	suite.Nil(err, "no error creating server")
+	suite.Nil(server.Tenants[""], "index not built before the server is started")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", path, nil)
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	// as set by startInitialIndexBuild, without building the index in the background
+	atomic.StoreInt32(&server.initialIndexBuild, 1)
+	for _, path := range []string{"/index.yaml", "/charts/mychart-0.1.0.tgz"} {
+		res := get(path)
+		suite.Equal(503, res.Code, fmt.Sprintf("503 GET %s while the initial index is built", path))
+		suite.Equal("5", res.Header().Get("Retry-After"))
+	}
+	suite.Equal(503, get("/readiness").Code, "not ready while the initial index is built")
+	suite.Equal(200, get("/health").Code, "healthy while the initial index is built")
+
+	server.buildInitialIndex()
+	suite.False(server.initialIndexBuilding())
+	suite.NotNil(server.Tenants[""], "initial index built")
+	res := get("/index.yaml")
+	suite.Equal(200, res.Code, "200 GET /index.yaml once the initial index is built")
+	suite.Empty(res.Header().Get("Retry-After"))
+	suite.Equal(200, get("/readiness").Code)
+}
+
+func (suite *MultiTenantServerTestSuite) TestReindex() {
+	dir := pathutil.Join(suite.TempDirectory, "reindex")
+	os.MkdirAll(dir, os.ModePerm)
+	copyTarball := func(tarballPath string) {
+		content, err := ioutil.ReadFile(tarballPath)
+		suite.Nil(err, "no error reading test tarball")
+		err = ioutil.WriteFile(pathutil.Join(dir, pathutil.Base(tarballPath)), content, 0644)
+		suite.Nil(err, "no error copying test tarball")
+	}
+	copyTarball(testTarballPath)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:                 logger,
+		Router:                 router,
+		StorageBackend:         storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:             1,
+		IndexReconcileInterval: time.Hour,
+		ReindexInterval:        time.Minute,
+		ReindexJitter:          time.Second,
+	})
+	suite.Nil(err, "no error creating server with background reindex")
+	suite.NotNil(server.reindex, "background reindex is enabled")
+	for i := 0; i < 10; i++ {
+		delay := server.reindex.next()
+		suite.True(delay >= time.Minute && delay < time.Minute+time.Second, "jitter is added to the interval")
+	}
+
+	log := logger.ContextLoggingFn(&gin.Context{})
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1)
+
+	// added directly in storage, not picked up until the next reconciliation
+	copyTarball(testTarballPathV2)
+	before := time.Now().Unix()
+	server.reindexRepos()
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 2, "reindex picks up changes in storage")
+
+	metric := &dto.Metric{}
+	suite.Nil(indexLastReindexGaugeVec.WithLabelValues("").Write(metric), "no error reading gauge")
+	suite.True(metric.GetGauge().GetValue() >= float64(before), "time of the last reindex is recorded")
+
+	// a rebuild already under way is not started again
+	suite.Nil(os.Remove(pathutil.Join(dir, "mychart-0.2.0.tgz")), "no error removing test tarball v2")
+	suite.True(server.claimRebuild("", false), "index is claimed")
+	suite.Nil(server.reindexRepo(log, ""))
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 2, "reindex is skipped while the index is rebuilt")
+	server.releaseRebuild("")
+	suite.Nil(server.reindexRepo(log, ""))
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "reindex runs once the rebuild is done")
+}
+
+func (suite *MultiTenantServerTestSuite) TestChartDigestVerification() {
+	dir := pathutil.Join(suite.TempDirectory, "digest")
+	os.MkdirAll(dir, os.ModePerm)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+		AllowOverwrite: true,
+	})
+	suite.Nil(err, "no error creating server")
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	push := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("POST", path, bytes.NewBuffer(content))
+		for key, value := range headers {
+			c.Request.Header.Set(key, value)
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+	mismatches := func() float64 {
+		metric := &dto.Metric{}
+		suite.Nil(chartDigestMismatchCounterVec.WithLabelValues("").Write(metric), "no error reading counter")
+		return metric.GetCounter().GetValue()
+	}
+	mismatchesBefore := mismatches()
+
+	res := push("/api/charts", map[string]string{"X-Content-SHA256": strings.Repeat("0", 64)})
+	suite.Equal(400, res.Code, "400 POST /api/charts with mismatching X-Content-SHA256")
+	suite.Equal(mismatchesBefore+1, mismatches(), "digest mismatch is counted")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "chart package is not stored on digest mismatch")
+
+	res = push("/api/charts?sha256="+strings.Repeat("0", 64), nil)
+	suite.Equal(400, res.Code, "400 POST /api/charts with mismatching sha256 query param")
+
+	res = push("/api/charts", map[string]string{"X-Content-SHA256": digest})
+	suite.Equal(201, res.Code, "201 POST /api/charts with matching X-Content-SHA256")
+
+	res = push("/api/charts?sha256=sha256:"+strings.ToUpper(digest), nil)
+	suite.Equal(200, res.Code, "200 POST /api/charts with matching sha256 query param")
+
+	res = push("/api/charts", nil)
+	suite.Equal(200, res.Code, "200 POST /api/charts without expected digest")
+	suite.Equal(mismatchesBefore+2, mismatches())
+}
+
+func (suite *MultiTenantServerTestSuite) TestStreamedUploads() {
+	newServer := func(name string, backend storage.Backend) *MultiTenantServer {
+		logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+		suite.Nil(err, "no error creating logger")
+		router := cm_router.NewRouter(cm_router.RouterOptions{
+			Logger:        logger,
+			MaxUploadSize: maxUploadSize,
+		})
+		server, err := NewMultiTenantServer(MultiTenantServerOptions{
+			Logger:                 logger,
+			Router:                 router,
+			StorageBackend:         backend,
+			IndexLimit:             1,
+			EnableAPI:              true,
+			ValidateCharts:         true,
+			IndexReconcileInterval: time.Hour,
+		})
+		suite.Nil(err, "no error creating server")
+		return server
+	}
+	pushTo := func(server *MultiTenantServer, path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("POST", path, body)
+		if contentType != "" {
+			c.Request.Header.Set("Content-Type", contentType)
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+	push := func(server *MultiTenantServer, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		return pushTo(server, "/api/charts", body, contentType)
+	}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	// the local backend streams from the request, the wrapped one only supports PutObject and
+	// gets the upload spooled to disk
+	for _, name := range []string{"streamed", "spooled"} {
+		dir := pathutil.Join(suite.TempDirectory, name+"-uploads")
+		os.MkdirAll(dir, os.ModePerm)
+		var backend storage.Backend = storage.NewLocalFilesystemBackend(dir)
+		if name == "spooled" {
+			backend = struct{ storage.Backend }{backend}
+		}
+		stored := func() []string {
+			infos, err := ioutil.ReadDir(dir)
+			suite.Nil(err, "no error listing storage")
+			var files []string
+			for _, info := range infos {
+				files = append(files, info.Name())
+			}
+			return files
+		}
+
+		server := newServer(name, backend)
+		res := pushTo(server, "/api/charts?sha256="+strings.Repeat("0", 64), bytes.NewBuffer(content), "")
+		suite.Equal(400, res.Code, fmt.Sprintf("400 POST /api/charts with mismatching digest (%s)", name))
+		suite.Empty(stored(), fmt.Sprintf("nothing stored on digest mismatch (%s)", name))
+
+		res = push(server, bytes.NewBuffer(content[:len(content)-16]), "")
+		suite.Equal(400, res.Code, fmt.Sprintf("400 POST /api/charts with a truncated chart package (%s)", name))
+		suite.Empty(stored(), fmt.Sprintf("nothing stored for a truncated chart package (%s)", name))
+
+		res = push(server, bytes.NewBuffer(content), "")
+		suite.Equal(201, res.Code, fmt.Sprintf("201 POST /api/charts (%s)", name))
+		storedContent, err := ioutil.ReadFile(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+		suite.Nil(err, "chart package stored")
+		suite.Equal(content, storedContent, "stored chart package matches upload")
+
+		log := server.Logger.ContextLoggingFn(&gin.Context{})
+		chartVersion, httpErr := server.getChartVersion(log, "", "mychart", "0.1.0")
+		suite.Nil(httpErr, "chart version in index")
+		suite.Equal(digest, chartVersion.Digest, "digest computed while storing")
+
+		os.Remove(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+		buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+		res = push(server, buf, w.FormDataContentType())
+		suite.Equal(201, res.Code, fmt.Sprintf("201 POST /api/charts multipart (%s)", name))
+		storedContent, err = ioutil.ReadFile(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+		suite.Nil(err, "chart package stored from multipart form")
+		suite.Equal(content, storedContent, "stored chart package matches multipart upload")
+		_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz.prov"))
+		suite.Nil(err, "provenance file stored from multipart form")
+	}
+}
+
+func (suite *MultiTenantServerTestSuite) TestChartValidation() {
+	newServer := func(name string, validateCharts bool) *MultiTenantServer {
+		dir := pathutil.Join(suite.TempDirectory, name)
+		os.MkdirAll(dir, os.ModePerm)
+		logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+		suite.Nil(err, "no error creating logger")
+		router := cm_router.NewRouter(cm_router.RouterOptions{
+			Logger:        logger,
+			MaxUploadSize: maxUploadSize,
+		})
+		server, err := NewMultiTenantServer(MultiTenantServerOptions{
+			Logger:         logger,
+			Router:         router,
+			StorageBackend: storage.NewLocalFilesystemBackend(dir),
+			IndexLimit:     1,
+			EnableAPI:      true,
+			ValidateCharts: validateCharts,
+		})
+		suite.Nil(err, "no error creating server")
+		return server
+	}
+	push := func(server *MultiTenantServer, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("POST", "/api/charts", body)
+		if contentType != "" {
+			c.Request.Header.Set("Content-Type", contentType)
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	server := newServer("validation", true)
+
+	res := push(server, bytes.NewBufferString("this is not a chart"), "")
+	suite.Equal(400, res.Code, "400 POST /api/charts with invalid gzip")
+	suite.Equal(`{"error":"chart package is not a valid gzip archive"}`, strings.TrimSpace(res.Body.String()))
+
+	renamedTarballPath := pathutil.Join(suite.TempDirectory, "validation", "renamed-0.1.0.tgz")
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	suite.Nil(ioutil.WriteFile(renamedTarballPath, content, 0644), "no error writing renamed tarball")
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{renamedTarballPath})
+	res = push(server, buf, w.FormDataContentType())
+	suite.Equal(400, res.Code, "400 POST /api/charts with filename not matching chart")
+	os.Remove(renamedTarballPath)
+
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{testTarballPath})
+	res = push(server, buf, w.FormDataContentType())
+	suite.Equal(201, res.Code, "201 POST /api/charts with valid chart package")
+
+	res = push(server, bytes.NewBuffer(content), "")
+	suite.Equal(409, res.Code, "valid chart package passes validation")
+
+	server = newServer("novalidation", false)
+	res = push(server, bytes.NewBufferString("this is not a chart"), "")
+	suite.Equal(500, res.Code, "500 POST /api/charts with invalid gzip and validation disabled")
+}
+
+func (suite *MultiTenantServerTestSuite) TestValidateChart() {
+	dir := pathutil.Join(suite.TempDirectory, "validate")
+	os.MkdirAll(dir, os.ModePerm)
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+		ValidateCharts: true,
+	})
+	suite.Nil(err, "no error creating server")
+	validate := func(path string, body io.Reader, contentType string) (int, chartValidationReport) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("POST", path, body)
+		if contentType != "" {
+			c.Request.Header.Set("Content-Type", contentType)
+		}
+		server.Router.HandleContext(c)
+		var report chartValidationReport
+		json.Unmarshal(recorder.Body.Bytes(), &report)
+		return recorder.Code, report
+	}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+
+	code, report := validate("/api/charts/validate", bytes.NewBuffer(content), "")
+	suite.Equal(200, code, "200 POST /api/charts/validate with valid chart package")
+	suite.True(report.Valid)
+	suite.Equal("mychart", report.Name)
+	suite.Equal("0.1.0", report.Version)
+	suite.Equal("mychart-0.1.0.tgz", report.Filename)
+	suite.Empty(report.Problems)
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "validated chart package is not stored")
+
+	code, report = validate("/api/charts/validate", bytes.NewBufferString("this is not a chart"), "")
+	suite.Equal(400, code, "400 POST /api/charts/validate with invalid gzip")
+	suite.False(report.Valid)
+	suite.Equal([]string{"chart package is not a valid gzip archive"}, report.Problems)
+
+	code, report = validate("/api/charts/validate?filename=renamed-0.1.0.tgz&sha256=0000", bytes.NewBuffer(content), "")
+	suite.Equal(400, code, "400 POST /api/charts/validate with filename and digest not matching")
+	suite.Len(report.Problems, 2, "every problem is reported")
+
+	renamedTarballPath := pathutil.Join(suite.TempDirectory, "renamed-0.1.0.tgz")
+	suite.Nil(ioutil.WriteFile(renamedTarballPath, content, 0644), "no error writing renamed tarball")
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{renamedTarballPath})
+	code, report = validate("/api/charts/validate", buf, w.FormDataContentType())
+	suite.Equal(400, code, "400 POST /api/charts/validate with form filename not matching chart")
+	suite.Len(report.Problems, 1)
+	os.Remove(renamedTarballPath)
+
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"prov"}, []string{testProvfilePath})
+	code, _ = validate("/api/charts/validate", buf, w.FormDataContentType())
+	suite.Equal(400, code, "400 POST /api/charts/validate with no chart in form")
+
+	suite.Nil(ioutil.WriteFile(pathutil.Join(dir, "mychart-0.1.0.tgz"), content, 0644), "no error storing chart package")
+	code, report = validate("/api/charts/validate", bytes.NewBuffer(content), "")
+	suite.Equal(400, code, "400 POST /api/charts/validate with existing chart package")
+	suite.Equal([]string{"file already exists"}, report.Problems)
+}
+
+func (suite *MultiTenantServerTestSuite) TestOCI() {
+	dir := pathutil.Join(suite.TempDirectory, "oci")
+	os.MkdirAll(dir, os.ModePerm)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Username:      "user",
+		Password:      "pass",
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableOCI:      true,
+	})
+	suite.Nil(err, "no error creating server with OCI enabled")
+
+	request := func(method string, path string, body []byte, authenticated bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest(method, path, bytes.NewBuffer(body))
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+	digestOf := func(content []byte) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	}
+
+	res := request("GET", "/v2/", nil, false)
+	suite.Equal(401, res.Code, "401 GET /v2/ without credentials")
+	suite.Equal("registry/2.0", res.Header().Get("Docker-Distribution-Api-Version"))
+	suite.NotEmpty(res.Header().Get("WWW-Authenticate"), "auth challenge is sent")
+	suite.Contains(res.Body.String(), `"code":"UNAUTHORIZED"`, "error in the distribution spec format")
+
+	res = request("GET", "/v2/", nil, true)
+	suite.Equal(200, res.Code, "200 GET /v2/")
+	suite.Equal("registry/2.0", res.Header().Get("Docker-Distribution-Api-Version"))
+
+	chartContent, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	chartDigest := digestOf(chartContent)
+	configContent := []byte(`{"name":"mychart","version":"0.1.0"}`)
+	configDigest := digestOf(configContent)
+
+	// chart layer uploaded in two steps
+	res = request("POST", "/v2/mychart/blobs/uploads/", nil, true)
+	suite.Equal(202, res.Code, "202 POST /v2/mychart/blobs/uploads/")
+	location := res.Header().Get("Location")
+	suite.True(strings.HasPrefix(location, "/v2/mychart/blobs/uploads/"), "upload location is returned")
+
+	res = request("PUT", location+"?digest="+digestOf([]byte("other")), chartContent, true)
+	suite.Equal(400, res.Code, "400 PUT upload with mismatching digest")
+
+	res = request("PUT", location+"?digest="+chartDigest, chartContent, true)
+	suite.Equal(404, res.Code, "404 PUT upload which has already been completed")
+
+	// uploads not completed in time are forgotten
+	res = request("POST", "/v2/mychart/blobs/uploads/", nil, true)
+	location = res.Header().Get("Location")
+	server.oci.now = func() time.Time { return time.Now().Add(ociUploadTTL) }
+	res = request("PUT", location+"?digest="+chartDigest, chartContent, true)
+	suite.Equal(404, res.Code, "404 PUT upload which has expired")
+	request("POST", "/v2/mychart/blobs/uploads/", nil, true)
+	suite.Len(server.oci.uploads, 1, "expired uploads are pruned")
+	server.oci.now = time.Now
+
+	res = request("POST", "/v2/MyChart/blobs/uploads/", nil, true)
+	suite.Equal(400, res.Code, "400 POST upload with invalid name")
+	suite.Contains(res.Body.String(), ociErrorNameInvalid)
+
+	res = request("POST", "/v2/mychart/blobs/uploads/", nil, true)
+	location = res.Header().Get("Location")
+	res = request("PUT", location+"?digest="+chartDigest, chartContent, true)
+	suite.Equal(201, res.Code, "201 PUT upload")
+	suite.Equal(chartDigest, res.Header().Get("Docker-Content-Digest"))
+
+	// config uploaded in a single request
+	res = request("POST", "/v2/mychart/blobs/uploads/?digest="+configDigest, configContent, true)
+	suite.Equal(201, res.Code, "201 POST monolithic upload")
+
+	res = request("HEAD", "/v2/mychart/blobs/"+chartDigest, nil, true)
+	suite.Equal(200, res.Code, "200 HEAD blob")
+	suite.Equal(strconv.Itoa(len(chartContent)), res.Header().Get("Content-Length"))
+
+	res = request("GET", "/v2/mychart/blobs/"+digestOf([]byte("missing")), nil, true)
+	suite.Equal(404, res.Code, "404 GET unknown blob")
+
+	manifest := func(layerDigest string) []byte {
+		content, err := json.Marshal(ociManifest{
+			SchemaVersion: 2,
+			MediaType:     ociManifestMediaType,
+			Config:        ociDescriptor{ociHelmConfigMediaType, configDigest, int64(len(configContent))},
+			Layers:        []ociDescriptor{{ociHelmChartMediaType, layerDigest, int64(len(chartContent))}},
+		})
+		suite.Nil(err, "no error encoding manifest")
+		return content
+	}
+
+	res = request("PUT", "/v2/mychart/manifests/0.1.0", manifest(digestOf([]byte("missing"))), true)
+	suite.Equal(400, res.Code, "400 PUT manifest with missing layer")
+
+	res = request("PUT", "/v2/otherchart/manifests/0.1.0", manifest(chartDigest), true)
+	suite.Equal(400, res.Code, "400 PUT manifest for a different chart")
+
+	res = request("PUT", "/v2/mychart/manifests/.hidden", manifest(chartDigest), true)
+	suite.Equal(400, res.Code, "400 PUT manifest with invalid tag")
+	suite.Contains(res.Body.String(), ociErrorTagInvalid)
+
+	res = request("GET", "/v2/mychart/manifests/.hidden", nil, true)
+	suite.Equal(400, res.Code, "400 GET manifest with invalid tag")
+
+	manifestContent := manifest(chartDigest)
+	res = request("PUT", "/v2/mychart/manifests/0.1.0", manifestContent, true)
+	suite.Equal(201, res.Code, "201 PUT manifest")
+	suite.Equal(digestOf(manifestContent), res.Header().Get("Docker-Content-Digest"))
+
+	res = request("GET", "/v2/mychart/manifests/0.1.0", nil, true)
+	suite.Equal(200, res.Code, "200 GET manifest by tag")
+	suite.Equal(manifestContent, res.Body.Bytes())
+	suite.Equal(ociManifestMediaType, res.Header().Get("Content-Type"))
+
+	res = request("HEAD", "/v2/mychart/manifests/"+digestOf(manifestContent), nil, true)
+	suite.Equal(200, res.Code, "200 HEAD manifest by digest")
+
+	res = request("GET", "/v2/mychart/manifests/9.9.9", nil, true)
+	suite.Equal(404, res.Code, "404 GET unknown manifest")
+
+	log := logger.ContextLoggingFn(&gin.Context{})
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "chart pushed as OCI artifact is in index.yaml")
+
+	res = request("GET", "/charts/mychart-0.1.0.tgz", nil, true)
+	suite.Equal(200, res.Code, "chart pushed as OCI artifact can be downloaded")
+	suite.Equal(chartContent, res.Body.Bytes())
+}
+
+func (suite *MultiTenantServerTestSuite) TestIncrementalIndex() {
+	dir := pathutil.Join(suite.TempDirectory, "incremental")
+	os.MkdirAll(dir, os.ModePerm)
+	suite.copyTestFilesTo(dir)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:                 logger,
+		Router:                 router,
+		StorageBackend:         storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:             1,
+		IndexReconcileInterval: time.Hour,
+	})
+	suite.Nil(err, "no error creating server with index reconcile interval")
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "index is reconciled with storage on first use")
+
+	// changes made outside of the server are not seen until the next reconciliation
+	err = os.Remove(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.Nil(err, "no error removing test tarball")
+
+	content, err := ioutil.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball v2")
+	suite.Nil(server.uploadChartPackage(log, "", bytes.NewReader(content), false, nil))
+
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 2, "pushed chart is added to the index without reconciliation")
+
+	server.Tenants[""].LastReconciled = time.Time{}
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "index is reconciled with storage once the interval has passed")
+	suite.Equal("0.2.0", index.Entries["mychart"][0].Version)
+
+	suite.Nil(server.deleteChartVersion(log, "", "mychart", "0.2.0"))
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Empty(index.Entries["mychart"], "deleted chart is removed from the index without reconciliation")
+}
+
+type notifyingCacheStore struct {
+	sync.Mutex
+	entries   map[string][]byte
+	published []string
+	handler   func(key string)
+}
+
+func (store *notifyingCacheStore) Get(key string) ([]byte, error) {
+	store.Lock()
+	defer store.Unlock()
+	content, ok := store.entries[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return content, nil
+}
+
+func (store *notifyingCacheStore) Set(key string, content []byte) error {
+	store.Lock()
+	defer store.Unlock()
+	store.entries[key] = content
+	return nil
+}
+
+func (store *notifyingCacheStore) Delete(key string) error {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.entries, key)
+	return nil
+}
+
+func (store *notifyingCacheStore) Publish(key string) error {
+	store.Lock()
+	defer store.Unlock()
+	store.published = append(store.published, key)
+	return nil
+}
+
+func (store *notifyingCacheStore) Subscribe(handler func(key string)) {
+	store.handler = handler
+}
+
+func (suite *MultiTenantServerTestSuite) TestCacheInvalidation() {
+	dir := pathutil.Join(suite.TempDirectory, "invalidation")
+	os.MkdirAll(dir, os.ModePerm)
+	copyFile := func(src string) {
+		content, err := ioutil.ReadFile(src)
+		suite.Nil(err, "no error reading test tarball")
+		suite.Nil(ioutil.WriteFile(pathutil.Join(dir, pathutil.Base(src)), content, 0644), "no error copying test tarball")
+	}
+	copyFile(testTarballPath)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger})
+	store := &notifyingCacheStore{entries: map[string][]byte{}}
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:                 logger,
+		Router:                 router,
+		StorageBackend:         storage.NewLocalFilesystemBackend(dir),
+		ExternalCacheStore:     store,
+		IndexLimit:             1,
+		IndexReconcileInterval: time.Hour,
+	})
+	suite.Nil(err, "no error creating server with notifying cache store")
+	suite.NotNil(store.handler, "server subscribes to cache invalidations")
+
+	log := logger.ContextLoggingFn(&gin.Context{})
+	_, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	store.Lock()
+	suite.Contains(store.published, "", "saving a cache entry publishes the repo")
+	store.Unlock()
+
+	// another instance stores a chart package, this instance regenerates its index once told
+	copyFile(otherTestTarballPath)
+	cached := func() bool {
+		content, _ := store.Get("")
+		return bytes.Contains(content, []byte("otherchart"))
+	}
+	store.handler("")
+	for i := 0; i < 200 && !cached(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	suite.True(cached(), "invalidation regenerates the index from storage")
+
+	store.handler("unknown/repo")
+	suite.Nil(server.getTenant("unknown/repo"), "invalidation of an unknown repo is ignored")
+}
+
+func (suite *MultiTenantServerTestSuite) TestCacheRebuild() {
+	dir := pathutil.Join(suite.TempDirectory, "rebuild")
+	os.MkdirAll(dir, os.ModePerm)
+	suite.copyTestFilesTo(dir)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:   logger,
+		Username: "user",
+		Password: "pass",
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:                 logger,
+		Router:                 router,
+		StorageBackend:         storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:             1,
+		EnableAPI:              true,
+		IndexReconcileInterval: time.Hour,
+		CacheTTL:               time.Hour,
+	})
+	suite.Nil(err, "no error creating server with cache TTL")
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1)
+
+	// a chart added directly in storage is not seen until the index is rebuilt
+	content, err := ioutil.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball v2")
+	err = ioutil.WriteFile(pathutil.Join(dir, "mychart-0.2.0.tgz"), content, 0644)
+	suite.Nil(err, "no error writing test tarball v2")
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "cached index is used")
+
+	invalidate := func(authenticated bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("POST", "/api/cache/invalidate", nil)
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	res := invalidate(false)
+	suite.Equal(401, res.Code, "401 POST /api/cache/invalidate without credentials")
+
+	res = invalidate(true)
+	suite.Equal(200, res.Code, "200 POST /api/cache/invalidate")
+	var summary map[string]interface{}
+	suite.Nil(json.Unmarshal(res.Body.Bytes(), &summary), "no error decoding rebuild summary")
+	suite.Equal(true, summary["rebuilt"])
+	suite.Equal(float64(1), summary["charts"])
+	suite.Equal(float64(2), summary["versions"])
+	suite.Contains(summary, "duration")
+
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 2, "rebuilt index is cached")
+
+	// once the cache TTL has passed, the next request rebuilds the index
+	err = os.Remove(pathutil.Join(dir, "mychart-0.2.0.tgz"))
+	suite.Nil(err, "no error removing test tarball v2")
+	rebuilt := server.Tenants[""].LastRebuilt
+	server.Tenants[""].LastRebuilt = time.Now().Add(-2 * time.Hour)
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "expired index is rebuilt")
+	suite.True(server.Tenants[""].LastRebuilt.After(rebuilt), "rebuild time is updated")
+
+	// while a request rebuilds the expired index, the others are served the cached one
+	err = ioutil.WriteFile(pathutil.Join(dir, "mychart-0.2.0.tgz"), content, 0644)
+	suite.Nil(err, "no error writing test tarball v2")
+	server.Tenants[""].LastRebuilt = time.Now().Add(-2 * time.Hour)
+	suite.True(server.claimRebuild("", true), "expired index is claimed")
+	suite.False(server.claimRebuild("", false), "index is only claimed once")
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "cached index is served while it is rebuilt")
+	server.releaseRebuild("")
+	index, httpErr = server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 2, "expired index is rebuilt once released")
+}
+
+func (suite *MultiTenantServerTestSuite) TestPushAnnotations() {
+	dir := pathutil.Join(suite.TempDirectory, "annotations")
+	os.MkdirAll(dir, os.ModePerm)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Username:      "user",
+		Password:      "pass",
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+		PushAnnotations: map[string]string{
+			"example.com/pushed-by": "{identity}",
+			"example.com/pushed-at": "{time}",
+			"example.com/team":      "platform",
+		},
+	})
+	suite.Nil(err, "no error creating server with push annotations")
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	request := func(method string, path string, body io.Reader) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest(method, path, body)
+		c.Request.SetBasicAuth("user", "pass")
+		server.Router.HandleContext(c)
+		return recorder.Code
+	}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	before := time.Now().Add(-time.Second)
+	suite.Equal(201, request("POST", "/api/charts", bytes.NewBuffer(content)), "201 POST /api/charts")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz.annotations"))
+	suite.Nil(err, "annotations are stored next to the package")
+
+	checkAnnotations := func(message string) {
+		index, httpErr := server.getIndexFile(log, "")
+		suite.Nil(httpErr)
+		suite.Len(index.Entries["mychart"], 1)
+		annotations := index.Entries["mychart"][0].Annotations
+		suite.Equal("user", annotations["example.com/pushed-by"], message)
+		suite.Equal("platform", annotations["example.com/team"], message)
+		pushedAt, err := time.Parse(time.RFC3339, annotations["example.com/pushed-at"])
+		suite.Nil(err, message)
+		suite.True(pushedAt.After(before), message)
+	}
+	checkAnnotations("annotations are in the index after the push")
+
+	_, httpErr := server.rebuildIndex(log, "")
+	suite.Nil(httpErr)
+	checkAnnotations("annotations are read back when the index is rebuilt")
+
+	server.PushAnnotations = nil
+	_, httpErr = server.rebuildIndex(log, "")
+	suite.Nil(httpErr)
+	checkAnnotations("annotations are read back once the option is no longer set")
+
+	suite.Equal(200, request("DELETE", "/api/charts/mychart/0.1.0", nil), "200 DELETE /api/charts/mychart/0.1.0")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz.annotations"))
+	suite.True(os.IsNotExist(err), "annotations are deleted along with the package")
+
+	// a package overwritten without annotations does not keep those of the package it replaces
+	server.PushAnnotations = map[string]string{"example.com/pushed-by": "{identity}"}
+	suite.Equal(201, request("POST", "/api/charts", bytes.NewBuffer(content)), "201 POST /api/charts")
+	server.PushAnnotations = nil
+	server.AllowOverwrite = true
+	suite.Equal(200, request("POST", "/api/charts", bytes.NewBuffer(content)), "200 POST /api/charts overwrite")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz.annotations"))
+	suite.True(os.IsNotExist(err), "annotations are deleted when overwritten without annotations")
+	_, httpErr = server.rebuildIndex(log, "")
+	suite.Nil(httpErr)
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	suite.Empty(index.Entries["mychart"][0].Annotations["example.com/pushed-by"], "no annotations after the overwrite")
+}
+
+func (suite *MultiTenantServerTestSuite) TestPutChartVersion() {
+	dir := pathutil.Join(suite.TempDirectory, "put")
+	os.MkdirAll(dir, os.ModePerm)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Username:      "user",
+		Password:      "pass",
+		Depth:         1,
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+	})
+	suite.Nil(err, "no error creating server")
+
+	put := func(path string, tarballPath string, authenticated bool) int {
+		content, err := ioutil.ReadFile(tarballPath)
+		suite.Nil(err, "no error opening test tarball")
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("PUT", path, bytes.NewBuffer(content))
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder.Code
+	}
+
+	suite.Equal(401, put("/api/myrepo/charts/mychart/0.1.0", testTarballPath, false), "401 PUT without credentials")
+	suite.Equal(400, put("/api/myrepo/charts/mychart/0.2.0", testTarballPath, true), "400 PUT of another version")
+	suite.Equal(400, put("/api/myrepo/charts/otherchart/0.1.0", testTarballPath, true), "400 PUT of another chart")
+
+	// an invalid chart package is reported the same way as when POSTed
+	invalid := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest(method, path, bytes.NewBufferString("not a chart package"))
+		c.Request.SetBasicAuth("user", "pass")
+		server.Router.HandleContext(c)
+		return recorder
+	}
+	posted := invalid("POST", "/api/myrepo/charts")
+	putted := invalid("PUT", "/api/myrepo/charts/mychart/0.1.0")
+	suite.Equal(posted.Code, putted.Code, "same status for an invalid chart package PUT and POSTed")
+	suite.Equal(posted.Body.String(), putted.Body.String(), "same error for an invalid chart package PUT and POSTed")
+
+	suite.Equal(201, put("/api/myrepo/charts/mychart/0.1.0", testTarballPath, true), "201 PUT of a new chart version")
+	_, err = os.Stat(pathutil.Join(dir, "myrepo", "mychart-0.1.0.tgz"))
+	suite.Nil(err, "package stored at the addressed chart version")
+	chartVersion, httpErr := server.getChartVersion(logger.ContextLoggingFn(&gin.Context{}), "myrepo", "mychart", "0.1.0")
+	suite.Nil(httpErr, "chart version in the index")
+	suite.Equal("mychart", chartVersion.Name)
+
+	suite.Equal(200, put("/api/myrepo/charts/mychart/0.1.0", testTarballPath, true), "200 PUT of the same package again")
+
+	os.MkdirAll(pathutil.Join(dir, "otherrepo"), os.ModePerm)
+	other, err := ioutil.ReadFile(otherTestTarballPath)
+	suite.Nil(err)
+	suite.Nil(ioutil.WriteFile(pathutil.Join(dir, "otherrepo", "mychart-0.1.0.tgz"), other, 0644))
+	suite.Equal(409, put("/api/otherrepo/charts/mychart/0.1.0", testTarballPath, true),
+		"409 PUT over a different package")
+}
+
+func (suite *MultiTenantServerTestSuite) TestPromoteChartVersion() {
+	dir := pathutil.Join(suite.TempDirectory, "promote")
+	os.MkdirAll(pathutil.Join(dir, "staging"), os.ModePerm)
+	suite.copyTestFilesTo(pathutil.Join(dir, "staging"))
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:   logger,
+		Username: "user",
+		Password: "pass",
+		Depth:    1,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+	})
+	suite.Nil(err, "no error creating server")
+
+	promote := func(path string, authenticated bool) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("POST", path, nil)
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder.Code
+	}
+
+	suite.Equal(401, promote("/api/staging/charts/mychart/0.1.0/promote?to=prod", false), "401 without credentials")
+	suite.Equal(400, promote("/api/staging/charts/mychart/0.1.0/promote", true), "400 without a repo to promote to")
+	suite.Equal(400, promote("/api/staging/charts/mychart/0.1.0/promote?to=staging", true), "400 promoting to the same repo")
+	suite.Equal(400, promote("/api/staging/charts/mychart/0.1.0/promote?to=prod/nested", true), "400 promoting to a repo too deep")
+	suite.Equal(404, promote("/api/staging/charts/mychart/9.9.9/promote?to=prod", true), "404 promoting a missing chart version")
+
+	server.Router.SetMaintenance(true)
+	suite.Equal(503, promote("/api/staging/charts/mychart/0.1.0/promote?to=prod", true), "503 in maintenance mode")
+	server.Router.SetMaintenance(false)
+
+	suite.Equal(201, promote("/api/staging/charts/mychart/0.1.0/promote?to=prod", true), "201 promoting a chart version")
+	for _, filename := range []string{"mychart-0.1.0.tgz", "mychart-0.1.0.tgz.prov"} {
+		_, err = os.Stat(pathutil.Join(dir, "prod", filename))
+		suite.Nil(err, "%s copied to the repo promoted to", filename)
+		_, err = os.Stat(pathutil.Join(dir, "staging", filename))
+		suite.Nil(err, "%s kept in the repo promoted from", filename)
+	}
+	log := logger.ContextLoggingFn(&gin.Context{})
+	promoted, httpErr := server.getChartVersion(log, "prod", "mychart", "0.1.0")
+	suite.Nil(httpErr, "chart version in the index of the repo promoted to")
+	original, httpErr := server.getChartVersion(log, "staging", "mychart", "0.1.0")
+	suite.Nil(httpErr)
+	suite.Equal(original.Digest, promoted.Digest)
+
+	suite.Equal(409, promote("/api/staging/charts/mychart/0.1.0/promote?to=prod", true), "409 promoting over an existing chart version")
+}
+
+func (suite *MultiTenantServerTestSuite) TestPushTimes() {
+	dir := pathutil.Join(suite.TempDirectory, "push-times")
+	os.MkdirAll(dir, os.ModePerm)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+		AllowOverwrite: true,
+	})
+	suite.Nil(err, "no error creating server")
+	log := logger.ContextLoggingFn(&gin.Context{})
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest("POST", "/api/charts", bytes.NewBuffer(content))
+	server.Router.HandleContext(c)
+	suite.Equal(201, recorder.Code, "201 POST /api/charts")
+
+	created := func() time.Time {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", "/api/charts/mychart/0.1.0", nil)
+		server.Router.HandleContext(c)
+		suite.Equal(200, recorder.Code, "200 GET /api/charts/mychart/0.1.0")
+		var chartVersion helm_repo.ChartVersion
+		suite.Nil(json.Unmarshal(recorder.Body.Bytes(), &chartVersion), "no error decoding chart version")
+		return chartVersion.Created
+	}
+	pushed := created()
+	suite.False(pushed.IsZero(), "created time is set")
+
+	// the package is written again in storage, e.g. when copied to another bucket
+	later := time.Now().Add(time.Hour)
+	suite.Nil(os.Chtimes(pathutil.Join(dir, "mychart-0.1.0.tgz"), later, later))
+	suite.True(pushed.Equal(created()), "push time kept when the index is reconciled with storage")
+	_, httpErr := server.rebuildIndex(log, "")
+	suite.Nil(httpErr, "no error rebuilding index")
+	suite.True(pushed.Equal(created()), "push time kept when the index is rebuilt")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"+chartPushTimeSuffix))
+	suite.Nil(err, "push time stored alongside the chart package")
+
+	// an overwrite which fails leaves the push time of the package already stored
+	recorder = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest("POST", "/api/charts?sha256=0000", bytes.NewBuffer(content))
+	server.Router.HandleContext(c)
+	suite.Equal(400, recorder.Code, "400 POST /api/charts with the wrong digest")
+	storedPushTime, ok := server.chartPushTime("", "mychart-0.1.0.tgz")
+	suite.True(ok, "push time still stored after a failed overwrite")
+	suite.True(pushed.Equal(storedPushTime), "push time unchanged by a failed overwrite")
+
+	// another server has neither the cache nor a statefile, only what is in storage
+	server, err = NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         cm_router.NewRouter(cm_router.RouterOptions{Logger: logger}),
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+	})
+	suite.Nil(err, "no error creating server")
+	suite.True(pushed.Equal(created()), "push time read from storage when the previous index is lost")
+
+	index, httpErr := server.getIndexFile(log, "")
+	suite.Nil(httpErr)
+	chartVersion := *index.Entries["mychart"][0]
+	chartVersion.Created = later
+	suite.True(pushed.Equal(pushTime(index, &chartVersion)), "push time of the same package")
+	chartVersion.Digest = "other"
+	suite.True(later.Equal(pushTime(index, &chartVersion)), "modification time of another package")
+}
+
+func (suite *MultiTenantServerTestSuite) TestListRepos() {
+	dir := pathutil.Join(suite.TempDirectory, "repos")
+	for _, repo := range []string{"org1/repoa", "org1/repob", "org2/repoc"} {
+		os.MkdirAll(pathutil.Join(dir, repo), os.ModePerm)
+		suite.copyTestFilesTo(pathutil.Join(dir, repo))
+	}
+	suite.copyTestFilesTo(pathutil.Join(dir, "org1")) // not at the depth of a repo
+	content, err := ioutil.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball v2")
+	err = ioutil.WriteFile(pathutil.Join(dir, "org1/repoa/mychart-0.2.0.tgz"), content, 0644)
+	suite.Nil(err, "no error writing test tarball v2")
+	content, err = ioutil.ReadFile(otherTestTarballPath)
+	suite.Nil(err, "no error opening other test tarball")
+	err = ioutil.WriteFile(pathutil.Join(dir, "org1/repoa/otherchart-0.1.0.tgz"), content, 0644)
+	suite.Nil(err, "no error writing other test tarball")
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:   logger,
+		Username: "user",
+		Password: "pass",
+		Depth:    2,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+	})
+	suite.Nil(err, "no error creating server")
+
+	listRepos := func(authenticated bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", "/api/repos", nil)
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	res := listRepos(false)
+	suite.Equal(401, res.Code, "401 GET /api/repos without credentials")
+
+	res = listRepos(true)
+	suite.Equal(200, res.Code, "200 GET /api/repos")
+	var body struct {
+		Repos []repoSummary `json:"repos"`
+	}
+	suite.Nil(json.Unmarshal(res.Body.Bytes(), &body), "no error decoding repos")
+	suite.Equal([]repoSummary{
+		{Name: "org1/repoa", Charts: 2, Versions: 3},
+		{Name: "org1/repob", Charts: 1, Versions: 1},
+		{Name: "org2/repoc", Charts: 1, Versions: 1},
+	}, body.Repos)
+
+	// the list is cached
+	os.MkdirAll(pathutil.Join(dir, "org3/repod"), os.ModePerm)
+	suite.copyTestFilesTo(pathutil.Join(dir, "org3/repod"))
+	repos, httpErr := server.listRepos(logger.ContextLoggingFn(&gin.Context{}))
+	suite.Nil(httpErr)
+	suite.Len(repos, 3, "cached list of repos is returned")
+	server.repoList.listed = time.Time{}
+	repos, httpErr = server.listRepos(logger.ContextLoggingFn(&gin.Context{}))
+	suite.Nil(httpErr)
+	suite.Len(repos, 4, "repos are listed again once the cache has expired")
+
+	server.StorageBackend = struct{ storage.Backend }{server.StorageBackend}
+	server.repoList.listed = time.Time{}
+	_, httpErr = server.listRepos(logger.ContextLoggingFn(&gin.Context{}))
+	suite.Equal(501, httpErr.Status, "501 if the storage backend cannot list recursively")
+}
+
+func (suite *MultiTenantServerTestSuite) TestRepoStats() {
+	dir := pathutil.Join(suite.TempDirectory, "stats")
+	for _, repo := range []string{"repoa", "repoa/nested"} {
+		os.MkdirAll(pathutil.Join(dir, repo), os.ModePerm)
+		suite.copyTestFilesTo(pathutil.Join(dir, repo))
+	}
+	var size int64
+	for _, path := range []string{testTarballPath, testProvfilePath} {
+		info, err := os.Stat(path)
+		suite.Nil(err, "no error reading size of %s", path)
+		size += info.Size()
+	}
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:   logger,
+		Username: "user",
+		Password: "pass",
+		Depth:    1,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+	})
+	suite.Nil(err, "no error creating server")
+
+	getStats := func(authenticated bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", "/api/repoa/stats", nil)
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	res := getStats(false)
+	suite.Equal(401, res.Code, "401 GET /api/repoa/stats without credentials")
+
+	res = getStats(true)
+	suite.Equal(200, res.Code, "200 GET /api/repoa/stats")
+	var stats repoStats
+	suite.Nil(json.Unmarshal(res.Body.Bytes(), &stats), "no error decoding stats")
+	suite.Equal(repoStats{Name: "repoa", Charts: 1, Versions: 1, Bytes: size}, stats,
+		"objects of the nested repo are not counted")
+
+	metric := &dto.Metric{}
+	suite.Nil(storageBytesGaugeVec.WithLabelValues("repoa").Write(metric), "no error reading gauge")
+	suite.Equal(float64(size), metric.GetGauge().GetValue(), "storage used is exported")
+
+	// a tenant never requested before is set up rather than read as nil
+	log := logger.ContextLoggingFn(&gin.Context{})
+	server.setStorageUsage(log, "repob", 1)
+	suite.NotNil(server.getTenant("repob"), "tenant is initialized")
+}
+
+func (suite *MultiTenantServerTestSuite) TestIgnoreChartNameCase() {
+	dir := pathutil.Join(suite.TempDirectory, "ignore-case")
+	os.MkdirAll(dir, os.ModePerm)
+	suite.copyTestFilesTo(dir)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	newServer := func(ignoreCase bool) *MultiTenantServer {
+		server, err := NewMultiTenantServer(MultiTenantServerOptions{
+			Logger:              logger,
+			Router:              cm_router.NewRouter(cm_router.RouterOptions{Logger: logger}),
+			StorageBackend:      storage.NewLocalFilesystemBackend(dir),
+			IndexLimit:          1,
+			EnableAPI:           true,
+			IgnoreChartNameCase: ignoreCase,
+		})
+		suite.Nil(err, "no error creating server")
+		return server
+	}
+	get := func(server *MultiTenantServer, path string) int {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", path, nil)
+		server.Router.HandleContext(c)
+		return recorder.Code
+	}
+
+	server := newServer(false)
+	suite.Equal(200, get(server, "/api/charts/mychart"))
+	suite.Equal(404, get(server, "/api/charts/MyChart"), "chart names match exactly by default")
+
+	server = newServer(true)
+	suite.Equal(200, get(server, "/api/charts/MyChart"), "chart name matched ignoring case")
+	suite.Equal(200, get(server, "/api/charts/MYCHART/0.1.0"), "chart version matched ignoring case")
+	suite.Equal(404, get(server, "/api/charts/MyOtherChart"))
+}
+
+func (suite *MultiTenantServerTestSuite) TestAllowedChartNameRegex() {
+	dir := pathutil.Join(suite.TempDirectory, "allowed-chart-names")
+	os.MkdirAll(dir, os.ModePerm)
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:                logger,
+		MaxUploadSize:         maxUploadSize,
+		AllowedChartNameRegex: "^other",
+	})
+	suite.NotNil(router.AllowedChartNames, "regex compiled")
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+	})
+	suite.Nil(err, "no error creating server")
+
+	push := func(method string, path string, tarballPath string) *httptest.ResponseRecorder {
+		content, err := ioutil.ReadFile(tarballPath)
+		suite.Nil(err, "no error opening test tarball")
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest(method, path, bytes.NewBuffer(content))
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	recorder := push("POST", "/api/charts", testTarballPath)
+	suite.Equal(400, recorder.Code, "400 POST of a chart name not allowed")
+	suite.Contains(recorder.Body.String(), "does not match the allowed chart name regex")
+	suite.Equal(400, push("PUT", "/api/charts/mychart/0.1.0", testTarballPath).Code, "400 PUT of a chart name not allowed")
+	recorder = push("POST", "/api/charts/validate", testTarballPath)
+	suite.Equal(400, recorder.Code, "400 validation of a chart name not allowed")
+	suite.Contains(recorder.Body.String(), "does not match the allowed chart name regex")
+	_, err = os.Stat(pathutil.Join(dir, "mychart-0.1.0.tgz"))
+	suite.True(os.IsNotExist(err), "chart not stored")
+
+	suite.Equal(201, push("POST", "/api/charts", otherTestTarballPath).Code, "201 POST of an allowed chart name")
+}
+
+func (suite *MultiTenantServerTestSuite) TestVariableDepth() {
+	dir := pathutil.Join(suite.TempDirectory, "variable-depth")
+	for _, repo := range []string{"org1", "org1/repoa", "org1/team1/project1"} {
+		os.MkdirAll(pathutil.Join(dir, repo), os.ModePerm)
+		suite.copyTestFilesTo(pathutil.Join(dir, repo))
+	}
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Depth:         2,
+		VariableDepth: true,
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: storage.NewLocalFilesystemBackend(dir),
+		IndexLimit:     1,
+		EnableAPI:      true,
+	})
+	suite.Nil(err, "no error creating server with variable depth")
+
+	do := func(method string, path string, body io.Reader) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest(method, path, body)
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	res := do("GET", "/org1/team1/project1/index.yaml", nil)
+	suite.Equal(200, res.Code, "200 GET /org1/team1/project1/index.yaml")
+	res = do("GET", "/org1/index.yaml", nil)
+	suite.Equal(404, res.Code, "404 GET /org1/index.yaml, shallower than the depth")
+
+	content, err := ioutil.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball v2")
+	res = do("POST", "/api/org1/team1/project1/charts", bytes.NewBuffer(content))
+	suite.Equal(201, res.Code, "201 POST /api/org1/team1/project1/charts")
+	_, err = os.Stat(pathutil.Join(dir, "org1/team1/project1/mychart-0.2.0.tgz"))
+	suite.Nil(err, "chart package stored in the directory of the repo")
+
+	log := logger.ContextLoggingFn(&gin.Context{})
+	index, httpErr := server.getIndexFile(log, "org1/team1/project1")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 2, "index of the deeper repo has the pushed version")
+	index, httpErr = server.getIndexFile(log, "org1/repoa")
+	suite.Nil(httpErr)
+	suite.Len(index.Entries["mychart"], 1, "index of another repo is left alone")
+
+	repos, httpErr := server.listRepos(log)
+	suite.Nil(httpErr)
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+	suite.Equal([]string{"org1/repoa", "org1/team1/project1"}, names, "repos at or below the depth are listed")
+}
+
+type presigningBackend struct {
+	storage.Backend
+}
+
+func (b presigningBackend) PresignedURL(path string, expires time.Duration) (string, error) {
+	return fmt.Sprintf("https://storage.example.com/%s?expires=%d", path, int(expires.Seconds())), nil
+}
+
+func (suite *MultiTenantServerTestSuite) TestPresignedRedirect() {
+	newServer := func(backend storage.Backend, presignedRedirect bool) *MultiTenantServer {
+		logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+		suite.Nil(err, "no error creating logger")
+		router := cm_router.NewRouter(cm_router.RouterOptions{
+			Logger:   logger,
+			Username: "user",
+			Password: "pass",
+		})
+		server, err := NewMultiTenantServer(MultiTenantServerOptions{
+			Logger:             logger,
+			Router:             router,
+			StorageBackend:     backend,
+			IndexLimit:         1,
+			PresignedRedirect:  presignedRedirect,
+			PresignedURLExpiry: time.Minute,
+		})
+		suite.Nil(err, "no error creating server with presigned redirects")
+		return server
+	}
+	download := func(server *MultiTenantServer, path string, authenticated bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", path, nil)
+		if authenticated {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	backend := presigningBackend{Backend: suite.Depth0Server.StorageBackend}
+	server := newServer(backend, true)
+
+	res := download(server, "/charts/mychart-0.1.0.tgz", true)
+	suite.Equal(302, res.Code, "302 GET /charts/mychart-0.1.0.tgz")
+	suite.Equal("https://storage.example.com/mychart-0.1.0.tgz?expires=60", res.Header().Get("Location"))
+
+	res = download(server, "/charts/mychart-0.1.0.tgz.prov", true)
+	suite.Equal(302, res.Code, "302 GET /charts/mychart-0.1.0.tgz.prov")
+
+	res = download(server, "/charts/fakechart-0.1.0.tgz", true)
+	suite.Equal(404, res.Code, "404 GET /charts/fakechart-0.1.0.tgz")
+	suite.Empty(res.Header().Get("Location"), "no presigned URL for a missing chart")
+
+	res = download(server, "/charts/mychart-0.1.0.tgz", false)
+	suite.Equal(401, res.Code, "401 GET /charts/mychart-0.1.0.tgz without credentials")
+	suite.Empty(res.Header().Get("Location"), "no presigned URL without credentials")
+
+	res = download(server, "/charts/mychart-0.1.0.txt", true)
+	suite.NotEqual(302, res.Code, "no redirect for unsupported file extension")
+
+	server = newServer(backend, false)
+	res = download(server, "/charts/mychart-0.1.0.tgz", true)
+	suite.NotEqual(302, res.Code, "no redirect when presigned redirects are disabled")
+
+	server = newServer(suite.Depth0Server.StorageBackend, true)
+	res = download(server, "/charts/mychart-0.1.0.tgz", true)
+	suite.NotEqual(302, res.Code, "no redirect when backend cannot presign URLs")
+}
+
+func (suite *MultiTenantServerTestSuite) TestIndexConditionalRequests() {
+	getIndex := func(headers map[string]string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", "/index.yaml", nil)
+		for key, value := range headers {
+			c.Request.Header.Set(key, value)
+		}
+		suite.Depth0Server.Router.HandleContext(c)
+		return recorder
+	}
+
+	res := getIndex(nil)
+	suite.Equal(200, res.Code, "200 GET /index.yaml")
+	etag := res.Header().Get("ETag")
+	lastModified := res.Header().Get("Last-Modified")
+	suite.NotEmpty(etag, "ETag is set")
+	suite.NotEmpty(lastModified, "Last-Modified is set")
+
+	res = getIndex(map[string]string{"If-None-Match": etag})
+	suite.Equal(304, res.Code, "304 GET /index.yaml with matching If-None-Match")
+	suite.Empty(res.Body.Bytes(), "no body with 304")
+
+	res = getIndex(map[string]string{"If-None-Match": `"other", W/` + etag})
+	suite.Equal(304, res.Code, "304 GET /index.yaml with weak matching If-None-Match")
+
+	res = getIndex(map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified})
+	suite.Equal(200, res.Code, "200 GET /index.yaml, If-None-Match takes precedence")
+
+	res = getIndex(map[string]string{"If-Modified-Since": lastModified})
+	suite.Equal(304, res.Code, "304 GET /index.yaml with If-Modified-Since")
+
+	res = getIndex(map[string]string{"If-Modified-Since": time.Unix(0, 0).UTC().Format(http.TimeFormat)})
+	suite.Equal(200, res.Code, "200 GET /index.yaml modified since")
+}
+
+func (suite *MultiTenantServerTestSuite) TestIndexJSON() {
+	get := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", path, nil)
+		for key, value := range headers {
+			c.Request.Header.Set(key, value)
+		}
+		suite.Depth0Server.Router.HandleContext(c)
+		return recorder
+	}
+
+	res := get("/index.yaml", nil)
+	suite.Equal(200, res.Code, "200 GET /index.yaml")
+	yamlETag := res.Header().Get("ETag")
+	var fromYAML map[string]interface{}
+	err := yaml.Unmarshal(res.Body.Bytes(), &fromYAML)
+	suite.Nil(err, "no error parsing index.yaml")
+
+	res = get("/index.json", nil)
+	suite.Equal(200, res.Code, "200 GET /index.json")
+	suite.Equal(indexJSONFileContentType, res.Header().Get("Content-Type"))
+	jsonETag := res.Header().Get("ETag")
+	suite.NotEmpty(jsonETag, "ETag is set")
+	suite.NotEqual(yamlETag, jsonETag, "index.json has an ETag of its own")
+	suite.NotEmpty(res.Header().Get("Last-Modified"), "Last-Modified is set")
+	var fromJSON map[string]interface{}
+	err = json.Unmarshal(res.Body.Bytes(), &fromJSON)
+	suite.Nil(err, "no error parsing index.json")
+	suite.Equal(fromYAML, fromJSON, "index.json holds the same index as index.yaml")
+	suite.Contains(fromJSON["entries"], "mychart")
+
+	res = get("/index.json", map[string]string{"If-None-Match": jsonETag})
+	suite.Equal(304, res.Code, "304 GET /index.json with matching If-None-Match")
+	suite.Empty(res.Body.Bytes(), "no body with 304")
+
+	res = get("/index.json", map[string]string{"If-None-Match": yamlETag})
+	suite.Equal(200, res.Code, "200 GET /index.json with the ETag of index.yaml")
+}
+
+func (suite *MultiTenantServerTestSuite) TestIndexSignature() {
+	signer, err := repo.NewIndexSigner("../../../../testdata/pgp/helm-test-key.secret", "", "")
+	suite.Nil(err, "no error loading signing key")
+	keyring, err := repo.LoadKeyring("../../../../testdata/pgp/helm-test-key.pub")
+	suite.Nil(err, "no error loading public keyring")
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{Debug: true})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{Logger: logger})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:         logger,
+		Router:         router,
+		StorageBackend: suite.Depth0Server.StorageBackend,
+		IndexLimit:     1,
+		IndexSigner:    signer,
+	})
+	suite.Nil(err, "no error creating server with index signing")
+
+	get := func(server *MultiTenantServer, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest("GET", path, nil)
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	res := get(server, "/index.yaml")
+	suite.Equal(200, res.Code, "200 GET /index.yaml")
+	index := res.Body.Bytes()
+
+	res = get(server, "/index.yaml.prov")
+	suite.Equal(200, res.Code, "200 GET /index.yaml.prov")
+	suite.Equal(provenanceFileContentType, res.Header().Get("Content-Type"))
+	suite.NotEmpty(res.Header().Get("ETag"), "ETag is set")
+	signature := res.Body.Bytes()
+
+	verified, err := repo.VerifyIndexSignature(keyring, index, signature)
+	suite.Nil(err, "no error verifying index signature")
+	suite.Equal(fmt.Sprintf("%x", sha256.Sum256(index)), verified.Digest)
+
+	res = get(server, "/index.yaml.prov")
+	suite.Equal(signature, res.Body.Bytes(), "signature is reused while the index is unchanged")
+
+	res = get(suite.Depth0Server, "/index.yaml.prov")
+	suite.Equal(404, res.Code, "404 GET /index.yaml.prov without index signing")
+}
+
+func (suite *MultiTenantServerTestSuite) TestRoutes() {
+	suite.testAllRoutes("", 0)
+	for org, teams := range suite.StorageDirectory {
+		suite.testAllRoutes(org, 1)
+		for team, repos := range teams {
+			suite.testAllRoutes(pathutil.Join(org, team), 2)
+			for _, repo := range repos {
+				suite.testAllRoutes(pathutil.Join(org, team, repo), 3)
+			}
+		}
+	}
+}
+
+func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
+	var res gin.ResponseWriter
+
+	stype := fmt.Sprintf("depth%d", depth)
+
+	// GET /
+	res = suite.doRequest(stype, "GET", "/", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /")
+
+	// GET /health
+	res = suite.doRequest(stype, "GET", "/health", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /health")
+
+	// GET /readiness
+	res = suite.doRequest(stype, "GET", "/readiness", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /readiness")
+
+	var repoPrefix string
+	if repo != "" {
+		repoPrefix = pathutil.Join("/", repo)
+	} else {
+		repoPrefix = ""
+	}
+
+	// GET /:repo/index.yaml
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/index.yaml", repoPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/index.yaml", repoPrefix))
+
+	// Issue #21
+	suite.NotEqual("", res.Header().Get("X-Request-Id"), "X-Request-Id header is present")
+	suite.Equal("", res.Header().Get("X-Blah-Blah-Blah"), "X-Blah-Blah-Blah header is not present")
+
+	// GET /:repo/index.json
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/index.json", repoPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/index.json", repoPrefix))
+
+	// GET /:repo/charts/:filename
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart-0.1.0.tgz", repoPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart-0.1.0.tgz", repoPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart-0.1.0.tgz.prov", repoPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart-0.1.0.tgz.prov", repoPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart-0.1.0.tgz", repoPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/fakechart-0.1.0.tgz", repoPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart-0.1.0.tgz.prov", repoPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/fakechart-0.1.0.tgz.prov", repoPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart-0.1.0.bad", repoPrefix), nil, "")
+	suite.Equal(500, res.Status(), fmt.Sprintf("500 GET %s/charts/fakechart-0.1.0.bad", repoPrefix))
+
+	// HEAD /:repo/charts/:filename
+	res = suite.doRequest(stype, "HEAD", fmt.Sprintf("%s/charts/mychart-0.1.0.tgz", repoPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 HEAD %s/charts/mychart-0.1.0.tgz", repoPrefix))
+	suite.NotEqual("", res.Header().Get("Content-Length"), "Content-Length header is present")
+	suite.NotEqual("", res.Header().Get("Last-Modified"), "Last-Modified header is present")
+	suite.Equal(0, res.Size(), "no body in HEAD response")
+
+	res = suite.doRequest(stype, "HEAD", fmt.Sprintf("%s/charts/fakechart-0.1.0.tgz", repoPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 HEAD %s/charts/fakechart-0.1.0.tgz", repoPrefix))
 
 	apiPrefix := pathutil.Join("/api", repo)
 
@@ -792,13 +3408,54 @@ func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
 	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts", apiPrefix), nil, "")
 	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts", apiPrefix))
 
+	// GET /api/:repo/charts?offset=&limit=
+	pageBuf := bytes.NewBufferString("")
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts?offset=0&limit=1", apiPrefix), nil, "", pageBuf)
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts?offset=0&limit=1", apiPrefix))
+	var page map[string]interface{}
+	suite.Nil(json.Unmarshal(pageBuf.Bytes(), &page), "no error decoding page of charts")
+	suite.Equal(1, len(page), "one chart in page")
+	suite.NotEqual("", res.Header().Get("X-Total-Count"), "X-Total-Count header is present")
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts?offset=1000", apiPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts?offset=1000", apiPrefix))
+	suite.Equal("", res.Header().Get("Link"), "no next page")
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts?limit=abc", apiPrefix), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 GET %s/charts?limit=abc", apiPrefix))
+
 	// GET /api/:repo/charts/:name
-	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart", apiPrefix), nil, "")
+	chartBuf := bytes.NewBufferString("")
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart", apiPrefix), nil, "", chartBuf)
 	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart", apiPrefix))
+	var chartVersions []map[string]interface{}
+	suite.Nil(json.Unmarshal(chartBuf.Bytes(), &chartVersions), "no error decoding chart versions")
+	suite.Equal(1, len(chartVersions), "all versions of the chart are listed")
+	suite.Equal("0.1.0", chartVersions[0]["version"])
+	suite.NotEmpty(chartVersions[0]["digest"], "chart version has its digest")
+	suite.NotEmpty(chartVersions[0]["created"], "chart version has its creation time")
+	suite.NotEmpty(chartVersions[0]["urls"], "chart version has its urls")
 
 	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart", apiPrefix), nil, "")
 	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/fakechart", apiPrefix))
 
+	// GET /api/:repo/charts/search
+	searchBuf := bytes.NewBufferString("")
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/search?q=MYCH", apiPrefix), nil, "", searchBuf)
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/search", apiPrefix))
+	var searchResults []map[string]interface{}
+	suite.Nil(json.Unmarshal(searchBuf.Bytes(), &searchResults), "no error decoding search results")
+	suite.Equal(1, len(searchResults), "one chart matches the query")
+	suite.Equal("mychart", searchResults[0]["name"])
+
+	searchBuf = bytes.NewBufferString("")
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/search?q=nomatch", apiPrefix), nil, "", searchBuf)
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/search", apiPrefix))
+	suite.Equal("[]", strings.TrimSpace(searchBuf.String()), "no charts match the query")
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/search?limit=-1", apiPrefix), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 GET %s/charts/search", apiPrefix))
+
 	// GET /api/:repo/charts/:name/:version
 	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart/0.1.0", apiPrefix), nil, "")
 	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart/0.1.0", apiPrefix))
@@ -812,6 +3469,13 @@ func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
 	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart/0.1.0", apiPrefix), nil, "")
 	suite.Equal(404, res.Status(), fmt.Sprintf("200 GET %s/charts/fakechart/0.1.0", apiPrefix))
 
+	// HEAD /api/:repo/charts/:name/:version
+	res = suite.doRequest(stype, "HEAD", fmt.Sprintf("%s/charts/mychart/0.1.0", apiPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 HEAD %s/charts/mychart/0.1.0", apiPrefix))
+
+	res = suite.doRequest(stype, "HEAD", fmt.Sprintf("%s/charts/mychart/0.1.1", apiPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 HEAD %s/charts/mychart/0.1.1", apiPrefix))
+
 	// DELETE /api/:repo/charts/:name/:version
 	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/mychart/0.1.0", apiPrefix), nil, "")
 	suite.Equal(200, res.Status(), fmt.Sprintf("200 DELETE %s/charts/mychart/0.1.0", apiPrefix))
@@ -894,6 +3558,28 @@ func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
 	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/mychart/0.1.0", apiPrefix), nil, "")
 	suite.Equal(200, res.Status(), fmt.Sprintf("200 DELETE %s/charts/mychart/0.1.0", apiPrefix))
 
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart-0.1.0.tgz.prov", repoPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/mychart-0.1.0.tgz.prov", repoPrefix))
+
+	// Create form file with chart=@mychart-0.1.0.tgz and the provenance file of another chart
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, otherTestProvfilePath})
+	res = suite.doRequest(stype, "POST", fmt.Sprintf("%s/charts", apiPrefix), buf, w.FormDataContentType())
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 POST %s/charts", apiPrefix))
+
+	// Create form file with chart=@mychart-0.1.0.tgz and a provenance file listing another digest
+	provContent, err := ioutil.ReadFile(testProvfilePath)
+	suite.Nil(err, "no error opening test provenance file")
+	tamperedProvContent := regexp.MustCompile("sha256:[0-9a-f]+").ReplaceAll(provContent, []byte("sha256:"+strings.Repeat("0", 64)))
+	tamperedProvfilePath := pathutil.Join(suite.TempDirectory, fmt.Sprintf("tampered-%s.tgz.prov", stype))
+	suite.Nil(ioutil.WriteFile(tamperedProvfilePath, tamperedProvContent, 0644), "no error writing tampered provenance file")
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, tamperedProvfilePath})
+	res = suite.doRequest(stype, "POST", fmt.Sprintf("%s/charts", apiPrefix), buf, w.FormDataContentType())
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 POST %s/charts", apiPrefix))
+
+	// neither file is stored when the provenance file does not match
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart-0.1.0.tgz", repoPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/mychart-0.1.0.tgz", repoPrefix))
+
 	// Create form file with unknown=@mychart-0.1.0.tgz, which should fail because the server doesn't know about the unknown field
 	buf, w = suite.getBodyWithMultipartFormFiles([]string{"unknown"}, []string{testTarballPath})
 	res = suite.doRequest(stype, "POST", fmt.Sprintf("%s/charts", apiPrefix), buf, w.FormDataContentType())
@@ -924,6 +3610,61 @@ func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
 	res = suite.doRequest(stype, "POST", fmt.Sprintf("%s/charts", apiPrefix), buf, w.FormDataContentType())
 	suite.Equal(400, res.Status(), fmt.Sprintf("400 POST %s/charts", apiPrefix))
 
+	// DELETE /api/:repo/charts/:name?semver=<constraint>&confirm=true
+	content, err = ioutil.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball v2")
+	body = bytes.NewBuffer(content)
+	res = suite.doRequest(stype, "POST", fmt.Sprintf("%s/charts", apiPrefix), body, "")
+	suite.Equal(201, res.Status(), fmt.Sprintf("201 POST %s/charts", apiPrefix))
+
+	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/mychart", apiPrefix), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 DELETE %s/charts/mychart without confirm", apiPrefix))
+
+	semverQuery := url.QueryEscape("<0.2.0")
+	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/mychart?semver=%s", apiPrefix, semverQuery), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 DELETE %s/charts/mychart without confirm", apiPrefix))
+
+	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/mychart?semver=notaversion&confirm=true", apiPrefix), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 DELETE %s/charts/mychart with invalid semver", apiPrefix))
+
+	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/fakechart?semver=%s&confirm=true", apiPrefix, semverQuery), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 DELETE %s/charts/fakechart", apiPrefix))
+
+	deleteBuf := bytes.NewBufferString("")
+	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/mychart?semver=%s&confirm=true", apiPrefix, semverQuery), nil, "", deleteBuf)
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 DELETE %s/charts/mychart?semver=<0.2.0", apiPrefix))
+	suite.Equal(`{"deleted":["0.1.0"],"failed":{}}`, strings.TrimSpace(deleteBuf.String()))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart/0.1.0", apiPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/mychart/0.1.0", apiPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart/0.2.0", apiPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart/0.2.0", apiPrefix))
+
+	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/mychart?semver=%s&confirm=true", apiPrefix, url.QueryEscape("~0.2.0")), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 DELETE %s/charts/mychart?semver=~0.2.0", apiPrefix))
+
+	// DELETE /api/:repo/charts/:name?confirm=true
+	for _, tarballPath := range []string{testTarballPath, testTarballPathV2} {
+		content, err = ioutil.ReadFile(tarballPath)
+		suite.Nil(err, "no error opening test tarball")
+		res = suite.doRequest(stype, "POST", fmt.Sprintf("%s/charts", apiPrefix), bytes.NewBuffer(content), "")
+		suite.Equal(201, res.Status(), fmt.Sprintf("201 POST %s/charts", apiPrefix))
+	}
+
+	deleteBuf = bytes.NewBufferString("")
+	res = suite.doRequest(stype, "DELETE", fmt.Sprintf("%s/charts/mychart?confirm=true", apiPrefix), nil, "", deleteBuf)
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 DELETE %s/charts/mychart?confirm=true", apiPrefix))
+	var deleteResult struct {
+		Deleted []string          `json:"deleted"`
+		Failed  map[string]string `json:"failed"`
+	}
+	suite.Nil(json.Unmarshal(deleteBuf.Bytes(), &deleteResult), "no error decoding deleted versions")
+	suite.ElementsMatch([]string{"0.1.0", "0.2.0"}, deleteResult.Deleted, "every version of the chart is deleted")
+	suite.Empty(deleteResult.Failed)
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart", apiPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/mychart", apiPrefix))
 }
 
 func (suite *MultiTenantServerTestSuite) getBodyWithMultipartFormFiles(fields []string, filenames []string) (io.Reader, *multipart.Writer) {
@@ -0,0 +1,78 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"sync"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+)
+
+type (
+	// indexSigner signs the index of each repo, keeping the last signature of each until
+	// its index changes so that the signing time stays the same between requests
+	indexSigner struct {
+		signer     *cm_repo.IndexSigner
+		mu         sync.Mutex
+		signatures map[string]indexSignature
+	}
+
+	indexSignature struct {
+		etag    string
+		content []byte
+	}
+)
+
+func newIndexSigner(signer *cm_repo.IndexSigner) *indexSigner {
+	return &indexSigner{
+		signer:     signer,
+		signatures: map[string]indexSignature{},
+	}
+}
+
+// sign returns the signature of a repo index with the given ETag
+func (s *indexSigner) sign(repo string, index *cm_repo.Index, etag string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if signature, ok := s.signatures[repo]; ok && signature.etag == etag {
+		return signature.content, nil
+	}
+	content, err := s.signer.Sign(index.Raw, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	s.signatures[repo] = indexSignature{etag: etag, content: content}
+	return content, nil
+}
+
+func (server *MultiTenantServer) getIndexSignature(log cm_logger.LoggingFn, repo string) ([]byte, *HTTPError) {
+	indexFile, httpErr := server.getIndexFile(log, repo)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	signature, err := server.indexSigner.sign(repo, indexFile, indexETag(indexFile))
+	if err != nil {
+		errStr := err.Error()
+		log(cm_logger.ErrorLevel, errStr,
+			"repo", repo,
+		)
+		return nil, &HTTPError{500, errStr}
+	}
+	return signature, nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// initialIndexRetryAfter is how long clients are told to wait while the initial index is built
+var initialIndexRetryAfter = 5 * time.Second
+
+// startInitialIndexBuild builds the index of a single tenant setup in the background, once the
+// server is started with BuildIndexOnListen (see Listen), so that a large repo does not hold up
+// the start. Until the build is done, requests served from the index get a 503 (see indexRequired)
+func (server *MultiTenantServer) startInitialIndexBuild() {
+	if server.Router.Depth != 0 {
+		return
+	}
+	atomic.StoreInt32(&server.initialIndexBuild, 1)
+	go server.buildInitialIndex()
+}
+
+// buildInitialIndex primes the cache. A failed build is only logged: requests then build
+// the index themselves, as they would for a repo which was never cached
+func (server *MultiTenantServer) buildInitialIndex() {
+	defer atomic.StoreInt32(&server.initialIndexBuild, 0)
+	if err := server.primeCache(); err != nil {
+		server.Logger.Errorw("Error building the initial index", "error", err.Error())
+	}
+}
+
+// initialIndexBuilding reports whether the initial index is being built
+func (server *MultiTenantServer) initialIndexBuilding() bool {
+	return atomic.LoadInt32(&server.initialIndexBuild) == 1
+}
+
+// indexRequired answers requests for the index, or served from it, with a 503 and a
+// Retry-After while the initial index is built, so that clients retry rather than get,
+// and cache, an empty index
+func (server *MultiTenantServer) indexRequired(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if server.initialIndexBuilding() {
+			c.Header("Retry-After", strconv.Itoa(int(initialIndexRetryAfter.Seconds())))
+			c.JSON(503, gin.H{"error": "the index is being built, retry later"})
+			return
+		}
+		handler(c)
+	}
+}
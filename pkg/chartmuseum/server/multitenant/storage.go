@@ -17,8 +17,10 @@ limitations under the License.
 package multitenant
 
 import (
+	"fmt"
 	pathutil "path"
 	"strings"
+	"time"
 
 	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "github.com/helm/chartmuseum/pkg/repo"
@@ -63,7 +65,7 @@ func (server *MultiTenantServer) getStorageObject(log cm_logger.LoggingFn, repo
 
 	var contentType string
 	if isProvenanceFile {
-		contentType = chartPackageContentType
+		contentType = provenanceFileContentType
 	} else {
 		contentType = chartPackageContentType
 	}
@@ -75,3 +77,100 @@ func (server *MultiTenantServer) getStorageObject(log cm_logger.LoggingFn, repo
 
 	return storageObject, nil
 }
+
+// statStorageObject returns a chart package or provenance file as stat'd in storage, without its
+// content, for answering a HEAD. Backends which cannot stat objects have the object fetched
+func (server *MultiTenantServer) statStorageObject(log cm_logger.LoggingFn, repo string, filename string) (*StorageObject, *HTTPError) {
+	stater, ok := server.StorageBackend.(storage.Stater)
+	if !ok {
+		return server.getStorageObject(log, repo, filename)
+	}
+	object, err := stater.StatObject(pathutil.Join(repo, filename))
+	if err == storage.ErrStatNotSupported {
+		return server.getStorageObject(log, repo, filename)
+	}
+	if err != nil {
+		log(cm_logger.WarnLevel, err.Error(),
+			"repo", repo,
+			"filename", filename,
+		)
+		return nil, &HTTPError{404, "object not found"}
+	}
+	object.Content = nil
+	contentType := chartPackageContentType
+	if strings.HasSuffix(filename, cm_repo.ProvenanceFileExtension) {
+		contentType = provenanceFileContentType
+	}
+	return &StorageObject{Object: &object, ContentType: contentType}, nil
+}
+
+// getStorageObjectRedirect returns a presigned URL for downloading a chart package or provenance file
+// straight from the storage backend. It returns false if presigned redirects are disabled, the
+// backend cannot presign URLs or the object is not in storage, in which case the object should be
+// served through ChartMuseum (which answers with its own 404 for a missing object)
+func (server *MultiTenantServer) getStorageObjectRedirect(log cm_logger.LoggingFn, repo string, filename string) (string, bool) {
+	if !server.PresignedRedirect {
+		return "", false
+	}
+	if !strings.HasSuffix(filename, cm_repo.ChartPackageFileExtension) && !strings.HasSuffix(filename, cm_repo.ProvenanceFileExtension) {
+		return "", false
+	}
+	presigner, ok := server.StorageBackend.(storage.Presigner)
+	if !ok {
+		return "", false
+	}
+	objectPath := pathutil.Join(repo, filename)
+	if !server.objectExists(objectPath) {
+		return "", false
+	}
+
+	expiry := server.PresignedURLExpiry
+	if expiry <= 0 {
+		expiry = defaultPresignedURLExpiry
+	}
+	url, err := presigner.PresignedURL(objectPath, expiry)
+	if err != nil {
+		if err != storage.ErrPresignNotSupported {
+			log(cm_logger.WarnLevel, "Could not presign URL, serving object through ChartMuseum",
+				"repo", repo,
+				"filename", filename,
+				"error", err.Error(),
+			)
+		}
+		return "", false
+	}
+	return url, true
+}
+
+// checkStorageReadiness performs a lightweight listing against the storage backend,
+// giving up after ReadinessTimeout so that a hung backend does not block the probe
+func (server *MultiTenantServer) checkStorageReadiness(log cm_logger.LoggingFn) *HTTPError {
+	timeout := server.ReadinessTimeout
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := server.StorageBackend.ListObjects("")
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			errStr := err.Error()
+			log(cm_logger.ErrorLevel, "Storage backend is not reachable",
+				"error", errStr,
+			)
+			return &HTTPError{503, fmt.Sprintf("storage backend is not reachable: %s", errStr)}
+		}
+	case <-time.After(timeout):
+		log(cm_logger.ErrorLevel, "Storage backend readiness check timed out",
+			"timeout", timeout,
+		)
+		return &HTTPError{503, fmt.Sprintf("storage backend did not respond within %s", timeout)}
+	}
+
+	return nil
+}
@@ -0,0 +1,393 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	pathutil "path"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+	cm_storage "github.com/helm/chartmuseum/pkg/storage"
+
+	helm_chart "k8s.io/helm/pkg/proto/hapi/chart"
+	helm_repo "k8s.io/helm/pkg/repo"
+)
+
+// chartUploadHeadLimit is how much of an uploaded chart package is read ahead to find its
+// Chart.yaml. A package which does not start with Chart.yaml is spooled to disk instead
+const chartUploadHeadLimit = 1024 * 1024
+
+type (
+	// fileUpload is an uploaded chart package or provenance file, which is never held in memory
+	// as a whole. A chart package is checked from the Chart.yaml it starts with, read ahead into
+	// head, and then streamed to storage from the request. An upload which has to be read as a
+	// whole first, e.g. a form, is spooled to a temporary file instead. The sha256 digest is
+	// computed while the upload is spooled or stored
+	fileUpload struct {
+		meta    *helm_chart.Metadata // nil for a provenance file
+		head    []byte
+		content io.Reader // the rest of the upload, after head, until spooled
+		file    *os.File
+		size    int64
+		digest  string
+	}
+
+	// uploadStream reads an upload for a storage backend to stream. The checks of the upload as
+	// a whole are run along the way, and fail the read rather than end it, so that the backend
+	// gives up on the object instead of storing it
+	uploadStream struct {
+		reader   io.Reader
+		hash     hash.Hash
+		size     int64
+		maxSize  int64
+		invalid  func(err error) *HTTPError
+		verify   func(digest string) *HTTPError // run once the whole upload is read
+		check    *io.PipeWriter                 // the upload is read again by checkChartArchive
+		checked  chan error
+		rejected *HTTPError
+	}
+)
+
+// readChartUpload reads the start of an uploaded chart package, up to its Chart.yaml. A package
+// which does not start with Chart.yaml is spooled to disk to find it. The caller must close
+// the returned upload
+func readChartUpload(content io.Reader) (*fileUpload, error) {
+	head := new(bytes.Buffer)
+	limited := &io.LimitedReader{R: content, N: chartUploadHeadLimit}
+	meta, err := cm_repo.ChartMetadataFromArchiveStart(io.TeeReader(limited, head))
+	upload := &fileUpload{meta: meta, head: head.Bytes(), content: content}
+	if err == nil {
+		return upload, nil
+	}
+	if limited.N > 0 {
+		return nil, err // the package ended before Chart.yaml
+	}
+	if err := upload.spool(); err != nil {
+		return nil, err
+	}
+	if err := upload.readChartMetadata(); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	return upload, nil
+}
+
+// spoolUpload copies content to a temporary file. The caller must close the returned upload
+func spoolUpload(content io.Reader) (*fileUpload, error) {
+	upload := &fileUpload{content: content}
+	if err := upload.spool(); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// spool copies the rest of the upload to a temporary file, if it is not spooled yet. A chart
+// package read ahead is then checked to be intact
+func (upload *fileUpload) spool() error {
+	if upload.file != nil {
+		return nil
+	}
+	file, err := ioutil.TempFile("", "chartmuseum-upload-")
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), io.MultiReader(bytes.NewReader(upload.head), upload.content))
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	upload.file = file
+	upload.size = size
+	upload.digest = hex.EncodeToString(hash.Sum(nil))
+	upload.head, upload.content = nil, nil
+	if upload.meta == nil {
+		return nil
+	}
+	return upload.readChartMetadata()
+}
+
+// reader returns the content of a spooled upload, from the start
+func (upload *fileUpload) reader() (io.Reader, error) {
+	if _, err := upload.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return upload.file, nil
+}
+
+// readAll reads the whole of a spooled upload, for provenance files, which are small
+func (upload *fileUpload) readAll() ([]byte, error) {
+	reader, err := upload.reader()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// readChartMetadata reads the Chart.yaml of a spooled chart package, reading the whole package
+// to check that it is intact
+func (upload *fileUpload) readChartMetadata() error {
+	reader, err := upload.reader()
+	if err != nil {
+		return err
+	}
+	meta, err := cm_repo.ChartMetadataFromArchive(reader)
+	if err != nil {
+		return err
+	}
+	upload.meta = meta
+	return nil
+}
+
+// Close removes the temporary file of a spooled upload
+func (upload *fileUpload) Close() error {
+	if upload.file == nil {
+		return nil
+	}
+	upload.file.Close()
+	return os.Remove(upload.file.Name())
+}
+
+// newUploadStream returns the stream of a chart package read ahead, checked to be intact and
+// against the max chart size, and then against verify
+func (server *MultiTenantServer) newUploadStream(upload *fileUpload, verify func(digest string) *HTTPError) *uploadStream {
+	check, checkWriter := io.Pipe()
+	stream := &uploadStream{
+		reader:  io.MultiReader(bytes.NewReader(upload.head), upload.content),
+		hash:    sha256.New(),
+		maxSize: int64(server.MaxChartSize),
+		invalid: server.invalidChartError,
+		verify:  verify,
+		check:   checkWriter,
+		checked: make(chan error, 1),
+	}
+	go checkChartArchive(check, stream.checked)
+	return stream
+}
+
+// checkChartArchive reads a chart package from a stream as it is stored, to check that it is
+// intact. Whatever follows the package is discarded, a broken package stops the stream
+func checkChartArchive(check *io.PipeReader, checked chan<- error) {
+	_, err := cm_repo.ChartMetadataFromArchive(check)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, check)
+	}
+	check.CloseWithError(err)
+	checked <- err
+}
+
+func (stream *uploadStream) Read(p []byte) (int, error) {
+	if stream.rejected != nil {
+		return 0, errors.New(stream.rejected.Message)
+	}
+	n, err := stream.reader.Read(p)
+	stream.size += int64(n)
+	if stream.maxSize > 0 && stream.size > stream.maxSize {
+		return 0, stream.reject(&HTTPError{413, fmt.Sprintf("chart package exceeds the max chart size of %d bytes",
+			stream.maxSize)})
+	}
+	stream.hash.Write(p[:n])
+	if n > 0 {
+		if _, checkErr := stream.check.Write(p[:n]); checkErr != nil {
+			return 0, stream.reject(stream.invalid(checkErr))
+		}
+	}
+	if err == io.EOF {
+		stream.check.Close()
+		if checkErr := <-stream.checked; checkErr != nil {
+			return 0, stream.reject(stream.invalid(checkErr))
+		}
+		if verifyErr := stream.verify(stream.digest()); verifyErr != nil {
+			return 0, stream.reject(verifyErr)
+		}
+	}
+	return n, err
+}
+
+func (stream *uploadStream) reject(err *HTTPError) error {
+	stream.rejected = err
+	return errors.New(err.Message)
+}
+
+func (stream *uploadStream) digest() string {
+	return hex.EncodeToString(stream.hash.Sum(nil))
+}
+
+// close stops the check of an upload the backend did not read to the end
+func (stream *uploadStream) close() {
+	stream.check.CloseWithError(io.ErrUnexpectedEOF)
+}
+
+// putUpload stores an upload at path, once its digest is checked against the expected one if
+// there is one. A chart package which is not spooled is streamed to storage if the backend
+// supports it. Backends which need the whole content get it only now, read from disk
+func (server *MultiTenantServer) putUpload(log cm_logger.LoggingFn, repo string, path string, upload *fileUpload, expectedDigest string) *HTTPError {
+	verify := func(digest string) *HTTPError {
+		return server.verifyChartDigest(log, repo, digest, expectedDigest)
+	}
+	if upload.file == nil {
+		if streamPutter, ok := server.StorageBackend.(cm_storage.StreamPutter); ok {
+			stream := server.newUploadStream(upload, verify)
+			err := streamPutter.PutObjectStream(path, stream)
+			stream.close()
+			if stream.rejected != nil {
+				return stream.rejected
+			}
+			if err != cm_storage.ErrStreamNotSupported || stream.size > 0 {
+				if err != nil {
+					return &HTTPError{500, err.Error()}
+				}
+				upload.size = stream.size
+				upload.digest = stream.digest()
+				return nil
+			}
+		}
+		if err := upload.spool(); err != nil {
+			return server.invalidChartError(err)
+		}
+	}
+	if upload.meta != nil {
+		if sizeErr := server.checkChartSize(upload); sizeErr != nil {
+			return sizeErr
+		}
+	}
+	if verifyErr := verify(upload.digest); verifyErr != nil {
+		return verifyErr
+	}
+	if err := server.putSpooledObject(path, upload); err != nil {
+		return &HTTPError{500, err.Error()}
+	}
+	return nil
+}
+
+// invalidChartError is a 400 for a chart package which cannot be read if chart packages are
+// validated, and a 500 otherwise
+func (server *MultiTenantServer) invalidChartError(err error) *HTTPError {
+	if server.ValidateCharts {
+		return &HTTPError{400, err.Error()}
+	}
+	return &HTTPError{500, err.Error()}
+}
+
+// putSpooledObject stores a spooled upload, streaming it from disk if the storage backend
+// supports it
+func (server *MultiTenantServer) putSpooledObject(path string, upload *fileUpload) error {
+	reader, err := upload.reader()
+	if err != nil {
+		return err
+	}
+	if streamPutter, ok := server.StorageBackend.(cm_storage.StreamPutter); ok {
+		err = streamPutter.PutObjectStream(path, reader)
+		if err != cm_storage.ErrStreamNotSupported {
+			return err
+		}
+		if reader, err = upload.reader(); err != nil {
+			return err
+		}
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return server.StorageBackend.PutObject(path, content)
+}
+
+// uploadChartPackage stores the chart package read from content, once it passed the checks of
+// a push
+func (server *MultiTenantServer) uploadChartPackage(log cm_logger.LoggingFn, repo string, content io.Reader, force bool, annotations map[string]string) *HTTPError {
+	upload, err := readChartUpload(content)
+	if err != nil {
+		return server.invalidChartError(err)
+	}
+	defer upload.Close()
+	_, httpErr := server.pushChartUpload(log, repo, upload, "", force, annotations)
+	return httpErr
+}
+
+// pushChartUpload stores an uploaded chart package, once it passed the checks of a push, and its
+// digest matches the expected one if there is one. It reports whether a chart package already
+// stored was overwritten
+func (server *MultiTenantServer) pushChartUpload(log cm_logger.LoggingFn, repo string, upload *fileUpload, expectedDigest string, force bool, annotations map[string]string) (bool, *HTTPError) {
+	meta := upload.meta
+	if server.ValidateCharts {
+		if err := cm_repo.ValidateChartMetadata(meta, ""); err != nil {
+			return false, &HTTPError{400, err.Error()}
+		}
+	}
+	if chartNameErr := server.checkChartName(log, repo, meta.Name); chartNameErr != nil {
+		return false, chartNameErr
+	}
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(meta.Name, meta.Version)
+	overwritten, overwriteErr := server.checkOverwrite(log, pathutil.Join(repo, filename), force)
+	if overwriteErr != nil {
+		return false, overwriteErr
+	}
+	if versionLimitErr := server.checkVersionLimit(log, repo, meta.Name, meta.Version); versionLimitErr != nil {
+		return false, versionLimitErr
+	}
+	limitReached, err := server.checkStorageLimit(repo, filename, force)
+	if err != nil {
+		return false, &HTTPError{500, err.Error()}
+	}
+	if limitReached {
+		return false, &HTTPError{507, "repo has reached storage limit"}
+	}
+	log(cm_logger.DebugLevel, "Adding package to storage",
+		"package", filename,
+	)
+	pushed := time.Now()
+	if putErr := server.putUpload(log, repo, pathutil.Join(repo, filename), upload, expectedDigest); putErr != nil {
+		return false, putErr
+	}
+	server.storeChartSidecars(log, repo, filename, pushed, annotations, overwritten)
+	server.chartUploadStored(log, repo, filename, upload, pushed, annotations)
+	return overwritten, nil
+}
+
+// checkChartSize returns a 413 if a spooled chart package is larger than the max chart size.
+// The max upload size covers the whole request, this covers the chart package alone, e.g. in a
+// form which also has its provenance file
+func (server *MultiTenantServer) checkChartSize(upload *fileUpload) *HTTPError {
+	if server.MaxChartSize > 0 && upload.size > int64(server.MaxChartSize) {
+		return &HTTPError{413, fmt.Sprintf("chart package of %d bytes exceeds the max chart size of %d bytes",
+			upload.size, server.MaxChartSize)}
+	}
+	return nil
+}
+
+// chartUploadStored adds a newly stored chart package, pushed at pushed, to the repo index and
+// sends out a push notification. The chart version is built from the metadata and digest already
+// known, without reading the package again
+func (server *MultiTenantServer) chartUploadStored(log cm_logger.LoggingFn, repo string, filename string, upload *fileUpload, pushed time.Time, annotations map[string]string) {
+	server.chartVersionStored(log, repo, withAnnotations(&helm_repo.ChartVersion{
+		URLs:     []string{fmt.Sprintf("charts/%s", filename)},
+		Metadata: upload.meta,
+		Digest:   upload.digest,
+		Created:  pushed,
+	}, annotations))
+}
@@ -0,0 +1,240 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	pathutil "path"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+	"github.com/helm/chartmuseum/pkg/storage"
+
+	"github.com/ghodss/yaml"
+	helm_repo "k8s.io/helm/pkg/repo"
+)
+
+const (
+	upstreamTimeout = 30 * time.Second
+	// how long the upstream index.yaml is reused, and a chart version found missing upstream
+	// is reported missing without asking again
+	upstreamIndexTTL = 5 * time.Minute
+	upstreamMissTTL  = time.Minute
+)
+
+var (
+	errUpstreamChartNotFound = errors.New("chart version not found in upstream repo")
+)
+
+type (
+	// upstreamRepo is the Helm repo chart packages missing from storage are fetched from,
+	// making ChartMuseum a pull-through cache of it
+	upstreamRepo struct {
+		URL    *url.URL
+		client *http.Client
+		now    func() time.Time
+
+		mu           sync.Mutex
+		index        *helm_repo.IndexFile
+		indexFetched time.Time
+		// chart versions missing upstream, by package filename, with when they were found missing
+		misses map[string]time.Time
+	}
+)
+
+func newUpstreamRepo(rawURL string) (*upstreamRepo, error) {
+	repoURL, err := url.Parse(strings.TrimSuffix(rawURL, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	if repoURL.Scheme != "http" && repoURL.Scheme != "https" {
+		return nil, fmt.Errorf("upstream repo URL must be http or https: %s", rawURL)
+	}
+	return &upstreamRepo{
+		URL:    repoURL,
+		client: &http.Client{Timeout: upstreamTimeout},
+		now:    time.Now,
+		misses: map[string]time.Time{},
+	}, nil
+}
+
+// fetchChartPackage downloads a chart version from the upstream repo, from the url given for it
+// in the upstream index.yaml, and checks it against the digest given there
+func (upstream *upstreamRepo) fetchChartPackage(name string, version string) ([]byte, error) {
+	chartVersion, err := upstream.getChartVersion(name, version)
+	if err != nil {
+		return nil, err
+	}
+	chartURL, err := url.Parse(chartVersion.URLs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := upstream.get(upstream.URL.ResolveReference(chartURL))
+	if err == errUpstreamChartNotFound {
+		upstream.recordMiss(name, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if chartVersion.Digest != "" {
+		if digest := fmt.Sprintf("%x", sha256.Sum256(content)); digest != chartVersion.Digest {
+			return nil, fmt.Errorf("upstream chart package digest %s does not match digest %s in upstream index", digest, chartVersion.Digest)
+		}
+	}
+	return content, nil
+}
+
+// getChartVersion looks up a chart version in the upstream index.yaml, which is fetched again
+// once it is older than upstreamIndexTTL. The lock is held while fetching it, so that
+// concurrent requests wait for the one fetch instead of each making their own
+func (upstream *upstreamRepo) getChartVersion(name string, version string) (*helm_repo.ChartVersion, error) {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	now := upstream.now()
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(name, version)
+	if missed, ok := upstream.misses[filename]; ok && now.Sub(missed) < upstreamMissTTL {
+		return nil, errUpstreamChartNotFound
+	}
+
+	if upstream.index == nil || now.Sub(upstream.indexFetched) >= upstreamIndexTTL {
+		content, err := upstream.get(upstream.URL.ResolveReference(&url.URL{Path: "index.yaml"}))
+		if err == errUpstreamChartNotFound {
+			upstream.misses[filename] = now
+		}
+		if err != nil {
+			return nil, err
+		}
+		indexFile := &helm_repo.IndexFile{}
+		if err := yaml.Unmarshal(content, indexFile); err != nil {
+			return nil, fmt.Errorf("invalid upstream index.yaml: %s", err)
+		}
+		upstream.index = indexFile
+		upstream.indexFetched = now
+		upstream.pruneMisses(now)
+	}
+
+	for _, chartVersion := range upstream.index.Entries[name] {
+		if chartVersion.Version == version && len(chartVersion.URLs) > 0 {
+			return chartVersion, nil
+		}
+	}
+	upstream.misses[filename] = now
+	return nil, errUpstreamChartNotFound
+}
+
+func (upstream *upstreamRepo) recordMiss(name string, version string) {
+	upstream.mu.Lock()
+	upstream.misses[cm_repo.ChartPackageFilenameFromNameVersion(name, version)] = upstream.now()
+	upstream.mu.Unlock()
+}
+
+// pruneMisses forgets the misses which have expired, whenever the upstream index is fetched
+func (upstream *upstreamRepo) pruneMisses(now time.Time) {
+	for filename, missed := range upstream.misses {
+		if now.Sub(missed) >= upstreamMissTTL {
+			delete(upstream.misses, filename)
+		}
+	}
+}
+
+func (upstream *upstreamRepo) get(u *url.URL) ([]byte, error) {
+	res, err := upstream.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, errUpstreamChartNotFound
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("upstream repo returned %d for %s", res.StatusCode, u.Path)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// getUpstreamChartPackage fetches a chart package missing from the storage of repo from the
+// upstream repo, by the name and version in its filename, and stores it in repo, going through
+// the same checks as a push, so that it is served from storage from then on. A package which
+// could not be stored, or is not stored because of maintenance mode, is still served. A chart
+// version missing upstream too is a 404
+func (server *MultiTenantServer) getUpstreamChartPackage(log cm_logger.LoggingFn, repo string, filename string) (*StorageObject, *HTTPError) {
+	// concurrent requests for the same package wait for the first one, which stores it
+	unlock := server.pushLocks.lock(pathutil.Join(repo, filename))
+	defer unlock()
+	if object, err := server.StorageBackend.GetObject(pathutil.Join(repo, filename)); err == nil {
+		return &StorageObject{Object: &object, ContentType: chartPackageContentType}, nil
+	}
+
+	name, version := cm_repo.ChartNameVersionFromPackageFilename(filename)
+	content, err := server.upstream.fetchChartPackage(name, version)
+	if err == errUpstreamChartNotFound {
+		return nil, &HTTPError{404, "object not found"}
+	}
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Error fetching chart package from upstream repo",
+			"repo", repo,
+			"filename", filename,
+			"error", err.Error(),
+		)
+		return nil, &HTTPError{502, "could not fetch chart package from upstream repo"}
+	}
+	if contentFilename, _ := cm_repo.ChartPackageFilenameFromContent(content); contentFilename != filename {
+		log(cm_logger.ErrorLevel, "Upstream chart package does not match the requested chart version",
+			"repo", repo,
+			"filename", filename,
+		)
+		return nil, &HTTPError{502, "could not fetch chart package from upstream repo"}
+	}
+
+	if server.Router.Maintenance() {
+		log(cm_logger.InfoLevel, "Not caching chart package from upstream repo in maintenance mode",
+			"repo", repo,
+			"filename", filename,
+		)
+	} else {
+		log(cm_logger.InfoLevel, "Caching chart package from upstream repo",
+			"repo", repo,
+			"filename", filename,
+		)
+		if uploadErr := server.uploadChartPackage(log, repo, bytes.NewReader(content), false, nil); uploadErr != nil {
+			log(cm_logger.WarnLevel, "Could not cache chart package from upstream repo",
+				"repo", repo,
+				"filename", filename,
+				"error", uploadErr.Message,
+			)
+		}
+	}
+	return &StorageObject{
+		Object: &storage.Object{
+			Path:         filename,
+			Content:      content,
+			LastModified: time.Now(),
+		},
+		ContentType: chartPackageContentType,
+	}, nil
+}
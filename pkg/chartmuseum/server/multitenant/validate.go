@@ -0,0 +1,124 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"errors"
+	"io"
+	pathutil "path"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "github.com/helm/chartmuseum/pkg/repo"
+
+	"github.com/gin-gonic/gin"
+)
+
+type (
+	// chartValidationReport is the outcome of a dry run of a chart package push
+	chartValidationReport struct {
+		Valid    bool     `json:"valid"`
+		Name     string   `json:"name,omitempty"`
+		Version  string   `json:"version,omitempty"`
+		Filename string   `json:"filename,omitempty"`
+		Digest   string   `json:"digest"`
+		Problems []string `json:"problems"`
+	}
+)
+
+var errNoChartToValidate = errors.New("no chart package found in form")
+
+// spoolChartToValidate spools the chart package of a validation request, either the
+// request body or the chart file of a multipart form. The filename returned is the one
+// given for the chart file, or the filename query parameter for a request body
+func (server *MultiTenantServer) spoolChartToValidate(c *gin.Context) (*fileUpload, string, error) {
+	if c.ContentType() != "multipart/form-data" {
+		upload, err := spoolUpload(c.Request.Body)
+		return upload, c.Query("filename"), err
+	}
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, "", errNoChartToValidate
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if part.FileName() == "" {
+			continue // not a file
+		}
+		if part.FormName() == defaultFormField || part.FormName() == server.ChartPostFormFieldName {
+			upload, err := spoolUpload(part)
+			return upload, part.FileName(), err
+		}
+	}
+}
+
+// validateSpooledChartPackage runs the checks a push of the chart package would go through,
+// without storing anything. Every problem found is reported, rather than only the first one
+func (server *MultiTenantServer) validateSpooledChartPackage(log cm_logger.LoggingFn, repo string, upload *fileUpload, filename string, digest string, force bool, preconditions pushPreconditions) *chartValidationReport {
+	report := &chartValidationReport{Digest: upload.digest, Problems: []string{}}
+	problem := func(message string) {
+		report.Problems = append(report.Problems, message)
+	}
+	if err := server.verifyChartDigest(log, repo, upload.digest, digest); err != nil {
+		problem(err.Message)
+	}
+	if err := server.checkChartSize(upload); err != nil {
+		problem(err.Message)
+	}
+	if err := upload.readChartMetadata(); err != nil {
+		problem(err.Error())
+		return report
+	}
+	meta := upload.meta
+	report.Name = meta.Name
+	report.Version = meta.Version
+	report.Filename = cm_repo.ChartPackageFilenameFromNameVersion(meta.Name, meta.Version)
+	if server.ValidateCharts {
+		if err := cm_repo.ValidateChartMetadata(meta, filename); err != nil {
+			problem(err.Error())
+		}
+	}
+	if err := server.checkChartName(log, repo, meta.Name); err != nil {
+		problem(err.Message)
+	}
+	path := pathutil.Join(repo, report.Filename)
+	if !preconditions.empty() {
+		if err := server.checkPushPreconditions(log, path, preconditions); err != nil {
+			problem(err.Message)
+		}
+		force = force || preconditions.overwrites()
+	}
+	if _, err := server.checkOverwrite(log, path, force); err != nil {
+		problem(err.Message)
+	}
+	if err := server.checkVersionLimit(log, repo, meta.Name, meta.Version); err != nil {
+		problem(err.Message)
+	}
+	limitReached, err := server.checkStorageLimit(repo, report.Filename, force)
+	if err != nil {
+		problem(err.Error())
+	} else if limitReached {
+		problem("repo has reached storage limit")
+	}
+	report.Valid = len(report.Problems) == 0
+	return report
+}
@@ -0,0 +1,220 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	cm_logger "github.com/helm/chartmuseum/pkg/chartmuseum/logger"
+
+	helm_repo "k8s.io/helm/pkg/repo"
+)
+
+const (
+	webhookEventPush       = "push"
+	webhookEventDelete     = "delete"
+	webhookSignatureHeader = "X-ChartMuseum-Signature"
+	webhookQueueSize       = 100
+	webhookWorkers         = 4
+	webhookMaxAttempts     = 3
+	webhookTimeout         = 10 * time.Second
+)
+
+var (
+	// delay before the first retry, doubled for each following attempt
+	webhookRetryBackoff = time.Second
+	// time allowed for delivering an event to a URL, all attempts included
+	webhookDeliveryTimeout = 30 * time.Second
+)
+
+type (
+	// webhookEvent is the JSON payload POSTed to each webhook URL
+	webhookEvent struct {
+		Event     string    `json:"event"`
+		Repo      string    `json:"repo"`
+		Name      string    `json:"name"`
+		Version   string    `json:"version"`
+		Digest    string    `json:"digest"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+
+	// webhookDelivery is an event to be POSTed to one of the webhook URLs
+	webhookDelivery struct {
+		URL   string
+		Event webhookEvent
+		Body  []byte
+	}
+
+	// webhookNotifier delivers events in the background so that slow
+	// webhook endpoints do not hold up request handling. Deliveries are
+	// shared by webhookWorkers, so that one slow URL does not hold up the others
+	webhookNotifier struct {
+		URLs   []string
+		Secret string
+		Logger *cm_logger.Logger
+		client *http.Client
+		queue  chan webhookDelivery
+	}
+)
+
+func newWebhookNotifier(urls []string, secret string, logger *cm_logger.Logger) *webhookNotifier {
+	notifier := &webhookNotifier{
+		URLs:   urls,
+		Secret: secret,
+		Logger: logger,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan webhookDelivery, webhookQueueSize),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		go notifier.run()
+	}
+	return notifier
+}
+
+// notify queues an event for delivery to each URL. If the queue is full the
+// event is dropped for the URLs it could not be queued for
+func (notifier *webhookNotifier) notify(event webhookEvent) {
+	event.Timestamp = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		notifier.Logger.Errorw("Error encoding webhook event", "error", err.Error())
+		return
+	}
+	for _, url := range notifier.URLs {
+		select {
+		case notifier.queue <- webhookDelivery{URL: url, Event: event, Body: body}:
+		default:
+			notifier.Logger.Warnw("Webhook queue is full, dropping event",
+				"url", url,
+				"event", event.Event,
+				"repo", event.Repo,
+				"name", event.Name,
+				"version", event.Version,
+			)
+		}
+	}
+}
+
+func (notifier *webhookNotifier) run() {
+	for delivery := range notifier.queue {
+		if err := notifier.deliver(delivery.URL, delivery.Body); err != nil {
+			notifier.Logger.Errorw("Error delivering webhook event",
+				"url", delivery.URL,
+				"event", delivery.Event.Event,
+				"repo", delivery.Event.Repo,
+				"name", delivery.Event.Name,
+				"version", delivery.Event.Version,
+				"error", err.Error(),
+			)
+		}
+	}
+}
+
+// deliver POSTs the body to url, retrying with exponential backoff until it gets
+// a 2xx response, webhookMaxAttempts is reached or webhookDeliveryTimeout has passed
+func (notifier *webhookNotifier) deliver(url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookDeliveryTimeout)
+	defer cancel()
+
+	var err error
+	backoff := webhookRetryBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return fmt.Errorf("gave up after %d attempts: %s", attempt-1, err)
+			}
+			backoff *= 2
+		}
+		if err = notifier.post(ctx, url, body); err == nil {
+			return nil
+		}
+		notifier.Logger.Debugw("Webhook delivery failed",
+			"url", url,
+			"attempt", attempt,
+			"error", err.Error(),
+		)
+	}
+	return err
+}
+
+func (notifier *webhookNotifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if notifier.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhookPayload(notifier.Secret, body))
+	}
+
+	resp, err := notifier.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhookPayload returns the value of the signature header, an HMAC-SHA256 of the body
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyChartPushed sends a push event for a chart version which has just been stored
+func (server *MultiTenantServer) notifyChartPushed(repo string, chartVersion *helm_repo.ChartVersion) {
+	if server.webhooks == nil {
+		return
+	}
+	server.webhooks.notify(webhookEvent{
+		Event:   webhookEventPush,
+		Repo:    repo,
+		Name:    chartVersion.Name,
+		Version: chartVersion.Version,
+		Digest:  chartVersion.Digest,
+	})
+}
+
+// notifyChartDeleted sends a delete event for a chart version which has just been removed
+func (server *MultiTenantServer) notifyChartDeleted(repo string, name string, version string, digest string) {
+	if server.webhooks == nil {
+		return
+	}
+	server.webhooks.notify(webhookEvent{
+		Event:   webhookEventDelete,
+		Repo:    repo,
+		Name:    name,
+		Version: version,
+		Digest:  digest,
+	})
+}
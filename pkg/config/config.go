@@ -17,12 +17,15 @@ limitations under the License.
 package config
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/ghodss/yaml"
 	"github.com/spf13/viper"
 	"github.com/urfave/cli"
 )
@@ -72,6 +75,8 @@ func (conf *Config) UpdateFromCLIContext(c *cli.Context) error {
 					conf.Set(key, c.Int(name))
 				case boolType:
 					conf.Set(key, c.Bool(name))
+				case stringSliceType:
+					conf.Set(key, c.StringSlice(name))
 				}
 			}
 		}
@@ -101,6 +106,34 @@ func (conf *Config) readConfigFileFromCLIContext(c *cli.Context) error {
 	return nil
 }
 
+// NewTenantStorageConfigs reads the file mapping tenant repo prefixes to their storage, each
+// set up like the storage section of the config file. It returns a config per tenant,
+// holding the storage settings of that tenant
+func NewTenantStorageConfigs(path string) (map[string]*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// not read with viper, which would lowercase the prefixes
+	tenants := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &tenants); err != nil {
+		return nil, fmt.Errorf("could not parse storage tenants file %s: %s", path, err)
+	}
+	confs := map[string]*Config{}
+	for prefix, storage := range tenants {
+		content, err := yaml.Marshal(map[string]interface{}{"storage": storage})
+		if err != nil {
+			return nil, err
+		}
+		conf := NewConfig()
+		if err := conf.MergeConfig(bytes.NewReader(content)); err != nil {
+			return nil, fmt.Errorf("could not read storage of tenant %s: %s", prefix, err)
+		}
+		confs[prefix] = conf
+	}
+	return confs, nil
+}
+
 func (conf *Config) setDefaults() {
 	for key, configVar := range configVars {
 		conf.SetDefault(key, configVar.Default)
@@ -131,6 +131,38 @@ func (suite *ConfigTestSuite) TestUpdateFromCLIContext() {
 	suite.Equal("mypass", conf.GetString("basicauth.pass"))
 }
 
+func (suite *ConfigTestSuite) TestNewTenantStorageConfigs() {
+	tenantsFile := pathutil.Join(suite.TempDirectory, "tenants.yaml")
+	data := []byte(
+		`
+teamA:
+    backend: amazon
+    amazon:
+        bucket: "team-a-charts"
+        region: "us-east-1"
+teamB/nested:
+    backend: local
+    local:
+        rootdir: "/charts/team-b"
+`,
+	)
+	err := ioutil.WriteFile(tenantsFile, data, 0644)
+	suite.Nil(err, fmt.Sprintf("no error creating storage tenants file %s", tenantsFile))
+
+	confs, err := NewTenantStorageConfigs(tenantsFile)
+	suite.Nil(err)
+	suite.Equal(2, len(confs))
+	suite.Equal("amazon", confs["teamA"].GetString("storage.backend"), "tenant prefix keeps its case")
+	suite.Equal("team-a-charts", confs["teamA"].GetString("storage.amazon.bucket"))
+	suite.Equal("us-east-1", confs["teamA"].GetString("storage.amazon.region"))
+	suite.Equal("local", confs["teamB/nested"].GetString("storage.backend"))
+	suite.Equal("/charts/team-b", confs["teamB/nested"].GetString("storage.local.rootdir"))
+	suite.Equal("", confs["teamB/nested"].GetString("storage.amazon.bucket"), "settings are per tenant")
+
+	_, err = NewTenantStorageConfigs(pathutil.Join(suite.TempDirectory, "missing.yaml"))
+	suite.NotNil(err, "error reading missing storage tenants file")
+}
+
 func getNewContext() *cli.Context {
 	var c *cli.Context
 	app := cli.NewApp()
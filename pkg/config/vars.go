@@ -34,9 +34,10 @@ type (
 var CLIFlags []cli.Flag
 
 var (
-	stringType configVarType = "string"
-	intType    configVarType = "int"
-	boolType   configVarType = "bool"
+	stringType      configVarType = "string"
+	intType         configVarType = "int"
+	boolType        configVarType = "bool"
+	stringSliceType configVarType = "stringslice"
 )
 
 var configVars = map[string]configVar{
@@ -58,6 +59,51 @@ var configVars = map[string]configVar{
 			EnvVar: "DEBUG",
 		},
 	},
+	"accesslogfields": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "access-log-fields",
+			Usage:  "fields to include in request logs (comma-separated)",
+			EnvVar: "ACCESS_LOG_FIELDS",
+		},
+	},
+	"accesslogsampling": {
+		Type:    intType,
+		Default: 1,
+		CLIFlag: cli.IntFlag{
+			Name:   "access-log-sampling",
+			Usage:  "log only 1 in this many successful (2xx) requests, other requests are always logged",
+			EnvVar: "ACCESS_LOG_SAMPLING",
+		},
+	},
+	"auditlog": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "audit-log",
+			Usage:  "file to append an audit entry to for each push and delete, as JSON lines (\"-\" for stdout)",
+			EnvVar: "AUDIT_LOG",
+		},
+	},
+	"requestidheader": {
+		Type:    stringType,
+		Default: "X-Request-Id",
+		CLIFlag: cli.StringFlag{
+			Name:   "request-id-header",
+			Usage:  "header used to pass a request ID in and out (one is generated if not provided)",
+			EnvVar: "REQUEST_ID_HEADER",
+		},
+	},
+	"responseheaders": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "response-headers",
+			Usage:  "headers added to every response, as \"Name: value\"",
+			EnvVar: "RESPONSE_HEADERS",
+		},
+	},
 	"logjson": {
 		Type:    boolType,
 		Default: false,
@@ -76,6 +122,53 @@ var configVars = map[string]configVar{
 			EnvVar: "DISABLE_METRICS",
 		},
 	},
+	"metricsnamespace": {
+		Type:    stringType,
+		Default: "chartmuseum",
+		CLIFlag: cli.StringFlag{
+			Name:   "metrics-namespace",
+			Usage:  "namespace of the HTTP request metrics",
+			EnvVar: "METRICS_NAMESPACE",
+			Value:  "chartmuseum",
+		},
+	},
+	"metricssubsystem": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "metrics-subsystem",
+			Usage:  "subsystem of the HTTP request metrics, after the namespace",
+			EnvVar: "METRICS_SUBSYSTEM",
+		},
+	},
+	"metricspath": {
+		Type:    stringType,
+		Default: "/metrics",
+		CLIFlag: cli.StringFlag{
+			Name:   "metrics-path",
+			Usage:  "path metrics are served at",
+			EnvVar: "METRICS_PATH",
+			Value:  "/metrics",
+		},
+	},
+	"enablepprof": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "enable-pprof",
+			Usage:  "serve pprof profiles at /debug/pprof, to authenticated users only",
+			EnvVar: "ENABLE_PPROF",
+		},
+	},
+	"enablegzip": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "enable-gzip",
+			Usage:  "gzip responses (e.g. index.yaml) for clients that accept it",
+			EnvVar: "ENABLE_GZIP",
+		},
+	},
 	"disableapi": {
 		Type:    boolType,
 		Default: false,
@@ -112,6 +205,15 @@ var configVars = map[string]configVar{
 			EnvVar: "DISABLE_FORCE_OVERWRITE",
 		},
 	},
+	"disablechartvalidation": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "disable-chart-validation",
+			Usage:  "do not check that uploaded chart packages are valid archives with a complete Chart.yaml",
+			EnvVar: "DISABLE_CHART_VALIDATION",
+		},
+	},
 	"port": {
 		Type:    intType,
 		Default: 8080,
@@ -121,6 +223,24 @@ var configVars = map[string]configVar{
 			EnvVar: "PORT",
 		},
 	},
+	"listenhost": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "listen-host",
+			Usage:  "address of the interface to listen on (all interfaces if unset)",
+			EnvVar: "LISTEN_HOST",
+		},
+	},
+	"listensocket": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "listen-socket",
+			Usage:  "path of a Unix domain socket to listen on, instead of a TCP port",
+			EnvVar: "LISTEN_SOCKET",
+		},
+	},
 	"charturl": {
 		Type:    stringType,
 		Default: "",
@@ -130,6 +250,24 @@ var configVars = map[string]configVar{
 			EnvVar: "CHART_URL",
 		},
 	},
+	"externalurl": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "external-url",
+			Usage:  "base url for .tgzs in index.yaml, replacing --chart-url and --context-path (e.g. a CDN)",
+			EnvVar: "EXTERNAL_URL",
+		},
+	},
+	"charturltemplate": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "chart-url-template",
+			Usage:  "go template for the url of .tgzs in index.yaml, replacing --chart-url and --external-url (e.g. https://cdn.example.com/{{.Repo}}/{{.Filename}})",
+			EnvVar: "CHART_URL_TEMPLATE",
+		},
+	},
 	"basicauth.user": {
 		Type:    stringType,
 		Default: "",
@@ -148,6 +286,42 @@ var configVars = map[string]configVar{
 			EnvVar: "BASIC_AUTH_PASS",
 		},
 	},
+	"basicauth.users": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "basic-auth-users",
+			Usage:  "additional user:pass entry for basic http authentication (repeat for each user, comma-separated in the env var)",
+			EnvVar: "BASIC_AUTH_USERS",
+		},
+	},
+	"basicauth.usersfile": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "basic-auth-users-file",
+			Usage:  "file of additional user:pass entries for basic http authentication, one per line",
+			EnvVar: "BASIC_AUTH_USERS_FILE",
+		},
+	},
+	"basicauth.realm": {
+		Type:    stringType,
+		Default: "ChartMuseum",
+		CLIFlag: cli.StringFlag{
+			Name:   "basic-auth-realm",
+			Usage:  "realm sent in the WWW-Authenticate challenge for basic http authentication",
+			EnvVar: "BASIC_AUTH_REALM",
+		},
+	},
+	"basicauth.htpasswd": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "basic-auth-htpasswd",
+			Usage:  "htpasswd file of users with bcrypt password hashes for basic http authentication",
+			EnvVar: "BASIC_AUTH_HTPASSWD",
+		},
+	},
 	"authanonymousget": {
 		Type:    boolType,
 		Default: false,
@@ -157,6 +331,24 @@ var configVars = map[string]configVar{
 			EnvVar: "AUTH_ANONYMOUS_GET",
 		},
 	},
+	"authreadonlyanonymous": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "auth-read-only-anonymous",
+			Usage:  "allow anonymous pulls while always requiring auth for pushes",
+			EnvVar: "AUTH_READ_ONLY_ANONYMOUS",
+		},
+	},
+	"authanonymousrepos": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "auth-anonymous-repos",
+			Usage:  "repos (or path.Match patterns of repos) which anyone can pull from, while pushes always require auth",
+			EnvVar: "AUTH_ANONYMOUS_REPOS",
+		},
+	},
 	"tls.cert": {
 		Type:    stringType,
 		Default: "",
@@ -175,6 +367,87 @@ var configVars = map[string]configVar{
 			EnvVar: "TLS_KEY",
 		},
 	},
+	"cors.origins": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "cors-allowed-origins",
+			Usage:  "origins allowed to make cross-origin requests (comma-separated, * for any)",
+			EnvVar: "CORS_ALLOWED_ORIGINS",
+		},
+	},
+	"cors.methods": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "cors-allowed-methods",
+			Usage:  "methods allowed for cross-origin requests (comma-separated)",
+			EnvVar: "CORS_ALLOWED_METHODS",
+		},
+	},
+	"cors.headers": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "cors-allowed-headers",
+			Usage:  "request headers allowed for cross-origin requests (comma-separated)",
+			EnvVar: "CORS_ALLOWED_HEADERS",
+		},
+	},
+	"cors.credentials": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "cors-allow-credentials",
+			Usage:  "allow credentials (cookies, auth headers) on cross-origin requests",
+			EnvVar: "CORS_ALLOW_CREDENTIALS",
+		},
+	},
+	"tls.minversion": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "tls-min-version",
+			Usage:  "minimum tls version to accept, one of: 1.0, 1.1, 1.2",
+			EnvVar: "TLS_MIN_VERSION",
+		},
+	},
+	"tls.ciphersuites": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "tls-cipher-suites",
+			Usage:  "tls cipher suites to accept (comma-separated, crypto/tls names)",
+			EnvVar: "TLS_CIPHER_SUITES",
+		},
+	},
+	"tls.cacert": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "tls-ca-cert",
+			Usage:  "path to CA certificate bundle used to verify tls client certificates",
+			EnvVar: "TLS_CA_CERT",
+		},
+	},
+	"tls.clientauth": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "tls-client-auth",
+			Usage:  "tls client certificate mode, one of: none, verify-if-given, require",
+			EnvVar: "TLS_CLIENT_AUTH",
+		},
+	},
+	"enableh2c": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "enable-h2c",
+			Usage:  "serve HTTP/2 over plaintext (h2c), e.g. behind a proxy which terminates TLS; cannot be used with tls-cert",
+			EnvVar: "ENABLE_H2C",
+		},
+	},
 	"cache.store": {
 		Type:    stringType,
 		Default: "",
@@ -212,6 +485,25 @@ var configVars = map[string]configVar{
 			Value:  0,
 		},
 	},
+	"cache.redis.tls": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "cache-redis-tls",
+			Usage:  "connect to Redis over TLS",
+			EnvVar: "CACHE_REDIS_TLS",
+		},
+	},
+	"cache.ttl": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "cache-ttl",
+			Usage:  "seconds after which a cached index is discarded and rebuilt from storage (0 to disable)",
+			EnvVar: "CACHE_TTL",
+			Value:  0,
+		},
+	},
 	"storage.backend": {
 		Type:    stringType,
 		Default: "",
@@ -221,6 +513,42 @@ var configVars = map[string]configVar{
 			EnvVar: "STORAGE",
 		},
 	},
+	"storage.prefix": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-prefix",
+			Usage:  "prefix to store charts and index under, within any storage backend",
+			EnvVar: "STORAGE_PREFIX",
+		},
+	},
+	"storage.layout": {
+		Type:    stringType,
+		Default: "flat",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-layout",
+			Usage:  "how chart objects are laid out in storage, can be one of: flat, date",
+			EnvVar: "STORAGE_LAYOUT",
+		},
+	},
+	"storage.listpagesize": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "storage-list-page-size",
+			Usage:  "number of objects listed per request to the storage backend (0 for the default of the backend)",
+			EnvVar: "STORAGE_LIST_PAGE_SIZE",
+		},
+	},
+	"storage.tenants": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-tenants",
+			Usage:  "yaml file mapping tenant repo prefixes to storage backends of their own",
+			EnvVar: "STORAGE_TENANTS",
+		},
+	},
 	"storage.local.rootdir": {
 		Type:    stringType,
 		Default: "",
@@ -230,6 +558,15 @@ var configVars = map[string]configVar{
 			EnvVar: "STORAGE_LOCAL_ROOTDIR",
 		},
 	},
+	"storage.local.fsync": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "storage-local-fsync",
+			Usage:  "flush charts to disk before acknowledging writes to local storage backend",
+			EnvVar: "STORAGE_LOCAL_FSYNC",
+		},
+	},
 	"storage.amazon.bucket": {
 		Type:    stringType,
 		Default: "",
@@ -275,6 +612,15 @@ var configVars = map[string]configVar{
 			EnvVar: "STORAGE_AMAZON_SSE",
 		},
 	},
+	"storage.amazon.ssekmskeyid": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-amazon-sse-kms-key-id",
+			Usage:  "KMS key to encrypt charts with, if --storage-amazon-sse is aws:kms",
+			EnvVar: "STORAGE_AMAZON_SSE_KMS_KEY_ID",
+		},
+	},
 	"storage.google.bucket": {
 		Type:    stringType,
 		Default: "",
@@ -383,6 +729,42 @@ var configVars = map[string]configVar{
 			EnvVar: "STORAGE_OPENSTACK_CACERT",
 		},
 	},
+	"storage.backblaze.bucket": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-backblaze-bucket",
+			Usage:  "B2 bucket to store charts for Backblaze B2 storage backend",
+			EnvVar: "STORAGE_BACKBLAZE_BUCKET",
+		},
+	},
+	"storage.backblaze.prefix": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-backblaze-prefix",
+			Usage:  "prefix to store charts for --storage-backblaze-bucket",
+			EnvVar: "STORAGE_BACKBLAZE_PREFIX",
+		},
+	},
+	"storage.backblaze.keyid": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-backblaze-key-id",
+			Usage:  "application key ID for Backblaze B2 storage backend",
+			EnvVar: "B2_APPLICATION_KEY_ID",
+		},
+	},
+	"storage.backblaze.applicationkey": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-backblaze-application-key",
+			Usage:  "application key for Backblaze B2 storage backend",
+			EnvVar: "B2_APPLICATION_KEY",
+		},
+	},
 	"chartpostformfieldname": {
 		Type:    stringType,
 		Default: "chart",
@@ -401,6 +783,15 @@ var configVars = map[string]configVar{
 			EnvVar: "PROV_POST_FORM_FIELD_NAME",
 		},
 	},
+	"pushannotations": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "push-annotations",
+			Usage:  "annotations added to the index entry of every pushed chart, as \"key=value\" ({identity} and {time} in values are replaced by the pusher and push time)",
+			EnvVar: "PUSH_ANNOTATIONS",
+		},
+	},
 	"maxstorageobjects": {
 		Type:    intType,
 		Default: 0,
@@ -410,16 +801,285 @@ var configVars = map[string]configVar{
 			EnvVar: "MAX_STORAGE_OBJECTS",
 		},
 	},
+	"maxversionsperchart": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "max-versions-per-chart",
+			Usage:  "maximum number of versions allowed for each chart (per tenant)",
+			EnvVar: "MAX_VERSIONS_PER_CHART",
+		},
+	},
+	"ignorechartnamecase": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "ignore-chart-name-case",
+			Usage:  "find charts by name ignoring case in the API, if only one chart matches",
+			EnvVar: "IGNORE_CHART_NAME_CASE",
+		},
+	},
+	"trailingslash": {
+		Type:    stringType,
+		Default: "strict",
+		CLIFlag: cli.StringFlag{
+			Name:   "trailing-slash",
+			Usage:  "handling of paths with a trailing slash: strict, strip or redirect",
+			EnvVar: "TRAILING_SLASH",
+			Value:  "strict",
+		},
+	},
+	"allowedchartnameregex": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "allowed-chart-name-regex",
+			Usage:  "regex the name of each chart pushed must match",
+			EnvVar: "ALLOWED_CHART_NAME_REGEX",
+		},
+	},
 	"maxuploadsize": {
 		Type:    intType,
 		Default: 1024 * 1024 * 20, // 20MB, per Helm's limit
 		CLIFlag: cli.IntFlag{
 			Name:   "max-upload-size",
-			Usage:  "max size of post body (in bytes)",
+			Usage:  "max size of chart and provenance file uploads (in bytes)",
 			EnvVar: "MAX_UPLOAD_SIZE",
 			Value:  1024 * 1024 * 20,
 		},
 	},
+	"maxchartsize": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "max-chart-size",
+			Usage:  "max size of each chart package uploaded, within the max upload size of the request (in bytes, 0 for no limit)",
+			EnvVar: "MAX_CHART_SIZE",
+		},
+	},
+	"maxrequestsize": {
+		Type:    intType,
+		Default: 1024 * 1024, // 1MB
+		CLIFlag: cli.IntFlag{
+			Name:   "max-request-size",
+			Usage:  "max size of the body of requests other than uploads (in bytes)",
+			EnvVar: "MAX_REQUEST_SIZE",
+			Value:  1024 * 1024,
+		},
+	},
+	"maxconcurrentuploads": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "max-concurrent-uploads",
+			Usage:  "max number of chart uploads handled at once, further uploads get a 503 (0 for no limit)",
+			EnvVar: "MAX_CONCURRENT_UPLOADS",
+		},
+	},
+	"storage.retry.maxattempts": {
+		Type:    intType,
+		Default: 1,
+		CLIFlag: cli.IntFlag{
+			Name:   "storage-retry-max-attempts",
+			Usage:  "max number of attempts for storage requests failing with a transient error (1 for no retries)",
+			EnvVar: "STORAGE_RETRY_MAX_ATTEMPTS",
+		},
+	},
+	"storage.retry.basedelay": {
+		Type:    intType,
+		Default: 100,
+		CLIFlag: cli.IntFlag{
+			Name:   "storage-retry-base-delay",
+			Usage:  "delay in milliseconds before the first retry of a storage request, doubled for each retry after it",
+			EnvVar: "STORAGE_RETRY_BASE_DELAY",
+		},
+	},
+	"readinesstimeout": {
+		Type:    intType,
+		Default: 5,
+		CLIFlag: cli.IntFlag{
+			Name:   "readiness-timeout",
+			Usage:  "seconds to wait for the storage backend when serving /readiness",
+			EnvVar: "READINESS_TIMEOUT",
+			Value:  5,
+		},
+	},
+	"shutdowntimeout": {
+		Type:    intType,
+		Default: 10,
+		CLIFlag: cli.IntFlag{
+			Name:   "shutdown-timeout",
+			Usage:  "seconds to wait for in-flight requests to finish on shutdown",
+			EnvVar: "SHUTDOWN_TIMEOUT",
+			Value:  10,
+		},
+	},
+	"requesttimeout": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "request-timeout",
+			Usage:  "seconds before a request is aborted with a 503 (0 for no timeout)",
+			EnvVar: "REQUEST_TIMEOUT",
+		},
+	},
+	"readheadertimeout": {
+		Type:    intType,
+		Default: 10,
+		CLIFlag: cli.IntFlag{
+			Name:   "read-header-timeout",
+			Usage:  "seconds allowed to read the headers of a request",
+			EnvVar: "READ_HEADER_TIMEOUT",
+			Value:  10,
+		},
+	},
+	"readtimeout": {
+		Type:    intType,
+		Default: 300,
+		CLIFlag: cli.IntFlag{
+			Name:   "read-timeout",
+			Usage:  "seconds allowed to read a whole request, body included",
+			EnvVar: "READ_TIMEOUT",
+			Value:  300,
+		},
+	},
+	"writetimeout": {
+		Type:    intType,
+		Default: 300,
+		CLIFlag: cli.IntFlag{
+			Name:   "write-timeout",
+			Usage:  "seconds allowed to write a response, from the end of its request headers",
+			EnvVar: "WRITE_TIMEOUT",
+			Value:  300,
+		},
+	},
+	"idletimeout": {
+		Type:    intType,
+		Default: 120,
+		CLIFlag: cli.IntFlag{
+			Name:   "idle-timeout",
+			Usage:  "seconds a keep-alive connection may stay idle before it is closed",
+			EnvVar: "IDLE_TIMEOUT",
+			Value:  120,
+		},
+	},
+	"ratelimit.rps": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "rate-limit",
+			Usage:  "requests per second allowed for each user or client IP (0 for no limit)",
+			EnvVar: "RATE_LIMIT",
+		},
+	},
+	"ratelimit.burst": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "rate-limit-burst",
+			Usage:  "requests allowed in a burst above the rate limit (defaults to the rate limit)",
+			EnvVar: "RATE_LIMIT_BURST",
+		},
+	},
+	"writeallowedcidrs": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "write-allowed-cidrs",
+			Usage:  "CIDR ranges allowed to upload and delete charts (all if unset)",
+			EnvVar: "WRITE_ALLOWED_CIDRS",
+		},
+	},
+	"trustedproxies": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "trusted-proxies",
+			Usage:  "CIDR ranges of proxies trusted to set X-Forwarded-For (any if unset)",
+			EnvVar: "TRUSTED_PROXIES",
+		},
+	},
+	"trustedplatform": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "trusted-platform",
+			Usage:  "platform to take the client IP from: cloudflare, gcp or the name of a header",
+			EnvVar: "TRUSTED_PLATFORM",
+		},
+	},
+	"webhook.urls": {
+		Type:    stringSliceType,
+		Default: []string{},
+		CLIFlag: cli.StringSliceFlag{
+			Name:   "webhook-urls",
+			Usage:  "URLs to POST a notification to when a chart is uploaded or deleted",
+			EnvVar: "WEBHOOK_URLS",
+		},
+	},
+	"webhook.secret": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "webhook-secret",
+			Usage:  "shared secret used to sign webhook notifications",
+			EnvVar: "WEBHOOK_SECRET",
+		},
+	},
+	"retention.keepversions": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "retention-keep-versions",
+			Usage:  "delete all but the newest N versions of each chart (0 to disable)",
+			EnvVar: "RETENTION_KEEP_VERSIONS",
+		},
+	},
+	"retention.maxage": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "retention-max-age",
+			Usage:  "delete chart versions created more than this many seconds ago (0 to disable)",
+			EnvVar: "RETENTION_MAX_AGE",
+		},
+	},
+	"retention.interval": {
+		Type:    intType,
+		Default: 3600,
+		CLIFlag: cli.IntFlag{
+			Name:   "retention-interval",
+			Usage:  "seconds between runs of the retention policy",
+			EnvVar: "RETENTION_INTERVAL",
+		},
+	},
+	"retention.dryrun": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "retention-dry-run",
+			Usage:  "log the chart versions the retention policy would delete, without deleting them",
+			EnvVar: "RETENTION_DRY_RUN",
+		},
+	},
+	"reindex.interval": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "reindex-interval",
+			Usage:  "seconds between background rebuilds of every repo index from storage (0 to disable)",
+			EnvVar: "REINDEX_INTERVAL",
+		},
+	},
+	"reindex.jitter": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "reindex-jitter",
+			Usage:  "up to this many seconds are randomly added to each reindex interval",
+			EnvVar: "REINDEX_JITTER",
+		},
+	},
 	"indexlimit": {
 		Type:    intType,
 		Default: 0,
@@ -429,6 +1089,88 @@ var configVars = map[string]configVar{
 			EnvVar: "INDEX_LIMIT",
 		},
 	},
+	"indexversionorder": {
+		Type:    stringType,
+		Default: "semver",
+		CLIFlag: cli.StringFlag{
+			Name:   "index-version-order",
+			Usage:  "order of the versions of each chart in index.yaml, can be one of: semver, created-desc, created-asc",
+			EnvVar: "INDEX_VERSION_ORDER",
+		},
+	},
+	"indexreconcileinterval": {
+		Type:    intType,
+		Default: 0,
+		CLIFlag: cli.IntFlag{
+			Name:   "index-reconcile-interval",
+			Usage:  "seconds between full comparisons of the index with storage (0 to compare on every index request)",
+			EnvVar: "INDEX_RECONCILE_INTERVAL",
+		},
+	},
+	"enableoci": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "enable-oci",
+			Usage:  "serve the OCI distribution API under /v2/, for pushing and pulling charts as OCI artifacts",
+			EnvVar: "ENABLE_OCI",
+		},
+	},
+	"indexsigning.keyring": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "index-signing-keyring",
+			Usage:  "path to a keyring with the private key used to sign index.yaml (served at index.yaml.prov)",
+			EnvVar: "INDEX_SIGNING_KEYRING",
+		},
+	},
+	"indexsigning.key": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "index-signing-key",
+			Usage:  "name or email of the key to sign index.yaml with (defaults to the first private key in the keyring)",
+			EnvVar: "INDEX_SIGNING_KEY",
+		},
+	},
+	"indexsigning.passphrase": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "index-signing-passphrase",
+			Usage:  "passphrase of the key to sign index.yaml with, if it is encrypted",
+			EnvVar: "INDEX_SIGNING_PASSPHRASE",
+		},
+	},
+	"presignedredirect": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "presigned-redirect",
+			Usage:  "redirect chart downloads to presigned storage URLs, if the storage backend supports them",
+			EnvVar: "PRESIGNED_REDIRECT",
+		},
+	},
+	"presignedexpiry": {
+		Type:    intType,
+		Default: 300,
+		CLIFlag: cli.IntFlag{
+			Name:   "presigned-expiry",
+			Usage:  "seconds for which presigned download URLs are valid",
+			EnvVar: "PRESIGNED_EXPIRY",
+			Value:  300,
+		},
+	},
+	"upstreamrepourl": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "upstream-repo-url",
+			Usage:  "url of a Helm repo to fetch and cache chart packages missing from storage from",
+			EnvVar: "UPSTREAM_REPO_URL",
+		},
+	},
 	"contextpath": {
 		Type:    stringType,
 		Default: "",
@@ -447,6 +1189,15 @@ var configVars = map[string]configVar{
 			EnvVar: "DEPTH",
 		},
 	},
+	"variabledepth": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "variable-depth",
+			Usage:  "allow repos nested deeper than --depth, the repo being the path up to the route",
+			EnvVar: "VARIABLE_DEPTH",
+		},
+	},
 	"bearerauth": {
 		Type:    boolType,
 		Default: false,
@@ -501,6 +1252,60 @@ var configVars = map[string]configVar{
 			EnvVar: "AUTH_CERT_PATH",
 		},
 	},
+	"authcertpem": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "auth-cert-pem",
+			Usage:  "authorization server public pem, given inline instead of --auth-cert-path",
+			EnvVar: "AUTH_CERT_PEM",
+		},
+	},
+	"authcerturl": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "auth-cert-url",
+			Usage:  "HTTPS URL the authorization server public pem is fetched from at startup, instead of --auth-cert-path",
+			EnvVar: "AUTH_CERT_URL",
+		},
+	},
+	"authjwksurl": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "auth-jwks-url",
+			Usage:  "URL of the authorization server JWKS, used instead of --auth-cert-path",
+			EnvVar: "AUTH_JWKS_URL",
+		},
+	},
+	"authtokencachesize": {
+		Type:    intType,
+		Default: 1000,
+		CLIFlag: cli.IntFlag{
+			Name:   "auth-token-cache-size",
+			Usage:  "number of validated bearer tokens kept until they expire, so they are not verified again (0 to disable)",
+			EnvVar: "AUTH_TOKEN_CACHE_SIZE",
+		},
+	},
+	"authaccessrules": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "auth-access-rules",
+			Usage:  "path to a file of rules granting identities pull and push access to repos (reloaded on SIGHUP)",
+			EnvVar: "AUTH_ACCESS_RULES",
+		},
+	},
+	"authjwksrefreshinterval": {
+		Type:    intType,
+		Default: 900,
+		CLIFlag: cli.IntFlag{
+			Name:   "auth-jwks-refresh-interval",
+			Usage:  "seconds between JWKS refreshes",
+			EnvVar: "AUTH_JWKS_REFRESH_INTERVAL",
+		},
+	},
 }
 
 func populateCLIFlags() {
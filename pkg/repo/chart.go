@@ -17,9 +17,13 @@ limitations under the License.
 package repo
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	pathutil "path"
 	"strconv"
 	"strings"
@@ -48,6 +52,13 @@ func ChartPackageFilenameFromNameVersion(name string, version string) string {
 	return filename
 }
 
+// ChartNameVersionFromPackageFilename returns the chart name and version of a chart package
+// filename, the reverse of ChartPackageFilenameFromNameVersion
+func ChartNameVersionFromPackageFilename(filename string) (string, string) {
+	meta := emptyChartVersionFromPackageFilename(filename).Metadata
+	return meta.Name, meta.Version
+}
+
 // ChartPackageFilenameFromContent returns a chart filename from binary content
 func ChartPackageFilenameFromContent(content []byte) (string, error) {
 	chart, err := chartFromContent(content)
@@ -59,6 +70,97 @@ func ChartPackageFilenameFromContent(content []byte) (string, error) {
 	return filename, nil
 }
 
+// ValidateChartPackage checks that content is a gzipped chart archive with a Chart.yaml
+// giving a name and version. If filename is not empty, it must match the chart name and version
+func ValidateChartPackage(content []byte, filename string) error {
+	if _, err := gzip.NewReader(bytes.NewReader(content)); err != nil {
+		return errors.New("chart package is not a valid gzip archive")
+	}
+	chart, err := chartFromContent(content)
+	if err != nil {
+		return fmt.Errorf("invalid chart package: %s", err)
+	}
+	return ValidateChartMetadata(chart.Metadata, filename)
+}
+
+// ValidateChartMetadata checks that a chart's Chart.yaml gives a name and version. If filename
+// is not empty, it must match the chart name and version
+func ValidateChartMetadata(meta *helm_chart.Metadata, filename string) error {
+	if meta == nil {
+		return errors.New("invalid chart package: Chart.yaml is missing")
+	}
+	if strings.TrimSpace(meta.Name) == "" {
+		return errors.New("invalid chart package: name is empty in Chart.yaml")
+	}
+	if strings.TrimSpace(meta.Version) == "" {
+		return errors.New("invalid chart package: version is empty in Chart.yaml")
+	}
+	if filename != "" {
+		expected := ChartPackageFilenameFromNameVersion(meta.Name, meta.Version)
+		if pathutil.Base(filename) != expected {
+			return fmt.Errorf("chart package filename %s does not match chart name and version (expected %s)",
+				pathutil.Base(filename), expected)
+		}
+	}
+	return nil
+}
+
+// ChartMetadataFromArchive reads the Chart.yaml of a gzipped chart archive. The whole archive
+// is read to check that it is intact, but only Chart.yaml is kept in memory
+func ChartMetadataFromArchive(archive io.Reader) (*helm_chart.Metadata, error) {
+	return chartMetadataFromArchive(archive, true)
+}
+
+// ChartMetadataFromArchiveStart reads the Chart.yaml of a gzipped chart archive, reading the
+// archive no further than Chart.yaml, which comes first in packages made by helm package.
+// Nothing after Chart.yaml is checked
+func ChartMetadataFromArchiveStart(archive io.Reader) (*helm_chart.Metadata, error) {
+	return chartMetadataFromArchive(archive, false)
+}
+
+func chartMetadataFromArchive(archive io.Reader, whole bool) (*helm_chart.Metadata, error) {
+	gzipReader, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, errors.New("chart package is not a valid gzip archive")
+	}
+	defer gzipReader.Close()
+
+	var meta *helm_chart.Metadata
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chart package: %s", err)
+		}
+		// entries are below a top-level directory named after the chart
+		parts := strings.SplitN(strings.TrimPrefix(header.Name, "./"), "/", 2)
+		if meta != nil || len(parts) != 2 || parts[1] != "Chart.yaml" {
+			if _, err := io.Copy(ioutil.Discard, tarReader); err != nil {
+				return nil, fmt.Errorf("invalid chart package: %s", err)
+			}
+			continue
+		}
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chart package: %s", err)
+		}
+		meta, err = chartutil.UnmarshalChartfile(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chart package: %s", err)
+		}
+		if !whole {
+			return meta, nil
+		}
+	}
+	if meta == nil {
+		return nil, errors.New("invalid chart package: Chart.yaml is missing")
+	}
+	return meta, nil
+}
+
 // ChartVersionFromStorageObject returns a chart version from a storage object
 func ChartVersionFromStorageObject(object storage.Object) (*helm_repo.ChartVersion, error) {
 	if len(object.Content) == 0 {
@@ -88,13 +190,22 @@ func ChartVersionFromStorageObject(object storage.Object) (*helm_repo.ChartVersi
 // StorageObjectFromChartVersion returns a storage object from a chart version (empty content)
 func StorageObjectFromChartVersion(chartVersion *helm_repo.ChartVersion) storage.Object {
 	object := storage.Object{
-		Path: pathutil.Base(chartVersion.URLs[0]),
+		Path: chartFilenameFromURL(chartVersion.URLs[0]),
 		Content: []byte{},
 		LastModified: chartVersion.Created,
 	}
 	return object
 }
 
+// chartFilenameFromURL returns the filename of the chart package at chartURL, leaving out any
+// query string added by a chart url template
+func chartFilenameFromURL(chartURL string) string {
+	if i := strings.IndexAny(chartURL, "?#"); i >= 0 {
+		chartURL = chartURL[:i]
+	}
+	return pathutil.Base(chartURL)
+}
+
 func chartFromContent(content []byte) (*helm_chart.Chart, error) {
 	chart, err := chartutil.LoadArchive(bytes.NewBuffer(content))
 	return chart, err
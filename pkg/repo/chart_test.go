@@ -17,6 +17,9 @@ limitations under the License.
 package repo
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"io/ioutil"
 	"testing"
 	"time"
@@ -24,6 +27,7 @@ import (
 	"github.com/helm/chartmuseum/pkg/storage"
 
 	"github.com/stretchr/testify/suite"
+	helm_chart "k8s.io/helm/pkg/proto/hapi/chart"
 	helm_repo "k8s.io/helm/pkg/repo"
 )
 
@@ -44,6 +48,12 @@ func (suite *ChartTestSuite) TestChartPackageFilenameFromNameVersion() {
 	suite.Equal("mychart-2.3.4.tgz", filename, "filename as expected")
 }
 
+func (suite *ChartTestSuite) TestChartNameVersionFromPackageFilename() {
+	name, version := ChartNameVersionFromPackageFilename("my-chart-2.3.4-rc.1.tgz")
+	suite.Equal("my-chart", name)
+	suite.Equal("2.3.4-rc.1", version)
+}
+
 func (suite *ChartTestSuite) TestChartVersionFromStorageObject() {
 	object := storage.Object{
 		Path:         "mychart-2.3.4.tgz",
@@ -137,6 +147,82 @@ func (suite *ChartTestSuite) TestChartPackageFilenameFromContent() {
 	suite.Equal("mychart-0.1.0.tgz", filename, "chart tarball filename as expected")
 }
 
+// chartArchive returns a gzipped tarball containing the given files, under a mychart/ directory
+func (suite *ChartTestSuite) chartArchive(files map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	gzipWriter := gzip.NewWriter(buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name: "mychart/" + name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		})
+		suite.Nil(err, "no error writing tar header")
+		_, err = tarWriter.Write([]byte(content))
+		suite.Nil(err, "no error writing tar content")
+	}
+	suite.Nil(tarWriter.Close(), "no error closing tar writer")
+	suite.Nil(gzipWriter.Close(), "no error closing gzip writer")
+	return buf.Bytes()
+}
+
+func (suite *ChartTestSuite) TestValidateChartPackage() {
+	err := ValidateChartPackage(suite.TarballContent, "")
+	suite.Nil(err, "no error validating test tarball")
+
+	err = ValidateChartPackage(suite.TarballContent, "mychart-0.1.0.tgz")
+	suite.Nil(err, "no error validating test tarball with matching filename")
+
+	err = ValidateChartPackage(suite.TarballContent, "mychart-9.9.9.tgz")
+	suite.NotNil(err, "error validating test tarball with wrong filename")
+
+	err = ValidateChartPackage([]byte("this is not gzip"), "")
+	suite.Equal("chart package is not a valid gzip archive", err.Error())
+
+	err = ValidateChartPackage(suite.chartArchive(map[string]string{"values.yaml": "a: b"}), "")
+	suite.NotNil(err, "error validating chart package without Chart.yaml")
+
+	err = ValidateChartPackage(suite.chartArchive(map[string]string{"Chart.yaml": "name: mychart"}), "")
+	suite.NotNil(err, "error validating chart package without version")
+
+	err = ValidateChartPackage(suite.chartArchive(map[string]string{"Chart.yaml": "version: 0.1.0"}), "")
+	suite.NotNil(err, "error validating chart package without name")
+}
+
+func (suite *ChartTestSuite) TestChartMetadataFromArchive() {
+	meta, err := ChartMetadataFromArchive(bytes.NewReader(suite.TarballContent))
+	suite.Nil(err, "no error reading test tarball")
+	suite.Equal("mychart", meta.Name)
+	suite.Equal("0.1.0", meta.Version)
+
+	_, err = ChartMetadataFromArchive(bytes.NewReader([]byte("this is not gzip")))
+	suite.Equal("chart package is not a valid gzip archive", err.Error())
+
+	_, err = ChartMetadataFromArchive(bytes.NewReader(suite.chartArchive(map[string]string{"values.yaml": "a: b"})))
+	suite.Equal("invalid chart package: Chart.yaml is missing", err.Error())
+
+	truncated := suite.TarballContent[:len(suite.TarballContent)/2]
+	_, err = ChartMetadataFromArchive(bytes.NewReader(truncated))
+	suite.NotNil(err, "error reading truncated tarball")
+
+	meta, err = ChartMetadataFromArchive(bytes.NewReader(suite.chartArchive(map[string]string{"Chart.yaml": "name: mychart"})))
+	suite.Nil(err, "no error reading chart package without version")
+	suite.NotNil(ValidateChartMetadata(meta, ""), "error validating chart metadata without version")
+	suite.NotNil(ValidateChartMetadata(&helm_chart.Metadata{Name: "mychart", Version: "0.1.0"}, "mychart-9.9.9.tgz"),
+		"error validating chart metadata with wrong filename")
+}
+
+func (suite *ChartTestSuite) TestChartMetadataFromArchiveStart() {
+	meta, err := ChartMetadataFromArchiveStart(bytes.NewReader(suite.TarballContent))
+	suite.Nil(err, "no error reading test tarball")
+	suite.Equal("mychart", meta.Name)
+	suite.Equal("0.1.0", meta.Version)
+
+	_, err = ChartMetadataFromArchiveStart(bytes.NewReader(suite.chartArchive(map[string]string{"values.yaml": "a: b"})))
+	suite.Equal("invalid chart package: Chart.yaml is missing", err.Error())
+}
+
 func TestChartTestSuite(t *testing.T) {
 	suite.Run(t, new(ChartTestSuite))
 }
@@ -17,10 +17,16 @@ limitations under the License.
 package repo
 
 import (
+	"bytes"
+	"fmt"
+	pathutil "path"
+	"sort"
+	"text/template"
 	"time"
 
 	"github.com/ghodss/yaml"
 
+	helm_chart "k8s.io/helm/pkg/proto/hapi/chart"
 	helm_repo "k8s.io/helm/pkg/repo"
 )
 
@@ -30,7 +36,19 @@ var (
 	StatefileFilename    = "index-cache.yaml"
 )
 
+const (
+	// VersionOrderSemver lists the versions of each chart from the highest semver down (the default)
+	VersionOrderSemver VersionOrder = "semver"
+	// VersionOrderCreatedDesc lists the versions of each chart from the most recently created
+	VersionOrderCreatedDesc VersionOrder = "created-desc"
+	// VersionOrderCreatedAsc lists the versions of each chart from the least recently created
+	VersionOrderCreatedAsc VersionOrder = "created-asc"
+)
+
 type (
+	// VersionOrder is the order of the versions listed under each chart in index.yaml
+	VersionOrder string
+
 	// ServerInfo contains extra data about the server
 	ServerInfo struct {
 		ContextPath string `json:"contextPath,omitempty"`
@@ -49,35 +67,127 @@ type (
 		RepoName   string `json:"b"`
 		Raw        []byte `json:"c"`
 		ChartURL   string `json:"d"`
+		// VersionOrder is set by the server on each index it regenerates, so it is not cached
+		VersionOrder VersionOrder `json:"-"`
+		// ChartURLTemplate is set by the server along with VersionOrder, and takes precedence
+		// over ChartURL for the chart versions added to the index
+		ChartURLTemplate *ChartURLTemplate `json:"-"`
+	}
+
+	// ChartURLTemplate renders the url of a chart package in index.yaml
+	ChartURLTemplate struct {
+		template *template.Template
+	}
+
+	// chartURLTemplateData holds the variables available to a chart url template
+	chartURLTemplateData struct {
+		Repo     string
+		Name     string
+		Version  string
+		Filename string
 	}
 )
 
+// NewChartURLTemplate parses a chart url template, e.g.
+// "https://cdn.example.com/{{.Repo}}/{{.Filename}}". The template is rendered once for a sample
+// chart, so that it fails now rather than for every chart. The chart filename must end the
+// path of the url, as the index is compared with storage by filename
+func NewChartURLTemplate(text string) (*ChartURLTemplate, error) {
+	tmpl, err := template.New("charturl").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart url template: %s", err)
+	}
+	chartURLTemplate := &ChartURLTemplate{template: tmpl}
+	sample := chartURLTemplateData{Repo: "org/repo", Name: "mychart", Version: "0.1.0", Filename: "mychart-0.1.0.tgz"}
+	chartURL, err := chartURLTemplate.render(sample)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart url template: %s", err)
+	}
+	if chartFilenameFromURL(chartURL) != sample.Filename {
+		return nil, fmt.Errorf("invalid chart url template %q: the url must end with {{.Filename}}", text)
+	}
+	return chartURLTemplate, nil
+}
+
+func (chartURLTemplate *ChartURLTemplate) render(data chartURLTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := chartURLTemplate.template.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
 // NewIndex creates a new instance of Index
 func NewIndex(chartURL string, repo string, serverInfo *ServerInfo) *Index {
 	indexFile := &IndexFile{
 		IndexFile:  &helm_repo.IndexFile{},
 		ServerInfo: serverInfo,
 	}
-	index := Index{indexFile, repo, []byte{}, chartURL}
+	index := Index{IndexFile: indexFile, RepoName: repo, Raw: []byte{}, ChartURL: chartURL}
 	index.Entries = map[string]helm_repo.ChartVersions{}
 	index.APIVersion = helm_repo.APIVersionV1
 	index.Regenerate()
 	return &index
 }
 
+// NewVersionOrder returns the version order with the given name, "" being semver
+func NewVersionOrder(name string) (VersionOrder, error) {
+	switch order := VersionOrder(name); order {
+	case "":
+		return VersionOrderSemver, nil
+	case VersionOrderSemver, VersionOrderCreatedDesc, VersionOrderCreatedAsc:
+		return order, nil
+	}
+	return "", fmt.Errorf("unsupported index version order: %s", name)
+}
+
 // Regenerate sorts entries in index file and sets current time for generated key
 func (index *Index) Regenerate() error {
-	index.SortEntries()
+	index.sortEntries()
 	index.Generated = time.Now().Round(time.Second)
 	raw, err := yaml.Marshal(index.IndexFile)
 	if err != nil {
 		return err
 	}
 	index.Raw = raw
-	index.updateMetrics()
+	index.UpdateMetrics()
 	return nil
 }
 
+// sortEntries sorts the versions of each chart by semver, highest first, then by creation
+// time if the version order asks for it. Versions created at the same time stay in semver order
+func (index *Index) sortEntries() {
+	index.SortEntries()
+	if index.VersionOrder != VersionOrderCreatedDesc && index.VersionOrder != VersionOrderCreatedAsc {
+		return
+	}
+	for _, versions := range index.Entries {
+		sort.SliceStable(versions, func(i, j int) bool {
+			if index.VersionOrder == VersionOrderCreatedAsc {
+				return versions[i].Created.Before(versions[j].Created)
+			}
+			return versions[i].Created.After(versions[j].Created)
+		})
+	}
+}
+
+// Clone returns a copy of index whose entries can be changed without affecting index, which
+// may still be served meanwhile. The chart versions themselves are shared, and must be
+// replaced rather than changed in place
+func (index *Index) Clone() *Index {
+	helmIndexFile := *index.IndexFile.IndexFile
+	helmIndexFile.Entries = make(map[string]helm_repo.ChartVersions, len(index.Entries))
+	for name, chartVersions := range index.Entries {
+		helmIndexFile.Entries[name] = append(helm_repo.ChartVersions{}, chartVersions...)
+	}
+	clone := *index
+	clone.IndexFile = &IndexFile{
+		IndexFile:  &helmIndexFile,
+		ServerInfo: index.ServerInfo,
+	}
+	return &clone
+}
+
 // RemoveEntry removes a chart version from index
 func (index *Index) RemoveEntry(chartVersion *helm_repo.ChartVersion) {
 	if entries, ok := index.Entries[chartVersion.Name]; ok {
@@ -128,14 +238,40 @@ func (index *Index) UpdateEntry(chartVersion *helm_repo.ChartVersion) {
 	}
 }
 
+// ChartPackageURL returns the url a chart version added to the index would have, as set by
+// the chart url template or the chart url of the index
+func (index *Index) ChartPackageURL(name string, version string) string {
+	chartVersion := &helm_repo.ChartVersion{
+		Metadata: &helm_chart.Metadata{Name: name, Version: version},
+		URLs:     []string{"charts/" + ChartPackageFilenameFromNameVersion(name, version)},
+	}
+	index.setChartURL(chartVersion)
+	return chartVersion.URLs[0]
+}
+
 func (index *Index) setChartURL(chartVersion *helm_repo.ChartVersion) {
+	if index.ChartURLTemplate != nil {
+		chartURL, err := index.ChartURLTemplate.render(chartURLTemplateData{
+			Repo:     index.RepoName,
+			Name:     chartVersion.Name,
+			Version:  chartVersion.Version,
+			Filename: pathutil.Base(chartVersion.URLs[0]),
+		})
+		// the template was checked on startup, should it still fail the chart gets the usual url
+		if err == nil {
+			chartVersion.URLs[0] = chartURL
+			return
+		}
+	}
 	if index.ChartURL != "" {
 		chartVersion.URLs[0] = index.ChartURL + "/" + chartVersion.URLs[0]
 	}
 }
 
-// UpdateMetrics updates chart index-related Prometheus metrics
-func (index *Index) updateMetrics() {
+// UpdateMetrics sets the chart and chart version gauges of the repo (tenant) to the contents of
+// the index. The gauges of a repo which becomes empty are zeroed rather than removed, so that
+// they still report the repo
+func (index *Index) UpdateMetrics() {
 	nChartVersions := 0
 	for _, chartVersions := range index.Entries {
 		nChartVersions += len(chartVersions)
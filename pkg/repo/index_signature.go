@@ -0,0 +1,167 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repo
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+	"k8s.io/helm/pkg/provenance"
+)
+
+var (
+	// IndexSignatureFilename is the filename the index.yaml signature is served as
+	IndexSignatureFilename = "index.yaml.prov"
+
+	// ErrorInvalidIndexSignature is raised when an index signature cannot be parsed or its signature is invalid
+	ErrorInvalidIndexSignature = errors.New("invalid index signature")
+
+	// ErrorIndexSignatureDigestMismatch is raised when an index signature does not list the digest of the index
+	ErrorIndexSignatureDigestMismatch = errors.New("index signature does not match index digest")
+)
+
+type (
+	// IndexSigner signs index.yaml files with a private key
+	IndexSigner struct {
+		entity *openpgp.Entity
+	}
+
+	// indexSignatureBody is the signed content of an index signature
+	indexSignatureBody struct {
+		Files  map[string]string `json:"files"`
+		Signed string            `json:"signed"`
+	}
+
+	// IndexSignature is the verified content of an index signature
+	IndexSignature struct {
+		Digest   string
+		Signed   time.Time
+		SignedBy string
+	}
+)
+
+// NewIndexSigner loads the private key from a keyring file. The key is the first private key
+// in the keyring whose identity contains key, which is an error if there is none, or the
+// first private key if key is empty. Encrypted keys are decrypted with passphrase
+func NewIndexSigner(keyring string, key string, passphrase string) (*IndexSigner, error) {
+	signatory, err := provenance.NewFromKeyring(keyring, key)
+	if err != nil {
+		return nil, err
+	}
+	entity := signatory.Entity
+	if entity == nil && key != "" {
+		return nil, fmt.Errorf("no private key for %q found in keyring %s", key, keyring)
+	}
+	if entity == nil {
+		for _, candidate := range signatory.KeyRing {
+			if candidate.PrivateKey != nil {
+				entity = candidate
+				break
+			}
+		}
+	}
+	if entity == nil || entity.PrivateKey == nil {
+		return nil, fmt.Errorf("no private key found in keyring %s", keyring)
+	}
+	if entity.PrivateKey.Encrypted {
+		if err := entity.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("could not decrypt private key: %s", err)
+		}
+	}
+	return &IndexSigner{entity: entity}, nil
+}
+
+// Sign returns a clearsigned document listing the sha256 digest of the index content
+// and the time it was signed, in the same format as chart provenance files
+func (signer *IndexSigner) Sign(indexContent []byte, signed time.Time) ([]byte, error) {
+	digest, err := provenanceDigestFromContent(indexContent)
+	if err != nil {
+		return nil, err
+	}
+	body := fmt.Sprintf("files:\n  index.yaml: sha256:%s\nsigned: %s\n", digest, signed.UTC().Format(time.RFC3339))
+
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, signer.entity.PrivateKey, &packet.Config{DefaultHash: crypto.SHA512})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadKeyring loads the public keys used to verify index signatures from a keyring file
+func LoadKeyring(keyring string) (openpgp.EntityList, error) {
+	signatory, err := provenance.NewFromKeyring(keyring, "")
+	if err != nil {
+		return nil, err
+	}
+	return signatory.KeyRing, nil
+}
+
+// VerifyIndexSignature checks that signature was made by a key in keyring, and that it lists
+// the sha256 digest of indexContent
+func VerifyIndexSignature(keyring openpgp.EntityList, indexContent []byte, signature []byte) (*IndexSignature, error) {
+	block, _ := clearsign.Decode(signature)
+	if block == nil {
+		return nil, ErrorInvalidIndexSignature
+	}
+	signer, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+	if err != nil {
+		return nil, ErrorInvalidIndexSignature
+	}
+
+	var body indexSignatureBody
+	if err := yaml.Unmarshal(block.Plaintext, &body); err != nil {
+		return nil, ErrorInvalidIndexSignature
+	}
+	signedDigest := body.Files["index.yaml"]
+	if !strings.HasPrefix(signedDigest, "sha256:") {
+		return nil, ErrorInvalidIndexSignature
+	}
+	signed, err := time.Parse(time.RFC3339, body.Signed)
+	if err != nil {
+		return nil, ErrorInvalidIndexSignature
+	}
+
+	digest, err := provenanceDigestFromContent(indexContent)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(strings.TrimPrefix(signedDigest, "sha256:"), digest) {
+		return nil, ErrorIndexSignatureDigestMismatch
+	}
+
+	indexSignature := &IndexSignature{Digest: digest, Signed: signed}
+	for name := range signer.Identities {
+		indexSignature.SignedBy = name
+		break
+	}
+	return indexSignature, nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repo
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+var (
+	testSecretKeyring = "../../testdata/pgp/helm-test-key.secret"
+	testPublicKeyring = "../../testdata/pgp/helm-test-key.pub"
+)
+
+type IndexSignatureTestSuite struct {
+	suite.Suite
+	Signer *IndexSigner
+}
+
+func (suite *IndexSignatureTestSuite) SetupSuite() {
+	signer, err := NewIndexSigner(testSecretKeyring, "", "")
+	suite.Nil(err, "no error loading signing key")
+	suite.Signer = signer
+}
+
+func (suite *IndexSignatureTestSuite) TestNewIndexSigner() {
+	_, err := NewIndexSigner(testSecretKeyring, "helm-test", "")
+	suite.Nil(err, "no error loading signing key by identity")
+
+	_, err = NewIndexSigner(testSecretKeyring, "nobody", "")
+	suite.NotNil(err, "error loading unknown signing key")
+
+	_, err = NewIndexSigner(testPublicKeyring, "", "")
+	suite.NotNil(err, "error loading keyring without a private key")
+
+	_, err = NewIndexSigner("../../testdata/pgp/no-such-keyring", "", "")
+	suite.NotNil(err, "error loading missing keyring")
+}
+
+func (suite *IndexSignatureTestSuite) TestSignAndVerify() {
+	index := []byte("apiVersion: v1\nentries: {}\n")
+	signed := time.Date(2018, 6, 15, 12, 0, 0, 0, time.UTC)
+	signature, err := suite.Signer.Sign(index, signed)
+	suite.Nil(err, "no error signing index")
+	suite.True(strings.HasPrefix(string(signature), "-----BEGIN PGP SIGNED MESSAGE-----"), "signature is clearsigned")
+	digest := fmt.Sprintf("%x", sha256.Sum256(index))
+	suite.Contains(string(signature), "index.yaml: sha256:"+digest, "signature lists index digest")
+	suite.Contains(string(signature), "signed: 2018-06-15T12:00:00Z", "signature lists signing time")
+
+	keyring, err := LoadKeyring(testPublicKeyring)
+	suite.Nil(err, "no error loading public keyring")
+
+	verified, err := VerifyIndexSignature(keyring, index, signature)
+	suite.Nil(err, "no error verifying index signature")
+	suite.Equal(digest, verified.Digest)
+	suite.True(signed.Equal(verified.Signed), "signing time is verified")
+	suite.Contains(verified.SignedBy, "helm-test")
+
+	_, err = VerifyIndexSignature(keyring, []byte("apiVersion: v1\nentries: {tampered: []}\n"), signature)
+	suite.Equal(ErrorIndexSignatureDigestMismatch, err, "tampered index is detected")
+
+	tampered := strings.Replace(string(signature), "signed: 2018", "signed: 2019", 1)
+	_, err = VerifyIndexSignature(keyring, index, []byte(tampered))
+	suite.Equal(ErrorInvalidIndexSignature, err, "tampered signature is detected")
+
+	_, err = VerifyIndexSignature(keyring, index, []byte("not a signature"))
+	suite.Equal(ErrorInvalidIndexSignature, err, "invalid signature is detected")
+}
+
+func TestIndexSignatureTestSuite(t *testing.T) {
+	suite.Run(t, new(IndexSignatureTestSuite))
+}
@@ -21,6 +21,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/suite"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 	helm_repo "k8s.io/helm/pkg/repo"
@@ -91,6 +93,26 @@ func (suite *IndexTestSuite) TestRemove() {
 	suite.Empty(suite.Index.HasEntry(chartVersion))
 }
 
+func (suite *IndexTestSuite) TestClone() {
+	index := NewIndex("", "", &ServerInfo{})
+	index.AddEntry(getChartVersion("a", 0, time.Now()))
+	index.Regenerate()
+	raw := index.Raw
+
+	clone := index.Clone()
+	clone.AddEntry(getChartVersion("a", 1, time.Now()))
+	clone.AddEntry(getChartVersion("b", 0, time.Now()))
+	clone.RemoveEntry(getChartVersion("a", 0, time.Now()))
+	clone.Regenerate()
+
+	suite.Len(index.Entries, 1)
+	suite.True(index.HasEntry(getChartVersion("a", 0, time.Now())))
+	suite.False(index.HasEntry(getChartVersion("a", 1, time.Now())))
+	suite.Equal(raw, index.Raw)
+	suite.Len(clone.Entries, 2)
+	suite.False(clone.HasEntry(getChartVersion("a", 0, time.Now())))
+}
+
 func (suite *IndexTestSuite) TestChartURLs() {
 	index := NewIndex("", "", &ServerInfo{})
 	chartVersion := getChartVersion("a", 0, time.Now())
@@ -105,6 +127,27 @@ func (suite *IndexTestSuite) TestChartURLs() {
 		index.Entries["a"][0].URLs[0], "absolute chart url")
 }
 
+func (suite *IndexTestSuite) TestChartURLTemplate() {
+	chartURLTemplate, err := NewChartURLTemplate("https://cdn.example.com/{{.Repo}}/{{.Name}}/{{.Version}}/{{.Filename}}?v=1")
+	suite.Nil(err, "no error parsing chart url template")
+
+	index := NewIndex("http://mysite.com:8080", "org1/repo1", &ServerInfo{})
+	index.ChartURLTemplate = chartURLTemplate
+	chartVersion := getChartVersion("a", 0, time.Now())
+	index.AddEntry(chartVersion)
+	suite.Equal("https://cdn.example.com/org1/repo1/a/1.0.0/a-1.0.0.tgz?v=1",
+		index.Entries["a"][0].URLs[0], "chart url from template, over chart url")
+	suite.Equal("a-1.0.0.tgz", StorageObjectFromChartVersion(index.Entries["a"][0]).Path,
+		"storage object from templated chart url")
+
+	_, err = NewChartURLTemplate("https://cdn.example.com/{{.Repo}")
+	suite.NotNil(err, "error parsing invalid chart url template")
+	_, err = NewChartURLTemplate("https://cdn.example.com/{{.Tenant}}/{{.Filename}}")
+	suite.NotNil(err, "error rendering chart url template with unknown variable")
+	_, err = NewChartURLTemplate("https://cdn.example.com/{{.Name}}/{{.Version}}")
+	suite.NotNil(err, "error for chart url template without filename")
+}
+
 func (suite *IndexTestSuite) TestServerInfo() {
 	serverInfo := &ServerInfo{}
 	index := NewIndex("", "", serverInfo)
@@ -117,6 +160,89 @@ func (suite *IndexTestSuite) TestServerInfo() {
 	suite.True(strings.Contains(string(index.Raw), "contextPath: /v1/helm"), "context path is in index")
 }
 
+func (suite *IndexTestSuite) TestMetrics() {
+	gaugeValue := func(gaugeVec *prometheus.GaugeVec, repo string) float64 {
+		metric := &dto.Metric{}
+		suite.Nil(gaugeVec.WithLabelValues(repo).Write(metric), "no error reading gauge")
+		return metric.GetGauge().GetValue()
+	}
+
+	index := NewIndex("", "org1/repo1", &ServerInfo{})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		index.AddEntry(getChartVersion("a", i, now))
+	}
+	index.AddEntry(getChartVersion("b", 0, now))
+	suite.Nil(index.Regenerate(), "no error regenerating index")
+	suite.Equal(float64(2), gaugeValue(chartTotalGaugeVec, "org1/repo1"), "2 charts")
+	suite.Equal(float64(4), gaugeValue(chartVersionTotalGaugeVec, "org1/repo1"), "4 chart versions")
+
+	for i := 0; i < 3; i++ {
+		index.RemoveEntry(getChartVersion("a", i, now))
+	}
+	index.RemoveEntry(getChartVersion("b", 0, now))
+	suite.Nil(index.Regenerate(), "no error regenerating index")
+	suite.Equal(float64(0), gaugeValue(chartTotalGaugeVec, "org1/repo1"), "charts gauge zeroed for empty repo")
+	suite.Equal(float64(0), gaugeValue(chartVersionTotalGaugeVec, "org1/repo1"), "chart versions gauge zeroed for empty repo")
+}
+
+func (suite *IndexTestSuite) TestMetricsPrefix() {
+	SetMetricsPrefix("cm", "frontend")
+	defer SetMetricsPrefix("", "")
+
+	index := NewIndex("", "org1/repo1", &ServerInfo{})
+	index.AddEntry(getChartVersion("a", 0, time.Now()))
+	suite.Nil(index.Regenerate(), "no error regenerating index")
+	families, err := prometheus.DefaultGatherer.Gather()
+	suite.Nil(err, "no error gathering metrics")
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	suite.Contains(names, "cm_frontend_charts_served_total", "chart metrics use the prefix")
+	suite.Contains(names, "cm_frontend_chart_versions_served_total", "chart metrics use the prefix")
+	suite.NotContains(names, "chartmuseum_charts_served_total", "default chart metrics are replaced")
+}
+
+func (suite *IndexTestSuite) TestVersionOrder() {
+	versions := func(index *Index) []string {
+		var result []string
+		for _, chartVersion := range index.Entries["a"] {
+			result = append(result, chartVersion.Version)
+		}
+		return result
+	}
+
+	now := time.Now()
+	// 1.0.1 and 1.0.2 are pushed at the same time, then 1.0.3, and 1.0.0 last (an old release pushed again)
+	created := map[int]time.Time{0: now, 1: now.Add(-time.Hour), 2: now.Add(-time.Hour), 3: now.Add(-time.Minute)}
+
+	for _, test := range []struct {
+		order    VersionOrder
+		expected []string
+	}{
+		{"", []string{"1.0.3", "1.0.2", "1.0.1", "1.0.0"}},
+		{VersionOrderSemver, []string{"1.0.3", "1.0.2", "1.0.1", "1.0.0"}},
+		{VersionOrderCreatedDesc, []string{"1.0.0", "1.0.3", "1.0.2", "1.0.1"}},
+		{VersionOrderCreatedAsc, []string{"1.0.2", "1.0.1", "1.0.3", "1.0.0"}},
+	} {
+		index := NewIndex("", "", &ServerInfo{})
+		index.VersionOrder = test.order
+		for i := 0; i < 4; i++ {
+			index.AddEntry(getChartVersion("a", i, created[i]))
+		}
+		suite.Nil(index.Regenerate(), "no error regenerating index")
+		suite.Equal(test.expected, versions(index), fmt.Sprintf("versions in %q order", test.order))
+	}
+
+	for _, name := range []string{"", "semver", "created-desc", "created-asc"} {
+		_, err := NewVersionOrder(name)
+		suite.Nil(err, fmt.Sprintf("%q is a valid version order", name))
+	}
+	_, err := NewVersionOrder("newest")
+	suite.NotNil(err, "unknown version order")
+}
+
 func TestIndexTestSuite(t *testing.T) {
 	suite.Run(t, new(IndexTestSuite))
 }
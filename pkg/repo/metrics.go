@@ -22,25 +22,50 @@ import (
 
 var (
 	// Number of distinct charts
+	chartTotalGaugeVec *prometheus.GaugeVec
+	// Sum of of the number of versions per chart
+	chartVersionTotalGaugeVec *prometheus.GaugeVec
+
+	metricsNamespace string
+	metricsSubsystem string
+)
+
+func init() {
+	SetMetricsPrefix("", "")
+}
+
+// SetMetricsPrefix creates the chart metrics under namespace ("chartmuseum" if empty) and
+// subsystem, in place of the ones registered before. It is called on startup, before any
+// index is built
+func SetMetricsPrefix(namespace string, subsystem string) {
+	if namespace == "" {
+		namespace = "chartmuseum"
+	}
+	if chartTotalGaugeVec != nil {
+		if namespace == metricsNamespace && subsystem == metricsSubsystem {
+			return
+		}
+		prometheus.Unregister(chartTotalGaugeVec)
+		prometheus.Unregister(chartVersionTotalGaugeVec)
+	}
+	metricsNamespace, metricsSubsystem = namespace, subsystem
 	chartTotalGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "chartmuseum",
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "charts_served_total",
 			Help:      "Current number of charts served",
 		},
 		[]string{"repo"},
 	)
-	// Sum of of the number of versions per chart
 	chartVersionTotalGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "chartmuseum",
+			Namespace: namespace,
+			Subsystem: subsystem,
 			Name:      "chart_versions_served_total",
 			Help:      "Current number of chart versions served",
 		},
 		[]string{"repo"},
 	)
-)
-
-func init() {
 	prometheus.MustRegister(chartTotalGaugeVec, chartVersionTotalGaugeVec)
 }
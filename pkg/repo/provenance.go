@@ -35,6 +35,9 @@ var (
 
 	// ErrorInvalidProvenanceFile is raised when a provenance file is invalid
 	ErrorInvalidProvenanceFile = errors.New("invalid provenance file")
+
+	// ErrorProvenanceDigestMismatch is raised when a provenance file does not list the digest of its chart package
+	ErrorProvenanceDigestMismatch = errors.New("provenance file does not match chart package digest")
 )
 
 // ProvenanceFilenameFromNameVersion returns a provenance filename from a name and version
@@ -59,6 +62,30 @@ func ProvenanceFilenameFromContent(content []byte) (string, error) {
 	return filename, nil
 }
 
+// VerifyProvenanceDigest checks that a provenance file lists the sha256 digest of the chart package
+// with the given filename and content. The provenance signature itself is not verified
+func VerifyProvenanceDigest(provContent []byte, chartFilename string, chartContent []byte) error {
+	digest, err := provenanceDigestFromContent(chartContent)
+	if err != nil {
+		return err
+	}
+	return VerifyProvenanceChartDigest(provContent, chartFilename, digest)
+}
+
+// VerifyProvenanceChartDigest checks that a provenance file lists the given sha256 digest (in hex)
+// for the chart package with the given filename. The provenance signature itself is not verified
+func VerifyProvenanceChartDigest(provContent []byte, chartFilename string, chartDigest string) error {
+	pattern := regexp.MustCompile("\n\\s+" + regexp.QuoteMeta(chartFilename) + ":\\s*sha256:([0-9a-fA-F]+)")
+	match := pattern.FindStringSubmatch(string(provContent))
+	if len(match) != 2 {
+		return ErrorProvenanceDigestMismatch
+	}
+	if !strings.EqualFold(match[1], chartDigest) {
+		return ErrorProvenanceDigestMismatch
+	}
+	return nil
+}
+
 func provenanceDigestFromContent(content []byte) (string, error) {
 	digest, err := provenance.Digest(bytes.NewBuffer(content))
 	return digest, err
@@ -17,6 +17,8 @@ limitations under the License.
 package repo
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/suite"
@@ -94,6 +96,31 @@ name: mychart`)
 	suite.Equal(ErrorInvalidProvenanceFile, err, "ErrorInvalidProvenanceFile from bad content, no version")
 }
 
+func (suite *ProvenanceTestSuite) TestVerifyProvenanceDigest() {
+	chartContent := []byte("mychart package content")
+	provContent := []byte(fmt.Sprintf(`-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+name: mychart
+version: 0.1.0
+
+...
+files:
+  mychart-0.1.0.tgz: sha256:%x
+-----BEGIN PGP SIGNATURE-----
+=/cXn
+-----END PGP SIGNATURE-----`, sha256.Sum256(chartContent)))
+
+	err := VerifyProvenanceDigest(provContent, "mychart-0.1.0.tgz", chartContent)
+	suite.Nil(err, "no error verifying digest of matching chart package")
+
+	err = VerifyProvenanceDigest(provContent, "mychart-0.1.0.tgz", []byte("corrupted content"))
+	suite.Equal(ErrorProvenanceDigestMismatch, err, "ErrorProvenanceDigestMismatch for different chart content")
+
+	err = VerifyProvenanceDigest(provContent, "otherchart-0.1.0.tgz", chartContent)
+	suite.Equal(ErrorProvenanceDigestMismatch, err, "ErrorProvenanceDigestMismatch for chart package not listed")
+}
+
 func TestProvenanceTestSuite(t *testing.T) {
 	suite.Run(t, new(ProvenanceTestSuite))
 }
@@ -32,6 +32,8 @@ type AlibabaCloudOSSBackend struct {
 	Client *oss.Client
 	Prefix string
 	SSE    string
+	// ListPageSize is the number of objects listed per request, 50 by default (1000 at most)
+	ListPageSize int
 }
 
 // NewAlibabaCloudOSSBackend creates a new instance of AlibabaCloudOSSBackend
@@ -74,25 +76,35 @@ func NewAlibabaCloudOSSBackend(bucket string, prefix string, endpoint string, ss
 
 // ListObjects lists all objects in Alibaba Cloud OSS bucket, at prefix
 func (b AlibabaCloudOSSBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, false)
+}
+
+// ListObjectsRecursive lists all objects in Alibaba Cloud OSS bucket, at all depths below prefix
+func (b AlibabaCloudOSSBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, true)
+}
+
+func (b AlibabaCloudOSSBackend) listObjects(prefix string, recursive bool) ([]Object, error) {
 	var objects []Object
 
 	prefix = pathutil.Join(b.Prefix, prefix)
 	ossPrefix := oss.Prefix(prefix)
 	marker := oss.Marker("")
 	for {
-		lor, err := b.Bucket.ListObjects(oss.MaxKeys(50), marker, ossPrefix)
+		lor, err := b.Bucket.ListObjects(oss.MaxKeys(listPageSize(b.ListPageSize, 50)), marker, ossPrefix)
 		if err != nil {
 			return objects, err
 		}
 		for _, obj := range lor.Objects {
-			path := removePrefixFromObjectPath(prefix, obj.Key)
-			if objectPathIsInvalid(path) {
+			path, listed := listedObjectPath(prefix, obj.Key, recursive)
+			if !listed {
 				continue
 			}
 			object := Object{
 				Path:         path,
 				Content:      []byte{},
 				LastModified: obj.LastModified,
+				Size:         obj.Size,
 			}
 			objects = append(objects, object)
 		}
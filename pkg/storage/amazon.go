@@ -18,9 +18,13 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/url"
 	pathutil "path"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -36,8 +40,19 @@ type AmazonS3Backend struct {
 	Prefix     string
 	Uploader   *s3manager.Uploader
 	SSE        string
+	// SSEKMSKeyID is the KMS key objects are encrypted with, if SSE is "aws:kms"
+	SSEKMSKeyID string
+	// ListPageSize is the number of objects listed per request, 1000 (the maximum) by default
+	ListPageSize int
 }
 
+const (
+	// AmazonSSEAES256 is the SSE mode for encryption with keys managed by S3
+	AmazonSSEAES256 = "AES256"
+	// AmazonSSEKMS is the SSE mode for encryption with a KMS key
+	AmazonSSEKMS = "aws:kms"
+)
+
 // NewAmazonS3Backend creates a new instance of AmazonS3Backend
 func NewAmazonS3Backend(bucket string, prefix string, region string, endpoint string, sse string) *AmazonS3Backend {
 	service := s3.New(session.New(), &aws.Config{
@@ -59,11 +74,21 @@ func NewAmazonS3Backend(bucket string, prefix string, region string, endpoint st
 
 // ListObjects lists all objects in Amazon S3 bucket, at prefix
 func (b AmazonS3Backend) ListObjects(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, false)
+}
+
+// ListObjectsRecursive lists all objects in Amazon S3 bucket, at all depths below prefix
+func (b AmazonS3Backend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, true)
+}
+
+func (b AmazonS3Backend) listObjects(prefix string, recursive bool) ([]Object, error) {
 	var objects []Object
 	prefix = pathutil.Join(b.Prefix, prefix)
 	s3Input := &s3.ListObjectsInput{
-		Bucket: aws.String(b.Bucket),
-		Prefix: aws.String(prefix),
+		Bucket:  aws.String(b.Bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(listPageSize(b.ListPageSize, 1000))),
 	}
 	for {
 		s3Result, err := b.Client.ListObjects(s3Input)
@@ -71,14 +96,15 @@ func (b AmazonS3Backend) ListObjects(prefix string) ([]Object, error) {
 			return objects, err
 		}
 		for _, obj := range s3Result.Contents {
-			path := removePrefixFromObjectPath(prefix, *obj.Key)
-			if objectPathIsInvalid(path) {
+			path, listed := listedObjectPath(prefix, *obj.Key, recursive)
+			if !listed {
 				continue
 			}
 			object := Object{
 				Path:         path,
 				Content:      []byte{},
 				LastModified: *obj.LastModified,
+				Size:         aws.Int64Value(obj.Size),
 			}
 			objects = append(objects, object)
 		}
@@ -112,19 +138,83 @@ func (b AmazonS3Backend) GetObject(path string) (Object, error) {
 	return object, nil
 }
 
+// StatObject looks up an object in Amazon S3 bucket, at prefix, with a HEAD request
+func (b AmazonS3Backend) StatObject(path string) (Object, error) {
+	object := Object{Path: path, Content: []byte{}}
+	s3Result, err := b.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(pathutil.Join(b.Prefix, path)),
+	})
+	if err != nil {
+		return object, err
+	}
+	object.LastModified = aws.TimeValue(s3Result.LastModified)
+	object.Size = aws.Int64Value(s3Result.ContentLength)
+	return object, nil
+}
+
 // PutObject uploads an object to Amazon S3 bucket, at prefix
 func (b AmazonS3Backend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewBuffer(content))
+}
+
+// PutObjectStream uploads an object to Amazon S3 bucket, at prefix, reading it from content.
+// Large objects are sent as a multipart upload, which is aborted if reading fails
+func (b AmazonS3Backend) PutObjectStream(path string, content io.Reader) error {
+	_, err := b.Uploader.Upload(b.uploadInput(path, content))
+	return err
+}
+
+// uploadInput builds the upload of an object, with the server side encryption headers
+func (b AmazonS3Backend) uploadInput(path string, content io.Reader) *s3manager.UploadInput {
 	s3Input := &s3manager.UploadInput{
 		Bucket: aws.String(b.Bucket),
 		Key:    aws.String(pathutil.Join(b.Prefix, path)),
-		Body:   bytes.NewBuffer(content),
+		Body:   content,
 	}
 
 	if b.SSE != "" {
 		s3Input.ServerSideEncryption = aws.String(b.SSE)
 	}
+	if b.SSEKMSKeyID != "" {
+		s3Input.SSEKMSKeyId = aws.String(b.SSEKMSKeyID)
+	}
+	return s3Input
+}
+
+// ValidateSSE checks the server side encryption settings: SSE must be empty, AES256 or
+// aws:kms, and a KMS key ID is required with aws:kms (and only allowed with it)
+func (b AmazonS3Backend) ValidateSSE() error {
+	switch b.SSE {
+	case "", AmazonSSEAES256:
+		if b.SSEKMSKeyID != "" {
+			return fmt.Errorf("a KMS key ID can only be used with %s server side encryption", AmazonSSEKMS)
+		}
+	case AmazonSSEKMS:
+		if b.SSEKMSKeyID == "" {
+			return fmt.Errorf("%s server side encryption requires a KMS key ID", AmazonSSEKMS)
+		}
+	default:
+		return fmt.Errorf("unsupported server side encryption: %s (must be %s or %s)", b.SSE, AmazonSSEAES256, AmazonSSEKMS)
+	}
+	return nil
+}
 
-	_, err := b.Uploader.Upload(s3Input)
+// CopyObject copies an object to another path in Amazon S3 bucket, at prefix, within S3.
+// The copy gets the same server side encryption as uploads
+func (b AmazonS3Backend) CopyObject(srcPath string, dstPath string) error {
+	s3Input := &s3.CopyObjectInput{
+		Bucket:     aws.String(b.Bucket),
+		CopySource: aws.String(url.PathEscape(b.Bucket + "/" + pathutil.Join(b.Prefix, srcPath))),
+		Key:        aws.String(pathutil.Join(b.Prefix, dstPath)),
+	}
+	if b.SSE != "" {
+		s3Input.ServerSideEncryption = aws.String(b.SSE)
+	}
+	if b.SSEKMSKeyID != "" {
+		s3Input.SSEKMSKeyId = aws.String(b.SSEKMSKeyID)
+	}
+	_, err := b.Client.CopyObject(s3Input)
 	return err
 }
 
@@ -137,3 +227,13 @@ func (b AmazonS3Backend) DeleteObject(path string) error {
 	_, err := b.Client.DeleteObject(s3Input)
 	return err
 }
+
+// PresignedURL returns a URL for downloading an object from Amazon S3 bucket, at prefix,
+// which is valid for the given duration
+func (b AmazonS3Backend) PresignedURL(path string, expires time.Duration) (string, error) {
+	req, _ := b.Client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(pathutil.Join(b.Prefix, path)),
+	})
+	return req.Presign(expires)
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package storage
 
 import (
+	"bytes"
 	"os"
 	"testing"
 
@@ -84,6 +85,48 @@ func (suite *AmazonTestSuite) TestPutObject() {
 	suite.NotNil(err, "cannot put objects with bad bucket")
 }
 
+type AmazonSSETestSuite struct {
+	suite.Suite
+}
+
+func (suite *AmazonSSETestSuite) TestValidateSSE() {
+	backend := NewAmazonS3Backend("bucket", "", "us-east-1", "", "")
+	suite.Nil(backend.ValidateSSE(), "no server side encryption is valid")
+
+	backend.SSE = AmazonSSEAES256
+	suite.Nil(backend.ValidateSSE(), "AES256 is valid")
+
+	backend.SSEKMSKeyID = "my-key-id"
+	suite.NotNil(backend.ValidateSSE(), "KMS key ID is not valid with AES256")
+
+	backend.SSE = AmazonSSEKMS
+	suite.Nil(backend.ValidateSSE(), "aws:kms with a KMS key ID is valid")
+
+	backend.SSEKMSKeyID = ""
+	suite.NotNil(backend.ValidateSSE(), "aws:kms without a KMS key ID is not valid")
+
+	backend.SSE = "KMS"
+	suite.NotNil(backend.ValidateSSE(), "unknown mode is not valid")
+}
+
+func (suite *AmazonSSETestSuite) TestUploadInput() {
+	backend := NewAmazonS3Backend("bucket", "prefix", "us-east-1", "", "")
+	input := backend.uploadInput("mychart-0.1.0.tgz", bytes.NewBufferString("content"))
+	suite.Equal("prefix/mychart-0.1.0.tgz", *input.Key)
+	suite.Nil(input.ServerSideEncryption, "no encryption header without SSE")
+	suite.Nil(input.SSEKMSKeyId, "no KMS key header without SSE")
+
+	backend.SSE = AmazonSSEKMS
+	backend.SSEKMSKeyID = "my-key-id"
+	input = backend.uploadInput("mychart-0.1.0.tgz", bytes.NewBufferString("content"))
+	suite.Equal(AmazonSSEKMS, *input.ServerSideEncryption, "encryption header set")
+	suite.Equal("my-key-id", *input.SSEKMSKeyId, "KMS key header set")
+}
+
+func TestAmazonSSETestSuite(t *testing.T) {
+	suite.Run(t, new(AmazonSSETestSuite))
+}
+
 func TestAmazonStorageTestSuite(t *testing.T) {
 	if os.Getenv("TEST_CLOUD_STORAGE") == "1" &&
 		os.Getenv("TEST_STORAGE_AMAZON_BUCKET") != "" &&
@@ -0,0 +1,594 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	pathutil "path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	backblazeB2AuthURL = "https://api.backblazeb2.com"
+	backblazeB2APIPath = "/b2api/v2/"
+
+	// used if B2 does not recommend a part size
+	backblazeB2DefaultPartSize = 100 * 1024 * 1024
+)
+
+type (
+	// BackblazeB2Backend is a storage backend for Backblaze B2
+	BackblazeB2Backend struct {
+		Bucket         string
+		Prefix         string
+		KeyID          string
+		ApplicationKey string
+		// PartSize is the size of each part of a large file upload. Files up to this size
+		// are uploaded in a single request. Defaults to the part size recommended by B2
+		PartSize int64
+		// ListPageSize is the number of files listed per request, 1000 by default. B2 bills
+		// each 1000 files listed as a transaction, and lists at most 10000 per request
+		ListPageSize int
+		Client       *http.Client
+		authURL      string
+		mu           sync.Mutex
+		auth         *b2Authorization
+		bucketID     string
+	}
+
+	b2Authorization struct {
+		AccountID           string `json:"accountId"`
+		AuthorizationToken  string `json:"authorizationToken"`
+		APIURL              string `json:"apiUrl"`
+		DownloadURL         string `json:"downloadUrl"`
+		RecommendedPartSize int64  `json:"recommendedPartSize"`
+		Allowed             struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"allowed"`
+	}
+
+	// b2Error is the body of a B2 error response
+	b2Error struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	b2File struct {
+		FileID          string `json:"fileId"`
+		FileName        string `json:"fileName"`
+		Action          string `json:"action"`
+		UploadTimestamp int64  `json:"uploadTimestamp"`
+		ContentLength   int64  `json:"contentLength"`
+	}
+
+	b2FileList struct {
+		Files        []b2File `json:"files"`
+		NextFileName *string  `json:"nextFileName"`
+		NextFileID   *string  `json:"nextFileId"`
+	}
+
+	b2UploadURL struct {
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+)
+
+// NewBackblazeB2Backend creates a new instance of BackblazeB2Backend
+func NewBackblazeB2Backend(bucket string, prefix string, keyID string, applicationKey string) *BackblazeB2Backend {
+	b := newBackblazeB2Backend(backblazeB2AuthURL, bucket, prefix, keyID, applicationKey)
+	if err := b.authorize(); err != nil {
+		panic(fmt.Sprintf("Backblaze B2 (authorize): %s", err))
+	}
+	return b
+}
+
+func newBackblazeB2Backend(authURL string, bucket string, prefix string, keyID string, applicationKey string) *BackblazeB2Backend {
+	return &BackblazeB2Backend{
+		Bucket:         bucket,
+		Prefix:         cleanPrefix(prefix),
+		KeyID:          keyID,
+		ApplicationKey: applicationKey,
+		Client:         &http.Client{Timeout: 5 * time.Minute},
+		authURL:        authURL,
+	}
+}
+
+// ListObjects lists all objects in Backblaze B2 bucket, at prefix
+func (b *BackblazeB2Backend) ListObjects(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, false)
+}
+
+// ListObjectsRecursive lists all objects in Backblaze B2 bucket, at all depths below prefix
+func (b *BackblazeB2Backend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, true)
+}
+
+func (b *BackblazeB2Backend) listObjects(prefix string, recursive bool) ([]Object, error) {
+	var objects []Object
+
+	bucketID, err := b.getBucketID()
+	if err != nil {
+		return objects, err
+	}
+
+	prefix = pathutil.Join(b.Prefix, prefix)
+	request := map[string]interface{}{
+		"bucketId":     bucketID,
+		"prefix":       prefix,
+		"maxFileCount": listPageSize(b.ListPageSize, 1000),
+	}
+	for {
+		var list b2FileList
+		if err := b.call("b2_list_file_names", request, &list); err != nil {
+			return objects, err
+		}
+		for _, file := range list.Files {
+			if file.Action != "upload" {
+				continue
+			}
+			path, listed := listedObjectPath(prefix, file.FileName, recursive)
+			if !listed {
+				continue
+			}
+			object := Object{
+				Path:         path,
+				Content:      []byte{},
+				LastModified: b2Time(file.UploadTimestamp),
+				Size:         file.ContentLength,
+			}
+			objects = append(objects, object)
+		}
+		if list.NextFileName == nil {
+			break
+		}
+		request["startFileName"] = *list.NextFileName
+	}
+
+	return objects, nil
+}
+
+// GetObject retrieves an object from Backblaze B2 bucket, at prefix
+func (b *BackblazeB2Backend) GetObject(path string) (Object, error) {
+	var object Object
+	object.Path = path
+
+	name := pathutil.Join(b.Prefix, path)
+	resp, err := b.download(name)
+	if isB2AuthError(err) {
+		if err = b.authorize(); err == nil {
+			resp, err = b.download(name)
+		}
+	}
+	if err != nil {
+		return object, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return object, err
+	}
+	object.Content = content
+	if timestamp, err := strconv.ParseInt(resp.Header.Get("X-Bz-Upload-Timestamp"), 10, 64); err == nil {
+		object.LastModified = b2Time(timestamp)
+	}
+	return object, nil
+}
+
+// PutObject uploads an object to Backblaze B2 bucket, at prefix
+func (b *BackblazeB2Backend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// PutObjectStream uploads an object to Backblaze B2 bucket, at prefix, reading it from content.
+// Objects larger than PartSize are sent with the large file API, one part at a time, so that
+// only a couple of parts are held in memory
+func (b *BackblazeB2Backend) PutObjectStream(path string, content io.Reader) error {
+	name := pathutil.Join(b.Prefix, path)
+	partSize := b.partSize()
+
+	first, err := readB2Part(content, partSize)
+	if err != nil {
+		return err
+	}
+	second, err := readB2Part(content, partSize)
+	if err != nil {
+		return err
+	}
+	if len(second) == 0 {
+		return b.uploadFile(name, first)
+	}
+	return b.uploadLargeFile(name, [][]byte{first, second}, content, partSize)
+}
+
+// DeleteObject removes an object from Backblaze B2 bucket, at prefix. All versions of
+// the file are deleted, so that an older version does not take its place
+func (b *BackblazeB2Backend) DeleteObject(path string) error {
+	name := pathutil.Join(b.Prefix, path)
+	versions, err := b.fileVersions(name)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("b2: file %s not found", name)
+	}
+	for _, version := range versions {
+		request := map[string]string{
+			"fileName": version.FileName,
+			"fileId":   version.FileID,
+		}
+		if err := b.call("b2_delete_file_version", request, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BackblazeB2Backend) fileVersions(name string) ([]b2File, error) {
+	bucketID, err := b.getBucketID()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []b2File
+	request := map[string]interface{}{
+		"bucketId":      bucketID,
+		"prefix":        name,
+		"startFileName": name,
+		"maxFileCount":  1000,
+	}
+	for {
+		var list b2FileList
+		if err := b.call("b2_list_file_versions", request, &list); err != nil {
+			return nil, err
+		}
+		for _, file := range list.Files {
+			if file.FileName == name {
+				versions = append(versions, file)
+			}
+		}
+		if list.NextFileName == nil || *list.NextFileName != name || list.NextFileID == nil {
+			break
+		}
+		request["startFileId"] = *list.NextFileID
+	}
+	return versions, nil
+}
+
+func (b *BackblazeB2Backend) uploadFile(name string, content []byte) error {
+	bucketID, err := b.getBucketID()
+	if err != nil {
+		return err
+	}
+	getUploadURL := func(uploadURL *b2UploadURL, retry bool) error {
+		return b.call("b2_get_upload_url", map[string]string{"bucketId": bucketID}, uploadURL)
+	}
+	headers := map[string]string{
+		"X-Bz-File-Name": escapeB2FileName(name),
+		"Content-Type":   "b2/x-auto",
+	}
+	_, err = b.upload(getUploadURL, content, headers)
+	return err
+}
+
+// uploadLargeFile uploads the parts already read, then the rest of content one part at a
+// time. If anything fails, the large file is cancelled so that its parts are not kept
+func (b *BackblazeB2Backend) uploadLargeFile(name string, parts [][]byte, content io.Reader, partSize int64) error {
+	bucketID, err := b.getBucketID()
+	if err != nil {
+		return err
+	}
+	var largeFile b2File
+	request := map[string]string{
+		"bucketId":    bucketID,
+		"fileName":    name,
+		"contentType": "b2/x-auto",
+	}
+	if err := b.call("b2_start_large_file", request, &largeFile); err != nil {
+		return err
+	}
+
+	err = b.uploadParts(largeFile.FileID, parts, content, partSize)
+	if err != nil {
+		b.call("b2_cancel_large_file", map[string]string{"fileId": largeFile.FileID}, nil)
+	}
+	return err
+}
+
+func (b *BackblazeB2Backend) uploadParts(fileID string, parts [][]byte, content io.Reader, partSize int64) error {
+	// the part upload URL is reused for each part, until it fails
+	var partURL b2UploadURL
+	getUploadURL := func(uploadURL *b2UploadURL, retry bool) error {
+		if partURL.UploadURL == "" || retry {
+			if err := b.call("b2_get_upload_part_url", map[string]string{"fileId": fileID}, &partURL); err != nil {
+				return err
+			}
+		}
+		*uploadURL = partURL
+		return nil
+	}
+
+	var sha1s []string
+	for partNumber := 1; ; partNumber++ {
+		var part []byte
+		if len(parts) > 0 {
+			part, parts = parts[0], parts[1:]
+		} else {
+			var err error
+			if part, err = readB2Part(content, partSize); err != nil {
+				return err
+			}
+			if len(part) == 0 {
+				break
+			}
+		}
+
+		headers := map[string]string{"X-Bz-Part-Number": strconv.Itoa(partNumber)}
+		sha1, err := b.upload(getUploadURL, part, headers)
+		if err != nil {
+			return err
+		}
+		sha1s = append(sha1s, sha1)
+	}
+
+	request := map[string]interface{}{
+		"fileId":        fileID,
+		"partSha1Array": sha1s,
+	}
+	return b.call("b2_finish_large_file", request, nil)
+}
+
+// upload POSTs content to an upload URL, returning its sha1. As recommended by B2, a new
+// upload URL is fetched and the upload tried again once if the upload URL fails
+func (b *BackblazeB2Backend) upload(getUploadURL func(uploadURL *b2UploadURL, retry bool) error, content []byte, headers map[string]string) (string, error) {
+	digest := sha1.Sum(content)
+	sha1 := hex.EncodeToString(digest[:])
+
+	var err error
+	for attempt := 1; attempt <= 2; attempt++ {
+		var uploadURL b2UploadURL
+		if err = getUploadURL(&uploadURL, attempt > 1); err != nil {
+			return "", err
+		}
+		var req *http.Request
+		req, err = http.NewRequest("POST", uploadURL.UploadURL, bytes.NewReader(content))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", uploadURL.AuthorizationToken)
+		req.Header.Set("X-Bz-Content-Sha1", sha1)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		err = b.do(req, nil)
+		if b2Err, ok := err.(*b2Error); !ok || (b2Err.Status != http.StatusUnauthorized && b2Err.Status < 500) {
+			break
+		}
+	}
+	return sha1, err
+}
+
+func (b *BackblazeB2Backend) download(name string) (*http.Response, error) {
+	auth, err := b.authorization()
+	if err != nil {
+		return nil, err
+	}
+	downloadURL := fmt.Sprintf("%s/file/%s/%s", auth.DownloadURL, url.PathEscape(b.Bucket), escapeB2FileName(name))
+	req, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, decodeB2Error(resp)
+	}
+	return resp, nil
+}
+
+// call makes a B2 API call, authorizing again (once) if the authorization token has expired
+func (b *BackblazeB2Backend) call(name string, request interface{}, response interface{}) error {
+	err := b.callOnce(name, request, response)
+	if isB2AuthError(err) {
+		if err = b.authorize(); err == nil {
+			err = b.callOnce(name, request, response)
+		}
+	}
+	return err
+}
+
+func (b *BackblazeB2Backend) callOnce(name string, request interface{}, response interface{}) error {
+	auth, err := b.authorization()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", auth.APIURL+backblazeB2APIPath+name, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	return b.do(req, response)
+}
+
+// do sends a request and decodes the JSON response into response, if not nil
+func (b *BackblazeB2Backend) do(req *http.Request, response interface{}) error {
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decodeB2Error(resp)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// authorize gets a new authorization token, and looks up the bucket ID the first time
+func (b *BackblazeB2Backend) authorize() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	req, err := http.NewRequest("GET", b.authURL+backblazeB2APIPath+"b2_authorize_account", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.KeyID, b.ApplicationKey)
+	auth := &b2Authorization{}
+	if err := b.do(req, auth); err != nil {
+		return err
+	}
+	if b.bucketID == "" {
+		bucketID, err := b.lookupBucketID(auth)
+		if err != nil {
+			return err
+		}
+		b.bucketID = bucketID
+	}
+	b.auth = auth
+	return nil
+}
+
+func (b *BackblazeB2Backend) lookupBucketID(auth *b2Authorization) (string, error) {
+	if auth.Allowed.BucketID != "" && auth.Allowed.BucketName == b.Bucket {
+		return auth.Allowed.BucketID, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"accountId":  auth.AccountID,
+		"bucketName": b.Bucket,
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", auth.APIURL+backblazeB2APIPath+"b2_list_buckets", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	var buckets struct {
+		Buckets []struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"buckets"`
+	}
+	if err := b.do(req, &buckets); err != nil {
+		return "", err
+	}
+	for _, bucket := range buckets.Buckets {
+		if bucket.BucketName == b.Bucket {
+			return bucket.BucketID, nil
+		}
+	}
+	return "", fmt.Errorf("b2: bucket %s not found", b.Bucket)
+}
+
+func (b *BackblazeB2Backend) authorization() (*b2Authorization, error) {
+	b.mu.Lock()
+	auth := b.auth
+	b.mu.Unlock()
+	if auth != nil {
+		return auth, nil
+	}
+	if err := b.authorize(); err != nil {
+		return nil, err
+	}
+	return b.authorization()
+}
+
+func (b *BackblazeB2Backend) getBucketID() (string, error) {
+	if _, err := b.authorization(); err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bucketID, nil
+}
+
+func (b *BackblazeB2Backend) partSize() int64 {
+	if b.PartSize > 0 {
+		return b.PartSize
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.auth != nil && b.auth.RecommendedPartSize > 0 {
+		return b.auth.RecommendedPartSize
+	}
+	return backblazeB2DefaultPartSize
+}
+
+func (e *b2Error) Error() string {
+	return fmt.Sprintf("b2: %s (%d %s)", e.Message, e.Status, e.Code)
+}
+
+func decodeB2Error(resp *http.Response) error {
+	b2Err := &b2Error{}
+	json.NewDecoder(resp.Body).Decode(b2Err)
+	b2Err.Status = resp.StatusCode
+	if b2Err.Message == "" {
+		b2Err.Message = http.StatusText(resp.StatusCode)
+	}
+	return b2Err
+}
+
+func isB2AuthError(err error) bool {
+	b2Err, ok := err.(*b2Error)
+	return ok && b2Err.Status == http.StatusUnauthorized &&
+		(b2Err.Code == "expired_auth_token" || b2Err.Code == "bad_auth_token")
+}
+
+// readB2Part reads up to partSize bytes of content, returning an empty part at the end
+func readB2Part(content io.Reader, partSize int64) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := io.CopyN(buf, content, partSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// escapeB2FileName percent-encodes a file name for a URL or the X-Bz-File-Name header,
+// keeping the slashes
+func escapeB2FileName(name string) string {
+	return (&url.URL{Path: name}).EscapedPath()
+}
+
+// b2Time converts a B2 timestamp, in milliseconds since the epoch
+func b2Time(timestamp int64) time.Time {
+	return time.Unix(0, timestamp*int64(time.Millisecond))
+}
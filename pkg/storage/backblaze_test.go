@@ -0,0 +1,467 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type BackblazeTestSuite struct {
+	suite.Suite
+	Server          *httptest.Server
+	B2              *mockB2
+	NoPrefixBackend *BackblazeB2Backend
+	PrefixBackend   *BackblazeB2Backend
+}
+
+// mockB2 is an in-memory implementation of the parts of the B2 API used by BackblazeB2Backend
+type mockB2 struct {
+	sync.Mutex
+	url            string
+	token          int
+	authorizations int
+	nextID         int
+	files          []*mockB2File
+	largeFiles     map[string]*mockB2LargeFile
+	cancelled      int
+	// pagedByRequest lists the maxFileCount asked for per page rather than two files,
+	// each page taking listLatency as a round trip to B2 would
+	pagedByRequest bool
+	listLatency    time.Duration
+}
+
+type mockB2File struct {
+	b2File
+	content []byte
+}
+
+type mockB2LargeFile struct {
+	name  string
+	parts map[int][]byte
+}
+
+func (m *mockB2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	switch {
+	case r.URL.Path == backblazeB2APIPath+"b2_authorize_account":
+		if keyID, key, ok := r.BasicAuth(); !ok || keyID != "keyid" || key != "key" {
+			m.error(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		m.token++
+		m.authorizations++
+		m.json(w, map[string]interface{}{
+			"accountId":           "account",
+			"authorizationToken":  m.currentToken(),
+			"apiUrl":              m.url,
+			"downloadUrl":         m.url,
+			"recommendedPartSize": 100 * 1024 * 1024,
+		})
+		return
+	case r.URL.Path == "/upload" || r.URL.Path == "/upload_part":
+		m.upload(w, r)
+		return
+	}
+
+	if r.Header.Get("Authorization") != m.currentToken() {
+		m.error(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/file/bucket/") {
+		name, _ := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/file/bucket/"))
+		file := m.latest(name)
+		if file == nil {
+			m.error(w, http.StatusNotFound, "not_found")
+			return
+		}
+		w.Header().Set("X-Bz-Upload-Timestamp", strconv.FormatInt(file.UploadTimestamp, 10))
+		w.Write(file.content)
+		return
+	}
+
+	var request map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&request)
+	str := func(key string) string {
+		s, _ := request[key].(string)
+		return s
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, backblazeB2APIPath) {
+	case "b2_list_buckets":
+		m.json(w, map[string]interface{}{
+			"buckets": []map[string]string{
+				{"bucketId": "otherid", "bucketName": "other"},
+				{"bucketId": "bucketid", "bucketName": "bucket"},
+			},
+		})
+	case "b2_list_file_names":
+		var files []b2File
+		for _, file := range m.files {
+			if strings.HasPrefix(file.FileName, str("prefix")) && file.FileName >= str("startFileName") &&
+				file == m.latest(file.FileName) {
+				files = append(files, file.b2File)
+			}
+		}
+		// page by two files, to exercise nextFileName
+		pageSize := 2
+		if m.pagedByRequest {
+			maxFileCount, _ := request["maxFileCount"].(float64)
+			pageSize = int(maxFileCount)
+			time.Sleep(m.listLatency)
+		}
+		var next *string
+		if len(files) > pageSize {
+			next = &files[pageSize].FileName
+			files = files[:pageSize]
+		}
+		m.json(w, map[string]interface{}{"files": files, "nextFileName": next})
+	case "b2_list_file_versions":
+		var files []b2File
+		for _, file := range m.files {
+			if strings.HasPrefix(file.FileName, str("prefix")) && file.FileName >= str("startFileName") &&
+				(str("startFileId") == "" || file.FileName != str("startFileName") || file.FileID >= str("startFileId")) {
+				files = append(files, file.b2File)
+			}
+		}
+		var nextName, nextID *string
+		if len(files) > 1 {
+			nextName, nextID = &files[1].FileName, &files[1].FileID
+			files = files[:1]
+		}
+		m.json(w, map[string]interface{}{"files": files, "nextFileName": nextName, "nextFileId": nextID})
+	case "b2_delete_file_version":
+		for i, file := range m.files {
+			if file.FileID == str("fileId") && file.FileName == str("fileName") {
+				m.files = append(m.files[:i], m.files[i+1:]...)
+				m.json(w, file.b2File)
+				return
+			}
+		}
+		m.error(w, http.StatusBadRequest, "file_not_present")
+	case "b2_get_upload_url":
+		if str("bucketId") != "bucketid" {
+			m.error(w, http.StatusBadRequest, "bad_bucket_id")
+			return
+		}
+		m.json(w, b2UploadURL{UploadURL: m.url + "/upload", AuthorizationToken: "upload-" + m.currentToken()})
+	case "b2_start_large_file":
+		id := m.newID()
+		m.largeFiles[id] = &mockB2LargeFile{name: str("fileName"), parts: map[int][]byte{}}
+		m.json(w, b2File{FileID: id, FileName: str("fileName")})
+	case "b2_get_upload_part_url":
+		m.json(w, b2UploadURL{UploadURL: m.url + "/upload_part?fileId=" + str("fileId"), AuthorizationToken: "upload-" + m.currentToken()})
+	case "b2_finish_large_file":
+		largeFile, ok := m.largeFiles[str("fileId")]
+		if !ok {
+			m.error(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		sha1s, _ := request["partSha1Array"].([]interface{})
+		if len(sha1s) < 2 || len(sha1s) != len(largeFile.parts) {
+			m.error(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		var content []byte
+		for i := range sha1s {
+			content = append(content, largeFile.parts[i+1]...)
+		}
+		delete(m.largeFiles, str("fileId"))
+		m.json(w, m.addFile(largeFile.name, content).b2File)
+	case "b2_cancel_large_file":
+		delete(m.largeFiles, str("fileId"))
+		m.cancelled++
+		m.json(w, map[string]string{"fileId": str("fileId")})
+	default:
+		m.error(w, http.StatusBadRequest, "bad_request")
+	}
+}
+
+func (m *mockB2) upload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "upload-"+m.currentToken() {
+		m.error(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+	content, _ := ioutil.ReadAll(r.Body)
+	digest := sha1.Sum(content)
+	if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(digest[:]) {
+		m.error(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+
+	if r.URL.Path == "/upload_part" {
+		largeFile, ok := m.largeFiles[r.URL.Query().Get("fileId")]
+		partNumber, err := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		if !ok || err != nil {
+			m.error(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		largeFile.parts[partNumber] = content
+		m.json(w, map[string]interface{}{"partNumber": partNumber})
+		return
+	}
+
+	name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil || r.Header.Get("Content-Type") != "b2/x-auto" {
+		m.error(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	m.json(w, m.addFile(name, content).b2File)
+}
+
+func (m *mockB2) addFile(name string, content []byte) *mockB2File {
+	file := &mockB2File{
+		b2File: b2File{
+			FileID:          m.newID(),
+			FileName:        name,
+			Action:          "upload",
+			UploadTimestamp: 1500000000000 + int64(m.nextID),
+		},
+		content: content,
+	}
+	m.files = append(m.files, file)
+	// keep the files sorted by name then id, as B2 does
+	sort.SliceStable(m.files, func(i, j int) bool {
+		if m.files[i].FileName != m.files[j].FileName {
+			return m.files[i].FileName < m.files[j].FileName
+		}
+		return m.files[i].FileID < m.files[j].FileID
+	})
+	return file
+}
+
+func (m *mockB2) latest(name string) *mockB2File {
+	var latest *mockB2File
+	for _, file := range m.files {
+		if file.FileName == name && (latest == nil || file.UploadTimestamp > latest.UploadTimestamp) {
+			latest = file
+		}
+	}
+	return latest
+}
+
+func (m *mockB2) newID() string {
+	m.nextID++
+	return fmt.Sprintf("id%06d", m.nextID)
+}
+
+func (m *mockB2) currentToken() string {
+	return fmt.Sprintf("token%d", m.token)
+}
+
+func (m *mockB2) expireToken() {
+	m.Lock()
+	defer m.Unlock()
+	m.token++
+}
+
+func (m *mockB2) json(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (m *mockB2) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(b2Error{Status: status, Code: code, Message: code})
+}
+
+func (suite *BackblazeTestSuite) SetupTest() {
+	suite.B2 = &mockB2{largeFiles: map[string]*mockB2LargeFile{}}
+	suite.Server = httptest.NewServer(suite.B2)
+	suite.B2.url = suite.Server.URL
+
+	suite.NoPrefixBackend = newBackblazeB2Backend(suite.Server.URL, "bucket", "", "keyid", "key")
+	suite.PrefixBackend = newBackblazeB2Backend(suite.Server.URL, "bucket", "/some/prefix/", "keyid", "key")
+}
+
+func (suite *BackblazeTestSuite) TearDownTest() {
+	suite.Server.Close()
+}
+
+func (suite *BackblazeTestSuite) TestAuthorize() {
+	err := suite.NoPrefixBackend.authorize()
+	suite.Nil(err, "no error authorizing")
+	suite.Equal("bucketid", suite.NoPrefixBackend.bucketID, "bucket ID is looked up")
+
+	backend := newBackblazeB2Backend(suite.Server.URL, "bucket", "", "keyid", "badkey")
+	err = backend.authorize()
+	suite.NotNil(err, "error authorizing with a bad key")
+
+	backend = newBackblazeB2Backend(suite.Server.URL, "fake-bucket-cant-exist-fbce123", "", "keyid", "key")
+	err = backend.authorize()
+	suite.NotNil(err, "error authorizing with a bucket which does not exist")
+	_, err = backend.ListObjects("")
+	suite.NotNil(err, "cannot list objects with a bucket which does not exist")
+}
+
+func (suite *BackblazeTestSuite) TestObjects() {
+	for _, backend := range []*BackblazeB2Backend{suite.NoPrefixBackend, suite.PrefixBackend} {
+		for i := 0; i < 5; i++ {
+			err := backend.PutObject(fmt.Sprintf("%ddeleteme.txt", i), []byte("some object"))
+			suite.Nil(err, "no error putting deleteme.txt using Backblaze B2 backend")
+		}
+		err := backend.PutObject("some dir/chart+1.tgz", []byte("in a dir"))
+		suite.Nil(err, "no error putting a file name to escape using Backblaze B2 backend")
+
+		objects, err := backend.ListObjects("")
+		suite.Nil(err, "no error listing objects using Backblaze B2 backend")
+		suite.Len(objects, 5, "all objects at the top level listed, across pages")
+		for _, object := range objects {
+			suite.True(strings.HasSuffix(object.Path, "deleteme.txt"), "object path has the prefix removed")
+			suite.False(object.LastModified.IsZero(), "object has a last modified time")
+		}
+
+		object, err := backend.GetObject("3deleteme.txt")
+		suite.Nil(err, "no error getting 3deleteme.txt using Backblaze B2 backend")
+		suite.Equal([]byte("some object"), object.Content, "object content is returned")
+		suite.False(object.LastModified.IsZero(), "object has a last modified time")
+
+		object, err = backend.GetObject("some dir/chart+1.tgz")
+		suite.Nil(err, "no error getting a file name to escape using Backblaze B2 backend")
+		suite.Equal([]byte("in a dir"), object.Content, "object content is returned")
+
+		_, err = backend.GetObject("does-not-exist.txt")
+		suite.NotNil(err, "error getting an object which does not exist")
+	}
+
+	suite.NotNil(suite.B2.latest("some/prefix/0deleteme.txt"), "objects stored at the prefix")
+}
+
+func (suite *BackblazeTestSuite) TestDeleteObject() {
+	backend := suite.PrefixBackend
+	for i := 0; i < 3; i++ {
+		err := backend.PutObject("deleteme.txt", []byte(fmt.Sprintf("version %d", i)))
+		suite.Nil(err, "no error putting a new version of deleteme.txt")
+	}
+	err := backend.PutObject("deleteme.txt.prov", []byte("keep me"))
+	suite.Nil(err, "no error putting deleteme.txt.prov")
+
+	object, err := backend.GetObject("deleteme.txt")
+	suite.Nil(err, "no error getting deleteme.txt")
+	suite.Equal([]byte("version 2"), object.Content, "latest version is returned")
+
+	err = backend.DeleteObject("deleteme.txt")
+	suite.Nil(err, "no error deleting deleteme.txt")
+	_, err = backend.GetObject("deleteme.txt")
+	suite.NotNil(err, "no older version of deleteme.txt left in its place")
+	_, err = backend.GetObject("deleteme.txt.prov")
+	suite.Nil(err, "deleteme.txt.prov is not deleted")
+	suite.Len(suite.B2.files, 1, "all versions of deleteme.txt deleted")
+
+	err = backend.DeleteObject("deleteme.txt")
+	suite.NotNil(err, "error deleting an object which does not exist")
+}
+
+func (suite *BackblazeTestSuite) TestPutLargeObject() {
+	backend := suite.NoPrefixBackend
+	backend.PartSize = 10
+
+	content := []byte("a chart package of 35 bytes, or so.")
+	err := backend.PutObjectStream("large.tgz", bytes.NewReader(content))
+	suite.Nil(err, "no error putting a large object")
+	suite.Len(suite.B2.largeFiles, 0, "large file finished")
+
+	object, err := backend.GetObject("large.tgz")
+	suite.Nil(err, "no error getting a large object")
+	suite.Equal(content, object.Content, "large object parts are put together")
+
+	err = backend.PutObject("exact.tgz", content[:10])
+	suite.Nil(err, "no error putting an object of exactly one part")
+	object, err = backend.GetObject("exact.tgz")
+	suite.Nil(err, "no error getting an object of exactly one part")
+	suite.Equal(content[:10], object.Content, "object of exactly one part is put in a single request")
+
+	err = backend.PutObjectStream("failing.tgz", io.MultiReader(bytes.NewReader(content[:25]), &failingReader{}))
+	suite.NotNil(err, "error putting a large object when reading fails")
+	suite.Equal(1, suite.B2.cancelled, "large file cancelled")
+	_, err = backend.GetObject("failing.tgz")
+	suite.NotNil(err, "large object not stored when reading fails")
+}
+
+func (suite *BackblazeTestSuite) TestExpiredAuthorization() {
+	backend := suite.NoPrefixBackend
+	err := backend.PutObject("deleteme.txt", []byte("some object"))
+	suite.Nil(err, "no error putting deleteme.txt")
+	suite.Equal(1, suite.B2.authorizations, "authorized once")
+
+	suite.B2.expireToken()
+	_, err = backend.ListObjects("")
+	suite.Nil(err, "no error listing objects once the authorization token has expired")
+	suite.Equal(2, suite.B2.authorizations, "authorized again")
+
+	suite.B2.expireToken()
+	_, err = backend.GetObject("deleteme.txt")
+	suite.Nil(err, "no error getting deleteme.txt once the authorization token has expired")
+
+	suite.B2.expireToken()
+	err = backend.PutObject("deleteme.txt", []byte("some object"))
+	suite.Nil(err, "no error putting deleteme.txt once the authorization token has expired")
+
+	suite.B2.expireToken()
+	err = backend.DeleteObject("deleteme.txt")
+	suite.Nil(err, "no error deleting deleteme.txt once the authorization token has expired")
+	suite.Equal(5, suite.B2.authorizations, "authorized again for each expired token")
+}
+
+// BenchmarkListPageSize lists a repo of 1000 chart packages with different page sizes, each
+// request to list a page taking a millisecond
+func BenchmarkListPageSize(b *testing.B) {
+	b2 := &mockB2{largeFiles: map[string]*mockB2LargeFile{}, pagedByRequest: true, listLatency: time.Millisecond}
+	server := httptest.NewServer(b2)
+	defer server.Close()
+	b2.url = server.URL
+	for i := 0; i < 1000; i++ {
+		b2.addFile(fmt.Sprintf("mychart-0.1.%d.tgz", i), []byte{})
+	}
+
+	for _, pageSize := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("%d", pageSize), func(b *testing.B) {
+			backend := newBackblazeB2Backend(server.URL, "bucket", "", "keyid", "key")
+			backend.ListPageSize = pageSize
+			for i := 0; i < b.N; i++ {
+				objects, err := backend.ListObjects("")
+				if err != nil || len(objects) != 1000 {
+					b.Fatalf("listed %d objects: %v", len(objects), err)
+				}
+			}
+		})
+	}
+}
+
+func TestBackblazeStorageTestSuite(t *testing.T) {
+	suite.Run(t, new(BackblazeTestSuite))
+}
@@ -17,19 +17,26 @@ limitations under the License.
 package storage
 
 import (
+	"io"
 	"io/ioutil"
+	"os"
 	pathutil "path"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/iterator"
 )
 
 // GoogleCSBackend is a storage backend for Google Cloud Storage
 type GoogleCSBackend struct {
+	Bucket  string
 	Prefix  string
 	Client  *storage.BucketHandle
 	Context context.Context
+	// ListPageSize is the number of objects listed per request, 0 leaving it to GCS (1000)
+	ListPageSize int
 }
 
 // NewGoogleCSBackend creates a new instance of GoogleCSBackend
@@ -42,6 +49,7 @@ func NewGoogleCSBackend(bucket string, prefix string) *GoogleCSBackend {
 	bucketHandle := client.Bucket(bucket)
 	prefix = cleanPrefix(prefix)
 	b := &GoogleCSBackend{
+		Bucket:  bucket,
 		Prefix:  prefix,
 		Client:  bucketHandle,
 		Context: ctx,
@@ -51,12 +59,22 @@ func NewGoogleCSBackend(bucket string, prefix string) *GoogleCSBackend {
 
 // ListObjects lists all objects in Google Cloud Storage bucket, at prefix
 func (b GoogleCSBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, false)
+}
+
+// ListObjectsRecursive lists all objects in Google Cloud Storage bucket, at all depths below prefix
+func (b GoogleCSBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, true)
+}
+
+func (b GoogleCSBackend) listObjects(prefix string, recursive bool) ([]Object, error) {
 	var objects []Object
 	prefix = pathutil.Join(b.Prefix, prefix)
 	listQuery := &storage.Query{
 		Prefix: prefix,
 	}
 	it := b.Client.Objects(b.Context, listQuery)
+	it.PageInfo().MaxSize = listPageSize(b.ListPageSize, 0)
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
@@ -65,14 +83,15 @@ func (b GoogleCSBackend) ListObjects(prefix string) ([]Object, error) {
 		if err != nil {
 			return objects, err
 		}
-		path := removePrefixFromObjectPath(prefix, attrs.Name)
-		if objectPathIsInvalid(path) {
+		path, listed := listedObjectPath(prefix, attrs.Name, recursive)
+		if !listed {
 			continue
 		}
 		object := Object{
 			Path:         path,
 			Content:      []byte{},
 			LastModified: attrs.Updated,
+			Size:         attrs.Size,
 		}
 		objects = append(objects, object)
 	}
@@ -102,6 +121,18 @@ func (b GoogleCSBackend) GetObject(path string) (Object, error) {
 	return object, nil
 }
 
+// StatObject looks up the attributes of an object in Google Cloud Storage bucket, at prefix
+func (b GoogleCSBackend) StatObject(path string) (Object, error) {
+	object := Object{Path: path, Content: []byte{}}
+	attrs, err := b.Client.Object(pathutil.Join(b.Prefix, path)).Attrs(b.Context)
+	if err != nil {
+		return object, err
+	}
+	object.LastModified = attrs.Updated
+	object.Size = attrs.Size
+	return object, nil
+}
+
 // PutObject uploads an object to Google Cloud Storage bucket, at prefix
 func (b GoogleCSBackend) PutObject(path string, content []byte) error {
 	wc := b.Client.Object(pathutil.Join(b.Prefix, path)).NewWriter(b.Context)
@@ -113,8 +144,54 @@ func (b GoogleCSBackend) PutObject(path string, content []byte) error {
 	return err
 }
 
+// PutObjectStream uploads an object to Google Cloud Storage bucket, at prefix, reading it
+// from content. If reading fails, the upload is cancelled rather than committed
+func (b GoogleCSBackend) PutObjectStream(path string, content io.Reader) error {
+	ctx, cancel := context.WithCancel(b.Context)
+	defer cancel()
+	wc := b.Client.Object(pathutil.Join(b.Prefix, path)).NewWriter(ctx)
+	if _, err := io.Copy(wc, content); err != nil {
+		cancel()
+		wc.Close()
+		return err
+	}
+	return wc.Close()
+}
+
+// CopyObject copies an object to another path in Google Cloud Storage bucket, at prefix,
+// within GCS
+func (b GoogleCSBackend) CopyObject(srcPath string, dstPath string) error {
+	src := b.Client.Object(pathutil.Join(b.Prefix, srcPath))
+	_, err := b.Client.Object(pathutil.Join(b.Prefix, dstPath)).CopierFrom(src).Run(b.Context)
+	return err
+}
+
 // DeleteObject removes an object from Google Cloud Storage bucket, at prefix
 func (b GoogleCSBackend) DeleteObject(path string) error {
 	err := b.Client.Object(pathutil.Join(b.Prefix, path)).Delete(b.Context)
 	return err
 }
+
+// PresignedURL returns a signed URL for downloading an object from Google Cloud Storage bucket,
+// at prefix, which is valid for the given duration. Signing needs a service account key, read
+// from GOOGLE_APPLICATION_CREDENTIALS; without one ErrPresignNotSupported is returned
+func (b GoogleCSBackend) PresignedURL(path string, expires time.Duration) (string, error) {
+	credentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if credentialsFile == "" {
+		return "", ErrPresignNotSupported
+	}
+	content, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return "", err
+	}
+	conf, err := google.JWTConfigFromJSON(content)
+	if err != nil {
+		return "", err
+	}
+	return storage.SignedURL(b.Bucket, pathutil.Join(b.Prefix, path), &storage.SignedURLOptions{
+		GoogleAccessID: conf.Email,
+		PrivateKey:     conf.PrivateKey,
+		Method:         "GET",
+		Expires:        time.Now().Add(expires),
+	})
+}
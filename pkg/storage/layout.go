@@ -0,0 +1,426 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	pathutil "path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LayoutMarkerName is the object recording which layout the objects under a prefix are stored with
+const LayoutMarkerName = ".chartmuseum-layout"
+
+type (
+	// KeyLayout decides where objects are kept within their directory in a storage backend,
+	// e.g. "mychart-0.1.0.tgz" in directory "org/repo" may be stored under "org/repo/2018/06/mychart-0.1.0.tgz"
+	KeyLayout interface {
+		// Name identifies the layout, and is recorded in storage to detect a change of layout
+		Name() string
+		// Key returns the key, relative to its directory, to store a new object under
+		Key(name string, now time.Time) string
+		// ObjectName returns the name of the object stored under key (relative to its directory),
+		// or false if key is not where this layout stores objects
+		ObjectName(key string) (string, bool)
+		// Nested reports whether keys can be in subdirectories, in which case existing objects
+		// are found by listing their directory recursively
+		Nested() bool
+	}
+
+	// FlatLayout stores objects directly in their directory, as their name
+	FlatLayout struct{}
+
+	// DateLayout stores chart packages and provenance files in a year/month subdirectory
+	// (e.g. "2018/06/mychart-0.1.0.tgz") of their directory, by the time they were first
+	// stored. Other objects, and objects stored flat before switching to this layout, are
+	// found directly in their directory
+	DateLayout struct{}
+
+	// LayoutBackend is a Backend which stores the objects of the Backend it wraps under
+	// Prefix, laid out by Layout
+	LayoutBackend struct {
+		Backend
+		Prefix string
+		Layout KeyLayout
+		mu     sync.Mutex
+		// keys of the objects found in each directory, by name
+		keys map[string]map[string]string
+		now  func() time.Time
+	}
+)
+
+// NewKeyLayout returns the layout with the given name, "flat" (the default) or "date"
+func NewKeyLayout(name string) (KeyLayout, error) {
+	switch name {
+	case "", "flat":
+		return FlatLayout{}, nil
+	case "date":
+		return DateLayout{}, nil
+	}
+	return nil, fmt.Errorf("unsupported storage layout: %s", name)
+}
+
+// Name returns "flat"
+func (FlatLayout) Name() string {
+	return "flat"
+}
+
+// Key returns name
+func (FlatLayout) Key(name string, now time.Time) string {
+	return name
+}
+
+// ObjectName returns key, if not in a subdirectory
+func (FlatLayout) ObjectName(key string) (string, bool) {
+	return key, !objectPathIsInvalid(key)
+}
+
+// Nested returns false
+func (FlatLayout) Nested() bool {
+	return false
+}
+
+// Name returns "date"
+func (DateLayout) Name() string {
+	return "date"
+}
+
+// Key returns name in the subdirectory for now, for chart packages and provenance files
+func (DateLayout) Key(name string, now time.Time) string {
+	switch pathutil.Ext(name) {
+	case ".tgz", ".prov":
+		return pathutil.Join(now.UTC().Format("2006/01"), name)
+	}
+	return name
+}
+
+// ObjectName returns the name of an object in a year/month subdirectory, or directly in its directory
+func (DateLayout) ObjectName(key string) (string, bool) {
+	parts := strings.Split(key, "/")
+	switch len(parts) {
+	case 1:
+		return key, key != ""
+	case 3:
+		if isDigits(parts[0], 4) && isDigits(parts[1], 2) && parts[2] != "" {
+			return parts[2], true
+		}
+	}
+	return "", false
+}
+
+// Nested returns true
+func (DateLayout) Nested() bool {
+	return true
+}
+
+func isDigits(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewLayoutBackend wraps a Backend to store objects under prefix, laid out by layout.
+// Nested layouts need a backend which is a RecursiveLister
+func NewLayoutBackend(backend Backend, prefix string, layout KeyLayout) (*LayoutBackend, error) {
+	if _, ok := backend.(RecursiveLister); layout.Nested() && !ok {
+		return nil, fmt.Errorf("storage backend does not support the %s layout", layout.Name())
+	}
+	return &LayoutBackend{
+		Backend: backend,
+		Prefix:  cleanPrefix(prefix),
+		Layout:  layout,
+		keys:    map[string]map[string]string{},
+		now:     time.Now,
+	}, nil
+}
+
+// CheckLayout compares the layout with the one recorded under the prefix, which is recorded
+// the first time a nested layout is used. Changing layout requires moving the objects already
+// stored, so an error is returned if the layout has changed, or if a nested layout cannot be
+// recorded. Failing to read the layout is taken to mean none was recorded yet
+func (b *LayoutBackend) CheckLayout() error {
+	marker := pathutil.Join(b.Prefix, LayoutMarkerName)
+	object, err := b.Backend.GetObject(marker)
+	if err == nil {
+		recorded := strings.TrimSpace(string(object.Content))
+		if recorded != b.Layout.Name() {
+			return fmt.Errorf("objects in storage are laid out with the %s layout, not %s: they must be migrated before changing layout", recorded, b.Layout.Name())
+		}
+		return nil
+	}
+	if b.Layout.Nested() {
+		if err := b.Backend.PutObject(marker, []byte(b.Layout.Name()+"\n")); err != nil {
+			return fmt.Errorf("could not record the %s layout: %s", b.Layout.Name(), err)
+		}
+	}
+	return nil
+}
+
+// ListObjects lists all objects in dir
+func (b *LayoutBackend) ListObjects(dir string) ([]Object, error) {
+	var objects []Object
+	if !b.Layout.Nested() {
+		found, err := b.Backend.ListObjects(pathutil.Join(b.Prefix, dir))
+		if err != nil {
+			return objects, err
+		}
+		for _, object := range found {
+			if object.Path != LayoutMarkerName {
+				objects = append(objects, object)
+			}
+		}
+		return objects, nil
+	}
+
+	found, err := b.Backend.(RecursiveLister).ListObjectsRecursive(pathutil.Join(b.Prefix, dir))
+	if err != nil {
+		return objects, err
+	}
+	keys := map[string]string{}
+	latest := map[string]int{}
+	for _, object := range found {
+		name, ok := b.Layout.ObjectName(object.Path)
+		if !ok || name == LayoutMarkerName {
+			continue
+		}
+		// the same object stored under two keys (e.g. copied by hand) is listed once, the latest wins
+		if i, ok := latest[name]; ok {
+			if object.LastModified.After(objects[i].LastModified) {
+				keys[name] = object.Path
+				objects[i] = Object{Path: name, Content: object.Content, LastModified: object.LastModified, Size: object.Size}
+			}
+			continue
+		}
+		keys[name] = object.Path
+		latest[name] = len(objects)
+		objects = append(objects, Object{Path: name, Content: object.Content, LastModified: object.LastModified, Size: object.Size})
+	}
+
+	b.mu.Lock()
+	b.keys[dir] = keys
+	b.mu.Unlock()
+	return objects, nil
+}
+
+// ListObjectsRecursive lists the objects at all depths below prefix, by their path as if
+// stored flat (e.g. "org/repo/mychart-0.1.0.tgz" rather than "org/repo/2018/06/mychart-0.1.0.tgz"),
+// or returns ErrRecursiveListNotSupported if the wrapped backend cannot list recursively
+func (b *LayoutBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	lister, ok := b.Backend.(RecursiveLister)
+	if !ok {
+		return nil, ErrRecursiveListNotSupported
+	}
+	found, err := lister.ListObjectsRecursive(pathutil.Join(b.Prefix, prefix))
+	if err != nil {
+		return nil, err
+	}
+	var objects []Object
+	for _, object := range found {
+		path, ok := b.objectPath(object.Path)
+		if !ok || pathutil.Base(path) == LayoutMarkerName {
+			continue
+		}
+		objects = append(objects, Object{Path: path, Content: object.Content, LastModified: object.LastModified, Size: object.Size})
+	}
+	return objects, nil
+}
+
+// objectPath returns the path of the object stored under key as if it were stored flat,
+// replacing the longest end of key the layout stores an object under with the object name
+func (b *LayoutBackend) objectPath(key string) (string, bool) {
+	parts := strings.Split(key, "/")
+	for i := range parts {
+		if name, ok := b.Layout.ObjectName(strings.Join(parts[i:], "/")); ok {
+			return pathutil.Join(append(parts[:i:i], name)...), true
+		}
+	}
+	return "", false
+}
+
+// GetObject retrieves an object
+func (b *LayoutBackend) GetObject(path string) (Object, error) {
+	key, err := b.key(path, false)
+	if err != nil {
+		return Object{Path: path}, err
+	}
+	object, err := b.Backend.GetObject(key)
+	object.Path = path
+	return object, err
+}
+
+// StatObject looks up an object, or returns ErrStatNotSupported if the wrapped backend cannot
+// look up objects without fetching them
+func (b *LayoutBackend) StatObject(path string) (Object, error) {
+	stater, ok := b.Backend.(Stater)
+	if !ok {
+		return Object{Path: path}, ErrStatNotSupported
+	}
+	key, err := b.key(path, false)
+	if err != nil {
+		return Object{Path: path}, err
+	}
+	object, err := stater.StatObject(key)
+	object.Path = path
+	return object, err
+}
+
+// PutObject stores an object, under the key it is already stored under if it exists
+func (b *LayoutBackend) PutObject(path string, content []byte) error {
+	key, err := b.key(path, true)
+	if err != nil {
+		return err
+	}
+	if err = b.Backend.PutObject(key, content); err == nil {
+		b.storedKey(path, key)
+	}
+	return err
+}
+
+// PutObjectStream stores an object from a reader, or returns ErrStreamNotSupported if the
+// wrapped backend cannot upload from a reader
+func (b *LayoutBackend) PutObjectStream(path string, content io.Reader) error {
+	streamPutter, ok := b.Backend.(StreamPutter)
+	if !ok {
+		return ErrStreamNotSupported
+	}
+	key, err := b.key(path, true)
+	if err != nil {
+		return err
+	}
+	if err = streamPutter.PutObjectStream(key, content); err == nil {
+		b.storedKey(path, key)
+	}
+	return err
+}
+
+// CopyObject copies an object within the wrapped backend, to the key of dstPath, or returns
+// ErrCopyNotSupported if the wrapped backend cannot copy objects itself
+func (b *LayoutBackend) CopyObject(srcPath string, dstPath string) error {
+	copier, ok := b.Backend.(Copier)
+	if !ok {
+		return ErrCopyNotSupported
+	}
+	srcKey, err := b.key(srcPath, false)
+	if err != nil {
+		return err
+	}
+	dstKey, err := b.key(dstPath, true)
+	if err != nil {
+		return err
+	}
+	if err = copier.CopyObject(srcKey, dstKey); err == nil {
+		b.storedKey(dstPath, dstKey)
+	}
+	return err
+}
+
+// DeleteObject removes an object
+func (b *LayoutBackend) DeleteObject(path string) error {
+	key, err := b.key(path, false)
+	if err != nil {
+		return err
+	}
+	if err = b.Backend.DeleteObject(key); err == nil {
+		b.storedKey(path, "")
+	}
+	return err
+}
+
+// PresignedURL returns a presigned URL for an object from the wrapped backend, or
+// ErrPresignNotSupported if the wrapped backend cannot presign URLs
+func (b *LayoutBackend) PresignedURL(path string, expires time.Duration) (string, error) {
+	presigner, ok := b.Backend.(Presigner)
+	if !ok {
+		return "", ErrPresignNotSupported
+	}
+	key, err := b.key(path, false)
+	if err != nil {
+		return "", err
+	}
+	return presigner.PresignedURL(key, expires)
+}
+
+// key returns the key of the object at path. With a nested layout, the key of an existing
+// object is looked up, listing its directory if it is not known yet. If the object does not
+// exist, a new key is returned if create is set, otherwise an error for which os.IsNotExist is true
+func (b *LayoutBackend) key(path string, create bool) (string, error) {
+	dir, name := splitObjectPath(path)
+	newKey := b.Layout.Key(name, b.now())
+	if !b.Layout.Nested() || !strings.Contains(newKey, "/") {
+		return pathutil.Join(b.Prefix, dir, newKey), nil
+	}
+
+	key, known := b.knownKey(dir, name)
+	if !known {
+		if _, err := b.ListObjects(dir); err != nil {
+			return "", err
+		}
+		key, known = b.knownKey(dir, name)
+	}
+	if known {
+		return pathutil.Join(b.Prefix, dir, key), nil
+	}
+	if create {
+		return pathutil.Join(b.Prefix, dir, newKey), nil
+	}
+	return "", &os.PathError{Op: "get", Path: path, Err: os.ErrNotExist}
+}
+
+func (b *LayoutBackend) knownKey(dir string, name string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys, listed := b.keys[dir]
+	if !listed {
+		return "", false
+	}
+	key, ok := keys[name]
+	return key, ok
+}
+
+// storedKey records the key an object was stored under, or that it was deleted if key is empty
+func (b *LayoutBackend) storedKey(path string, key string) {
+	if !b.Layout.Nested() {
+		return
+	}
+	dir, name := splitObjectPath(path)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys, listed := b.keys[dir]
+	if !listed {
+		return
+	}
+	if key == "" {
+		delete(keys, name)
+		return
+	}
+	keys[name] = strings.TrimPrefix(key, pathutil.Join(b.Prefix, dir)+"/")
+}
+
+func splitObjectPath(path string) (string, string) {
+	dir, name := pathutil.Split(path)
+	return strings.TrimSuffix(dir, "/"), name
+}
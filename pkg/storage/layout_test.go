@@ -0,0 +1,212 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type LayoutTestSuite struct {
+	suite.Suite
+	LocalFilesystemBackend *LocalFilesystemBackend
+	TempDirectory          string
+}
+
+func (suite *LayoutTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-layout/%s", timestamp)
+	suite.LocalFilesystemBackend = NewLocalFilesystemBackend(suite.TempDirectory)
+}
+
+func (suite *LayoutTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *LayoutTestSuite) newLayoutBackend(prefix string, layoutName string) *LayoutBackend {
+	layout, err := NewKeyLayout(layoutName)
+	suite.Nil(err, "no error getting layout %s", layoutName)
+	backend, err := NewLayoutBackend(suite.LocalFilesystemBackend, prefix, layout)
+	suite.Nil(err, "no error creating layout backend")
+	backend.now = func() time.Time {
+		return time.Date(2018, 6, 15, 12, 0, 0, 0, time.UTC)
+	}
+	return backend
+}
+
+func (suite *LayoutTestSuite) TestNewKeyLayout() {
+	_, err := NewKeyLayout("")
+	suite.Nil(err, "default layout")
+	_, err = NewKeyLayout("unknown")
+	suite.NotNil(err, "error getting unknown layout")
+
+	_, err = NewLayoutBackend(struct{ Backend }{suite.LocalFilesystemBackend}, "", DateLayout{})
+	suite.NotNil(err, "nested layout needs a recursive lister")
+}
+
+func (suite *LayoutTestSuite) TestFlatLayoutWithPrefix() {
+	backend := suite.newLayoutBackend("/shared/chartmuseum/", "flat")
+	err := backend.PutObject("org/repo/mychart-0.1.0.tgz", []byte("chart"))
+	suite.Nil(err, "no error putting object")
+
+	_, err = suite.LocalFilesystemBackend.GetObject("shared/chartmuseum/org/repo/mychart-0.1.0.tgz")
+	suite.Nil(err, "object stored under prefix")
+
+	objects, err := backend.ListObjects("org/repo")
+	suite.Nil(err, "no error listing objects")
+	suite.Equal(1, len(objects))
+	suite.Equal("mychart-0.1.0.tgz", objects[0].Path)
+
+	object, err := backend.GetObject("org/repo/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error getting object")
+	suite.Equal("org/repo/mychart-0.1.0.tgz", object.Path, "object path has the prefix removed")
+	suite.Equal([]byte("chart"), object.Content)
+
+	objects, err = backend.ListObjectsRecursive("org")
+	suite.Nil(err, "no error listing objects recursively")
+	suite.Equal(1, len(objects))
+	suite.Equal("repo/mychart-0.1.0.tgz", objects[0].Path, "object path is relative to the listed prefix")
+
+	err = backend.DeleteObject("org/repo/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.LocalFilesystemBackend.GetObject("shared/chartmuseum/org/repo/mychart-0.1.0.tgz")
+	suite.NotNil(err, "object deleted under prefix")
+}
+
+func (suite *LayoutTestSuite) TestDateLayout() {
+	backend := suite.newLayoutBackend("prefix", "date")
+	err := backend.PutObject("repo/mychart-0.1.0.tgz", []byte("chart"))
+	suite.Nil(err, "no error putting chart package")
+	err = backend.PutObjectStream("repo/mychart-0.1.0.tgz.prov", bytes.NewBufferString("prov"))
+	suite.Nil(err, "no error streaming provenance file")
+	err = backend.PutObject("repo/index-cache.yaml", []byte("index"))
+	suite.Nil(err, "no error putting index")
+
+	_, err = suite.LocalFilesystemBackend.GetObject("prefix/repo/2018/06/mychart-0.1.0.tgz")
+	suite.Nil(err, "chart package stored in date subdirectory")
+	_, err = suite.LocalFilesystemBackend.GetObject("prefix/repo/2018/06/mychart-0.1.0.tgz.prov")
+	suite.Nil(err, "provenance file stored in date subdirectory")
+	_, err = suite.LocalFilesystemBackend.GetObject("prefix/repo/index-cache.yaml")
+	suite.Nil(err, "index stored directly in its directory")
+
+	// a chart stored before switching layouts is still found
+	err = suite.LocalFilesystemBackend.PutObject("prefix/repo/legacy-0.1.0.tgz", []byte("legacy"))
+	suite.Nil(err)
+	// as well as one uploaded out-of-band
+	err = suite.LocalFilesystemBackend.PutObject("prefix/repo/2017/01/old-0.1.0.tgz", []byte("old"))
+	suite.Nil(err)
+
+	objects, err := backend.ListObjects("repo")
+	suite.Nil(err, "no error listing objects")
+	var paths []string
+	for _, object := range objects {
+		paths = append(paths, object.Path)
+	}
+	sort.Strings(paths)
+	suite.Equal([]string{"index-cache.yaml", "legacy-0.1.0.tgz", "mychart-0.1.0.tgz", "mychart-0.1.0.tgz.prov", "old-0.1.0.tgz"}, paths)
+
+	object, err := backend.StatObject("repo/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error looking up chart package in date subdirectory")
+	suite.Equal("repo/mychart-0.1.0.tgz", object.Path)
+	_, err = backend.StatObject("repo/missing-0.1.0.tgz")
+	suite.NotNil(err, "cannot look up a missing chart package")
+
+	for path, content := range map[string]string{
+		"repo/mychart-0.1.0.tgz": "chart",
+		"repo/legacy-0.1.0.tgz":  "legacy",
+		"repo/old-0.1.0.tgz":     "old",
+		"repo/index-cache.yaml":  "index",
+	} {
+		object, err := backend.GetObject(path)
+		suite.Nil(err, "no error getting %s", path)
+		suite.Equal(path, object.Path)
+		suite.Equal(content, string(object.Content))
+	}
+
+	_, err = backend.GetObject("repo/missing-0.1.0.tgz")
+	suite.True(os.IsNotExist(err), "missing object is not found")
+
+	// overwriting a chart keeps it where it is, a month later
+	backend.now = func() time.Time {
+		return time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+	}
+	err = backend.PutObject("repo/mychart-0.1.0.tgz", []byte("new chart"))
+	suite.Nil(err, "no error overwriting chart package")
+	object, err = suite.LocalFilesystemBackend.GetObject("prefix/repo/2018/06/mychart-0.1.0.tgz")
+	suite.Nil(err)
+	suite.Equal("new chart", string(object.Content), "chart overwritten in place")
+	err = backend.PutObject("repo/mychart-0.2.0.tgz", []byte("chart"))
+	suite.Nil(err, "no error putting new chart package")
+	_, err = suite.LocalFilesystemBackend.GetObject("prefix/repo/2018/07/mychart-0.2.0.tgz")
+	suite.Nil(err, "new chart package stored in new date subdirectory")
+
+	objects, err = backend.ListObjectsRecursive("")
+	suite.Nil(err, "no error listing objects recursively")
+	paths = nil
+	for _, object := range objects {
+		paths = append(paths, object.Path)
+	}
+	sort.Strings(paths)
+	suite.Equal([]string{"repo/index-cache.yaml", "repo/legacy-0.1.0.tgz", "repo/mychart-0.1.0.tgz", "repo/mychart-0.1.0.tgz.prov", "repo/mychart-0.2.0.tgz", "repo/old-0.1.0.tgz"}, paths,
+		"objects are listed recursively by their path as if stored flat")
+
+	err = backend.DeleteObject("repo/old-0.1.0.tgz")
+	suite.Nil(err, "no error deleting chart package")
+	_, err = suite.LocalFilesystemBackend.GetObject("prefix/repo/2017/01/old-0.1.0.tgz")
+	suite.NotNil(err, "chart package deleted from its date subdirectory")
+	_, err = backend.GetObject("repo/old-0.1.0.tgz")
+	suite.NotNil(err, "deleted chart package is not found")
+}
+
+func (suite *LayoutTestSuite) TestCheckLayout() {
+	flat := suite.newLayoutBackend("prefix", "flat")
+	suite.Nil(flat.CheckLayout(), "no layout recorded yet")
+	_, err := suite.LocalFilesystemBackend.GetObject("prefix/" + LayoutMarkerName)
+	suite.NotNil(err, "flat layout is not recorded")
+
+	date := suite.newLayoutBackend("prefix", "date")
+	suite.Nil(date.CheckLayout(), "no layout recorded yet")
+	object, err := suite.LocalFilesystemBackend.GetObject("prefix/" + LayoutMarkerName)
+	suite.Nil(err, "date layout is recorded")
+	suite.Equal("date\n", string(object.Content))
+	suite.Nil(date.CheckLayout(), "same layout as recorded")
+
+	objects, err := date.ListObjects("")
+	suite.Nil(err)
+	suite.Equal(0, len(objects), "layout marker is not listed")
+
+	suite.NotNil(flat.CheckLayout(), "layout change is detected")
+	suite.Nil(suite.newLayoutBackend("other", "flat").CheckLayout(), "layout is recorded per prefix")
+
+	failing := &flakyBackend{LocalFilesystemBackend: suite.LocalFilesystemBackend, failures: 2, err: errors.New("unavailable")}
+	layout, err := NewKeyLayout("date")
+	suite.Nil(err)
+	backend, err := NewLayoutBackend(failing, "failing", layout)
+	suite.Nil(err, "no error creating layout backend")
+	suite.NotNil(backend.CheckLayout(), "error recording the layout")
+}
+
+func TestLayoutTestSuite(t *testing.T) {
+	suite.Run(t, new(LayoutTestSuite))
+}
@@ -17,16 +17,24 @@ limitations under the License.
 package storage
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 
 	pathutil "path"
 	"path/filepath"
+	"strings"
 )
 
+// localTempFilePrefix is the prefix of the temporary files objects are written to
+const localTempFilePrefix = ".upload-"
+
 // LocalFilesystemBackend is a storage backend for local filesystem storage
 type LocalFilesystemBackend struct {
 	RootDirectory string
+	// Fsync makes writes flush objects (and their directory) to disk before returning
+	Fsync bool
 }
 
 // NewLocalFilesystemBackend creates a new instance of LocalFilesystemBackend
@@ -50,15 +58,40 @@ func (b LocalFilesystemBackend) ListObjects(prefix string) ([]Object, error) {
 		return objects, err
 	}
 	for _, f := range files {
-		if f.IsDir() {
+		if f.IsDir() || strings.HasPrefix(f.Name(), localTempFilePrefix) {
 			continue
 		}
-		object := Object{Path: f.Name(), Content: []byte{}, LastModified: f.ModTime()}
+		object := Object{Path: f.Name(), Content: []byte{}, LastModified: f.ModTime(), Size: f.Size()}
 		objects = append(objects, object)
 	}
 	return objects, nil
 }
 
+// ListObjectsRecursive lists all objects in root directory, at all depths below prefix
+func (b LocalFilesystemBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	var objects []Object
+	root := pathutil.Join(b.RootDirectory, prefix)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), localTempFilePrefix) {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		object := Object{Path: filepath.ToSlash(relPath), Content: []byte{}, LastModified: info.ModTime(), Size: info.Size()}
+		objects = append(objects, object)
+		return nil
+	})
+	if os.IsNotExist(err) { // OK if the directory doesnt exist yet
+		err = nil
+	}
+	return objects, err
+}
+
 // GetObject retrieves an object from root directory
 func (b LocalFilesystemBackend) GetObject(path string) (Object, error) {
 	var object Object
@@ -77,23 +110,72 @@ func (b LocalFilesystemBackend) GetObject(path string) (Object, error) {
 	return object, err
 }
 
+// StatObject looks up an object in root directory, without reading it
+func (b LocalFilesystemBackend) StatObject(path string) (Object, error) {
+	object := Object{Path: path, Content: []byte{}}
+	info, err := os.Stat(pathutil.Join(b.RootDirectory, path))
+	if err != nil {
+		return object, err
+	}
+	if info.IsDir() {
+		return object, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	object.LastModified = info.ModTime()
+	object.Size = info.Size()
+	return object, nil
+}
+
 // PutObject puts an object in root directory
 func (b LocalFilesystemBackend) PutObject(path string, content []byte) error {
+	return b.PutObjectStream(path, bytes.NewReader(content))
+}
+
+// PutObjectStream puts an object in root directory, copying it from content. The object is
+// written to a temporary file in the same directory first, then renamed into place, so that it
+// never appears partially written, even to concurrent writes of the same object
+func (b LocalFilesystemBackend) PutObjectStream(path string, content io.Reader) error {
 	fullpath := pathutil.Join(b.RootDirectory, path)
 	folderPath := pathutil.Dir(fullpath)
-	_, err := os.Stat(folderPath)
+	err := os.MkdirAll(folderPath, 0777)
 	if err != nil {
-		if os.IsNotExist(err) {
-			err := os.MkdirAll(folderPath, 0777)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+		return err
 	}
-	err = ioutil.WriteFile(fullpath, content, 0644)
-	return err
+	tmpfile, err := ioutil.TempFile(folderPath, localTempFilePrefix)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmpfile, content)
+	if err == nil && b.Fsync {
+		err = tmpfile.Sync()
+	}
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpfile.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), fullpath)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if b.Fsync {
+		return syncDir(folderPath)
+	}
+	return nil
+}
+
+// CopyObject copies an object to another path in root directory, the same way PutObjectStream
+// writes it
+func (b LocalFilesystemBackend) CopyObject(srcPath string, dstPath string) error {
+	src, err := os.Open(pathutil.Join(b.RootDirectory, srcPath))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return b.PutObjectStream(dstPath, src)
 }
 
 // DeleteObject removes an object from root directory
@@ -102,3 +184,16 @@ func (b LocalFilesystemBackend) DeleteObject(path string) error {
 	err := os.Remove(fullpath)
 	return err
 }
+
+// syncDir flushes a directory to disk, so that a rename into it survives a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
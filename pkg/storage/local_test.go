@@ -17,8 +17,15 @@ limitations under the License.
 package storage
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -49,11 +56,110 @@ func (suite *LocalTestSuite) TestGetObject() {
 	suite.NotNil(err, "cannot get objects with bad path")
 }
 
+func (suite *LocalTestSuite) TestStatObject() {
+	err := suite.LocalFilesystemBackend.PutObject("statdir/test.tgz", []byte("test content"))
+	suite.Nil(err)
+	object, err := suite.LocalFilesystemBackend.StatObject("statdir/test.tgz")
+	suite.Nil(err, "no error looking up object")
+	suite.Equal("statdir/test.tgz", object.Path)
+	suite.Equal(int64(len("test content")), object.Size)
+	suite.Empty(object.Content, "content is not read")
+	suite.False(object.LastModified.IsZero())
+
+	_, err = suite.LocalFilesystemBackend.StatObject("statdir/this-file-cannot-possibly-exist.tgz")
+	suite.True(os.IsNotExist(err), "cannot look up a missing object")
+	_, err = suite.LocalFilesystemBackend.StatObject("statdir")
+	suite.True(os.IsNotExist(err), "a directory is not an object")
+}
+
 func (suite *LocalTestSuite) TestPutObjectWithNonExistentPath() {
 	err := suite.LocalFilesystemBackend.PutObject("testdir/test/test.tgz", []byte("test content"))
 	suite.Nil(err)
 }
 
+func (suite *LocalTestSuite) TestPutObjectStream() {
+	err := suite.LocalFilesystemBackend.PutObjectStream("streamdir/test.tgz", bytes.NewBufferString("test content"))
+	suite.Nil(err, "no error streaming object")
+	object, err := suite.LocalFilesystemBackend.GetObject("streamdir/test.tgz")
+	suite.Nil(err, "no error getting streamed object")
+	suite.Equal("test content", string(object.Content))
+
+	failing := io.MultiReader(bytes.NewBufferString("partial"), &failingReader{})
+	err = suite.LocalFilesystemBackend.PutObjectStream("streamdir/failed.tgz", failing)
+	suite.NotNil(err, "error streaming from failing reader")
+	_, err = suite.LocalFilesystemBackend.GetObject("streamdir/failed.tgz")
+	suite.NotNil(err, "partially written object is not stored")
+	files, err := ioutil.ReadDir(suite.LocalFilesystemBackend.RootDirectory + "/streamdir")
+	suite.Nil(err)
+	suite.Equal(1, len(files), "temporary file removed")
+}
+
+func (suite *LocalTestSuite) TestCopyObject() {
+	err := suite.LocalFilesystemBackend.PutObject("copydir/src.tgz", []byte("test content"))
+	suite.Nil(err)
+	err = suite.LocalFilesystemBackend.CopyObject("copydir/src.tgz", "copydir/nested/dst.tgz")
+	suite.Nil(err, "no error copying object")
+	object, err := suite.LocalFilesystemBackend.GetObject("copydir/nested/dst.tgz")
+	suite.Nil(err, "no error getting copied object")
+	suite.Equal("test content", string(object.Content))
+	_, err = suite.LocalFilesystemBackend.GetObject("copydir/src.tgz")
+	suite.Nil(err, "source object kept")
+
+	err = suite.LocalFilesystemBackend.CopyObject("copydir/this-file-cannot-possibly-exist.tgz", "copydir/missing.tgz")
+	suite.True(os.IsNotExist(err), "cannot copy a missing object")
+}
+
+func (suite *LocalTestSuite) TestPutObjectConcurrently() {
+	var wg sync.WaitGroup
+	contents := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		content := strings.Repeat(strconv.Itoa(i), 64*1024)
+		contents[content] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := suite.LocalFilesystemBackend.PutObject("concurrentdir/test.tgz", []byte(content))
+			suite.Nil(err, "no error putting object concurrently")
+		}()
+	}
+	wg.Wait()
+
+	object, err := suite.LocalFilesystemBackend.GetObject("concurrentdir/test.tgz")
+	suite.Nil(err, "no error getting object put concurrently")
+	suite.True(contents[string(object.Content)], "object has the content of one of the writes")
+	files, err := ioutil.ReadDir(suite.LocalFilesystemBackend.RootDirectory + "/concurrentdir")
+	suite.Nil(err)
+	suite.Equal(1, len(files), "temporary files renamed into place")
+}
+
+func (suite *LocalTestSuite) TestPutObjectFsync() {
+	backend := NewLocalFilesystemBackend(suite.LocalFilesystemBackend.RootDirectory)
+	backend.Fsync = true
+	err := backend.PutObject("fsyncdir/test.tgz", []byte("test content"))
+	suite.Nil(err, "no error putting object with fsync")
+	object, err := backend.GetObject("fsyncdir/test.tgz")
+	suite.Nil(err, "no error getting object put with fsync")
+	suite.Equal("test content", string(object.Content))
+}
+
+func (suite *LocalTestSuite) TestListObjectsSkipsTemporaryFiles() {
+	err := suite.LocalFilesystemBackend.PutObject("listdir/test.tgz", []byte("test content"))
+	suite.Nil(err)
+	err = ioutil.WriteFile(suite.LocalFilesystemBackend.RootDirectory+"/listdir/"+localTempFilePrefix+"123", []byte("partial"), 0644)
+	suite.Nil(err)
+	objects, err := suite.LocalFilesystemBackend.ListObjects("listdir")
+	suite.Nil(err)
+	suite.Equal(1, len(objects), "temporary files are not listed")
+	suite.Equal("test.tgz", objects[0].Path)
+	suite.Equal(int64(len("test content")), objects[0].Size, "size is listed")
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
 func TestLocalStorageTestSuite(t *testing.T) {
 	suite.Run(t, new(LocalTestSuite))
 }
@@ -0,0 +1,218 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Latency of calls to the storage backend
+	storageRequestDurationHistogramVec *prometheus.HistogramVec
+	// Number of failed calls to the storage backend
+	storageRequestErrorCounterVec *prometheus.CounterVec
+	// Number of storage backend calls retried after a transient error
+	storageRequestRetryCounterVec *prometheus.CounterVec
+
+	metricsNamespace string
+	metricsSubsystem string
+)
+
+type (
+	// InstrumentedBackend is a Backend which records Prometheus metrics for each call
+	// to the Backend it wraps
+	InstrumentedBackend struct {
+		Backend
+		BackendType string
+	}
+)
+
+func init() {
+	SetMetricsPrefix("", "")
+}
+
+// SetMetricsPrefix creates the storage metrics under namespace ("chartmuseum" if empty) and
+// subsystem, in place of the ones registered before. It is called on startup, before storage
+// is used
+func SetMetricsPrefix(namespace string, subsystem string) {
+	if namespace == "" {
+		namespace = "chartmuseum"
+	}
+	if storageRequestDurationHistogramVec != nil {
+		if namespace == metricsNamespace && subsystem == metricsSubsystem {
+			return
+		}
+		prometheus.Unregister(storageRequestDurationHistogramVec)
+		prometheus.Unregister(storageRequestErrorCounterVec)
+		prometheus.Unregister(storageRequestRetryCounterVec)
+	}
+	metricsNamespace, metricsSubsystem = namespace, subsystem
+	storageRequestDurationHistogramVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "storage_request_duration_seconds",
+			Help:      "Storage backend request latencies in seconds",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"operation", "backend"},
+	)
+	storageRequestErrorCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "storage_request_errors_total",
+			Help:      "How many storage backend requests failed",
+		},
+		[]string{"operation", "backend"},
+	)
+	storageRequestRetryCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "storage_request_retries_total",
+			Help:      "How many storage backend requests were retried",
+		},
+		[]string{"operation", "backend"},
+	)
+	prometheus.MustRegister(storageRequestDurationHistogramVec, storageRequestErrorCounterVec, storageRequestRetryCounterVec)
+}
+
+// NewInstrumentedBackend wraps a Backend to record metrics, labeled with the backend type (e.g. "amazon")
+func NewInstrumentedBackend(backend Backend, backendType string) *InstrumentedBackend {
+	return &InstrumentedBackend{
+		Backend:     backend,
+		BackendType: backendType,
+	}
+}
+
+// ListObjects lists all objects in the wrapped backend
+func (b InstrumentedBackend) ListObjects(prefix string) ([]Object, error) {
+	start := time.Now()
+	objects, err := b.Backend.ListObjects(prefix)
+	b.observe("list", start, err)
+	return objects, err
+}
+
+// ListObjectsRecursive lists the objects at all depths in the wrapped backend, or returns
+// ErrRecursiveListNotSupported if the wrapped backend cannot list recursively
+func (b InstrumentedBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	lister, ok := b.Backend.(RecursiveLister)
+	if !ok {
+		return nil, ErrRecursiveListNotSupported
+	}
+	start := time.Now()
+	objects, err := lister.ListObjectsRecursive(prefix)
+	if err != ErrRecursiveListNotSupported {
+		b.observe("list", start, err)
+	}
+	return objects, err
+}
+
+// GetObject retrieves an object from the wrapped backend
+func (b InstrumentedBackend) GetObject(path string) (Object, error) {
+	start := time.Now()
+	object, err := b.Backend.GetObject(path)
+	b.observe("get", start, err)
+	return object, err
+}
+
+// StatObject looks up an object in the wrapped backend, or returns ErrStatNotSupported if the
+// wrapped backend cannot look up objects without fetching them
+func (b InstrumentedBackend) StatObject(path string) (Object, error) {
+	stater, ok := b.Backend.(Stater)
+	if !ok {
+		return Object{Path: path}, ErrStatNotSupported
+	}
+	start := time.Now()
+	object, err := stater.StatObject(path)
+	if err != ErrStatNotSupported {
+		b.observe("stat", start, err)
+	}
+	return object, err
+}
+
+// PutObject uploads an object to the wrapped backend
+func (b InstrumentedBackend) PutObject(path string, content []byte) error {
+	start := time.Now()
+	err := b.Backend.PutObject(path, content)
+	b.observe("put", start, err)
+	return err
+}
+
+// PutObjectStream uploads an object from a reader to the wrapped backend, or returns
+// ErrStreamNotSupported if the wrapped backend cannot upload from a reader
+func (b InstrumentedBackend) PutObjectStream(path string, content io.Reader) error {
+	streamPutter, ok := b.Backend.(StreamPutter)
+	if !ok {
+		return ErrStreamNotSupported
+	}
+	start := time.Now()
+	err := streamPutter.PutObjectStream(path, content)
+	if err != ErrStreamNotSupported {
+		b.observe("put", start, err)
+	}
+	return err
+}
+
+// CopyObject copies an object within the wrapped backend, or returns ErrCopyNotSupported if
+// the wrapped backend cannot copy objects itself
+func (b InstrumentedBackend) CopyObject(srcPath string, dstPath string) error {
+	copier, ok := b.Backend.(Copier)
+	if !ok {
+		return ErrCopyNotSupported
+	}
+	start := time.Now()
+	err := copier.CopyObject(srcPath, dstPath)
+	if err != ErrCopyNotSupported {
+		b.observe("copy", start, err)
+	}
+	return err
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b InstrumentedBackend) DeleteObject(path string) error {
+	start := time.Now()
+	err := b.Backend.DeleteObject(path)
+	b.observe("delete", start, err)
+	return err
+}
+
+// PresignedURL returns a presigned URL from the wrapped backend, or ErrPresignNotSupported
+// if the wrapped backend cannot presign URLs
+func (b InstrumentedBackend) PresignedURL(path string, expires time.Duration) (string, error) {
+	presigner, ok := b.Backend.(Presigner)
+	if !ok {
+		return "", ErrPresignNotSupported
+	}
+	start := time.Now()
+	url, err := presigner.PresignedURL(path, expires)
+	if err != ErrPresignNotSupported {
+		b.observe("presign", start, err)
+	}
+	return url, err
+}
+
+func (b InstrumentedBackend) observe(operation string, start time.Time, err error) {
+	storageRequestDurationHistogramVec.WithLabelValues(operation, b.BackendType).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageRequestErrorCounterVec.WithLabelValues(operation, b.BackendType).Inc()
+	}
+}
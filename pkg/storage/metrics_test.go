@@ -0,0 +1,111 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/suite"
+)
+
+type MetricsTestSuite struct {
+	suite.Suite
+	InstrumentedBackend *InstrumentedBackend
+	TempDirectory       string
+}
+
+func (suite *MetricsTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-metrics/%s", timestamp)
+	suite.InstrumentedBackend = NewInstrumentedBackend(NewLocalFilesystemBackend(suite.TempDirectory), "local")
+}
+
+func (suite *MetricsTestSuite) TearDownSuite() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *MetricsTestSuite) counterValue(counter prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	suite.Nil(counter.Write(metric), "no error reading counter")
+	return metric.GetCounter().GetValue()
+}
+
+func (suite *MetricsTestSuite) histogramCount(histogram prometheus.Histogram) uint64 {
+	metric := &dto.Metric{}
+	suite.Nil(histogram.Write(metric), "no error reading histogram")
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func (suite *MetricsTestSuite) TestObserve() {
+	getErrors := storageRequestErrorCounterVec.WithLabelValues("get", "local")
+	errorsBefore := suite.counterValue(getErrors)
+	putCountBefore := suite.histogramCount(storageRequestDurationHistogramVec.WithLabelValues("put", "local"))
+
+	err := suite.InstrumentedBackend.PutObject("test.txt", []byte("test content"))
+	suite.Nil(err, "no error putting object")
+	suite.Equal(putCountBefore+1, suite.histogramCount(storageRequestDurationHistogramVec.WithLabelValues("put", "local")))
+
+	_, err = suite.InstrumentedBackend.GetObject("test.txt")
+	suite.Nil(err, "no error getting object")
+	suite.Equal(errorsBefore, suite.counterValue(getErrors), "successful request is not an error")
+
+	_, err = suite.InstrumentedBackend.GetObject("this-file-cannot-possibly-exist.tgz")
+	suite.NotNil(err, "error getting missing object")
+	suite.Equal(errorsBefore+1, suite.counterValue(getErrors), "failed request is counted")
+}
+
+func (suite *MetricsTestSuite) TestPresignedURL() {
+	_, err := suite.InstrumentedBackend.PresignedURL("test.txt", time.Minute)
+	suite.Equal(ErrPresignNotSupported, err, "local backend cannot presign URLs")
+}
+
+func (suite *MetricsTestSuite) TestPutObjectStream() {
+	putCountBefore := suite.histogramCount(storageRequestDurationHistogramVec.WithLabelValues("put", "local"))
+	err := suite.InstrumentedBackend.PutObjectStream("stream.txt", bytes.NewBufferString("test content"))
+	suite.Nil(err, "no error streaming object")
+	suite.Equal(putCountBefore+1, suite.histogramCount(storageRequestDurationHistogramVec.WithLabelValues("put", "local")))
+
+	nonStreaming := NewInstrumentedBackend(struct{ Backend }{suite.InstrumentedBackend.Backend}, "local")
+	err = nonStreaming.PutObjectStream("stream.txt", bytes.NewBufferString("test content"))
+	suite.Equal(ErrStreamNotSupported, err, "wrapped backend without streaming support")
+}
+
+func (suite *MetricsTestSuite) TestMetricsPrefix() {
+	SetMetricsPrefix("cm", "backend")
+	defer SetMetricsPrefix("", "")
+
+	err := suite.InstrumentedBackend.PutObject("prefix.txt", []byte("test content"))
+	suite.Nil(err, "no error putting object")
+	families, err := prometheus.DefaultGatherer.Gather()
+	suite.Nil(err, "no error gathering metrics")
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	suite.Contains(names, "cm_backend_storage_request_duration_seconds", "storage metrics use the prefix")
+	suite.NotContains(names, "chartmuseum_storage_request_duration_seconds", "default storage metrics are replaced")
+}
+
+func TestMetricsTestSuite(t *testing.T) {
+	suite.Run(t, new(MetricsTestSuite))
+}
@@ -30,6 +30,8 @@ import (
 type MicrosoftBlobBackend struct {
 	Prefix    string
 	Container *microsoft_storage.Container
+	// ListPageSize is the number of blobs listed per request, 5000 (the maximum) by default
+	ListPageSize int
 }
 
 // NewMicrosoftBlobBackend creates a new instance of MicrosoftBlobBackend
@@ -59,6 +61,15 @@ func NewMicrosoftBlobBackend(container string, prefix string) *MicrosoftBlobBack
 
 // ListObjects lists all objects in Microsoft Azure Blob Storage container
 func (b MicrosoftBlobBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, false)
+}
+
+// ListObjectsRecursive lists all objects in Microsoft Azure Blob Storage container, at all depths below prefix
+func (b MicrosoftBlobBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, true)
+}
+
+func (b MicrosoftBlobBackend) listObjects(prefix string, recursive bool) ([]Object, error) {
 	var objects []Object
 
 	if b.Container == nil {
@@ -68,29 +79,37 @@ func (b MicrosoftBlobBackend) ListObjects(prefix string) ([]Object, error) {
 	var params microsoft_storage.ListBlobsParameters
 	prefix = pathutil.Join(b.Prefix, prefix)
 	params.Prefix = prefix
-	response, err := b.Container.ListBlobs(params)
-	if err != nil {
-		return objects, err
-	}
-
-	for _, blob := range response.Blobs {
-		path := removePrefixFromObjectPath(prefix, blob.Name)
-		if objectPathIsInvalid(path) {
-			continue
-		}
-
-		err = blob.GetProperties(nil)
+	params.MaxResults = uint(listPageSize(b.ListPageSize, 5000))
+	for {
+		response, err := b.Container.ListBlobs(params)
 		if err != nil {
 			return objects, err
 		}
 
-		object := Object{
-			Path:         path,
-			Content:      []byte{},
-			LastModified: time.Time(blob.Properties.LastModified),
+		for _, blob := range response.Blobs {
+			path, listed := listedObjectPath(prefix, blob.Name, recursive)
+			if !listed {
+				continue
+			}
+
+			err = blob.GetProperties(nil)
+			if err != nil {
+				return objects, err
+			}
+
+			object := Object{
+				Path:         path,
+				Content:      []byte{},
+				LastModified: time.Time(blob.Properties.LastModified),
+				Size:         blob.Properties.ContentLength,
+			}
+
+			objects = append(objects, object)
 		}
-
-		objects = append(objects, object)
+		if response.NextMarker == "" {
+			break
+		}
+		params.Marker = response.NextMarker
 	}
 	return objects, nil
 }
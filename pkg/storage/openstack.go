@@ -63,6 +63,8 @@ type OpenstackOSBackend struct {
 	Region    string
 	CACert    string
 	Client    *gophercloud.ServiceClient
+	// ListPageSize is the number of objects listed per request, 0 leaving it to Swift (10000)
+	ListPageSize int
 }
 
 // NewOpenstackOSBackend creates a new instance of OpenstackOSBackend
@@ -129,12 +131,22 @@ func NewOpenstackOSBackend(container string, prefix string, region string, caCer
 
 // ListObjects lists all objects in an Openstack container, at prefix
 func (b OpenstackOSBackend) ListObjects(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, false)
+}
+
+// ListObjectsRecursive lists all objects in an Openstack container, at all depths below prefix
+func (b OpenstackOSBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	return b.listObjects(prefix, true)
+}
+
+func (b OpenstackOSBackend) listObjects(prefix string, recursive bool) ([]Object, error) {
 	var objects []Object
 
 	prefix = pathutil.Join(b.Prefix, prefix)
 	opts := &osObjects.ListOpts{
 		Full:   true,
 		Prefix: prefix,
+		Limit:  listPageSize(b.ListPageSize, 0),
 	}
 
 	pager := osObjects.List(b.Client, b.Container, opts)
@@ -145,14 +157,15 @@ func (b OpenstackOSBackend) ListObjects(prefix string) ([]Object, error) {
 		}
 
 		for _, openStackObject := range objectList {
-			path := removePrefixFromObjectPath(prefix, openStackObject.Name)
-			if objectPathIsInvalid(path) {
+			path, listed := listedObjectPath(prefix, openStackObject.Name, recursive)
+			if !listed {
 				continue
 			}
 			object := Object{
 				Path:         path,
 				Content:      []byte{},
 				LastModified: openStackObject.LastModified,
+				Size:         openStackObject.Bytes,
 			}
 			objects = append(objects, object)
 		}
@@ -0,0 +1,276 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay  = 10 * time.Second
+)
+
+type (
+	// RetryOptions are options for constructing a RetryBackend
+	RetryOptions struct {
+		// MaxAttempts is the number of times a call is made before giving up, including the first
+		MaxAttempts int
+		// BaseDelay is the delay before the first retry, doubled for each retry after it
+		BaseDelay time.Duration
+		// MaxDelay caps the delay between two attempts
+		MaxDelay time.Duration
+		// IsRetryable classifies errors, defaults to IsRetryableError
+		IsRetryable func(err error) bool
+		// OnRetry, if set, is called before each retry
+		OnRetry func(operation string, attempt int, delay time.Duration, err error)
+	}
+
+	// RetryBackend is a Backend which retries the calls to the Backend it wraps that fail
+	// with a transient error, with jittered exponential backoff
+	RetryBackend struct {
+		Backend
+		BackendType string
+		RetryOptions
+		sleep func(time.Duration)
+	}
+
+	// statusCoder is implemented by errors which carry the HTTP status of a failed request,
+	// such as awserr.RequestFailure
+	statusCoder interface {
+		StatusCode() int
+	}
+)
+
+// retryableAWSErrorCodes are the error codes of throttled or timed out Amazon S3 requests
+var retryableAWSErrorCodes = map[string]bool{
+	"RequestError":            true,
+	"RequestTimeout":          true,
+	"RequestTimeoutException": true,
+	"SlowDown":                true,
+	"Throttling":              true,
+	"ThrottlingException":     true,
+	"RequestLimitExceeded":    true,
+}
+
+// NewRetryBackend wraps a Backend to retry failed calls, labeling metrics with the backend type (e.g. "amazon")
+func NewRetryBackend(backend Backend, backendType string, options RetryOptions) *RetryBackend {
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = 1
+	}
+	if options.BaseDelay <= 0 {
+		options.BaseDelay = defaultRetryBaseDelay
+	}
+	if options.MaxDelay <= 0 {
+		options.MaxDelay = defaultRetryMaxDelay
+	}
+	if options.IsRetryable == nil {
+		options.IsRetryable = IsRetryableError
+	}
+	return &RetryBackend{
+		Backend:      backend,
+		BackendType:  backendType,
+		RetryOptions: options,
+		sleep:        time.Sleep,
+	}
+}
+
+// IsRetryableError returns true if err looks transient: a server error or throttling
+// response, or a network timeout. Any other error, such as a missing object, is returned
+// to the caller straight away
+func IsRetryableError(err error) bool {
+	if err == nil || os.IsNotExist(err) || err == ErrStreamNotSupported || err == ErrPresignNotSupported || err == ErrRecursiveListNotSupported ||
+		err == ErrCopyNotSupported {
+		return false
+	}
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return isRetryableStatus(e.Code)
+	case *b2Error:
+		return isRetryableStatus(e.Status)
+	case statusCoder:
+		if isRetryableStatus(e.StatusCode()) {
+			return true
+		}
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return retryableAWSErrorCodes[awsErr.Code()]
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// ListObjects lists all objects in the wrapped backend
+func (b RetryBackend) ListObjects(prefix string) ([]Object, error) {
+	var objects []Object
+	err := b.retry("list", func() error {
+		var err error
+		objects, err = b.Backend.ListObjects(prefix)
+		return err
+	})
+	return objects, err
+}
+
+// ListObjectsRecursive lists the objects at all depths in the wrapped backend, or returns
+// ErrRecursiveListNotSupported if the wrapped backend cannot list recursively
+func (b RetryBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	lister, ok := b.Backend.(RecursiveLister)
+	if !ok {
+		return nil, ErrRecursiveListNotSupported
+	}
+	var objects []Object
+	err := b.retry("list", func() error {
+		var err error
+		objects, err = lister.ListObjectsRecursive(prefix)
+		return err
+	})
+	return objects, err
+}
+
+// GetObject retrieves an object from the wrapped backend
+func (b RetryBackend) GetObject(path string) (Object, error) {
+	var object Object
+	err := b.retry("get", func() error {
+		var err error
+		object, err = b.Backend.GetObject(path)
+		return err
+	})
+	return object, err
+}
+
+// StatObject looks up an object in the wrapped backend, or returns ErrStatNotSupported if the
+// wrapped backend cannot look up objects without fetching them
+func (b RetryBackend) StatObject(path string) (Object, error) {
+	stater, ok := b.Backend.(Stater)
+	if !ok {
+		return Object{Path: path}, ErrStatNotSupported
+	}
+	var object Object
+	err := b.retry("stat", func() error {
+		var err error
+		object, err = stater.StatObject(path)
+		return err
+	})
+	return object, err
+}
+
+// PutObject uploads an object to the wrapped backend. Putting the same content again is
+// safe: overwrite checks are made before the upload, not by the backend
+func (b RetryBackend) PutObject(path string, content []byte) error {
+	return b.retry("put", func() error {
+		return b.Backend.PutObject(path, content)
+	})
+}
+
+// PutObjectStream uploads an object from a reader to the wrapped backend, or returns
+// ErrStreamNotSupported if the wrapped backend cannot upload from a reader. The upload is
+// only retried if content can be rewound, i.e. is an io.Seeker
+func (b RetryBackend) PutObjectStream(path string, content io.Reader) error {
+	streamPutter, ok := b.Backend.(StreamPutter)
+	if !ok {
+		return ErrStreamNotSupported
+	}
+	seeker, ok := content.(io.Seeker)
+	if !ok {
+		return streamPutter.PutObjectStream(path, content)
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return streamPutter.PutObjectStream(path, content)
+	}
+	attempt := 0
+	return b.retry("put", func() error {
+		attempt++
+		if attempt > 1 {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		return streamPutter.PutObjectStream(path, content)
+	})
+}
+
+// CopyObject copies an object within the wrapped backend, or returns ErrCopyNotSupported if
+// the wrapped backend cannot copy objects itself
+func (b RetryBackend) CopyObject(srcPath string, dstPath string) error {
+	copier, ok := b.Backend.(Copier)
+	if !ok {
+		return ErrCopyNotSupported
+	}
+	return b.retry("copy", func() error {
+		return copier.CopyObject(srcPath, dstPath)
+	})
+}
+
+// DeleteObject removes an object from the wrapped backend
+func (b RetryBackend) DeleteObject(path string) error {
+	return b.retry("delete", func() error {
+		return b.Backend.DeleteObject(path)
+	})
+}
+
+// PresignedURL returns a presigned URL from the wrapped backend, or ErrPresignNotSupported
+// if the wrapped backend cannot presign URLs
+func (b RetryBackend) PresignedURL(path string, expires time.Duration) (string, error) {
+	presigner, ok := b.Backend.(Presigner)
+	if !ok {
+		return "", ErrPresignNotSupported
+	}
+	return presigner.PresignedURL(path, expires)
+}
+
+func (b RetryBackend) retry(operation string, call func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = call()
+		if attempt >= b.MaxAttempts || !b.IsRetryable(err) {
+			return err
+		}
+		delay := b.delay(attempt)
+		storageRequestRetryCounterVec.WithLabelValues(operation, b.BackendType).Inc()
+		if b.OnRetry != nil {
+			b.OnRetry(operation, attempt, delay, err)
+		}
+		b.sleep(delay)
+	}
+}
+
+// delay returns the delay after a failed attempt: BaseDelay doubled for each attempt
+// before it, capped at MaxDelay, with the upper half of it picked at random
+func (b RetryBackend) delay(attempt int) time.Duration {
+	delay := b.MaxDelay
+	if attempt < 32 {
+		if d := b.BaseDelay << uint(attempt-1); d > 0 && d < delay {
+			delay = d
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
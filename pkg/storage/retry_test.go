@@ -0,0 +1,221 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/api/googleapi"
+)
+
+type RetryTestSuite struct {
+	suite.Suite
+	LocalFilesystemBackend *LocalFilesystemBackend
+	FlakyBackend           *flakyBackend
+	RetryBackend           *RetryBackend
+	Delays                 []time.Duration
+	Retries                []string
+	TempDirectory          string
+}
+
+// flakyBackend fails the next calls with err, as many times as failures
+type flakyBackend struct {
+	*LocalFilesystemBackend
+	failures int
+	err      error
+	calls    int
+}
+
+func (b *flakyBackend) fail() error {
+	b.calls++
+	if b.failures > 0 {
+		b.failures--
+		return b.err
+	}
+	return nil
+}
+
+func (b *flakyBackend) ListObjects(prefix string) ([]Object, error) {
+	if err := b.fail(); err != nil {
+		return nil, err
+	}
+	return b.LocalFilesystemBackend.ListObjects(prefix)
+}
+
+func (b *flakyBackend) GetObject(path string) (Object, error) {
+	if err := b.fail(); err != nil {
+		return Object{}, err
+	}
+	return b.LocalFilesystemBackend.GetObject(path)
+}
+
+func (b *flakyBackend) PutObject(path string, content []byte) error {
+	if err := b.fail(); err != nil {
+		return err
+	}
+	return b.LocalFilesystemBackend.PutObject(path, content)
+}
+
+// PutObjectStream consumes part of content before failing, as an interrupted upload would
+func (b *flakyBackend) PutObjectStream(path string, content io.Reader) error {
+	if err := b.fail(); err != nil {
+		content.Read(make([]byte, 4))
+		return err
+	}
+	return b.LocalFilesystemBackend.PutObjectStream(path, content)
+}
+
+func (b *flakyBackend) DeleteObject(path string) error {
+	if err := b.fail(); err != nil {
+		return err
+	}
+	return b.LocalFilesystemBackend.DeleteObject(path)
+}
+
+func (suite *RetryTestSuite) SetupSuite() {
+	timestamp := time.Now().Format("20060102150405")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-retry/%s", timestamp)
+	suite.LocalFilesystemBackend = NewLocalFilesystemBackend(suite.TempDirectory)
+}
+
+func (suite *RetryTestSuite) TearDownSuite() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *RetryTestSuite) SetupTest() {
+	suite.Delays = nil
+	suite.Retries = nil
+	suite.FlakyBackend = &flakyBackend{
+		LocalFilesystemBackend: suite.LocalFilesystemBackend,
+		err:                    awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "request-id"),
+	}
+	suite.RetryBackend = NewRetryBackend(suite.FlakyBackend, "flaky", RetryOptions{
+		MaxAttempts: 3,
+		BaseDelay:   time.Second,
+		MaxDelay:    3 * time.Second,
+		OnRetry: func(operation string, attempt int, delay time.Duration, err error) {
+			suite.Retries = append(suite.Retries, fmt.Sprintf("%s %d", operation, attempt))
+		},
+	})
+	suite.RetryBackend.sleep = func(delay time.Duration) {
+		suite.Delays = append(suite.Delays, delay)
+	}
+}
+
+func (suite *RetryTestSuite) retryCount(operation string) float64 {
+	metric := &dto.Metric{}
+	suite.Nil(storageRequestRetryCounterVec.WithLabelValues(operation, "flaky").Write(metric), "no error reading counter")
+	return metric.GetCounter().GetValue()
+}
+
+func (suite *RetryTestSuite) TestRetryTransientErrors() {
+	retriesBefore := suite.retryCount("put")
+	suite.FlakyBackend.failures = 2
+	err := suite.RetryBackend.PutObject("transient/test.txt", []byte("test content"))
+	suite.Nil(err, "put succeeds on the third attempt")
+	suite.Equal(3, suite.FlakyBackend.calls, "put attempted three times")
+	suite.Equal([]string{"put 1", "put 2"}, suite.Retries, "each retry is reported")
+	suite.Equal(retriesBefore+2, suite.retryCount("put"), "each retry is counted")
+
+	suite.Len(suite.Delays, 2)
+	suite.True(suite.Delays[0] >= 500*time.Millisecond && suite.Delays[0] <= time.Second, "first delay is jittered base delay")
+	suite.True(suite.Delays[1] >= time.Second && suite.Delays[1] <= 2*time.Second, "second delay is doubled")
+
+	suite.FlakyBackend.failures = 2
+	object, err := suite.RetryBackend.GetObject("transient/test.txt")
+	suite.Nil(err, "get succeeds on the third attempt")
+	suite.Equal([]byte("test content"), object.Content)
+
+	suite.FlakyBackend.failures = 1
+	objects, err := suite.RetryBackend.ListObjects("transient")
+	suite.Nil(err, "list succeeds on the second attempt")
+	suite.Len(objects, 1)
+
+	suite.FlakyBackend.failures = 1
+	err = suite.RetryBackend.DeleteObject("transient/test.txt")
+	suite.Nil(err, "delete succeeds on the second attempt")
+}
+
+func (suite *RetryTestSuite) TestGiveUp() {
+	suite.FlakyBackend.failures = 5
+	_, err := suite.RetryBackend.GetObject("test.txt")
+	suite.Equal(suite.FlakyBackend.err, err, "last error returned")
+	suite.Equal(3, suite.FlakyBackend.calls, "no more than MaxAttempts calls")
+
+	delay := suite.RetryBackend.delay(10)
+	suite.True(delay >= 1500*time.Millisecond && delay <= 3*time.Second, "delay capped at MaxDelay")
+}
+
+func (suite *RetryTestSuite) TestNonRetryableErrors() {
+	_, err := suite.RetryBackend.GetObject("this-file-cannot-possibly-exist.tgz")
+	suite.NotNil(err, "error getting missing object")
+	suite.Equal(1, suite.FlakyBackend.calls, "missing object is not retried")
+	suite.Len(suite.Retries, 0)
+
+	suite.FlakyBackend.calls = 0
+	suite.FlakyBackend.failures = 1
+	suite.FlakyBackend.err = errors.New("access denied")
+	err = suite.RetryBackend.PutObject("test.txt", []byte("test content"))
+	suite.NotNil(err, "error returned straight away")
+	suite.Equal(1, suite.FlakyBackend.calls, "unknown error is not retried")
+}
+
+func (suite *RetryTestSuite) TestPutObjectStream() {
+	suite.FlakyBackend.failures = 1
+	err := suite.RetryBackend.PutObjectStream("stream.txt", bytes.NewReader([]byte("test content")))
+	suite.Nil(err, "stream put succeeds on the second attempt")
+	object, err := suite.LocalFilesystemBackend.GetObject("stream.txt")
+	suite.Nil(err)
+	suite.Equal([]byte("test content"), object.Content, "content is rewound before retrying")
+
+	suite.FlakyBackend.calls = 0
+	suite.FlakyBackend.failures = 1
+	err = suite.RetryBackend.PutObjectStream("stream.txt", bytes.NewBufferString("test content"))
+	suite.NotNil(err, "error streaming content which cannot be rewound")
+	suite.Equal(1, suite.FlakyBackend.calls, "content which cannot be rewound is not retried")
+
+	backend := NewRetryBackend(struct{ Backend }{suite.LocalFilesystemBackend}, "flaky", RetryOptions{})
+	err = backend.PutObjectStream("stream.txt", bytes.NewReader([]byte("test content")))
+	suite.Equal(ErrStreamNotSupported, err, "stream put not supported if the wrapped backend does not support it")
+}
+
+func (suite *RetryTestSuite) TestIsRetryableError() {
+	suite.False(IsRetryableError(nil))
+	suite.False(IsRetryableError(os.ErrNotExist))
+	suite.False(IsRetryableError(errors.New("some error")))
+	suite.False(IsRetryableError(ErrStreamNotSupported))
+	suite.True(IsRetryableError(awserr.New("SlowDown", "slow down", nil)), "S3 throttling is retryable")
+	suite.True(IsRetryableError(awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, "")), "S3 server error is retryable")
+	suite.False(IsRetryableError(awserr.NewRequestFailure(awserr.New("NoSuchKey", "", nil), 404, "")), "S3 missing key is not retryable")
+	suite.False(IsRetryableError(awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, "")), "S3 access denied is not retryable")
+	suite.True(IsRetryableError(&googleapi.Error{Code: 429}), "GCS rate limit is retryable")
+	suite.False(IsRetryableError(&googleapi.Error{Code: 404}), "GCS not found is not retryable")
+	suite.True(IsRetryableError(&b2Error{Status: 503}), "B2 busy is retryable")
+}
+
+func TestRetryTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryTestSuite))
+}
@@ -17,8 +17,13 @@ limitations under the License.
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -29,6 +34,8 @@ type (
 		Path         string
 		Content      []byte
 		LastModified time.Time
+		// Size of the object in bytes, as listed (0 if the backend did not tell)
+		Size int64
 	}
 
 	// ObjectSliceDiff provides information on what has changed since last calling ListObjects
@@ -46,6 +53,54 @@ type (
 		PutObject(path string, content []byte) error
 		DeleteObject(path string) error
 	}
+
+	// Presigner is implemented by backends which can hand out short-lived URLs for
+	// downloading an object directly, without going through ChartMuseum
+	Presigner interface {
+		PresignedURL(path string, expires time.Duration) (string, error)
+	}
+
+	// StreamPutter is implemented by backends which can upload an object from a reader,
+	// without the whole content being held in memory
+	StreamPutter interface {
+		PutObjectStream(path string, content io.Reader) error
+	}
+
+	// RecursiveLister is implemented by backends which can list the objects at all depths
+	// below prefix, with paths relative to prefix (e.g. "2018/06/mychart-0.1.0.tgz")
+	RecursiveLister interface {
+		ListObjectsRecursive(prefix string) ([]Object, error)
+	}
+
+	// Copier is implemented by backends which can copy an object to another path themselves,
+	// without its content going through ChartMuseum
+	Copier interface {
+		CopyObject(srcPath string, dstPath string) error
+	}
+
+	// Stater is implemented by backends which can look up an object without fetching its
+	// content, e.g. to check that it exists. The object is returned without content
+	Stater interface {
+		StatObject(path string) (Object, error)
+	}
+)
+
+var (
+	// ErrPresignNotSupported is returned by PresignedURL when a backend cannot presign URLs
+	ErrPresignNotSupported = errors.New("backend does not support presigned URLs")
+
+	// ErrStreamNotSupported is returned by PutObjectStream when a backend cannot upload from a reader
+	ErrStreamNotSupported = errors.New("backend does not support streaming uploads")
+
+	// ErrRecursiveListNotSupported is returned by ListObjectsRecursive when a backend cannot list recursively
+	ErrRecursiveListNotSupported = errors.New("backend does not support recursive listing")
+
+	// ErrCopyNotSupported is returned by CopyObject when a backend cannot copy objects itself
+	ErrCopyNotSupported = errors.New("backend does not support copying objects")
+
+	// ErrStatNotSupported is returned by StatObject when a backend cannot look up objects
+	// without fetching them
+	ErrStatNotSupported = errors.New("backend does not support looking up objects")
 )
 
 // HasExtension determines whether or not an object contains a file extension
@@ -87,6 +142,31 @@ func GetObjectSliceDiff(os1 []Object, os2 []Object) ObjectSliceDiff {
 	return diff
 }
 
+// ChangeToken returns a digest of the paths and modification times of objects, in any order.
+// Two listings have the same token only if GetObjectSliceDiff would find no change between them.
+// The token is computed from a full listing, it only spares comparing every object with the index
+func ChangeToken(objects []Object) string {
+	entries := make([]string, len(objects))
+	for i, object := range objects {
+		entries[i] = fmt.Sprintf("%s\t%d", object.Path, object.LastModified.UnixNano())
+	}
+	sort.Strings(entries)
+	hash := sha256.New()
+	for _, entry := range entries {
+		io.WriteString(hash, entry+"\n")
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// listPageSize returns the number of objects to ask for per listing request, the page size
+// configured for a backend or else its default
+func listPageSize(pageSize int, defaultPageSize int) int {
+	if pageSize > 0 {
+		return pageSize
+	}
+	return defaultPageSize
+}
+
 func cleanPrefix(prefix string) string {
 	return strings.Trim(prefix, "/")
 }
@@ -102,3 +182,20 @@ func removePrefixFromObjectPath(prefix string, path string) string {
 func objectPathIsInvalid(path string) bool {
 	return strings.Contains(path, "/") || path == ""
 }
+
+// listedObjectPath returns the path of the object stored under key relative to prefix, and
+// whether it is listed: objects directly at prefix, or at any depth when listing recursively
+func listedObjectPath(prefix string, key string, recursive bool) (string, bool) {
+	if !recursive {
+		path := removePrefixFromObjectPath(prefix, key)
+		return path, !objectPathIsInvalid(path)
+	}
+	path := key
+	if prefix != "" {
+		if !strings.HasPrefix(key, prefix+"/") {
+			return "", false
+		}
+		path = strings.TrimPrefix(key, prefix+"/")
+	}
+	return path, path != "" && !strings.HasSuffix(path, "/")
+}
@@ -133,6 +133,31 @@ func (suite *StorageTestSuite) TestListObjects() {
 	}
 }
 
+func (suite *StorageTestSuite) TestListObjectsRecursive() {
+	for key, backend := range suite.StorageBackends {
+		lister, ok := backend.(RecursiveLister)
+		suite.True(ok, fmt.Sprintf("%s backend lists objects recursively", key))
+		objects, err := lister.ListObjectsRecursive("")
+		message := fmt.Sprintf("no error listing objects recursively using %s backend", key)
+		suite.Nil(err, message)
+		expectedNumObjects := 10
+		if key == "LocalFilesystem" {
+			expectedNumObjects = 9
+		}
+		message = fmt.Sprintf("%d objects listed recursively using %s backend", expectedNumObjects, key)
+		suite.Equal(expectedNumObjects, len(objects), message)
+
+		if key == "LocalFilesystem" {
+			continue
+		}
+		objects, err = lister.ListObjectsRecursive("this/is")
+		message = fmt.Sprintf("no error listing objects recursively at prefix using %s backend", key)
+		suite.Nil(err, message)
+		suite.Equal(1, len(objects), message)
+		suite.Equal("a/skipped/object.txt", objects[0].Path, "object path is relative to prefix")
+	}
+}
+
 func (suite *StorageTestSuite) TestGetObject() {
 	for key, backend := range suite.StorageBackends {
 		for i := 1; i <= 9; i++ {
@@ -205,6 +230,35 @@ func (suite *StorageTestSuite) TestGetObjectSliceDiff() {
 	suite.Empty(diff.Updated, "updated slice empty")
 }
 
+func (suite *StorageTestSuite) TestChangeToken() {
+	now := time.Now()
+	objects := []Object{
+		{Path: "test1.txt", LastModified: now},
+		{Path: "test2.txt", LastModified: now},
+	}
+	token := ChangeToken(objects)
+	suite.Len(token, 64, "token is a sha256 digest")
+	suite.Equal(token, ChangeToken([]Object{objects[1], objects[0]}), "order does not matter")
+	suite.Equal(token, ChangeToken([]Object{
+		{Path: "test1.txt", Content: []byte("content"), LastModified: now.UTC()},
+		{Path: "test2.txt", LastModified: now},
+	}), "content and location do not matter")
+
+	suite.NotEqual(token, ChangeToken(objects[:1]), "removed object changes token")
+	suite.NotEqual(token, ChangeToken(append(objects, Object{Path: "test3.txt", LastModified: now})), "added object changes token")
+	suite.NotEqual(token, ChangeToken([]Object{
+		{Path: "test1.txt", LastModified: now.Add(1)},
+		{Path: "test2.txt", LastModified: now},
+	}), "updated object changes token")
+	suite.NotEqual(ChangeToken(nil), token)
+}
+
+func (suite *StorageTestSuite) TestListPageSize() {
+	suite.Equal(1000, listPageSize(0, 1000), "backend default without page size")
+	suite.Equal(1000, listPageSize(-1, 1000), "backend default with invalid page size")
+	suite.Equal(200, listPageSize(200, 1000))
+}
+
 func TestStorageTestSuite(t *testing.T) {
 	suite.Run(t, new(StorageTestSuite))
 }
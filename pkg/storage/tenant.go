@@ -0,0 +1,193 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"io"
+	pathutil "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// TenantBackend is a Backend which keeps the objects of some tenants in backends of their
+	// own, by the repo prefix of the tenant (e.g. "teamA" for "teamA/*"). Objects are stored at
+	// the root of the backend of their tenant, without the prefix. Objects of other tenants are
+	// kept in the Default backend
+	TenantBackend struct {
+		Default Backend
+		// tenants sorted by prefix, longest first, so that nested prefixes take precedence
+		tenants []tenantBackend
+	}
+
+	tenantBackend struct {
+		prefix  string
+		backend Backend
+	}
+)
+
+// NewTenantBackend creates a TenantBackend keeping the objects of each tenant, by prefix,
+// in its own backend
+func NewTenantBackend(defaultBackend Backend, tenants map[string]Backend) (*TenantBackend, error) {
+	b := &TenantBackend{Default: defaultBackend}
+	for prefix, backend := range tenants {
+		prefix = cleanPrefix(prefix)
+		if prefix == "" {
+			return nil, fmt.Errorf("tenant storage backend needs a repo prefix")
+		}
+		b.tenants = append(b.tenants, tenantBackend{prefix: prefix, backend: backend})
+	}
+	sort.Slice(b.tenants, func(i, j int) bool {
+		return len(b.tenants[i].prefix) > len(b.tenants[j].prefix)
+	})
+	return b, nil
+}
+
+// route returns the index of the tenant path belongs to (-1 for the default backend), its
+// backend, and the path within that backend
+func (b *TenantBackend) route(path string) (int, Backend, string) {
+	path = cleanPrefix(path)
+	for i, tenant := range b.tenants {
+		if path == tenant.prefix {
+			return i, tenant.backend, ""
+		}
+		if strings.HasPrefix(path, tenant.prefix+"/") {
+			return i, tenant.backend, strings.TrimPrefix(path, tenant.prefix+"/")
+		}
+	}
+	return -1, b.Default, path
+}
+
+// ListObjects lists all objects in prefix, in the backend of its tenant
+func (b *TenantBackend) ListObjects(prefix string) ([]Object, error) {
+	_, backend, path := b.route(prefix)
+	return backend.ListObjects(path)
+}
+
+// ListObjectsRecursive lists the objects at all depths below prefix, including those of
+// tenants below prefix, which are kept in their own backends. Every backend involved must be
+// a RecursiveLister, otherwise ErrRecursiveListNotSupported is returned
+func (b *TenantBackend) ListObjectsRecursive(prefix string) ([]Object, error) {
+	prefix = cleanPrefix(prefix)
+	index, backend, path := b.route(prefix)
+	lister, ok := backend.(RecursiveLister)
+	if !ok {
+		return nil, ErrRecursiveListNotSupported
+	}
+	found, err := lister.ListObjectsRecursive(path)
+	if err != nil {
+		return nil, err
+	}
+	var objects []Object
+	for _, object := range found {
+		// objects left behind where another tenant is now kept are not listed
+		if objectIndex, _, _ := b.route(pathutil.Join(prefix, object.Path)); objectIndex == index {
+			objects = append(objects, object)
+		}
+	}
+
+	for i, tenant := range b.tenants {
+		if i == index || (prefix != "" && !strings.HasPrefix(tenant.prefix, prefix+"/")) {
+			continue
+		}
+		lister, ok := tenant.backend.(RecursiveLister)
+		if !ok {
+			return nil, ErrRecursiveListNotSupported
+		}
+		found, err := lister.ListObjectsRecursive("")
+		if err != nil {
+			return nil, err
+		}
+		relPrefix := strings.TrimPrefix(tenant.prefix, prefix+"/")
+		for _, object := range found {
+			object.Path = pathutil.Join(relPrefix, object.Path)
+			if objectIndex, _, _ := b.route(pathutil.Join(prefix, object.Path)); objectIndex == i {
+				objects = append(objects, object)
+			}
+		}
+	}
+	return objects, nil
+}
+
+// GetObject retrieves an object from the backend of its tenant
+func (b *TenantBackend) GetObject(path string) (Object, error) {
+	_, backend, tenantPath := b.route(path)
+	object, err := backend.GetObject(tenantPath)
+	object.Path = path
+	return object, err
+}
+
+// StatObject looks up an object in the backend of its tenant, or returns ErrStatNotSupported
+// if that backend cannot look up objects without fetching them
+func (b *TenantBackend) StatObject(path string) (Object, error) {
+	_, backend, tenantPath := b.route(path)
+	stater, ok := backend.(Stater)
+	if !ok {
+		return Object{Path: path}, ErrStatNotSupported
+	}
+	object, err := stater.StatObject(tenantPath)
+	object.Path = path
+	return object, err
+}
+
+// PutObject uploads an object to the backend of its tenant
+func (b *TenantBackend) PutObject(path string, content []byte) error {
+	_, backend, tenantPath := b.route(path)
+	return backend.PutObject(tenantPath, content)
+}
+
+// PutObjectStream uploads an object from a reader to the backend of its tenant, or returns
+// ErrStreamNotSupported if that backend cannot upload from a reader
+func (b *TenantBackend) PutObjectStream(path string, content io.Reader) error {
+	_, backend, tenantPath := b.route(path)
+	streamPutter, ok := backend.(StreamPutter)
+	if !ok {
+		return ErrStreamNotSupported
+	}
+	return streamPutter.PutObjectStream(tenantPath, content)
+}
+
+// CopyObject copies an object within the backend of its tenant. Objects are only copied by
+// a backend when both paths belong to the same tenant, otherwise ErrCopyNotSupported is returned
+func (b *TenantBackend) CopyObject(srcPath string, dstPath string) error {
+	srcIndex, backend, srcTenantPath := b.route(srcPath)
+	dstIndex, _, dstTenantPath := b.route(dstPath)
+	copier, ok := backend.(Copier)
+	if !ok || srcIndex != dstIndex {
+		return ErrCopyNotSupported
+	}
+	return copier.CopyObject(srcTenantPath, dstTenantPath)
+}
+
+// DeleteObject removes an object from the backend of its tenant
+func (b *TenantBackend) DeleteObject(path string) error {
+	_, backend, tenantPath := b.route(path)
+	return backend.DeleteObject(tenantPath)
+}
+
+// PresignedURL returns a presigned URL from the backend of the tenant of the object, or
+// ErrPresignNotSupported if that backend cannot presign URLs
+func (b *TenantBackend) PresignedURL(path string, expires time.Duration) (string, error) {
+	_, backend, tenantPath := b.route(path)
+	presigner, ok := backend.(Presigner)
+	if !ok {
+		return "", ErrPresignNotSupported
+	}
+	return presigner.PresignedURL(tenantPath, expires)
+}
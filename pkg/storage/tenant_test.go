@@ -0,0 +1,163 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TenantTestSuite struct {
+	suite.Suite
+	DefaultBackend *LocalFilesystemBackend
+	TeamABackend   *LocalFilesystemBackend
+	NestedBackend  *LocalFilesystemBackend
+	TenantBackend  *TenantBackend
+	TempDirectory  string
+}
+
+func (suite *TenantTestSuite) SetupTest() {
+	timestamp := time.Now().Format("20060102150405.000000")
+	suite.TempDirectory = fmt.Sprintf("../../.test/storage-tenant/%s", timestamp)
+	suite.DefaultBackend = NewLocalFilesystemBackend(suite.TempDirectory + "/default")
+	suite.TeamABackend = NewLocalFilesystemBackend(suite.TempDirectory + "/teama")
+	suite.NestedBackend = NewLocalFilesystemBackend(suite.TempDirectory + "/nested")
+	backend, err := NewTenantBackend(suite.DefaultBackend, map[string]Backend{
+		"teamA":          suite.TeamABackend,
+		"/teamA/nested/": suite.NestedBackend,
+	})
+	suite.Nil(err, "no error creating tenant backend")
+	suite.TenantBackend = backend
+}
+
+func (suite *TenantTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *TenantTestSuite) TestNewTenantBackend() {
+	_, err := NewTenantBackend(suite.DefaultBackend, map[string]Backend{"/": suite.TeamABackend})
+	suite.NotNil(err, "tenant needs a prefix")
+}
+
+func (suite *TenantTestSuite) TestRouting() {
+	for path, backend := range map[string]*LocalFilesystemBackend{
+		"teamA/mychart-0.1.0.tgz":        suite.TeamABackend,
+		"teamA/repo/mychart-0.1.0.tgz":   suite.TeamABackend,
+		"teamA/nested/mychart-0.1.0.tgz": suite.NestedBackend,
+		"teamB/mychart-0.1.0.tgz":        suite.DefaultBackend,
+		"teamAB/mychart-0.1.0.tgz":       suite.DefaultBackend,
+		"mychart-0.1.0.tgz":              suite.DefaultBackend,
+	} {
+		err := suite.TenantBackend.PutObject(path, []byte(path))
+		suite.Nil(err, "no error putting %s", path)
+
+		var tenantPath string
+		switch backend {
+		case suite.TeamABackend:
+			tenantPath = path[len("teamA/"):]
+		case suite.NestedBackend:
+			tenantPath = path[len("teamA/nested/"):]
+		default:
+			tenantPath = path
+		}
+		object, err := backend.GetObject(tenantPath)
+		suite.Nil(err, "%s stored in the backend of its tenant, without the tenant prefix", path)
+		suite.Equal(path, string(object.Content))
+
+		object, err = suite.TenantBackend.GetObject(path)
+		suite.Nil(err, "no error getting %s", path)
+		suite.Equal(path, object.Path, "object path has the tenant prefix")
+		suite.Equal(path, string(object.Content))
+	}
+
+	objects, err := suite.TenantBackend.ListObjects("teamA")
+	suite.Nil(err, "no error listing objects")
+	suite.Equal(1, len(objects))
+	suite.Equal("mychart-0.1.0.tgz", objects[0].Path)
+
+	err = suite.TenantBackend.PutObjectStream("teamA/nested/mychart-0.1.0.tgz.prov", bytes.NewBufferString("prov"))
+	suite.Nil(err, "no error streaming provenance file")
+	_, err = suite.NestedBackend.GetObject("mychart-0.1.0.tgz.prov")
+	suite.Nil(err, "provenance file streamed to the backend of its tenant")
+
+	err = suite.TenantBackend.DeleteObject("teamA/repo/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error deleting object")
+	_, err = suite.TeamABackend.GetObject("repo/mychart-0.1.0.tgz")
+	suite.NotNil(err, "object deleted from the backend of its tenant")
+
+	_, err = suite.TenantBackend.PresignedURL("teamA/mychart-0.1.0.tgz", time.Minute)
+	suite.Equal(ErrPresignNotSupported, err, "local backend cannot presign URLs")
+}
+
+func (suite *TenantTestSuite) TestCopyObject() {
+	err := suite.TenantBackend.PutObject("teamA/staging/mychart-0.1.0.tgz", []byte("chart"))
+	suite.Nil(err)
+	err = suite.TenantBackend.CopyObject("teamA/staging/mychart-0.1.0.tgz", "teamA/prod/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error copying within a tenant")
+	object, err := suite.TeamABackend.GetObject("prod/mychart-0.1.0.tgz")
+	suite.Nil(err, "object copied by the backend of its tenant")
+	suite.Equal("chart", string(object.Content))
+
+	err = suite.TenantBackend.CopyObject("teamA/staging/mychart-0.1.0.tgz", "teamB/mychart-0.1.0.tgz")
+	suite.Equal(ErrCopyNotSupported, err, "objects are not copied across tenants")
+}
+
+func (suite *TenantTestSuite) TestListObjectsRecursive() {
+	for _, path := range []string{
+		"teamA/repo/mychart-0.1.0.tgz",
+		"teamA/nested/mychart-0.1.0.tgz",
+		"teamB/mychart-0.1.0.tgz",
+	} {
+		err := suite.TenantBackend.PutObject(path, []byte("chart"))
+		suite.Nil(err, "no error putting %s", path)
+	}
+	// left behind in the backend of teamA before teamA/nested got a backend of its own
+	err := suite.TeamABackend.PutObject("nested/stale-0.1.0.tgz", []byte("stale"))
+	suite.Nil(err)
+
+	paths := func(prefix string) []string {
+		objects, err := suite.TenantBackend.ListObjectsRecursive(prefix)
+		suite.Nil(err, "no error listing objects recursively below %q", prefix)
+		var paths []string
+		for _, object := range objects {
+			paths = append(paths, object.Path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	suite.Equal([]string{"teamA/nested/mychart-0.1.0.tgz", "teamA/repo/mychart-0.1.0.tgz", "teamB/mychart-0.1.0.tgz"}, paths(""),
+		"objects of all tenants are listed")
+	suite.Equal([]string{"nested/mychart-0.1.0.tgz", "repo/mychart-0.1.0.tgz"}, paths("teamA"),
+		"objects of nested tenants are listed, relative to the listed prefix")
+	suite.Equal([]string{"mychart-0.1.0.tgz"}, paths("teamA/nested"))
+	suite.Equal([]string{"mychart-0.1.0.tgz"}, paths("teamB"))
+
+	backend, err := NewTenantBackend(suite.DefaultBackend, map[string]Backend{"teamA": struct{ Backend }{suite.TeamABackend}})
+	suite.Nil(err)
+	_, err = backend.ListObjectsRecursive("")
+	suite.Equal(ErrRecursiveListNotSupported, err, "every tenant backend must be a recursive lister")
+}
+
+func TestTenantTestSuite(t *testing.T) {
+	suite.Run(t, new(TenantTestSuite))
+}